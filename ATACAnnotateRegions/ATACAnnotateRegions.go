@@ -20,6 +20,9 @@ import (
 /*BEDFILENAME bed file name (input) */
 var BEDFILENAME utils.Filename
 
+/*BEDFILENAMES bed file names (-bed can be repeated with -gtf) */
+var BEDFILENAMES utils.ArrayFlags
+
 /*REFBEDFILENAME bed file containing annotation as fourth column */
 var REFBEDFILENAME utils.Filename
 
@@ -77,6 +80,42 @@ var SCOREFILTERCOLUMNS int
 /*UNIQUEPEAKTOSYMBOL map used to link peak to unique top symbol */
 var UNIQUEPEAKTOSYMBOL map[string]string
 
+/*CLOSEST annotate each region with the closest reference regions */
+var CLOSEST bool
+
+/*CLOSESTK number of closest reference regions reported */
+var CLOSESTK int
+
+/*STRANDPOS position of the strand column in the -ref file (-1: all the reference regions on the + strand) */
+var STRANDPOS int
+
+/*TIES ties handling of the -closest mode (all or first) */
+var TIES string
+
+/*MAXDISTANCE maximum distance of the closest reference regions (no limit if 0) */
+var MAXDISTANCE int
+
+/*GTFFILE gene annotation file (GTF or GFF3) used to annotate the genomic categories of the regions */
+var GTFFILE utils.Filename
+
+/*PROMOTERUPSTREAM promoter window upstream of the TSS */
+var PROMOTERUPSTREAM int
+
+/*PROMOTERDOWNSTREAM promoter window downstream of the TSS */
+var PROMOTERDOWNSTREAM int
+
+/*DOWNSTREAMWINDOW window downstream of the gene end */
+var DOWNSTREAMWINDOW int
+
+/*PRIORITY priority of the genomic categories */
+var PRIORITY string
+
+/*BIOTYPE biotype of the genes used with -gtf (all the genes if empty) */
+var BIOTYPE string
+
+/*SUMMARYFILE category summary table */
+var SUMMARYFILE string
+
 func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, `
@@ -86,6 +125,9 @@ This software presents some similarities with bedtools usage however it provides
 """Annotate bed file using a reference bed file containing the annotations"""
 USAGE: ATACAnnotateRegions -bed <file> -ref <file> (optional -out <string> -unique -unique_ref -intersect -write_ref -edit -ref_sep "[3]int" -ref_symbol "[]int|str" -diff -stdout -annotate_line -score_pos)
 
+"""Annotate each region of the bed file with its closest reference regions and their signed distance"""
+USAGE: ATACAnnotateRegions -closest -bed <file> -ref <file> (optional -k <int> -strand_pos <int> -ties <all|first> -max_distance <int> -out <string> -write_ref -edit -ref_pos "[3]int" -symbol_pos "[]int|str" -stdout -annotate_line -ignore)
+
 for -ref_sep and -ref_symbol options, the input should be a string of numbers separated by whitespace and delimited with ". -ref_sep needs exactly three positions: 1) for the chromosomes column, 2) for the begining and 3) for the end of the region
 
 Example: ATACAnnotateRegions -bed regionToAnnotate.bed -ref referenceAnnotation.tsv -ref_sep 0,1,2 -ref_symbol "4 5"
@@ -95,12 +137,23 @@ Example: ATACAnnotateRegions -bed regionToAnnotate.bed -ref referenceAnnotation.
 -score_pos is an alternative mechanism to retain unique peaks (no dupplicate) from the bed file by using an additional column of the bed file as score (needs to be float). if multiple entries exist for a given peak in the bed file, only the one with the highest score will be kept.
 
 Here the three first columns of referenceAnnotation.tsv will be used to identify chromosome (column 0), start (column 1), and end (column 2) of each region, and regionToAnnotate.bed will be annotatd using columns 4 and 5 from referenceAnnotation.tsv
+
+-closest reports for each region (each region of a bedpe line) the -k closest reference regions with the format: <region><TAB>(<ref region><TAB> if -write_ref)<symbol><TAB><distance>. The distance is 0 for overlapping regions and otherwise the gap + 1 (bedtools closest convention). It is negative when the region is upstream of the reference region according to its strand (-strand_pos column, + strand if not provided). With -ties all, all the reference regions at the same distance than the k-th one are reported, with -ties first only the first k (ordered by position). Regions without reference region are written with an empty symbol (and empty reference region columns with -write_ref) and a NA distance (unless -ignore)
+
+Example: ATACAnnotateRegions -closest -bed peaks.bed -ref gene_tss.bed -symbol_pos 3 -strand_pos 5 -k 2
+
+"""Annotate the genomic category (promoter, UTRs, exon, intron, downstream or distal intergenic) of each region using a GTF / GFF3 file"""
+USAGE: ATACAnnotateRegions -gtf <file> -bed <file1> (-bed <file2> ...) (optional -priority <string> -promoter_upstream <int> -promoter_downstream <int> -downstream_window <int> -biotype <string> -summary <fname> -out <string> -edit -bed_pos "[3]int" -stdout -annotate_line)
+
+-gtf annotates each region (each region of a bedpe line) with the format: <region><TAB><category><TAB><gene name><TAB><transcript ID><TAB><distance to TSS>. The category is the first one of -priority overlapping the region for any transcript, then other if the region overlaps a category omitted from -priority, and distal_intergenic otherwise. The gene and the transcript are the ones defining the category (closest TSS if several transcripts, closest TSS for distal_intergenic). The distance to the TSS follows the -closest convention. Multiple bed files can be given (repeated -bed) and the fraction of each category per file is written in the -summary table
+
+Example: ATACAnnotateRegions -gtf gencode.annotation.gtf.gz -bed peaks_cluster1.bed -bed peaks_cluster2.bed -summary peaks.category_summary.tsv
 `)
 		flag.PrintDefaults()
 	}
 	uniqsymbolstr := ""
 
-	flag.Var(&BEDFILENAME, "bed", "name of the bed file no annotate")
+	flag.Var(&BEDFILENAMES, "bed", "name of the bed file no annotate (can be repeated with -gtf)")
 	flag.Var(&REFBEDFILENAME, "ref", "name of the reference bed file containing the annotations")
 	flag.StringVar(&FILENAMEOUT, "out", "", "name the output file(s)")
 	flag.BoolVar(&REPLACEINPUT, "edit", false, `edit input bed file instead of creating a new file`)
@@ -118,6 +171,18 @@ Here the three first columns of referenceAnnotation.tsv will be used to identify
 	flag.StringVar(&REFPOS, "ref_pos", "", "separator to the bed region in ref for the ref file. Default: (0,1,2 for bed and 0,1,2,3,4,5 for bedpe files")
 	flag.StringVar(&BEDPOS, "bed_pos", "", "separator to the bed region(s) in genomic coordinates for the bed file. Default: (0,1,2 for bed and 0,1,2,3,4,5 for bedpe files")
 	flag.StringVar(&SYMBOLPOS, "symbol_pos", "3", "separator to the bed region in ref for the ref file")
+	flag.BoolVar(&CLOSEST, "closest", false, `annotate each region with the -k closest reference regions and their signed distance`)
+	flag.IntVar(&CLOSESTK, "k", 1, "(-closest) number of closest reference regions reported per region")
+	flag.IntVar(&STRANDPOS, "strand_pos", -1, "(-closest) position of the strand column (+/-) in the ref file used to sign the distance (upstream: negative). All the reference regions are on the + strand if not provided")
+	flag.StringVar(&TIES, "ties", "all", "(-closest) ties handling: all (report all the reference regions at the same distance than the k-th one) or first (report only the first k ordered by position)")
+	flag.IntVar(&MAXDISTANCE, "max_distance", 0, "(-closest) maximum distance of the reported reference regions (no limit if 0)")
+	flag.Var(&GTFFILE, "gtf", "gene annotation file (GTF or GFF3) used to annotate the genomic category of the regions instead of -ref")
+	flag.IntVar(&PROMOTERUPSTREAM, "promoter_upstream", 3000, "(-gtf) promoter window upstream of the TSS")
+	flag.IntVar(&PROMOTERDOWNSTREAM, "promoter_downstream", 3000, "(-gtf) promoter window downstream of the TSS")
+	flag.IntVar(&DOWNSTREAMWINDOW, "downstream_window", 3000, "(-gtf) window downstream of the gene end used for the downstream category (not used if 0)")
+	flag.StringVar(&PRIORITY, "priority", "promoter,5UTR,3UTR,exon,intron,downstream", "(-gtf) priority of the genomic categories (the omitted categories are reported as other and the regions overlapping none of them are distal_intergenic)")
+	flag.StringVar(&BIOTYPE, "biotype", "", "(-gtf) biotype of the genes used (the genes without biotype are kept). All the genes if empty")
+	flag.StringVar(&SUMMARYFILE, "summary", "", "(-gtf) category summary table (fraction of each category per bed file). Default: <out>.category_summary.tsv")
 
 	flag.Parse()
 
@@ -130,6 +195,19 @@ Here the three first columns of referenceAnnotation.tsv will be used to identify
 
 	UNIQSYMBOL = uniqsymbolstr == "true"
 
+	for _, fname := range BEDFILENAMES {
+		utils.AssertIfFileExists(fname)
+	}
+
+	switch {
+	case len(BEDFILENAMES) == 0:
+		panic(fmt.Sprintf("Error! -bed should be provided!\n"))
+	case len(BEDFILENAMES) > 1 && GTFFILE == "":
+		panic(fmt.Sprintf("Error! multiple -bed files can only be used with -gtf!\n"))
+	}
+
+	BEDFILENAME = utils.Filename(BEDFILENAMES[0])
+
 	tail := flag.Args()
 
 	if len(tail) > 0 {
@@ -138,6 +216,11 @@ Here the three first columns of referenceAnnotation.tsv will be used to identify
 Example: ATACAnnotateRegions -bed regionToAnnotate.bed -ref referenceAnnotation.tsv -ref_sep "0 1 2" -ref_symbol "4 5"\n`, tail))
 	}
 
+	if GTFFILE != "" {
+		annotateGenomicCategories()
+		return
+	}
+
 	symbol := returnSymbolType()
 
 	ext := path.Ext(BEDFILENAME.String())
@@ -173,16 +256,39 @@ Example: ATACAnnotateRegions -bed regionToAnnotate.bed -ref referenceAnnotation.
 		panic(fmt.Sprintf("Error! options -write_ref and -intersect cannot be TRUE together. Please chose one!\n"))
 	}
 
-	if !WRITEDIFF {
-		utils.LoadRefCustomFileWithSymbol(
-			REFBEDFILENAME, REFSEP, symbol, refPos, SCOREFILTERCOLUMNS)
-	}
+	switch {
+	case CLOSEST:
+		if WRITEDIFF || WRITEINTERSECT || UNIQ || UNIQREF {
+			panic(fmt.Sprintf("Error! options -diff, -intersect, -unique and -unique_ref cannot be used with -closest!\n"))
+		}
 
-	utils.LoadPeaksCustom(REFBEDFILENAME, REFSEP, refPos)
-	utils.CreatePeakIntervalTreeCustom(refPos, REFSEP)
+		if CLOSESTK < 1 {
+			panic(fmt.Sprintf("Error! -k should be a positive number: %d\n", CLOSESTK))
+		}
+
+		if TIES != "all" && TIES != "first" {
+			panic(fmt.Sprintf("Error! -ties should be all or first: %s\n", TIES))
+		}
+
+		loadClosestFeatures(refPos, symbol)
+		scanBedFileAndAddClosest()
+	default:
+		if !WRITEDIFF {
+			utils.LoadRefCustomFileWithSymbol(
+				REFBEDFILENAME, REFSEP, symbol, refPos, SCOREFILTERCOLUMNS)
+		}
+
+		utils.LoadPeaksCustom(REFBEDFILENAME, REFSEP, refPos)
+		utils.CreatePeakIntervalTreeCustom(refPos, REFSEP)
 
-	scanBedFileAndAddAnnotation(refPos)
+		scanBedFileAndAddAnnotation(refPos)
+	}
+
+	finalizeOutputFile()
+}
 
+/*finalizeOutputFile replace the input bed file with the output file if -edit */
+func finalizeOutputFile() {
 	if REPLACEINPUT {
 		utils.Check(os.Remove(string(BEDFILENAME)))
 		utils.Check(os.Rename(FILENAMEOUT, string(BEDFILENAME)))
@@ -0,0 +1,340 @@
+package main
+
+import (
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+	"os"
+	"fmt"
+	"strings"
+	"bytes"
+	"time"
+	"sort"
+	"strconv"
+	"io"
+)
+
+
+/*closestFeature reference region used by the -closest mode */
+type closestFeature struct {
+	start, end int
+	strand byte
+	peakstr, symbol string
+}
+
+/*closestHit reference feature found for a region with its signed distance */
+type closestHit struct {
+	feature int
+	distance int
+}
+
+/*chrFeatures reference features of a chromosome sorted by start and the length of the longest feature */
+type chrFeatures struct {
+	features []closestFeature
+	maxLen int
+}
+
+/*CLOSESTFEATURES reference features per chromosome */
+var CLOSESTFEATURES map[string]*chrFeatures
+
+
+/*loadClosestFeatures load the reference regions with their symbol and strand (-strand_pos) for the -closest mode */
+func loadClosestFeatures(refPosList []int, symbol utils.SymbolType) {
+	var split, symbolSlice []string
+	var peak utils.Peak
+	var refPos [3]int
+
+	CLOSESTFEATURES = make(map[string]*chrFeatures)
+
+	nbPeaksPerRef := utils.CheckIfPeakPosIsMutltipleOf3(refPosList)
+	maxPos := utils.MaxIntList(append(append([]int{STRANDPOS}, refPosList...), symbol.SymbolPos...))
+	symbolSlice = make([]string, len(symbol.SymbolPos))
+
+	scanner, file := REFBEDFILENAME.ReturnReader(0)
+	defer utils.CloseFile(file)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		split = strings.Split(line, REFSEP)
+
+		if len(split) <= maxPos {
+			panic(fmt.Sprintf(
+				"Error line %s from %s should have at least %d fields (-ref_pos, -symbol_pos and -strand_pos)\n",
+				line, REFBEDFILENAME, maxPos + 1))
+		}
+
+		strand := byte('+')
+
+		if STRANDPOS > -1 && split[STRANDPOS] == "-" {
+			strand = '-'
+		}
+
+		symbolStr := symbol.SymbolStr
+
+		if symbolStr == "" {
+			for i, pos := range symbol.SymbolPos {
+				symbolSlice[i] = split[pos]
+			}
+
+			symbolStr = strings.Join(symbolSlice, REFSEP)
+		}
+
+		for nbPeakRef := 0; nbPeakRef < nbPeaksPerRef; nbPeakRef++ {
+			refPos[0] = refPosList[0 + 3 * nbPeakRef]
+			refPos[1] = refPosList[1 + 3 * nbPeakRef]
+			refPos[2] = refPosList[2 + 3 * nbPeakRef]
+
+			peak.SplitToPeak([]string{split[refPos[0]], split[refPos[1]], split[refPos[2]]})
+
+			chrom, isInside := CLOSESTFEATURES[peak.Chr()]
+
+			if !isInside {
+				chrom = &chrFeatures{}
+				CLOSESTFEATURES[peak.Chr()] = chrom
+			}
+
+			chrom.features = append(chrom.features, closestFeature{
+				start: peak.Start,
+				end: peak.End,
+				strand: strand,
+				peakstr: peak.PeakToString(),
+				symbol: symbolStr,
+			})
+
+			if peak.End - peak.Start > chrom.maxLen {
+				chrom.maxLen = peak.End - peak.Start
+			}
+		}
+	}
+
+	for _, chrom := range CLOSESTFEATURES {
+		features := chrom.features
+		sort.SliceStable(features, func(i, j int) bool {
+			if features[i].start != features[j].start {
+				return features[i].start < features[j].start
+			}
+
+			return features[i].end < features[j].end
+		})
+	}
+}
+
+/*closestDistance signed distance between a region and a reference feature: 0 if they overlap, otherwise the gap + 1 (bedtools closest convention).
+The distance is negative if the region is upstream of the feature according to its strand */
+func closestDistance(start, end int, feature closestFeature) (distance int) {
+	switch {
+	case feature.end <= start:
+		distance = start - feature.end + 1
+	case feature.start >= end:
+		distance = -(feature.start - end + 1)
+	default:
+		return 0
+	}
+
+	if feature.strand == '-' {
+		distance = -distance
+	}
+
+	return distance
+}
+
+func absInt(a int) int {
+	if a < 0 {
+		return -a
+	}
+
+	return a
+}
+
+/*findClosestFeatures return the -k closest reference features of a region (all the features tied with the k-th one if -ties all)
+sorted by absolute distance and position */
+func findClosestFeatures(chrom *chrFeatures, start, end int) (hits []closestHit) {
+	features := chrom.features
+
+	// sorted absolute distances of the hits used to stop the search
+	var bestDistances []int
+
+	kthDistance := func() int {
+		if len(bestDistances) < CLOSESTK {
+			return -1
+		}
+
+		return bestDistances[CLOSESTK - 1]
+	}
+
+	addHit := func(index int) {
+		distance := closestDistance(start, end, features[index])
+		absDist := absInt(distance)
+
+		if MAXDISTANCE > 0 && absDist > MAXDISTANCE {
+			return
+		}
+
+		if kth := kthDistance(); kth > -1 && absDist > kth {
+			return
+		}
+
+		hits = append(hits, closestHit{feature: index, distance: distance})
+
+		pos := sort.SearchInts(bestDistances, absDist)
+		bestDistances = append(bestDistances, 0)
+		copy(bestDistances[pos + 1:], bestDistances[pos:])
+		bestDistances[pos] = absDist
+	}
+
+	first := sort.Search(len(features), func(i int) bool {return features[i].start >= start})
+
+	// features starting inside or after the region: the distance increases with the start
+	for i := first; i < len(features); i++ {
+		if kth := kthDistance(); kth > -1 && features[i].start - end + 1 > kth {
+			break
+		}
+
+		if MAXDISTANCE > 0 && features[i].start - end + 1 > MAXDISTANCE {
+			break
+		}
+
+		addHit(i)
+	}
+
+	// features starting before the region: the distance is at least start - (feature start + longest feature) + 1
+	for i := first - 1; i >= 0; i-- {
+		minDist := start - (features[i].start + chrom.maxLen) + 1
+
+		if kth := kthDistance(); kth > -1 && minDist > kth {
+			break
+		}
+
+		if MAXDISTANCE > 0 && minDist > MAXDISTANCE {
+			break
+		}
+
+		addHit(i)
+	}
+
+	kth := kthDistance()
+
+	sort.Slice(hits, func(i, j int) bool {
+		di, dj := absInt(hits[i].distance), absInt(hits[j].distance)
+
+		if di != dj {
+			return di < dj
+		}
+
+		return hits[i].feature < hits[j].feature
+	})
+
+	for i := range hits {
+		absDist := absInt(hits[i].distance)
+
+		if (kth > -1 && absDist > kth) || (TIES == "first" && i >= CLOSESTK) {
+			return hits[:i]
+		}
+	}
+
+	return hits
+}
+
+/*scanBedFileAndAddClosest annotate each region of the bed (or bedpe) file with its -k closest reference features and their signed distance */
+func scanBedFileAndAddClosest() {
+	var buffer bytes.Buffer
+	var writer io.WriteCloser
+	var peak utils.Peak
+	var err error
+
+	count := 0
+
+	scanner, file := BEDFILENAME.ReturnReader(0)
+	defer utils.CloseFile(file)
+
+	if STDOUT {
+		writer = os.Stdout
+	} else {
+		writer = utils.ReturnWriter(FILENAMEOUT)
+	}
+
+	defer utils.CloseFile(writer)
+
+	tStart := time.Now()
+
+	BEDPOSINT = returnPosIntSlice(BEDPOS)
+	nbPeaksPerLine := utils.CheckIfPeakPosIsMutltipleOf3(BEDPOSINT)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		for nbPeak := 0; nbPeak < nbPeaksPerLine; nbPeak++ {
+			peak.StringToPeakWithPosAndStart(line, BEDPOSINT, nbPeak * 3)
+
+			peakstr := peak.PeakToString()
+
+			if ANNOTATELINE {
+				peakstr = line
+			}
+
+			var hits []closestHit
+
+			if chrom, isInside := CLOSESTFEATURES[peak.Chr()]; isInside {
+				hits = findClosestFeatures(chrom, peak.Start, peak.End)
+			}
+
+			if len(hits) == 0 {
+				if !IGNOREUNANNOATED {
+					buffer.WriteString(peakstr)
+
+					// empty reference region (<chr><start><end>)
+					if WRITEREF {
+						buffer.WriteString("\t\t\t")
+					}
+
+					buffer.WriteString("\t\tNA\n")
+					count++
+				}
+
+				continue
+			}
+
+			features := CLOSESTFEATURES[peak.Chr()].features
+
+			for _, hit := range hits {
+				buffer.WriteString(peakstr)
+				buffer.WriteRune('\t')
+
+				if WRITEREF {
+					buffer.WriteString(features[hit.feature].peakstr)
+					buffer.WriteRune('\t')
+				}
+
+				buffer.WriteString(features[hit.feature].symbol)
+				buffer.WriteRune('\t')
+				buffer.WriteString(strconv.Itoa(hit.distance))
+				buffer.WriteRune('\n')
+				count++
+			}
+		}
+
+		if count >= 5000 {
+			_, err = writer.Write(buffer.Bytes())
+			utils.Check(err)
+			buffer.Reset()
+			count = 0
+		}
+	}
+
+	_, err = writer.Write(buffer.Bytes())
+	utils.Check(err)
+	buffer.Reset()
+
+	tDiff := time.Since(tStart)
+
+	if !STDOUT {
+		fmt.Printf("done in time: %f s \n", tDiff.Seconds())
+	}
+}
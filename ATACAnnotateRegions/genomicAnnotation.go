@@ -0,0 +1,510 @@
+package main
+
+import (
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+	"github.com/biogo/store/interval"
+	"os"
+	"fmt"
+	"strings"
+	"bytes"
+	"time"
+	"sort"
+	"strconv"
+	"path"
+	"io"
+)
+
+
+/*DISTALINTERGENIC category of the regions outside of all the other categories */
+const DISTALINTERGENIC = "distal_intergenic"
+
+/*OTHERCATEGORY category of the regions overlapping only categories omitted from -priority */
+const OTHERCATEGORY = "other"
+
+/*GENOMICCATEGORIES categories usable with -priority */
+var GENOMICCATEGORIES = []string{"promoter", "5UTR", "3UTR", "exon", "intron", "downstream"}
+
+/*annotatedTranscript transcript of the -gtf file with the name of its gene */
+type annotatedTranscript struct {
+	geneName, transcriptID string
+	transcript *utils.TranscriptAnnotation
+}
+
+/*chrTranscripts transcripts of a chromosome: interval tree of the transcripts extended with the promoter and downstream windows
+and TSS sorted by position (used for the distal intergenic regions) */
+type chrTranscripts struct {
+	tree *interval.IntTree
+	tss []int
+	tssTranscript []int
+}
+
+/*TRANSCRIPTS transcripts of the -gtf file */
+var TRANSCRIPTS []annotatedTranscript
+
+/*CHRTRANSCRIPTS transcripts per chromosome */
+var CHRTRANSCRIPTS map[string]*chrTranscripts
+
+/*CATEGORYPRIORITY categories ordered by priority (followed by other if categories are omitted from -priority, the last one is always distal_intergenic) */
+var CATEGORYPRIORITY []string
+
+/*OMITTEDCATEGORIES categories omitted from -priority, reported as other */
+var OMITTEDCATEGORIES []string
+
+
+/*annotateGenomicCategories annotate the genomic categories of the regions of each -bed file with the -gtf file
+and write the category summary table */
+func annotateGenomicCategories() {
+	if WRITEDIFF || WRITEINTERSECT || UNIQ || UNIQREF || CLOSEST || WRITEREF {
+		panic(fmt.Sprintf("Error! options -diff, -intersect, -unique, -unique_ref, -closest and -write_ref cannot be used with -gtf!\n"))
+	}
+
+	if PROMOTERUPSTREAM < 0 || PROMOTERDOWNSTREAM < 0 || DOWNSTREAMWINDOW < 0 {
+		panic(fmt.Sprintf("Error! -promoter_upstream, -promoter_downstream and -downstream_window should be positive numbers!\n"))
+	}
+
+	fnames := []string(BEDFILENAMES)
+	isOutDefined, isBedPosDefined := FILENAMEOUT != "", BEDPOS != ""
+
+	if len(fnames) > 1 && (isOutDefined || STDOUT) {
+		panic(fmt.Sprintf("Error! -out and -stdout cannot be used with multiple bed files!\n"))
+	}
+
+	if len(fnames) > 1 && SUMMARYFILE == "" {
+		panic(fmt.Sprintf("Error! -summary should be provided with multiple bed files!\n"))
+	}
+
+	parseCategoryPriority()
+	loadTranscriptAnnotation()
+
+	counts := make([]map[string]int, len(fnames))
+
+	for i, fname := range fnames {
+		BEDFILENAME = utils.Filename(fname)
+		ext := path.Ext(fname)
+
+		if !isBedPosDefined {
+			switch ext {
+			case ".bedpe":
+				BEDPOS = "0,1,2,3,4,5"
+			default:
+				BEDPOS = "0,1,2"
+			}
+		}
+
+		if !isOutDefined {
+			FILENAMEOUT = fmt.Sprintf("%s.annotated%s", fname[:len(fname) - len(ext)], ext)
+		}
+
+		if SUMMARYFILE == "" {
+			SUMMARYFILE = fmt.Sprintf("%s.category_summary.tsv",
+				FILENAMEOUT[:len(FILENAMEOUT) - len(path.Ext(FILENAMEOUT))])
+		}
+
+		counts[i] = scanBedFileAndAddGenomicCategories()
+
+		if !STDOUT {
+			finalizeOutputFile()
+		}
+	}
+
+	writeCategorySummary(fnames, counts)
+}
+
+/*parseCategoryPriority parse the -priority option */
+func parseCategoryPriority() {
+	isUsed := make(map[string]bool)
+	isKnown := make(map[string]bool)
+
+	for _, category := range GENOMICCATEGORIES {
+		isKnown[category] = true
+	}
+
+	CATEGORYPRIORITY = []string{}
+
+	for _, category := range strings.Split(PRIORITY, ",") {
+		category = strings.TrimSpace(category)
+
+		switch {
+		case category == DISTALINTERGENIC:
+			continue
+		case !isKnown[category]:
+			panic(fmt.Sprintf("Error! unknown category in -priority: %s (categories: %s)\n",
+				category, strings.Join(GENOMICCATEGORIES, ",")))
+		case isUsed[category]:
+			panic(fmt.Sprintf("Error! category %s used twice in -priority\n", category))
+		}
+
+		isUsed[category] = true
+		CATEGORYPRIORITY = append(CATEGORYPRIORITY, category)
+	}
+
+	OMITTEDCATEGORIES = []string{}
+
+	for _, category := range GENOMICCATEGORIES {
+		if !isUsed[category] {
+			OMITTEDCATEGORIES = append(OMITTEDCATEGORIES, category)
+		}
+	}
+
+	if len(OMITTEDCATEGORIES) > 0 {
+		CATEGORYPRIORITY = append(CATEGORYPRIORITY, OTHERCATEGORY)
+	}
+
+	CATEGORYPRIORITY = append(CATEGORYPRIORITY, DISTALINTERGENIC)
+}
+
+/*loadTranscriptAnnotation load the transcripts of the -gtf file (genes of -biotype) and create the interval trees */
+func loadTranscriptAnnotation() {
+	var err error
+
+	genes := utils.LoadGeneAnnotation(GTFFILE)
+
+	TRANSCRIPTS = []annotatedTranscript{}
+	CHRTRANSCRIPTS = make(map[string]*chrTranscripts)
+
+	// extension of the transcripts with the promoter and downstream windows
+	flank := utils.MaxInt(utils.MaxInt(PROMOTERUPSTREAM, PROMOTERDOWNSTREAM), DOWNSTREAMWINDOW)
+
+	for _, gene := range genes {
+		if BIOTYPE != "" && gene.Biotype != "" && gene.Biotype != BIOTYPE {
+			continue
+		}
+
+		transcripts := gene.Transcripts
+
+		// gene without transcript: its body is used as a single exon
+		if len(transcripts) == 0 {
+			transcripts = []*utils.TranscriptAnnotation{{
+				ID: gene.ID,
+				Chr: gene.Chr,
+				Start: gene.Start,
+				End: gene.End,
+				Strand: gene.Strand,
+				Exons: [][2]int{{gene.Start, gene.End}},
+			}}
+		}
+
+		for _, transcript := range transcripts {
+			if len(transcript.Exons) == 0 {
+				transcript.Exons = [][2]int{{transcript.Start, transcript.End}}
+			}
+
+			chrom, isInside := CHRTRANSCRIPTS[transcript.Chr]
+
+			if !isInside {
+				chrom = &chrTranscripts{tree: &interval.IntTree{}}
+				CHRTRANSCRIPTS[transcript.Chr] = chrom
+			}
+
+			index := len(TRANSCRIPTS)
+
+			TRANSCRIPTS = append(TRANSCRIPTS, annotatedTranscript{
+				geneName: gene.Name,
+				transcriptID: strings.TrimPrefix(transcript.ID, "transcript:"),
+				transcript: transcript,
+			})
+
+			err = chrom.tree.Insert(utils.IntInterval{
+				Start: transcript.Start - flank,
+				End: transcript.End + flank,
+				UID: uintptr(index)}, false)
+			utils.Check(err)
+
+			chrom.tss = append(chrom.tss, transcript.TSS())
+			chrom.tssTranscript = append(chrom.tssTranscript, index)
+		}
+	}
+
+	for _, chrom := range CHRTRANSCRIPTS {
+		chrom.tree.AdjustRanges()
+		sort.Sort(tssSorter{chrom})
+	}
+
+	fmt.Printf("%d transcripts loaded from %s\n", len(TRANSCRIPTS), GTFFILE)
+}
+
+/*tssSorter sort the TSS of a chromosome with their transcripts */
+type tssSorter struct {
+	chrom *chrTranscripts
+}
+
+func (s tssSorter) Len() int {
+	return len(s.chrom.tss)
+}
+
+func (s tssSorter) Less(i, j int) bool {
+	if s.chrom.tss[i] != s.chrom.tss[j] {
+		return s.chrom.tss[i] < s.chrom.tss[j]
+	}
+
+	return s.chrom.tssTranscript[i] < s.chrom.tssTranscript[j]
+}
+
+func (s tssSorter) Swap(i, j int) {
+	s.chrom.tss[i], s.chrom.tss[j] = s.chrom.tss[j], s.chrom.tss[i]
+	s.chrom.tssTranscript[i], s.chrom.tssTranscript[j] = s.chrom.tssTranscript[j], s.chrom.tssTranscript[i]
+}
+
+/*hasCategory true if one of the categories is found */
+func hasCategory(found map[string]bool, categories []string) bool {
+	for _, category := range categories {
+		if found[category] {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*isOverlapping true if [start, end) overlaps one of the intervals */
+func isOverlapping(start, end int, intervals [][2]int) bool {
+	for _, inter := range intervals {
+		if inter[0] < end && inter[1] > start {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*transcriptCategories categories of the region for one transcript */
+func transcriptCategories(start, end int, transcript *utils.TranscriptAnnotation) (categories map[string]bool) {
+	categories = make(map[string]bool)
+	tss := transcript.TSS()
+
+	// promoter and downstream windows (strand-aware)
+	promoter := [2]int{tss - PROMOTERUPSTREAM, tss + PROMOTERDOWNSTREAM}
+	downstream := [2]int{transcript.End, transcript.End + DOWNSTREAMWINDOW}
+
+	if transcript.Strand == '-' {
+		promoter = [2]int{tss - PROMOTERDOWNSTREAM + 1, tss + PROMOTERUPSTREAM + 1}
+		downstream = [2]int{transcript.Start - DOWNSTREAMWINDOW, transcript.Start}
+	}
+
+	categories["promoter"] = isOverlapping(start, end, [][2]int{promoter})
+	categories["downstream"] = DOWNSTREAMWINDOW > 0 && isOverlapping(start, end, [][2]int{downstream})
+	categories["5UTR"] = isOverlapping(start, end, transcript.UTR5)
+	categories["3UTR"] = isOverlapping(start, end, transcript.UTR3)
+	categories["exon"] = isOverlapping(start, end, transcript.Exons)
+
+	// introns: gaps between the consecutive exons
+	for i := 1; i < len(transcript.Exons); i++ {
+		if isOverlapping(start, end, [][2]int{{transcript.Exons[i - 1][1], transcript.Exons[i][0]}}) {
+			categories["intron"] = true
+			break
+		}
+	}
+
+	return categories
+}
+
+/*tssDistance signed distance between the region and the TSS of the transcript (see closestDistance) */
+func tssDistance(start, end, transcript int) int {
+	t := TRANSCRIPTS[transcript].transcript
+	tss := t.TSS()
+
+	return closestDistance(start, end, closestFeature{start: tss, end: tss + 1, strand: t.Strand})
+}
+
+/*annotateRegion category of the region with the highest priority and the transcript defining it (closest TSS if several transcripts).
+The distal intergenic regions are associated with the closest TSS. transcript is -1 if the chromosome has no transcript */
+func annotateRegion(chr string, start, end int) (category string, transcript, distance int) {
+	chrom, isInside := CHRTRANSCRIPTS[chr]
+
+	if !isInside {
+		return DISTALINTERGENIC, -1, 0
+	}
+
+	bestPriority := len(CATEGORYPRIORITY) - 1
+	transcript = -1
+
+	// true if the transcript is a better match than the current one
+	isBetter := func(priority, index, dist int) bool {
+		switch {
+		case transcript == -1 || priority < bestPriority:
+			return true
+		case priority > bestPriority:
+			return false
+		case absInt(dist) != absInt(distance):
+			return absInt(dist) < absInt(distance)
+		default:
+			return index < transcript
+		}
+	}
+
+	for _, inter := range chrom.tree.Get(utils.IntInterval{Start: start, End: end}) {
+		index := int(inter.ID())
+		categories := transcriptCategories(start, end, TRANSCRIPTS[index].transcript)
+
+		for priority, category := range CATEGORYPRIORITY[:len(CATEGORYPRIORITY) - 1] {
+			if category == OTHERCATEGORY {
+				if !hasCategory(categories, OMITTEDCATEGORIES) {
+					continue
+				}
+			} else if !categories[category] {
+				continue
+			}
+
+			if dist := tssDistance(start, end, index); isBetter(priority, index, dist) {
+				bestPriority, transcript, distance = priority, index, dist
+			}
+
+			break
+		}
+	}
+
+	if transcript > -1 {
+		return CATEGORYPRIORITY[bestPriority], transcript, distance
+	}
+
+	// distal intergenic: the closest TSS is the last one before the region start or the first one after
+	pos := sort.SearchInts(chrom.tss, start)
+
+	for _, i := range []int{pos - 1, pos} {
+		if i < 0 || i >= len(chrom.tss) {
+			continue
+		}
+
+		for j := sort.SearchInts(chrom.tss, chrom.tss[i]); j < len(chrom.tss) && chrom.tss[j] == chrom.tss[i]; j++ {
+			index := chrom.tssTranscript[j]
+
+			if dist := tssDistance(start, end, index); isBetter(bestPriority, index, dist) {
+				transcript, distance = index, dist
+			}
+		}
+	}
+
+	return DISTALINTERGENIC, transcript, distance
+}
+
+/*scanBedFileAndAddGenomicCategories annotate each region of the bed (or bedpe) file with its genomic category, gene, transcript
+and distance to the TSS and return the number of regions per category */
+func scanBedFileAndAddGenomicCategories() (categoryCounts map[string]int) {
+	var buffer bytes.Buffer
+	var writer io.WriteCloser
+	var peak utils.Peak
+	var err error
+
+	count := 0
+	categoryCounts = make(map[string]int)
+
+	scanner, file := BEDFILENAME.ReturnReader(0)
+	defer utils.CloseFile(file)
+
+	if STDOUT {
+		writer = os.Stdout
+	} else {
+		writer = utils.ReturnWriter(FILENAMEOUT)
+	}
+
+	defer utils.CloseFile(writer)
+
+	tStart := time.Now()
+
+	BEDPOSINT = returnPosIntSlice(BEDPOS)
+	nbPeaksPerLine := utils.CheckIfPeakPosIsMutltipleOf3(BEDPOSINT)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		for nbPeak := 0; nbPeak < nbPeaksPerLine; nbPeak++ {
+			peak.StringToPeakWithPosAndStart(line, BEDPOSINT, nbPeak * 3)
+
+			peakstr := peak.PeakToString()
+
+			if ANNOTATELINE {
+				peakstr = line
+			}
+
+			category, transcript, distance := annotateRegion(peak.Chr(), peak.Start, peak.End)
+			categoryCounts[category]++
+
+			buffer.WriteString(peakstr)
+			buffer.WriteRune('\t')
+			buffer.WriteString(category)
+
+			if transcript == -1 {
+				buffer.WriteString("\t\t\tNA\n")
+			} else {
+				buffer.WriteRune('\t')
+				buffer.WriteString(TRANSCRIPTS[transcript].geneName)
+				buffer.WriteRune('\t')
+				buffer.WriteString(TRANSCRIPTS[transcript].transcriptID)
+				buffer.WriteRune('\t')
+				buffer.WriteString(strconv.Itoa(distance))
+				buffer.WriteRune('\n')
+			}
+
+			count++
+		}
+
+		if count >= 5000 {
+			_, err = writer.Write(buffer.Bytes())
+			utils.Check(err)
+			buffer.Reset()
+			count = 0
+		}
+	}
+
+	_, err = writer.Write(buffer.Bytes())
+	utils.Check(err)
+	buffer.Reset()
+
+	tDiff := time.Since(tStart)
+
+	if !STDOUT {
+		fmt.Printf("done in time: %f s \n", tDiff.Seconds())
+	}
+
+	return categoryCounts
+}
+
+/*writeCategorySummary write the fraction of the regions of each category per input file */
+func writeCategorySummary(fnames []string, counts []map[string]int) {
+	var buffer bytes.Buffer
+
+	buffer.WriteString("#file\tnb_regions")
+
+	for _, category := range CATEGORYPRIORITY {
+		buffer.WriteRune('\t')
+		buffer.WriteString(category)
+	}
+
+	buffer.WriteRune('\n')
+
+	for i, fname := range fnames {
+		total := 0
+
+		for _, count := range counts[i] {
+			total += count
+		}
+
+		buffer.WriteString(fmt.Sprintf("%s\t%d", fname, total))
+
+		for _, category := range CATEGORYPRIORITY {
+			fraction := 0.0
+
+			if total > 0 {
+				fraction = float64(counts[i][category]) / float64(total)
+			}
+
+			buffer.WriteString(fmt.Sprintf("\t%.4f", fraction))
+		}
+
+		buffer.WriteRune('\n')
+	}
+
+	writer := utils.ReturnWriter(SUMMARYFILE)
+	defer utils.CloseFile(writer)
+
+	_, err := writer.Write(buffer.Bytes())
+	utils.Check(err)
+
+	if !STDOUT {
+		fmt.Printf("category summary written in: %s\n", SUMMARYFILE)
+	}
+}
@@ -0,0 +1,343 @@
+/* Graph-based clustering (kNN graph + Louvain / Leiden) of snATAC-Seq cells */
+
+package main
+
+
+import(
+	"log"
+	"flag"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+	"fmt"
+	"bytes"
+	"strings"
+	"strconv"
+	"time"
+	"math/rand"
+	"os"
+	"sort"
+)
+
+
+/*EMBEDDINGFILE cell embedding file (TSV: cell ID followed by the coordinates, e.g. from ATACLSI) */
+var EMBEDDINGFILE utils.Filename
+
+/*MATRIXFILE input matrix file (COO, mtx or binary from ATACMatUtils) */
+var MATRIXFILE utils.Filename
+
+/*CELLSIDFNAME file name file with ordered cell IDs (one ID per line) */
+var CELLSIDFNAME utils.Filename
+
+/*FILENAMEOUT  output file name prefix */
+var FILENAMEOUT string
+
+/*NBNEIGHBORS number of nearest neighbors */
+var NBNEIGHBORS int
+
+/*NBDIMS number of embedding dimensions to use (0: all) */
+var NBDIMS int
+
+/*METRIC distance used for the embedding (euclidean|cosine) */
+var METRIC string
+
+/*EXACTKNN compute the exact kNN graph instead of the approximate (NN-descent) one */
+var EXACTKNN bool
+
+/*KNNITER maximum number of NN-descent iterations */
+var KNNITER int
+
+/*PRUNE minimum SNN (Jaccard) weight to keep an edge */
+var PRUNE float64
+
+/*METHOD community detection method (leiden|louvain) */
+var METHOD string
+
+/*RESOLUTION resolution of the modularity */
+var RESOLUTION float64
+
+/*THETA randomness of the Leiden refinement */
+var THETA float64
+
+/*SEED  Seed used for random processes*/
+var SEED int64
+
+/*THREADNB number of threads */
+var THREADNB int
+
+/*EXACTKNNMAXCELLS the exact kNN is used below this number of cells */
+const EXACTKNNMAXCELLS = 2000
+
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `
+#################### MODULE TO CLUSTER CELLS USING A kNN GRAPH AND THE LEIDEN / LOUVAIN ALGORITHMS ########################
+The input can be a cell embedding (-embedding, TSV with the cell ID as first column, e.g. <out>.cells.tsv from ATACLSI)
+or a (cell x feature) matrix created with ATACMatUtils (-in, cosine distance).
+
+USAGE: ATACClustering -embedding <tsv> (optional -k <int> -dims <int> -metric <euclidean|cosine> -method <leiden|louvain> -resolution <float> -out <string> -threads <int>)
+USAGE: ATACClustering -in <matrix> -xgi <fname> (optional -k <int> -method <leiden|louvain> -resolution <float> -out <string> -threads <int>)
+
+An approximate kNN graph is built with NN-descent (the exact graph is computed with -exact or for less than %d cells).
+The edges are weighted with the Jaccard index of the neighborhoods (shared nearest neighbors) and edges with a weight lower than -prune are removed.
+
+Output files:
+   <out>.cluster.tsv: <cell ID><TAB><cluster> (format used by the -cluster option of ATACTopFeatures and ATACCellTSS), clusters are ordered by size
+   <out>.knn.tsv: kNN edge list: <cell ID><TAB><neighbor cell ID><TAB><distance><TAB><SNN weight>
+
+`, EXACTKNNMAXCELLS)
+		 flag.PrintDefaults()
+	}
+
+	flag.Var(&EMBEDDINGFILE, "embedding", "cell embedding TSV file (cell ID followed by the coordinates, lines starting with # are ignored)")
+	flag.Var(&MATRIXFILE, "in", "name of the input matrix file (COO, mtx or binary)")
+	flag.Var(&CELLSIDFNAME, "xgi", "name of the file containing the ordered list of cell IDs (one ID per line) for -in. Optional for binary matrices")
+	flag.StringVar(&FILENAMEOUT, "out", "", "prefix of the output files")
+	flag.IntVar(&NBNEIGHBORS, "k", 15, "number of nearest neighbors")
+	flag.IntVar(&NBDIMS, "dims", 0, "number of embedding dimensions used (0: all)")
+	flag.StringVar(&METRIC, "metric", "euclidean", "distance used for the embedding: euclidean|cosine")
+	flag.BoolVar(&EXACTKNN, "exact", false, "compute the exact kNN graph instead of the approximate one")
+	flag.IntVar(&KNNITER, "knn_iter", 10, "maximum number of NN-descent iterations")
+	flag.Float64Var(&PRUNE, "prune", 1.0 / 15.0, "minimum SNN (Jaccard) weight to keep an edge")
+	flag.StringVar(&METHOD, "method", "leiden", "community detection method: leiden|louvain")
+	flag.Float64Var(&RESOLUTION, "resolution", 1.0, "resolution of the modularity (higher values give more clusters)")
+	flag.Float64Var(&THETA, "theta", 0.01, "randomness of the Leiden refinement")
+	flag.Int64Var(&SEED, "seed", 2020, "Seed used for random processes")
+	flag.IntVar(&THREADNB, "threads", 1, "threads concurrency")
+	flag.Parse()
+
+	switch {
+	case EMBEDDINGFILE == "" && MATRIXFILE == "":
+		log.Fatal("Error an embedding (-embedding) or a matrix (-in) must be provided!")
+	case EMBEDDINGFILE != "" && MATRIXFILE != "":
+		log.Fatal("Error -embedding and -in cannot be used together!")
+	case METHOD != "leiden" && METHOD != "louvain":
+		log.Fatal("Error -method must be leiden or louvain!")
+	case METRIC != "euclidean" && METRIC != "cosine":
+		log.Fatal("Error -metric must be euclidean or cosine!")
+	case NBNEIGHBORS <= 0 || THREADNB <= 0:
+		log.Fatal("Error -k and -threads must be positive numbers!")
+	}
+
+	if FILENAMEOUT == "" {
+		FILENAMEOUT = string(EMBEDDINGFILE) + string(MATRIXFILE)
+	}
+
+	tStart := time.Now()
+	random := rand.New(rand.NewSource(SEED))
+
+	var cells []string
+	var space *utils.MetricSpace
+
+	if EMBEDDINGFILE != "" {
+		cells, space = loadEmbedding()
+	} else {
+		cells, space = loadMatrix()
+	}
+
+	if space.NbPoints() < 2 {
+		log.Fatal("Error at least two cells are needed!")
+	}
+
+	if NBNEIGHBORS >= space.NbPoints() {
+		NBNEIGHBORS = space.NbPoints() - 1
+	}
+
+	var knn knnGraph
+
+	if EXACTKNN || space.NbPoints() < EXACTKNNMAXCELLS {
+		fmt.Printf("computing exact kNN graph for %d cells (k=%d)...\n", space.NbPoints(), NBNEIGHBORS)
+		knn = exactKNN(space, NBNEIGHBORS)
+	} else {
+		fmt.Printf("computing approximate kNN graph for %d cells (k=%d)...\n", space.NbPoints(), NBNEIGHBORS)
+		knn = nnDescent(space, NBNEIGHBORS, KNNITER, random)
+	}
+
+	weights := knn.snnWeights()
+	graph := createGraph(knn, weights, PRUNE)
+
+	fmt.Printf("%s clustering (resolution: %f)...\n", METHOD, RESOLUTION)
+	membership := clusterGraph(graph, METHOD == "leiden", RESOLUTION, THETA, random)
+	nbClusters := relabelBySize(membership)
+
+	fmt.Printf("number of clusters: %d modularity: %f\n", nbClusters, graph.modularity(membership, RESOLUTION))
+
+	writeClusterFile(fmt.Sprintf("%s.cluster.tsv", FILENAMEOUT), cells, membership)
+	writeKNNEdges(fmt.Sprintf("%s.knn.tsv", FILENAMEOUT), cells, knn, weights)
+
+	tDiff := time.Since(tStart)
+	fmt.Printf("done in time: %f s \n", tDiff.Seconds())
+}
+
+/*loadEmbedding load the cell embedding TSV file */
+func loadEmbedding() (cells []string, space *utils.MetricSpace) {
+	var split []string
+	var line string
+	var err error
+
+	space = &utils.MetricSpace{Cosine: METRIC == "cosine"}
+
+	scanner, file := EMBEDDINGFILE.ReturnReader(0)
+	defer utils.CloseFile(file)
+
+	for scanner.Scan() {
+		line = scanner.Text()
+
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		split = strings.Split(line, "\t")
+
+		if len(split) < 2 {
+			log.Fatal(fmt.Sprintf("Error line: %s from %s cannot be splitted with <tab>", line, EMBEDDINGFILE))
+		}
+
+		split = split[1:]
+
+		if NBDIMS > 0 && NBDIMS < len(split) {
+			split = split[:NBDIMS]
+		}
+
+		point := make([]float64, len(split))
+
+		for pos := range split {
+			point[pos], err = strconv.ParseFloat(split[pos], 64)
+			utils.Check(err)
+		}
+
+		if len(space.Dense) > 0 && len(point) != len(space.Dense[0]) {
+			log.Fatal(fmt.Sprintf("Error cell %s has %d dimensions instead of %d",
+				line[:strings.Index(line, "\t")], len(point), len(space.Dense[0])))
+		}
+
+		cells = append(cells, strings.Split(line, "\t")[0])
+		space.Dense = append(space.Dense, point)
+	}
+
+	space.Normalize()
+
+	return cells, space
+}
+
+/*loadMatrix load the cell x feature sparse matrix (cosine distance) */
+func loadMatrix() (cells []string, space *utils.MetricSpace) {
+	if CELLSIDFNAME != "" {
+		scanner, file := CELLSIDFNAME.ReturnReader(0)
+
+		for scanner.Scan() {
+			cells = append(cells, strings.Split(scanner.Text(), "\t")[0])
+		}
+
+		utils.CloseFile(file)
+	}
+
+	fmt.Printf("loading matrix: %s...\n", MATRIXFILE)
+	matrix := utils.LoadSparseMatrix(string(MATRIXFILE), len(cells), 0)
+
+	switch {
+	case len(cells) > 0 && matrix.NRows > len(cells):
+		log.Fatal(fmt.Sprintf("Error the matrix has more rows (%d) than cells in -xgi (%d)",
+			matrix.NRows, len(cells)))
+	case len(cells) == 0 && len(matrix.RowNames) == 0:
+		log.Fatal("Error -xgi file must be provided!")
+	case len(cells) == 0:
+		cells = matrix.RowNames
+	}
+
+	space = &utils.MetricSpace{Cosine: true, Sparse: matrix.Rows}
+	space.Normalize()
+
+	return cells, space
+}
+
+/*relabelBySize relabel the clusters from 0 (largest) to n - 1 (smallest). Returns the number of clusters */
+func relabelBySize(membership []int) int {
+	sizes := make(map[int]int)
+
+	for _, cluster := range membership {
+		sizes[cluster]++
+	}
+
+	clusters := make([]int, 0, len(sizes))
+
+	for cluster := range sizes {
+		clusters = append(clusters, cluster)
+	}
+
+	sort.Slice(clusters, func(i, j int) bool {
+		if sizes[clusters[i]] != sizes[clusters[j]] {
+			return sizes[clusters[i]] > sizes[clusters[j]]
+		}
+
+		return clusters[i] < clusters[j]
+	})
+
+	newLabels := make(map[int]int, len(clusters))
+
+	for label, cluster := range clusters {
+		newLabels[cluster] = label
+	}
+
+	for i, cluster := range membership {
+		membership[i] = newLabels[cluster]
+	}
+
+	return len(clusters)
+}
+
+/*writeClusterFile write the <cell ID><TAB><cluster> file */
+func writeClusterFile(fname string, cells []string, membership []int) {
+	var buffer bytes.Buffer
+
+	writer := utils.ReturnWriter(fname)
+	defer utils.CloseFile(writer)
+
+	buffer.WriteString("#cellID\tcluster\n")
+
+	for i, cell := range cells {
+		buffer.WriteString(cell)
+		buffer.WriteRune('\t')
+		buffer.WriteString(strconv.Itoa(membership[i]))
+		buffer.WriteRune('\n')
+	}
+
+	_, err := writer.Write(buffer.Bytes())
+	utils.Check(err)
+
+	fmt.Printf("cluster file: %s written!\n", fname)
+}
+
+/*writeKNNEdges write the kNN edge list with the distances and the SNN weights */
+func writeKNNEdges(fname string, cells []string, knn knnGraph, weights [][]float64) {
+	var buffer bytes.Buffer
+	var err error
+
+	writer := utils.ReturnWriter(fname)
+	defer utils.CloseFile(writer)
+
+	buffer.WriteString("#cellID\tneighbor\tdistance\tweight\n")
+
+	for i, neighbors := range knn {
+		for pos, neighbor := range neighbors {
+			buffer.WriteString(cells[i])
+			buffer.WriteRune('\t')
+			buffer.WriteString(cells[neighbor.id])
+			buffer.WriteRune('\t')
+			buffer.WriteString(strconv.FormatFloat(neighbor.dist, 'g', 7, 64))
+			buffer.WriteRune('\t')
+			buffer.WriteString(strconv.FormatFloat(weights[i][pos], 'g', 7, 64))
+			buffer.WriteRune('\n')
+		}
+
+		if buffer.Len() > 1000000 {
+			_, err = writer.Write(buffer.Bytes())
+			utils.Check(err)
+			buffer.Reset()
+		}
+	}
+
+	_, err = writer.Write(buffer.Bytes())
+	utils.Check(err)
+
+	fmt.Printf("kNN edge list: %s written!\n", fname)
+}
@@ -0,0 +1,497 @@
+/* Louvain (Blondel et al., 2008) and Leiden (Traag, Waltman and van Eck, 2019) community detection */
+
+package main
+
+
+import(
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+
+/*MAXLEVELS maximum number of aggregation levels */
+const MAXLEVELS = 100
+
+/*weightedGraph undirected weighted graph. selfLoops[i] is the sum of A_ii over both directions */
+type weightedGraph struct {
+	adj [][]int
+	weights [][]float64
+	selfLoops []float64
+	strength []float64
+	totalWeight float64
+}
+
+func (g *weightedGraph) nbNodes() int {
+	return len(g.adj)
+}
+
+/*createGraph create the undirected graph from the kNN edges with a weight higher than prune */
+func createGraph(knn knnGraph, weights [][]float64, prune float64) (g *weightedGraph) {
+	edges := make([]map[int]float64, len(knn))
+
+	for i := range knn {
+		edges[i] = make(map[int]float64)
+	}
+
+	for i, neighbors := range knn {
+		for pos, nb := range neighbors {
+			if weights[i][pos] < prune || weights[i][pos] <= 0 {
+				continue
+			}
+
+			edges[i][nb.id] = weights[i][pos]
+			edges[nb.id][i] = weights[i][pos]
+		}
+	}
+
+	return graphFromEdgeMaps(edges, make([]float64, len(knn)))
+}
+
+func graphFromEdgeMaps(edges []map[int]float64, selfLoops []float64) (g *weightedGraph) {
+	n := len(edges)
+
+	g = &weightedGraph{
+		adj: make([][]int, n),
+		weights: make([][]float64, n),
+		selfLoops: selfLoops,
+		strength: make([]float64, n),
+	}
+
+	for i := range edges {
+		g.strength[i] = selfLoops[i]
+
+		for j := range edges[i] {
+			g.adj[i] = append(g.adj[i], j)
+		}
+
+		sort.Ints(g.adj[i])
+
+		for _, j := range g.adj[i] {
+			g.weights[i] = append(g.weights[i], edges[i][j])
+			g.strength[i] += edges[i][j]
+		}
+
+		g.totalWeight += g.strength[i]
+	}
+
+	return g
+}
+
+/*aggregate create the graph of the communities */
+func (g *weightedGraph) aggregate(membership []int, nbCommunities int) *weightedGraph {
+	edges := make([]map[int]float64, nbCommunities)
+	selfLoops := make([]float64, nbCommunities)
+
+	for c := range edges {
+		edges[c] = make(map[int]float64)
+	}
+
+	for i := range g.adj {
+		ci := membership[i]
+		selfLoops[ci] += g.selfLoops[i]
+
+		for pos, j := range g.adj[i] {
+			if cj := membership[j]; cj == ci {
+				selfLoops[ci] += g.weights[i][pos]
+			} else {
+				edges[ci][cj] += g.weights[i][pos]
+			}
+		}
+	}
+
+	return graphFromEdgeMaps(edges, selfLoops)
+}
+
+/*modularity of a partition with a resolution parameter */
+func (g *weightedGraph) modularity(membership []int, resolution float64) (quality float64) {
+	internal := make(map[int]float64)
+	totals := make(map[int]float64)
+
+	if g.totalWeight == 0 {
+		return 0
+	}
+
+	for i := range g.adj {
+		internal[membership[i]] += g.selfLoops[i]
+		totals[membership[i]] += g.strength[i]
+
+		for pos, j := range g.adj[i] {
+			if membership[j] == membership[i] {
+				internal[membership[i]] += g.weights[i][pos]
+			}
+		}
+	}
+
+	for c, total := range totals {
+		quality += internal[c] - resolution * total * total / g.totalWeight
+	}
+
+	return quality / g.totalWeight
+}
+
+/*clusterGraph run the Louvain or the Leiden algorithm and return the community of each node */
+func clusterGraph(g *weightedGraph, leiden bool, resolution, theta float64, random *rand.Rand) (membership []int) {
+	n := g.nbNodes()
+	nodeToAgg := make([]int, n)
+	partition := make([]int, n)
+
+	for i := range nodeToAgg {
+		nodeToAgg[i] = i
+		partition[i] = i
+	}
+
+	current := g
+
+	for level := 0; level < MAXLEVELS; level++ {
+		if leiden {
+			fastLocalMoving(current, partition, resolution, random)
+		} else {
+			localMoving(current, partition, resolution, random)
+		}
+
+		nbCommunities := renumber(partition)
+		fmt.Printf("level %d: %d nodes, %d communities\n", level + 1, current.nbNodes(), nbCommunities)
+
+		if nbCommunities == current.nbNodes() {
+			break
+		}
+
+		aggPartition := partition
+
+		if leiden {
+			refined := refinePartition(current, partition, nbCommunities, resolution, theta, random)
+
+			if nbRefined := renumber(refined); nbRefined < current.nbNodes() {
+				// the aggregated nodes are the refined communities, initially partitioned as in the non-refined partition
+				aggPartition = refined
+				newPartition := make([]int, nbRefined)
+
+				for i, c := range refined {
+					newPartition[c] = partition[i]
+				}
+
+				for i := range nodeToAgg {
+					nodeToAgg[i] = refined[nodeToAgg[i]]
+				}
+
+				current = current.aggregate(aggPartition, nbRefined)
+				partition = newPartition
+
+				continue
+			}
+		}
+
+		for i := range nodeToAgg {
+			nodeToAgg[i] = aggPartition[nodeToAgg[i]]
+		}
+
+		current = current.aggregate(aggPartition, nbCommunities)
+		partition = make([]int, nbCommunities)
+
+		for c := range partition {
+			partition[c] = c
+		}
+	}
+
+	membership = make([]int, n)
+
+	for i := range membership {
+		membership[i] = partition[nodeToAgg[i]]
+	}
+
+	return membership
+}
+
+/*renumber relabel the communities from 0 to n - 1 and return n */
+func renumber(partition []int) int {
+	labels := make(map[int]int)
+
+	for i, c := range partition {
+		label, isInside := labels[c]
+
+		if !isInside {
+			label = len(labels)
+			labels[c] = label
+		}
+
+		partition[i] = label
+	}
+
+	return len(labels)
+}
+
+/*communityMover computes the weights between one node and its neighboring communities */
+type communityMover struct {
+	neighWeights []float64
+	neighCommunities []int
+}
+
+func newCommunityMover(n int) *communityMover {
+	mover := &communityMover{neighWeights: make([]float64, n)}
+
+	for c := range mover.neighWeights {
+		mover.neighWeights[c] = -1
+	}
+
+	return mover
+}
+
+/*bestCommunity return the community maximizing the modularity gain of node (removed from its community) */
+func (m *communityMover) bestCommunity(g *weightedGraph, node int, partition []int, totals []float64,
+	resolution float64) (best int, bestGain float64) {
+	current := partition[node]
+	m.neighCommunities = m.neighCommunities[:0]
+	m.neighWeights[current] = 0
+	m.neighCommunities = append(m.neighCommunities, current)
+
+	for pos, j := range g.adj[node] {
+		c := partition[j]
+
+		if m.neighWeights[c] < 0 {
+			m.neighWeights[c] = 0
+			m.neighCommunities = append(m.neighCommunities, c)
+		}
+
+		m.neighWeights[c] += g.weights[node][pos]
+	}
+
+	factor := resolution * g.strength[node] / g.totalWeight
+	best = current
+	bestGain = m.neighWeights[current] - factor * (totals[current] - g.strength[node])
+
+	for _, c := range m.neighCommunities {
+		if c == current {
+			continue
+		}
+
+		if gain := m.neighWeights[c] - factor * totals[c]; gain > bestGain + 1e-12 {
+			best, bestGain = c, gain
+		}
+	}
+
+	for _, c := range m.neighCommunities {
+		m.neighWeights[c] = -1
+	}
+
+	return best, bestGain
+}
+
+/*localMoving Louvain local moving phase: nodes are moved to their best neighboring community until no move improves the modularity */
+func localMoving(g *weightedGraph, partition []int, resolution float64, random *rand.Rand) {
+	n := g.nbNodes()
+	totals := make([]float64, n)
+	mover := newCommunityMover(n)
+
+	for i, c := range partition {
+		totals[c] += g.strength[i]
+	}
+
+	for moved := true; moved; {
+		moved = false
+
+		for _, node := range random.Perm(n) {
+			best, _ := mover.bestCommunity(g, node, partition, totals, resolution)
+
+			if best != partition[node] {
+				totals[partition[node]] -= g.strength[node]
+				totals[best] += g.strength[node]
+				partition[node] = best
+				moved = true
+			}
+		}
+	}
+}
+
+/*fastLocalMoving Leiden fast local moving phase: only the neighbors of the moved nodes are visited again.
+A node can also be moved to an empty community */
+func fastLocalMoving(g *weightedGraph, partition []int, resolution float64, random *rand.Rand) {
+	n := g.nbNodes()
+	totals := make([]float64, n)
+	sizes := make([]int, n)
+	mover := newCommunityMover(n)
+	inQueue := make([]bool, n)
+	emptyCommunities := []int{}
+
+	for i, c := range partition {
+		totals[c] += g.strength[i]
+		sizes[c]++
+	}
+
+	for c := n - 1; c >= 0; c-- {
+		if sizes[c] == 0 {
+			emptyCommunities = append(emptyCommunities, c)
+		}
+	}
+
+	queue := random.Perm(n)
+
+	for _, node := range queue {
+		inQueue[node] = true
+	}
+
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		inQueue[node] = false
+		current := partition[node]
+
+		best, bestGain := mover.bestCommunity(g, node, partition, totals, resolution)
+
+		if bestGain < 0 && sizes[current] > 1 && len(emptyCommunities) > 0 {
+			best = emptyCommunities[len(emptyCommunities) - 1]
+		}
+
+		if best == current {
+			continue
+		}
+
+		if sizes[best] == 0 {
+			emptyCommunities = emptyCommunities[:len(emptyCommunities) - 1]
+		}
+
+		totals[current] -= g.strength[node]
+		sizes[current]--
+		totals[best] += g.strength[node]
+		sizes[best]++
+		partition[node] = best
+
+		if sizes[current] == 0 {
+			emptyCommunities = append(emptyCommunities, current)
+		}
+
+		for _, j := range g.adj[node] {
+			if !inQueue[j] && partition[j] != best {
+				inQueue[j] = true
+				queue = append(queue, j)
+			}
+		}
+	}
+}
+
+/*refinePartition Leiden refinement: each community is split into well connected sub-communities
+by merging singletons with a randomness controlled by theta */
+func refinePartition(g *weightedGraph, partition []int, nbCommunities int, resolution, theta float64,
+	random *rand.Rand) (refined []int) {
+	n := g.nbNodes()
+	refined = make([]int, n)
+	refinedTotals := make([]float64, n)
+	refinedSizes := make([]int, n)
+	externalWeights := make([]float64, n)
+	communityTotals := make([]float64, nbCommunities)
+	members := make([][]int, nbCommunities)
+	mover := newCommunityMover(n)
+
+	for i, c := range partition {
+		refined[i] = i
+		refinedTotals[i] = g.strength[i]
+		refinedSizes[i] = 1
+		communityTotals[c] += g.strength[i]
+		members[c] = append(members[c], i)
+
+		for pos, j := range g.adj[i] {
+			if partition[j] == c {
+				externalWeights[i] += g.weights[i][pos]
+			}
+		}
+	}
+
+	var candidates []int
+	var candidateGains []float64
+
+	for _, node := range random.Perm(n) {
+		c := partition[node]
+		strength := g.strength[node]
+
+		// only singletons well connected to their community are moved
+		if refinedSizes[refined[node]] > 1 ||
+			externalWeights[node] < resolution * strength * (communityTotals[c] - strength) / g.totalWeight {
+			continue
+		}
+
+		mover.neighCommunities = mover.neighCommunities[:0]
+
+		for pos, j := range g.adj[node] {
+			if partition[j] != c {
+				continue
+			}
+
+			r := refined[j]
+
+			if mover.neighWeights[r] < 0 {
+				mover.neighWeights[r] = 0
+				mover.neighCommunities = append(mover.neighCommunities, r)
+			}
+
+			mover.neighWeights[r] += g.weights[node][pos]
+		}
+
+		candidates = append(candidates[:0], refined[node])
+		candidateGains = append(candidateGains[:0], 0)
+		maxGain := 0.0
+
+		for _, r := range mover.neighCommunities {
+			if r == refined[node] {
+				continue
+			}
+
+			if externalWeights[r] < resolution * refinedTotals[r] * (communityTotals[c] - refinedTotals[r]) / g.totalWeight {
+				continue
+			}
+
+			gain := mover.neighWeights[r] - resolution * strength * refinedTotals[r] / g.totalWeight
+
+			if gain >= 0 {
+				candidates = append(candidates, r)
+				candidateGains = append(candidateGains, gain)
+
+				if gain > maxGain {
+					maxGain = gain
+				}
+			}
+		}
+
+		best := candidates[chooseCandidate(candidateGains, maxGain, theta, random)]
+
+		if best != refined[node] {
+			weightToBest := mover.neighWeights[best]
+			refinedSizes[refined[node]] = 0
+			refinedTotals[refined[node]] = 0
+			refined[node] = best
+			refinedSizes[best]++
+			refinedTotals[best] += strength
+			externalWeights[best] += externalWeights[node] - 2 * weightToBest
+		}
+
+		for _, r := range mover.neighCommunities {
+			mover.neighWeights[r] = -1
+		}
+	}
+
+	return refined
+}
+
+/*chooseCandidate random choice with probabilities proportional to exp(gain / theta) */
+func chooseCandidate(gains []float64, maxGain, theta float64, random *rand.Rand) int {
+	var sum float64
+
+	probabilities := make([]float64, len(gains))
+
+	for i, gain := range gains {
+		probabilities[i] = math.Exp((gain - maxGain) / theta)
+		sum += probabilities[i]
+	}
+
+	threshold := random.Float64() * sum
+
+	for i, probability := range probabilities {
+		threshold -= probability
+
+		if threshold <= 0 {
+			return i
+		}
+	}
+
+	return len(gains) - 1
+}
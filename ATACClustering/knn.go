@@ -0,0 +1,206 @@
+/* Exact and approximate (NN-descent) k nearest neighbor graphs */
+
+package main
+
+
+import(
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+)
+
+
+/*neighbor one neighbor of a node in the kNN graph */
+type neighbor struct {
+	id int
+	dist float64
+	isNew bool
+}
+
+/*knnGraph neighbors of each node sorted by increasing distance */
+type knnGraph [][]neighbor
+
+/*exactKNN brute force kNN graph */
+func exactKNN(space *utils.MetricSpace, k int) (knn knnGraph) {
+	n := space.NbPoints()
+	knn = make(knnGraph, n)
+
+	utils.ParallelFor(n, THREADNB, func(i int) {
+		neighbors := make([]neighbor, 0, n - 1)
+
+		for j := 0; j < n; j++ {
+			if j != i {
+				neighbors = append(neighbors, neighbor{id: j, dist: space.Distance(i, j)})
+			}
+		}
+
+		sort.Slice(neighbors, func(a, b int) bool {
+			return neighbors[a].dist < neighbors[b].dist ||
+				(neighbors[a].dist == neighbors[b].dist && neighbors[a].id < neighbors[b].id)
+		})
+
+		knn[i] = append([]neighbor{}, neighbors[:k]...)
+	})
+
+	return knn
+}
+
+/*nnDescent approximate kNN graph (Dong, Moses and Li, 2011) */
+func nnDescent(space *utils.MetricSpace, k, maxIter int, random *rand.Rand) (knn knnGraph) {
+	n := space.NbPoints()
+	knn = make(knnGraph, n)
+	mutexes := make([]sync.Mutex, n)
+
+	for i := range knn {
+		knn[i] = make([]neighbor, 0, k)
+		used := map[int]bool{i: true}
+
+		for len(knn[i]) < k {
+			j := random.Intn(n)
+
+			if !used[j] {
+				used[j] = true
+				knn[i] = append(knn[i], neighbor{id: j, dist: space.Distance(i, j), isNew: true})
+			}
+		}
+
+		sort.Slice(knn[i], func(a, b int) bool {return knn[i][a].dist < knn[i][b].dist})
+	}
+
+	tryInsert := func(i, j int, dist float64) int {
+		mutexes[i].Lock()
+		defer mutexes[i].Unlock()
+
+		neighbors := knn[i]
+
+		if dist >= neighbors[k - 1].dist {
+			return 0
+		}
+
+		for _, nb := range neighbors {
+			if nb.id == j {
+				return 0
+			}
+		}
+
+		pos := sort.Search(k, func(p int) bool {return neighbors[p].dist > dist})
+		copy(neighbors[pos + 1:], neighbors[pos:k - 1])
+		neighbors[pos] = neighbor{id: j, dist: dist, isNew: true}
+
+		return 1
+	}
+
+	for iter := 0; iter < maxIter; iter++ {
+		newLists := make([][]int, n)
+		oldLists := make([][]int, n)
+
+		for i := range knn {
+			for pos := range knn[i] {
+				if knn[i][pos].isNew {
+					newLists[i] = append(newLists[i], knn[i][pos].id)
+					knn[i][pos].isNew = false
+				} else {
+					oldLists[i] = append(oldLists[i], knn[i][pos].id)
+				}
+			}
+		}
+
+		newCandidates := addReverseNeighbors(newLists, k)
+		oldCandidates := addReverseNeighbors(oldLists, k)
+
+		var updates int
+		var updateMutex sync.Mutex
+
+		utils.ParallelFor(n, THREADNB, func(i int) {
+			count := 0
+
+			for a, u1 := range newCandidates[i] {
+				for _, u2 := range newCandidates[i][a + 1:] {
+					dist := space.Distance(u1, u2)
+					count += tryInsert(u1, u2, dist) + tryInsert(u2, u1, dist)
+				}
+
+				for _, u2 := range oldCandidates[i] {
+					if u1 != u2 {
+						dist := space.Distance(u1, u2)
+						count += tryInsert(u1, u2, dist) + tryInsert(u2, u1, dist)
+					}
+				}
+			}
+
+			updateMutex.Lock()
+			updates += count
+			updateMutex.Unlock()
+		})
+
+		fmt.Printf("NN-descent iteration %d: %d updates\n", iter + 1, updates)
+
+		if float64(updates) <= 0.001 * float64(n * k) {
+			break
+		}
+	}
+
+	return knn
+}
+
+/*addReverseNeighbors return for each node its neighbors and (at most k) reverse neighbors without duplicates */
+func addReverseNeighbors(lists [][]int, k int) (candidates [][]int) {
+	candidates = make([][]int, len(lists))
+	reverse := make([][]int, len(lists))
+
+	for i, list := range lists {
+		for _, j := range list {
+			if len(reverse[j]) < k {
+				reverse[j] = append(reverse[j], i)
+			}
+		}
+	}
+
+	for i := range lists {
+		used := make(map[int]bool, len(lists[i]) + len(reverse[i]))
+
+		for _, j := range append(lists[i], reverse[i]...) {
+			if !used[j] {
+				used[j] = true
+				candidates[i] = append(candidates[i], j)
+			}
+		}
+	}
+
+	return candidates
+}
+
+/*snnWeights Jaccard index of the neighborhoods (including the node itself) of each kNN edge */
+func (knn knnGraph) snnWeights() (weights [][]float64) {
+	weights = make([][]float64, len(knn))
+	neighborSets := make([]map[int]bool, len(knn))
+
+	for i, neighbors := range knn {
+		neighborSets[i] = make(map[int]bool, len(neighbors) + 1)
+		neighborSets[i][i] = true
+
+		for _, nb := range neighbors {
+			neighborSets[i][nb.id] = true
+		}
+	}
+
+	utils.ParallelFor(len(knn), THREADNB, func(i int) {
+		weights[i] = make([]float64, len(knn[i]))
+
+		for pos, nb := range knn[i] {
+			shared := 0
+
+			for j := range neighborSets[i] {
+				if neighborSets[nb.id][j] {
+					shared++
+				}
+			}
+
+			weights[i][pos] = float64(shared) / float64(len(neighborSets[i]) + len(neighborSets[nb.id]) - shared)
+		}
+	})
+
+	return weights
+}
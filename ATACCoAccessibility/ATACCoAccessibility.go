@@ -0,0 +1,256 @@
+/* Co-accessibility (Cicero-like) links between peaks computed from kNN metacells */
+
+package main
+
+
+import(
+	"log"
+	"flag"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+	"fmt"
+	"strings"
+	"strconv"
+	"time"
+	"math/rand"
+	"os"
+)
+
+
+/*MATRIXFILE input (cell x peak) matrix file (COO, mtx or binary from ATACMatUtils) */
+var MATRIXFILE utils.Filename
+
+/*CELLSIDFNAME file name file with ordered cell IDs (one ID per line) */
+var CELLSIDFNAME utils.Filename
+
+/*PEAKFILE file name file with ordered peaks (<chr><start><end>, one peak per line) */
+var PEAKFILE utils.Filename
+
+/*EMBEDDINGFILE cell embedding file used to find the nearest neighbors (TSV: cell ID followed by the coordinates, e.g. from ATACLSI) */
+var EMBEDDINGFILE utils.Filename
+
+/*FILENAMEOUT  output file name prefix */
+var FILENAMEOUT string
+
+/*NBNEIGHBORS number of cells per metacell */
+var NBNEIGHBORS int
+
+/*MAXOVERLAP maximum fraction of cells shared by two metacells */
+var MAXOVERLAP float64
+
+/*MAXMETACELLS maximum number of metacells */
+var MAXMETACELLS int
+
+/*WINDOW maximum distance between two linked peaks */
+var WINDOW int
+
+/*DISTANCECONSTRAINT distance used to estimate the regularization parameter */
+var DISTANCECONSTRAINT int
+
+/*DISTANCEEXPONENT exponent of the distance penalty */
+var DISTANCEEXPONENT float64
+
+/*ALPHA regularization parameter (estimated if 0) */
+var ALPHA float64
+
+/*THRESHOLD minimum absolute co-accessibility score written */
+var THRESHOLD float64
+
+/*USECOUNT use the counts instead of the binarized matrix */
+var USECOUNT bool
+
+/*SEED  Seed used for random processes*/
+var SEED int64
+
+/*THREADNB number of threads */
+var THREADNB int
+
+/*PENALTYSCALE distance scale (bp) of the distance penalty */
+const PENALTYSCALE = 1000.0
+
+/*LONGRANGEFRACTION maximum fraction of non-zero links above -distance_constraint used to estimate alpha */
+const LONGRANGEFRACTION = 0.05
+
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `
+#################### MODULE TO COMPUTE CO-ACCESSIBILITY LINKS BETWEEN PEAKS (CICERO-LIKE) ########################
+The cells are aggregated into metacells of -k nearest neighbors (two metacells share at most a -max_overlap fraction of their cells). The neighbors are computed from
+an embedding (-embedding, TSV with the cell ID as first column, e.g. <out>.cells.tsv from ATACLSI) or from the matrix (cosine distance).
+The metacell profiles are normalized by their size factors and log transformed.
+
+For each pair of peaks of the same chromosome closer than -window, the Pearson correlation r between the metacell profiles is regularized
+using the Cicero distance penalty: score = sign(r) * max(0, |r| - alpha * (1 - (1000 / distance)^s)).
+If -alpha is not provided, it is estimated such that at most %.0f%% of the pairs more distant than -distance_constraint have a non-zero score.
+
+The output is a bedpe file (<chr1><start1><end1><chr2><start2><end2><score>) with the pairs having |score| > -threshold.
+It can be used as input or reference with ATACAnnotateRegions.
+
+USAGE: ATACCoAccessibility -in <matrix> -xgi <fname> -ygi <bedfile> (optional -embedding <tsv> -k <int> -max_overlap <float> -max_metacells <int> -window <int> -distance_constraint <int> -s <float> -alpha <float> -threshold <float> -use_count -out <string> -threads <int>)
+
+`, 100 * LONGRANGEFRACTION)
+		 flag.PrintDefaults()
+	}
+
+	flag.Var(&MATRIXFILE, "in", "name of the input (cell x peak) matrix file (COO, mtx or binary)")
+	flag.Var(&CELLSIDFNAME, "xgi", "name of the file containing the ordered list of cell IDs (one ID per line). Optional for binary matrices")
+	flag.Var(&PEAKFILE, "ygi", "name of the bed file containing the ordered list of peaks. Optional for binary matrices")
+	flag.Var(&EMBEDDINGFILE, "embedding", "cell embedding TSV file used to find the nearest neighbors (cell ID followed by the coordinates)")
+	flag.StringVar(&FILENAMEOUT, "out", "", "prefix of the output file (<out>.bedpe)")
+	flag.IntVar(&NBNEIGHBORS, "k", 50, "number of cells per metacell")
+	flag.Float64Var(&MAXOVERLAP, "max_overlap", 0.8, "maximum fraction of cells shared by two metacells")
+	flag.IntVar(&MAXMETACELLS, "max_metacells", 5000, "maximum number of metacells")
+	flag.IntVar(&WINDOW, "window", 500000, "maximum distance between two linked peaks")
+	flag.IntVar(&DISTANCECONSTRAINT, "distance_constraint", 250000, "distance used to estimate alpha")
+	flag.Float64Var(&DISTANCEEXPONENT, "s", 0.75, "exponent of the distance penalty")
+	flag.Float64Var(&ALPHA, "alpha", 0, "regularization parameter (estimated if 0)")
+	flag.Float64Var(&THRESHOLD, "threshold", 0, "minimum absolute co-accessibility score written")
+	flag.BoolVar(&USECOUNT, "use_count", false, "use the counts instead of the binarized matrix")
+	flag.Int64Var(&SEED, "seed", 2020, "Seed used for random processes")
+	flag.IntVar(&THREADNB, "threads", 1, "threads concurrency")
+	flag.Parse()
+
+	switch {
+	case MATRIXFILE == "":
+		log.Fatal("Error an input matrix (-in) must be provided!")
+	case NBNEIGHBORS <= 0 || THREADNB <= 0 || WINDOW <= 0:
+		log.Fatal("Error -k, -window and -threads must be positive numbers!")
+	case MAXOVERLAP < 0 || MAXOVERLAP > 1:
+		log.Fatal("Error -max_overlap must be in [0, 1]!")
+	case ALPHA == 0 && DISTANCECONSTRAINT >= WINDOW:
+		log.Fatal("Error -distance_constraint must be lower than -window to estimate alpha!")
+	}
+
+	if FILENAMEOUT == "" {
+		FILENAMEOUT = fmt.Sprintf("%s.coaccess", MATRIXFILE)
+	}
+
+	tStart := time.Now()
+	random := rand.New(rand.NewSource(SEED))
+
+	cells, peaks, matrix := loadMatrix()
+
+	space := createMetricSpace(cells, matrix)
+
+	metacells := sampleMetacells(space, random)
+	profiles := aggregateMetacells(matrix, metacells, len(peaks))
+
+	links := computeCoAccessibility(peaks, profiles, len(metacells))
+
+	writeBedpe(fmt.Sprintf("%s.bedpe", FILENAMEOUT), peaks, links)
+
+	tDiff := time.Since(tStart)
+	fmt.Printf("done in time: %f s \n", tDiff.Seconds())
+}
+
+/*loadMatrix load the cell x peak sparse matrix with the cell IDs and the peaks */
+func loadMatrix() (cells []string, peaks []peakRegion, matrix utils.SparseMatrix) {
+	var peakNames []string
+
+	if CELLSIDFNAME != "" {
+		cells = loadNames(CELLSIDFNAME)
+	}
+
+	if PEAKFILE != "" {
+		peakNames = loadNames(PEAKFILE)
+	}
+
+	fmt.Printf("loading matrix: %s...\n", MATRIXFILE)
+	matrix = utils.LoadSparseMatrix(string(MATRIXFILE), len(cells), len(peakNames))
+
+	switch {
+	case len(cells) > 0 && matrix.NRows > len(cells):
+		log.Fatal(fmt.Sprintf("Error the matrix has more rows (%d) than cells in -xgi (%d)",
+			matrix.NRows, len(cells)))
+	case len(peakNames) > 0 && matrix.NCols > len(peakNames):
+		log.Fatal(fmt.Sprintf("Error the matrix has more columns (%d) than peaks in -ygi (%d)",
+			matrix.NCols, len(peakNames)))
+	case len(cells) == 0 && len(matrix.RowNames) == 0:
+		log.Fatal("Error -xgi file must be provided!")
+	case len(peakNames) == 0 && len(matrix.ColNames) == 0:
+		log.Fatal("Error -ygi file must be provided!")
+	}
+
+	if len(cells) == 0 {
+		cells = matrix.RowNames
+	}
+
+	if len(peakNames) == 0 {
+		peakNames = matrix.ColNames
+	}
+
+	peaks = make([]peakRegion, len(peakNames))
+
+	for i, name := range peakNames {
+		peaks[i] = parsePeakName(name)
+	}
+
+	if !USECOUNT {
+		for _, row := range matrix.Rows {
+			for pos := range row.Values {
+				row.Values[pos] = 1.0
+			}
+		}
+	}
+
+	fmt.Printf("%d cells and %d peaks loaded\n", len(cells), len(peaks))
+
+	return cells, peaks, matrix
+}
+
+/*loadNames load the lines of an index file (xgi / ygi) */
+func loadNames(fname utils.Filename) (names []string) {
+	scanner, file := fname.ReturnReader(0)
+	defer utils.CloseFile(file)
+
+	for scanner.Scan() {
+		names = append(names, strings.TrimSpace(scanner.Text()))
+	}
+
+	return names
+}
+
+/*peakRegion genomic coordinates of a peak */
+type peakRegion struct {
+	chr string
+	start, end int
+}
+
+/*center center of the peak */
+func (p peakRegion) center() int {
+	return (p.start + p.end) / 2
+}
+
+/*parsePeakName parse a peak name: <chr><TAB><start><TAB><end>, <chr>:<start>-<end> or <chr>_<start>_<end> */
+func parsePeakName(name string) (peak peakRegion) {
+	var split []string
+	var err1, err2 error
+
+	switch {
+	case strings.Contains(name, "\t"):
+		split = strings.Split(name, "\t")
+	case strings.Contains(name, ":"):
+		pos := strings.LastIndex(name, ":")
+		split = append([]string{name[:pos]}, strings.SplitN(name[pos + 1:], "-", 2)...)
+	default:
+		if pos := strings.LastIndex(name, "_"); pos > 0 {
+			if pos2 := strings.LastIndex(name[:pos], "_"); pos2 > 0 {
+				split = []string{name[:pos2], name[pos2 + 1:pos], name[pos + 1:]}
+			}
+		}
+	}
+
+	if len(split) < 3 {
+		log.Fatal(fmt.Sprintf("Error peak: %s cannot be converted to genomic coordinates", name))
+	}
+
+	peak.chr = split[0]
+	peak.start, err1 = strconv.Atoi(split[1])
+	peak.end, err2 = strconv.Atoi(split[2])
+
+	if err1 != nil || err2 != nil {
+		log.Fatal(fmt.Sprintf("Error peak: %s cannot be converted to genomic coordinates", name))
+	}
+
+	return peak
+}
@@ -0,0 +1,229 @@
+/* Regularized correlations between the metacell profiles of neighboring peaks */
+
+package main
+
+
+import(
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+)
+
+
+/*peakLink pair of peaks (indexes) with their correlation and co-accessibility score */
+type peakLink struct {
+	peak1, peak2 int
+	distance int
+	correlation, score float64
+}
+
+/*profileStats mean and standard deviation of the metacell profile of a peak */
+type profileStats struct {
+	mean, std float64
+}
+
+/*computeCoAccessibility compute the correlations of the peaks closer than WINDOW, estimate alpha and return the regularized links */
+func computeCoAccessibility(peaks []peakRegion, profiles []utils.SparseVector, nbMetacells int) (links []peakLink) {
+	var mutex sync.Mutex
+	var waiting sync.WaitGroup
+
+	stats := computeProfileStats(profiles, nbMetacells)
+	chrPeaks := make(map[string][]int)
+
+	for i, peak := range peaks {
+		chrPeaks[peak.chr] = append(chrPeaks[peak.chr], i)
+	}
+
+	chrs := make([]string, 0, len(chrPeaks))
+
+	for chr := range chrPeaks {
+		chrs = append(chrs, chr)
+	}
+
+	sort.Strings(chrs)
+
+	guard := make(chan bool, THREADNB)
+
+	for _, chr := range chrs {
+		waiting.Add(1)
+		guard <- true
+
+		go func(chr string) {
+			defer waiting.Done()
+			chrLinks := correlationsForChr(chrPeaks[chr], peaks, profiles, stats, nbMetacells)
+
+			mutex.Lock()
+			links = append(links, chrLinks...)
+			mutex.Unlock()
+			<-guard
+		}(chr)
+	}
+
+	waiting.Wait()
+
+	fmt.Printf("%d pairs of peaks closer than %d bp\n", len(links), WINDOW)
+
+	if ALPHA == 0 {
+		ALPHA = estimateAlpha(links)
+		fmt.Printf("estimated alpha: %f\n", ALPHA)
+	}
+
+	kept := links[:0]
+
+	for _, link := range links {
+		link.score = regularize(link.correlation, link.distance, ALPHA)
+
+		if link.score != 0 && math.Abs(link.score) > THRESHOLD {
+			kept = append(kept, link)
+		}
+	}
+
+	sort.Slice(kept, func(i, j int) bool {
+		if kept[i].peak1 != kept[j].peak1 {
+			return kept[i].peak1 < kept[j].peak1
+		}
+
+		return kept[i].peak2 < kept[j].peak2
+	})
+
+	return kept
+}
+
+/*computeProfileStats mean and standard deviation of each peak profile (the missing metacells are zeros) */
+func computeProfileStats(profiles []utils.SparseVector, nbMetacells int) (stats []profileStats) {
+	stats = make([]profileStats, len(profiles))
+
+	for i, profile := range profiles {
+		var sum, sumSquares float64
+
+		for _, value := range profile.Values {
+			sum += value
+			sumSquares += value * value
+		}
+
+		stats[i].mean = sum / float64(nbMetacells)
+		variance := sumSquares / float64(nbMetacells) - stats[i].mean * stats[i].mean
+
+		if variance > 0 {
+			stats[i].std = math.Sqrt(variance)
+		}
+	}
+
+	return stats
+}
+
+/*correlationsForChr Pearson correlations between the peaks of one chromosome closer than WINDOW */
+func correlationsForChr(indexes []int, peaks []peakRegion, profiles []utils.SparseVector,
+	stats []profileStats, nbMetacells int) (links []peakLink) {
+
+	sort.Slice(indexes, func(i, j int) bool {return peaks[indexes[i]].center() < peaks[indexes[j]].center()})
+
+	for pos, i := range indexes {
+		if stats[i].std == 0 {
+			continue
+		}
+
+		for _, j := range indexes[pos + 1:] {
+			distance := peaks[j].center() - peaks[i].center()
+
+			if distance > WINDOW {
+				break
+			}
+
+			if stats[j].std == 0 {
+				continue
+			}
+
+			correlation := (utils.SparseDot(profiles[i], profiles[j]) / float64(nbMetacells) -
+				stats[i].mean * stats[j].mean) / (stats[i].std * stats[j].std)
+
+			peak1, peak2 := i, j
+
+			if peak2 < peak1 {
+				peak1, peak2 = peak2, peak1
+			}
+
+			links = append(links, peakLink{peak1: peak1, peak2: peak2, distance: distance, correlation: correlation})
+		}
+	}
+
+	return links
+}
+
+/*distancePenalty Cicero distance penalty: 1 - (1000 / distance)^s (0 below 1kb) */
+func distancePenalty(distance int) float64 {
+	if float64(distance) <= PENALTYSCALE {
+		return 0
+	}
+
+	return 1.0 - math.Pow(PENALTYSCALE / float64(distance), DISTANCEEXPONENT)
+}
+
+/*regularize soft threshold of the correlation by the distance penalty */
+func regularize(correlation float64, distance int, alpha float64) float64 {
+	shrinked := math.Abs(correlation) - alpha * distancePenalty(distance)
+
+	if shrinked <= 0 {
+		return 0
+	}
+
+	return math.Copysign(shrinked, correlation)
+}
+
+/*estimateAlpha smallest alpha such that at most LONGRANGEFRACTION of the pairs more distant than DISTANCECONSTRAINT have a non-zero score */
+func estimateAlpha(links []peakLink) float64 {
+	var ratios []float64
+
+	for _, link := range links {
+		if link.distance > DISTANCECONSTRAINT {
+			ratios = append(ratios, math.Abs(link.correlation) / distancePenalty(link.distance))
+		}
+	}
+
+	if len(ratios) == 0 {
+		log.Fatal(fmt.Sprintf("Error no pair of peaks more distant than %d bp: alpha cannot be estimated (use -alpha)!", DISTANCECONSTRAINT))
+	}
+
+	sort.Float64s(ratios)
+
+	return ratios[int(float64(len(ratios) - 1) * (1.0 - LONGRANGEFRACTION))]
+}
+
+/*writeBedpe write the links as bedpe: <chr1><start1><end1><chr2><start2><end2><score> */
+func writeBedpe(fname string, peaks []peakRegion, links []peakLink) {
+	var buffer bytes.Buffer
+	var err error
+
+	writer := utils.ReturnWriter(fname)
+	defer utils.CloseFile(writer)
+
+	for _, link := range links {
+		for _, peak := range []peakRegion{peaks[link.peak1], peaks[link.peak2]} {
+			buffer.WriteString(peak.chr)
+			buffer.WriteRune('\t')
+			buffer.WriteString(strconv.Itoa(peak.start))
+			buffer.WriteRune('\t')
+			buffer.WriteString(strconv.Itoa(peak.end))
+			buffer.WriteRune('\t')
+		}
+
+		buffer.WriteString(strconv.FormatFloat(link.score, 'g', 7, 64))
+		buffer.WriteRune('\n')
+
+		if buffer.Len() > 1000000 {
+			_, err = writer.Write(buffer.Bytes())
+			utils.Check(err)
+			buffer.Reset()
+		}
+	}
+
+	_, err = writer.Write(buffer.Bytes())
+	utils.Check(err)
+
+	fmt.Printf("%d links written in: %s\n", len(links), fname)
+}
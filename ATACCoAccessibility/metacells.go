@@ -0,0 +1,236 @@
+/* Metacells: aggregation of overlapping groups of k nearest neighbor cells */
+
+package main
+
+
+import(
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+)
+
+
+/*metricSpace cells (dense embedding or L2 normalized sparse matrix rows) used to find the nearest neighbors with their matrix rows */
+type metricSpace struct {
+	utils.MetricSpace
+	matrixRows []int
+}
+
+/*createMetricSpace load the embedding (if provided) or use the normalized matrix rows */
+func createMetricSpace(cells []string, matrix utils.SparseMatrix) (space *metricSpace) {
+	space = &metricSpace{}
+
+	if EMBEDDINGFILE == "" {
+		space.Sparse = make([]utils.SparseVector, 0, len(matrix.Rows))
+
+		for i, row := range matrix.Rows {
+			// copy of the values: the matrix is used to aggregate the metacells
+			space.Sparse = append(space.Sparse, utils.SparseVector{Index: row.Index, Values: append([]float64(nil), row.Values...)})
+			space.matrixRows = append(space.matrixRows, i)
+		}
+
+		space.Normalize()
+
+		return space
+	}
+
+	cellIndex := make(map[string]int, len(cells))
+
+	for i, cell := range cells {
+		cellIndex[cell] = i
+	}
+
+	scanner, file := EMBEDDINGFILE.ReturnReader(0)
+	defer utils.CloseFile(file)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		split := strings.Split(line, "\t")
+		row, isInside := cellIndex[split[0]]
+
+		if !isInside || row >= len(matrix.Rows) {
+			continue
+		}
+
+		point := make([]float64, len(split) - 1)
+
+		for pos := range point {
+			value, err := strconv.ParseFloat(split[pos + 1], 64)
+			utils.Check(err)
+			point[pos] = value
+		}
+
+		space.Dense = append(space.Dense, point)
+		space.matrixRows = append(space.matrixRows, row)
+	}
+
+	if len(space.Dense) == 0 {
+		log.Fatal(fmt.Sprintf("Error no cell from %s found in the matrix", EMBEDDINGFILE))
+	}
+
+	fmt.Printf("%d cells of the embedding found in the matrix\n", len(space.Dense))
+
+	return space
+}
+
+/*nearestNeighbors return the k nearest cells of a cell (including the cell itself) */
+func nearestNeighbors(space *metricSpace, cell, k int) (neighbors []int) {
+	dists := make([]float64, 0, k)
+	neighbors = make([]int, 0, k)
+
+	for j := 0; j < space.NbPoints(); j++ {
+		dist := 0.0
+
+		if j != cell {
+			dist = space.Distance(cell, j)
+		}
+
+		if len(neighbors) == k && dist >= dists[k - 1] {
+			continue
+		}
+
+		pos := sort.SearchFloat64s(dists, dist)
+
+		for pos < len(dists) && dists[pos] == dist {
+			pos++
+		}
+
+		if len(neighbors) < k {
+			dists = append(dists, 0)
+			neighbors = append(neighbors, 0)
+		}
+
+		copy(dists[pos + 1:], dists[pos:])
+		copy(neighbors[pos + 1:], neighbors[pos:])
+		dists[pos] = dist
+		neighbors[pos] = j
+	}
+
+	return neighbors
+}
+
+/*sampleMetacells choose metacells (k nearest neighbors of random cells) sharing at most MAXOVERLAP * k cells with the previous metacells.
+Returns the matrix rows of each metacell */
+func sampleMetacells(space *metricSpace, random *rand.Rand) (metacells [][]int) {
+	k := NBNEIGHBORS
+	n := space.NbPoints()
+
+	if k > n {
+		k = n
+	}
+
+	maxShared := int(MAXOVERLAP * float64(k))
+	order := random.Perm(n)
+	cellMetacells := make([][]int, n)
+	batchSize := 64 * THREADNB
+
+	fmt.Printf("sampling metacells of %d cells (maximum overlap: %d cells)...\n", k, maxShared)
+
+	for batchStart := 0; batchStart < n && len(metacells) < MAXMETACELLS; batchStart += batchSize {
+		batchEnd := batchStart + batchSize
+
+		if batchEnd > n {
+			batchEnd = n
+		}
+
+		neighborhoods := make([][]int, batchEnd - batchStart)
+
+		utils.ParallelFor(len(neighborhoods), THREADNB, func(i int) {
+			neighborhoods[i] = nearestNeighbors(space, order[batchStart + i], k)
+		})
+
+		for _, neighbors := range neighborhoods {
+			if len(metacells) >= MAXMETACELLS {
+				break
+			}
+
+			shared := make(map[int]int)
+			isValid := true
+
+			for _, cell := range neighbors {
+				for _, metacell := range cellMetacells[cell] {
+					shared[metacell]++
+
+					if shared[metacell] > maxShared {
+						isValid = false
+					}
+				}
+			}
+
+			if !isValid {
+				continue
+			}
+
+			for _, cell := range neighbors {
+				cellMetacells[cell] = append(cellMetacells[cell], len(metacells))
+			}
+
+			metacells = append(metacells, neighbors)
+		}
+	}
+
+	for i := range metacells {
+		for pos, cell := range metacells[i] {
+			metacells[i][pos] = space.matrixRows[cell]
+		}
+	}
+
+	fmt.Printf("number of metacells: %d\n", len(metacells))
+
+	if len(metacells) < 3 {
+		log.Fatal("Error not enough metacells to compute correlations (try to decrease -k or increase -max_overlap)!")
+	}
+
+	return metacells
+}
+
+/*aggregateMetacells return the normalized (log(1 + x / size factor)) metacell profile of each peak (sparse vector indexed by metacell) */
+func aggregateMetacells(matrix utils.SparseMatrix, metacells [][]int, nbPeaks int) (profiles []utils.SparseVector) {
+	var meanSize float64
+
+	profiles = make([]utils.SparseVector, nbPeaks)
+	sums := make([]map[uint32]float64, len(metacells))
+	sizes := make([]float64, len(metacells))
+
+	utils.ParallelFor(len(metacells), THREADNB, func(i int) {
+		sums[i] = make(map[uint32]float64)
+
+		for _, row := range metacells[i] {
+			for pos, peak := range matrix.Rows[row].Index {
+				sums[i][peak] += matrix.Rows[row].Values[pos]
+				sizes[i] += matrix.Rows[row].Values[pos]
+			}
+		}
+	})
+
+	for _, size := range sizes {
+		meanSize += size
+	}
+
+	meanSize /= float64(len(sizes))
+
+	for i := range metacells {
+		if sizes[i] == 0 {
+			continue
+		}
+
+		sizeFactor := sizes[i] / meanSize
+
+		for peak, value := range sums[i] {
+			profiles[peak].Index = append(profiles[peak].Index, uint32(i))
+			profiles[peak].Values = append(profiles[peak].Values, math.Log1p(value / sizeFactor))
+		}
+	}
+
+	return profiles
+}
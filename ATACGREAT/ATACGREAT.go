@@ -0,0 +1,179 @@
+/* GREAT-like gene set enrichment of genomic regions (peaks) using the regulatory domains of the genes */
+
+package main
+
+
+import(
+	"log"
+	"flag"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+	"fmt"
+	"sort"
+	"time"
+	"os"
+)
+
+
+/*GTFFILE gene annotation file (GTF or GFF3) */
+var GTFFILE utils.Filename
+
+/*GMTFILE gene set file (GMT: <name><TAB><description><TAB><gene1><TAB><gene2>...) */
+var GMTFILE utils.Filename
+
+/*FOREGROUNDFILE foreground regions (bed file) */
+var FOREGROUNDFILE utils.Filename
+
+/*PVALUETABLE corrected p-value table of the significant peaks per cluster (ATACTopFeatures) used as foreground */
+var PVALUETABLE utils.Filename
+
+/*BACKGROUNDFILE background regions (bed file) */
+var BACKGROUNDFILE utils.Filename
+
+/*CHROMSIZESFILE chromosome sizes (<chr><TAB><length>, such as a .fai index) */
+var CHROMSIZESFILE utils.Filename
+
+/*FILENAMEOUT  output file name prefix */
+var FILENAMEOUT string
+
+/*UPSTREAM basal regulatory domain upstream of the TSS */
+var UPSTREAM int
+
+/*DOWNSTREAM basal regulatory domain downstream of the TSS */
+var DOWNSTREAM int
+
+/*EXTENSION maximum extension of the regulatory domain from the TSS */
+var EXTENSION int
+
+/*BIOTYPE biotype of the genes used (all the genes if empty) */
+var BIOTYPE string
+
+/*MINGENES minimum number of annotated genes of a gene set */
+var MINGENES int
+
+/*MAXGENES maximum number of annotated genes of a gene set (no limit if 0) */
+var MAXGENES int
+
+/*ALPHA threshold of the binomial and hypergeometric q-values */
+var ALPHA float64
+
+/*WRITEALL write all the gene sets including the not significant ones */
+var WRITEALL bool
+
+/*THREADNB number of threads */
+var THREADNB int
+
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `
+#################### MODULE TO COMPUTE THE GREAT-LIKE GENE SET ENRICHMENT OF GENOMIC REGIONS ########################
+Each gene of the GTF / GFF3 file (-gtf) gets a regulatory domain using the GREAT basal plus extension rule: a basal domain of -upstream bp upstream
+and -downstream bp downstream of its TSS, extended in both directions to the basal domains of the nearest genes, up to -extension bp from the TSS.
+Each region is associated with the genes whose regulatory domain contains its center.
+
+For each gene set of the GMT file (-gmt), the enrichment of the foreground regions (-fg bed file, or the significant peaks of each cluster of an
+ATACTopFeatures table with -table) is computed with:
+ * a binomial test over the regions: number of foreground regions in the regulatory domains of the set vs the fraction of the genome covered
+   by these domains (-chrom_sizes, required without -bg) or vs the fraction of the background regions (-bg) in these domains (NA if no background region)
+ * a hypergeometric test over the genes: number of genes of the set associated with the foreground regions vs all the genes with a regulatory
+   domain (or vs the genes associated with the background regions (-bg))
+The p-values are corrected with the Benjamini-Hochberg procedure for each test.
+
+USAGE: ATACGREAT -gtf <fname> -gmt <fname> (-fg <bedfile> OR -table <tsv>) (-chrom_sizes <fname> OR -bg <bedfile>) (optional -upstream <int> -downstream <int> -extension <int> -biotype <string> -min_genes <int> -max_genes <int> -alpha <float> -write_all -out <string> -threads <int>)
+
+`)
+		 flag.PrintDefaults()
+	}
+
+	flag.Var(&GTFFILE, "gtf", "gene annotation file (GTF or GFF3)")
+	flag.Var(&GMTFILE, "gmt", "gene set file (GMT format: <name><TAB><description><TAB><gene1><TAB><gene2>...)")
+	flag.Var(&FOREGROUNDFILE, "fg", "foreground regions (bed file)")
+	flag.Var(&PVALUETABLE, "table", "ATACTopFeatures corrected p-value table: the significant peaks of each cluster are used as foreground")
+	flag.Var(&BACKGROUNDFILE, "bg", "background regions (bed file). Default: the whole genome (binomial test) and all the genes (hypergeometric test)")
+	flag.Var(&CHROMSIZESFILE, "chrom_sizes", "chromosome sizes (<chr><TAB><length>, such as a .fai index). Required without -bg. With -bg, default: the extent of the genes and the regions of each chromosome")
+	flag.StringVar(&FILENAMEOUT, "out", "", "prefix of the output files")
+	flag.IntVar(&UPSTREAM, "upstream", 5000, "basal regulatory domain upstream of the TSS")
+	flag.IntVar(&DOWNSTREAM, "downstream", 1000, "basal regulatory domain downstream of the TSS")
+	flag.IntVar(&EXTENSION, "extension", 1000000, "maximum extension of the regulatory domain from the TSS")
+	flag.StringVar(&BIOTYPE, "biotype", "protein_coding", "biotype of the genes used (the genes without biotype are kept). All the genes if empty")
+	flag.IntVar(&MINGENES, "min_genes", 5, "minimum number of annotated genes of a gene set")
+	flag.IntVar(&MAXGENES, "max_genes", 0, "maximum number of annotated genes of a gene set (no limit if 0)")
+	flag.Float64Var(&ALPHA, "alpha", 0.05, "threshold of the binomial and hypergeometric q-values")
+	flag.BoolVar(&WRITEALL, "write_all", false, "Write all the gene sets including the not significant ones")
+	flag.IntVar(&THREADNB, "threads", 1, "threads concurrency")
+	flag.Parse()
+
+	switch {
+	case GTFFILE == "" || GMTFILE == "":
+		log.Fatal("Error -gtf and -gmt must be provided!")
+	case (FOREGROUNDFILE == "") == (PVALUETABLE == ""):
+		log.Fatal("Error either -fg or -table must be provided!")
+	case CHROMSIZESFILE == "" && BACKGROUNDFILE == "":
+		log.Fatal("Error -chrom_sizes must be provided without -bg (the genome size defines the expected fractions of the binomial test)!")
+	case UPSTREAM < 0 || DOWNSTREAM < 0 || EXTENSION < 0:
+		log.Fatal("Error -upstream, -downstream and -extension must be positive numbers!")
+	case THREADNB <= 0:
+		log.Fatal("Error -threads must be a positive number!")
+	}
+
+	if FILENAMEOUT == "" {
+		if FOREGROUNDFILE != "" {
+			FILENAMEOUT = fmt.Sprintf("%s.great", FOREGROUNDFILE)
+		} else {
+			FILENAMEOUT = fmt.Sprintf("%s.great", PVALUETABLE)
+		}
+	}
+
+	tStart := time.Now()
+
+	genes := loadGenes()
+	chromSizes := loadChromSizes()
+
+	foregrounds := make(map[string][]region)
+
+	if FOREGROUNDFILE != "" {
+		foregrounds[""] = loadRegions(FOREGROUNDFILE)
+	} else {
+		foregrounds = loadSignificantRegions()
+	}
+
+	var background []region
+
+	if BACKGROUNDFILE != "" {
+		background = loadRegions(BACKGROUNDFILE)
+	}
+
+	updateChromSizes(chromSizes, genes, foregrounds, background)
+
+	domains := createRegulatoryDomains(genes, chromSizes)
+	writeRegulatoryDomains(fmt.Sprintf("%s.regulatory_domains.bed", FILENAMEOUT), domains)
+
+	sets := loadGeneSets(domains, background, chromSizes)
+	bg := createEnrichmentBackground(domains, background)
+
+	names := make([]string, 0, len(foregrounds))
+
+	for name := range foregrounds {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		prefix := FILENAMEOUT
+
+		if name != "" {
+			prefix = fmt.Sprintf("%s.%s", FILENAMEOUT, name)
+		}
+
+		if len(foregrounds[name]) == 0 {
+			fmt.Printf("%s skipped: no foreground region\n", prefix)
+			continue
+		}
+
+		computeEnrichment(prefix, foregrounds[name], bg, domains, sets)
+	}
+
+	tDiff := time.Since(tStart)
+	fmt.Printf("done in time: %f s \n", tDiff.Seconds())
+}
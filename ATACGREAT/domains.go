@@ -0,0 +1,352 @@
+/* Regulatory domains of the genes (GREAT basal plus extension rule) and region to gene associations */
+
+package main
+
+
+import(
+	"bytes"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+)
+
+
+/*region genomic region (0-based half-open) */
+type region struct {
+	chr string
+	start, end int
+}
+
+/*center center of the region */
+func (r region) center() int {
+	return (r.start + r.end) / 2
+}
+
+/*regulatoryDomain regulatory domain of a gene */
+type regulatoryDomain struct {
+	gene int
+	chr string
+	tss int
+	strand byte
+	start, end int
+	basalStart, basalEnd int
+}
+
+/*geneDomains regulatory domains (sorted by chromosome and start) and gene names */
+type geneDomains struct {
+	domains []regulatoryDomain
+	names []string
+	// gene name / ID (with and without version) -> gene index
+	geneIndex map[string]int
+	// chromosome -> first and last domain indexes and maximum domain length
+	chrRange map[string][3]int
+}
+
+/*geneVersionRegexp version suffix of the gene IDs (ENSG00000141510.17) */
+var geneVersionRegexp = regexp.MustCompile(`\.[0-9]+$`)
+
+/*loadGenes load the genes of the annotation with the biotype -biotype (one gene per name: the first locus is kept) */
+func loadGenes() (genes []*utils.GeneAnnotation) {
+	fmt.Printf("loading gene annotation: %s...\n", GTFFILE)
+
+	isUsed := make(map[string]bool)
+	nbDuplicated := 0
+
+	for _, gene := range utils.LoadGeneAnnotation(GTFFILE) {
+		if BIOTYPE != "" && gene.Biotype != "" && gene.Biotype != BIOTYPE {
+			continue
+		}
+
+		if isUsed[gene.Name] {
+			nbDuplicated++
+			continue
+		}
+
+		isUsed[gene.Name] = true
+		genes = append(genes, gene)
+	}
+
+	if len(genes) == 0 {
+		log.Fatal(fmt.Sprintf("Error no gene with the biotype %s found in %s!", BIOTYPE, GTFFILE))
+	}
+
+	fmt.Printf("%d genes loaded (%d duplicated gene names ignored)\n", len(genes), nbDuplicated)
+
+	return genes
+}
+
+/*loadChromSizes load the chromosome sizes of -chrom_sizes (two first columns) */
+func loadChromSizes() (chromSizes map[string]int) {
+	chromSizes = make(map[string]int)
+
+	if CHROMSIZESFILE == "" {
+		return chromSizes
+	}
+
+	scanner, file := CHROMSIZESFILE.ReturnReader(0)
+	defer utils.CloseFile(file)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		split := strings.Split(line, "\t")
+
+		if len(split) < 2 {
+			log.Fatal(fmt.Sprintf("Error line: %s from %s must be <chr><TAB><length>", line, CHROMSIZESFILE))
+		}
+
+		size, err := strconv.Atoi(split[1])
+		utils.Check(err)
+		chromSizes[split[0]] = size
+	}
+
+	return chromSizes
+}
+
+/*updateChromSizes define the size of the chromosomes missing from -chrom_sizes as the extent of their genes and regions */
+func updateChromSizes(chromSizes map[string]int, genes []*utils.GeneAnnotation, foregrounds map[string][]region, background []region) {
+	extents := make(map[string]int)
+
+	update := func(chr string, end int) {
+		if end > extents[chr] {
+			extents[chr] = end
+		}
+	}
+
+	for _, gene := range genes {
+		update(gene.Chr, gene.End)
+	}
+
+	for _, regions := range foregrounds {
+		for _, r := range regions {
+			update(r.chr, r.end)
+		}
+	}
+
+	for _, r := range background {
+		update(r.chr, r.end)
+	}
+
+	nbMissing := 0
+
+	for chr, extent := range extents {
+		if _, isInside := chromSizes[chr]; !isInside {
+			chromSizes[chr] = extent
+			nbMissing++
+		}
+	}
+
+	switch {
+	case nbMissing == 0:
+	case CHROMSIZESFILE == "":
+		fmt.Printf("Warning -chrom_sizes not provided: the size of the %d chromosomes is the extent of their genes and regions\n",
+			nbMissing)
+	default:
+		fmt.Printf("Warning %d chromosomes not found in %s: their size is the extent of their genes and regions\n",
+			nbMissing, CHROMSIZESFILE)
+	}
+}
+
+/*createRegulatoryDomains basal domain of each gene (-upstream / -downstream of the TSS) extended up to the basal domains
+of the nearest genes and at most -extension bp from the TSS (GREAT basal plus extension rule) */
+func createRegulatoryDomains(genes []*utils.GeneAnnotation, chromSizes map[string]int) (domains geneDomains) {
+	domains.geneIndex = make(map[string]int)
+	domains.chrRange = make(map[string][3]int)
+
+	for index, gene := range genes {
+		domains.names = append(domains.names, gene.Name)
+
+		for _, key := range []string{gene.Name, gene.ID, geneVersionRegexp.ReplaceAllString(gene.ID, "")} {
+			if _, isInside := domains.geneIndex[key]; !isInside {
+				domains.geneIndex[key] = index
+			}
+		}
+
+		tss := gene.TSS()
+		domain := regulatoryDomain{gene: index, chr: gene.Chr, tss: tss, strand: gene.Strand}
+
+		if gene.Strand == '-' {
+			domain.basalStart, domain.basalEnd = tss - DOWNSTREAM, tss + UPSTREAM + 1
+		} else {
+			domain.basalStart, domain.basalEnd = tss - UPSTREAM, tss + DOWNSTREAM + 1
+		}
+
+		domain.basalStart = utils.MaxInt(domain.basalStart, 0)
+		domain.basalEnd = utils.MinInt(domain.basalEnd, chromSizes[gene.Chr])
+
+		domains.domains = append(domains.domains, domain)
+	}
+
+	sort.Slice(domains.domains, func(i, j int) bool {
+		if domains.domains[i].chr != domains.domains[j].chr {
+			return domains.domains[i].chr < domains.domains[j].chr
+		}
+
+		return domains.domains[i].tss < domains.domains[j].tss
+	})
+
+	for first := 0; first < len(domains.domains); {
+		chr := domains.domains[first].chr
+		last := first
+
+		for last < len(domains.domains) && domains.domains[last].chr == chr {
+			last++
+		}
+
+		extendDomains(domains.domains[first:last], chromSizes[chr])
+
+		sort.Slice(domains.domains[first:last], func(i, j int) bool {
+			return domains.domains[first + i].start < domains.domains[first + j].start
+		})
+
+		maxLength := 0
+
+		for _, domain := range domains.domains[first:last] {
+			maxLength = utils.MaxInt(maxLength, domain.end - domain.start)
+		}
+
+		domains.chrRange[chr] = [3]int{first, last, maxLength}
+		first = last
+	}
+
+	return domains
+}
+
+/*extendDomains extend the domains of one chromosome (sorted by TSS) up to the basal domains of their neighbors */
+func extendDomains(domains []regulatoryDomain, chrSize int) {
+	// maximum basal end of the previous genes
+	previousEnd := 0
+
+	for i := range domains {
+		domains[i].start = utils.MaxInt(utils.MaxInt(domains[i].tss - EXTENSION, previousEnd), 0)
+		domains[i].start = utils.MinInt(domains[i].start, domains[i].basalStart)
+		previousEnd = utils.MaxInt(previousEnd, domains[i].basalEnd)
+	}
+
+	// minimum basal start of the next genes
+	nextStart := chrSize
+
+	for i := len(domains) - 1; i >= 0; i-- {
+		domains[i].end = utils.MinInt(utils.MinInt(domains[i].tss + EXTENSION + 1, nextStart), chrSize)
+		domains[i].end = utils.MaxInt(domains[i].end, domains[i].basalEnd)
+		nextStart = utils.MinInt(nextStart, domains[i].basalStart)
+	}
+}
+
+/*associateGenes indexes of the domains containing the center of each region */
+func (domains *geneDomains) associateGenes(regions []region) (regionDomains [][]int) {
+	regionDomains = make([][]int, len(regions))
+
+	utils.ParallelFor(len(regions), THREADNB, func(i int) {
+		chrRange, isInside := domains.chrRange[regions[i].chr]
+
+		if !isInside {
+			return
+		}
+
+		center := regions[i].center()
+		chrDomains := domains.domains[chrRange[0]:chrRange[1]]
+		// first domain starting after the center
+		pos := sort.Search(len(chrDomains), func(j int) bool {return chrDomains[j].start > center})
+
+		for j := pos - 1; j >= 0 && chrDomains[j].start > center - chrRange[2]; j-- {
+			if chrDomains[j].end > center {
+				regionDomains[i] = append(regionDomains[i], chrRange[0] + j)
+			}
+		}
+
+		sort.Ints(regionDomains[i])
+	})
+
+	return regionDomains
+}
+
+/*distance signed distance between the TSS and the position (positive downstream of the TSS) */
+func (domain regulatoryDomain) distance(pos int) int {
+	if domain.strand == '-' {
+		return domain.tss - pos
+	}
+
+	return pos - domain.tss
+}
+
+/*writeRegulatoryDomains write the regulatory domains: <chr><start><end><gene><TSS><strand> */
+func writeRegulatoryDomains(fname string, domains geneDomains) {
+	var buffer bytes.Buffer
+
+	writer := utils.ReturnWriter(fname)
+	defer utils.CloseFile(writer)
+
+	for _, domain := range domains.domains {
+		buffer.WriteString(fmt.Sprintf("%s\t%d\t%d\t%s\t%d\t%c\n",
+			domain.chr, domain.start, domain.end, domains.names[domain.gene], domain.tss, domain.strand))
+	}
+
+	_, err := writer.Write(buffer.Bytes())
+	utils.Check(err)
+
+	fmt.Printf("%d regulatory domains written in: %s\n", len(domains.domains), fname)
+}
+
+/*loadRegions load the regions of a bed file (three first columns) */
+func loadRegions(fname utils.Filename) (regions []region) {
+	scanner, file := fname.ReturnReader(0)
+	defer utils.CloseFile(file)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if len(line) == 0 || line[0] == '#' || strings.HasPrefix(line, "track") {
+			continue
+		}
+
+		regions = append(regions, parseRegion(strings.Split(line, "\t"), line, fname))
+	}
+
+	fmt.Printf("%d regions loaded from %s\n", len(regions), fname)
+
+	return regions
+}
+
+/*parseRegion region of the three first columns of a line */
+func parseRegion(split []string, line string, fname utils.Filename) (r region) {
+	var err1, err2 error
+
+	if len(split) < 3 {
+		log.Fatal(fmt.Sprintf("Error line: %s from %s is not a bed line", line, fname))
+	}
+
+	r.chr = split[0]
+	r.start, err1 = strconv.Atoi(split[1])
+	r.end, err2 = strconv.Atoi(split[2])
+
+	if err1 != nil || err2 != nil {
+		log.Fatal(fmt.Sprintf("Error line: %s from %s is not a bed line", line, fname))
+	}
+
+	return r
+}
+
+/*loadSignificantRegions load the significant peaks with an odd ratio > 1 (or a log2 fold change > 0) of each cluster
+from the ATACTopFeatures corrected p-value (or -da) table */
+func loadSignificantRegions() (clusterRegions map[string][]region) {
+	clusterRegions = make(map[string][]region)
+
+	for cluster, features := range utils.LoadSignificantFeatures(PVALUETABLE) {
+		clusterRegions[cluster] = nil
+
+		for _, split := range features {
+			clusterRegions[cluster] = append(clusterRegions[cluster], parseRegion(split, strings.Join(split, "\t"), PVALUETABLE))
+		}
+	}
+
+	return clusterRegions
+}
@@ -0,0 +1,436 @@
+/* Binomial (region-based) and hypergeometric (gene-based) enrichment tests of the gene sets */
+
+package main
+
+
+import(
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+)
+
+
+/*geneSet gene set of the GMT file with its annotated genes */
+type geneSet struct {
+	name, description string
+	genes []int
+	// fraction of the genome covered by the regulatory domains of the genes (or fraction of the background regions)
+	fraction float64
+}
+
+/*setEnrichment enrichment of the foreground regions for one gene set */
+type setEnrichment struct {
+	set int
+	binomRegions int
+	binomExpected, binomFold, binomPvalue, binomQvalue float64
+	hyperGenes, hyperSetGenes int
+	hyperExpected, hyperFold, hyperPvalue, hyperQvalue float64
+	genes []string
+}
+
+/*enrichmentBackground background of the tests: genes associated with the background regions (all the genes without -bg) */
+type enrichmentBackground struct {
+	isGene []bool
+}
+
+/*loadGeneSets load the gene sets of the GMT file with at least -min_genes (and at most -max_genes) annotated genes
+and compute the fraction of the genome covered by their regulatory domains (or the fraction of the background regions in these domains) */
+func loadGeneSets(domains geneDomains, background []region, chromSizes map[string]int) (sets []geneSet) {
+	nbFiltered := 0
+
+	scanner, file := GMTFILE.ReturnReader(0)
+	defer utils.CloseFile(file)
+
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r\n")
+
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		split := strings.Split(line, "\t")
+
+		if len(split) < 3 {
+			log.Fatal(fmt.Sprintf("Error line: %s from %s is not a GMT line (<name><TAB><description><TAB><genes>...)", line, GMTFILE))
+		}
+
+		set := geneSet{name: split[0], description: split[1]}
+		isUsed := make(map[int]bool)
+
+		for _, gene := range split[2:] {
+			index, isInside := domains.geneIndex[strings.TrimSpace(gene)]
+
+			if isInside && !isUsed[index] {
+				isUsed[index] = true
+				set.genes = append(set.genes, index)
+			}
+		}
+
+		if len(set.genes) < MINGENES || (MAXGENES > 0 && len(set.genes) > MAXGENES) {
+			nbFiltered++
+			continue
+		}
+
+		sort.Ints(set.genes)
+		sets = append(sets, set)
+	}
+
+	if len(sets) == 0 {
+		log.Fatal(fmt.Sprintf("Error no gene set of %s with at least %d annotated genes!", GMTFILE, MINGENES))
+	}
+
+	fmt.Printf("%d gene sets loaded (%d gene sets filtered with -min_genes / -max_genes)\n", len(sets), nbFiltered)
+
+	if background != nil {
+		backgroundFractions(sets, domains, background)
+	} else {
+		genomeFractions(sets, domains, chromSizes)
+	}
+
+	return sets
+}
+
+/*genomeFractions fraction of the genome covered by the union of the regulatory domains of the genes of each set */
+func genomeFractions(sets []geneSet, domains geneDomains, chromSizes map[string]int) {
+	genomeSize := 0
+
+	for _, size := range chromSizes {
+		genomeSize += size
+	}
+
+	geneDomain := make([]int, len(domains.names))
+
+	for index, domain := range domains.domains {
+		geneDomain[domain.gene] = index
+	}
+
+	utils.ParallelFor(len(sets), THREADNB, func(i int) {
+		intervals := make([]int, 0, len(sets[i].genes))
+
+		for _, gene := range sets[i].genes {
+			intervals = append(intervals, geneDomain[gene])
+		}
+
+		// the domains are sorted by chromosome and start
+		sort.Ints(intervals)
+
+		covered := 0
+		var current regulatoryDomain
+
+		for pos, index := range intervals {
+			domain := domains.domains[index]
+
+			if pos == 0 || domain.chr != current.chr || domain.start >= current.end {
+				covered += current.end - current.start
+				current = domain
+				continue
+			}
+
+			current.end = utils.MaxInt(current.end, domain.end)
+		}
+
+		covered += current.end - current.start
+		sets[i].fraction = float64(covered) / float64(genomeSize)
+	})
+}
+
+/*backgroundFractions fraction of the background regions associated with the genes of each set */
+func backgroundFractions(sets []geneSet, domains geneDomains, background []region) {
+	counts := countSetRegions(sets, domains, domains.associateGenes(background))
+
+	for i := range sets {
+		sets[i].fraction = float64(counts[i]) / float64(len(background))
+	}
+}
+
+/*countSetRegions number of regions associated with at least one gene of each set */
+func countSetRegions(sets []geneSet, domains geneDomains, regionDomains [][]int) (counts []int) {
+	geneSets := make([][]int, len(domains.names))
+
+	for i, set := range sets {
+		for _, gene := range set.genes {
+			geneSets[gene] = append(geneSets[gene], i)
+		}
+	}
+
+	counts = make([]int, len(sets))
+	lastRegion := make([]int, len(sets))
+
+	for i := range lastRegion {
+		lastRegion[i] = -1
+	}
+
+	for r, indexes := range regionDomains {
+		for _, index := range indexes {
+			for _, set := range geneSets[domains.domains[index].gene] {
+				if lastRegion[set] != r {
+					lastRegion[set] = r
+					counts[set]++
+				}
+			}
+		}
+	}
+
+	return counts
+}
+
+/*createEnrichmentBackground genes of the hypergeometric test population: associated with the background regions or all the genes */
+func createEnrichmentBackground(domains geneDomains, background []region) (bg enrichmentBackground) {
+	bg.isGene = make([]bool, len(domains.names))
+
+	if background == nil {
+		for gene := range bg.isGene {
+			bg.isGene[gene] = true
+		}
+
+		return bg
+	}
+
+	for _, indexes := range domains.associateGenes(background) {
+		for _, index := range indexes {
+			bg.isGene[domains.domains[index].gene] = true
+		}
+	}
+
+	return bg
+}
+
+/*computeEnrichment test the enrichment of each gene set in the foreground regions and write <prefix>.great_enrichment.tsv
+and the region to gene associations <prefix>.region_genes.tsv */
+func computeEnrichment(prefix string, foreground []region, bg enrichmentBackground, domains geneDomains, sets []geneSet) {
+	regionDomains := domains.associateGenes(foreground)
+	writeRegionGenes(fmt.Sprintf("%s.region_genes.tsv", prefix), foreground, regionDomains, domains)
+
+	regionCounts := countSetRegions(sets, domains, regionDomains)
+
+	// the genes associated with the foreground are added to the population
+	isPopulation := append([]bool(nil), bg.isGene...)
+	isForegroundGene := make([]bool, len(domains.names))
+	nbForegroundGenes, nbPopulation := 0, 0
+
+	for _, indexes := range regionDomains {
+		for _, index := range indexes {
+			gene := domains.domains[index].gene
+
+			if !isForegroundGene[gene] {
+				isForegroundGene[gene] = true
+				isPopulation[gene] = true
+				nbForegroundGenes++
+			}
+		}
+	}
+
+	for _, isInside := range isPopulation {
+		if isInside {
+			nbPopulation++
+		}
+	}
+
+	nbRegions := len(foreground)
+	results := make([]setEnrichment, len(sets))
+
+	utils.ParallelFor(len(sets), THREADNB, func(i int) {
+		result := setEnrichment{set: i, binomRegions: regionCounts[i]}
+
+		result.binomExpected = float64(nbRegions) * sets[i].fraction
+		result.binomFold = float64(result.binomRegions) / result.binomExpected
+		result.binomPvalue = binomialUpperTail(result.binomRegions, nbRegions, sets[i].fraction)
+
+		// no background region associated with the set (-bg): the binomial test is not defined
+		if sets[i].fraction == 0 {
+			result.binomFold, result.binomPvalue = math.NaN(), math.NaN()
+		}
+
+		for _, gene := range sets[i].genes {
+			if !isPopulation[gene] {
+				continue
+			}
+
+			result.hyperSetGenes++
+
+			if isForegroundGene[gene] {
+				result.hyperGenes++
+				result.genes = append(result.genes, domains.names[gene])
+			}
+		}
+
+		sort.Strings(result.genes)
+
+		result.hyperExpected = float64(nbForegroundGenes) * float64(result.hyperSetGenes) / float64(nbPopulation)
+		result.hyperFold = float64(result.hyperGenes) / result.hyperExpected
+		result.hyperPvalue = utils.HypergeometricUpperTail(result.hyperGenes, nbPopulation, result.hyperSetGenes, nbForegroundGenes)
+
+		results[i] = result
+	})
+
+	benjaminiHochberg(results,
+		func(result *setEnrichment) float64 {return result.hyperPvalue},
+		func(result *setEnrichment, qvalue float64) {result.hyperQvalue = qvalue})
+	benjaminiHochberg(results,
+		func(result *setEnrichment) float64 {return result.binomPvalue},
+		func(result *setEnrichment, qvalue float64) {result.binomQvalue = qvalue})
+
+	nbSignificant := writeEnrichmentTable(fmt.Sprintf("%s.great_enrichment.tsv", prefix), results, sets)
+
+	fmt.Printf("%s: %d regions, %d associated genes (%d genes in the population), %d significant gene sets\n",
+		prefix, nbRegions, nbForegroundGenes, nbPopulation, nbSignificant)
+}
+
+/*binomialUpperTail P(X >= k) with X the number of successes of n trials with a probability p */
+func binomialUpperTail(k, n int, p float64) float64 {
+	switch {
+	case k <= 0:
+		return 1.0
+	case k > n || p <= 0:
+		return 0.0
+	case p >= 1:
+		return 1.0
+	}
+
+	logP, logQ := math.Log(p), math.Log1p(-p)
+	mode := int(float64(n + 1) * p)
+
+	// sum of the terms from first in the direction step until they are negligible (decreasing terms away from the mode)
+	tail := func(first, last, step int) float64 {
+		maxLog := math.Inf(-1)
+		logTerms := make([]float64, 0)
+
+		for i := first; i != last + step; i += step {
+			logTerm := utils.LogChoose(n, i) + float64(i) * logP + float64(n - i) * logQ
+			logTerms = append(logTerms, logTerm)
+			maxLog = math.Max(maxLog, logTerm)
+
+			if logTerm < maxLog - 50 {
+				break
+			}
+		}
+
+		sum := 0.0
+
+		for _, logTerm := range logTerms {
+			sum += math.Exp(logTerm - maxLog)
+		}
+
+		return math.Exp(maxLog + math.Log(sum))
+	}
+
+	if k > mode {
+		return math.Min(1.0, tail(k, n, 1))
+	}
+
+	// the upper tail contains the mode: 1 - P(X < k)
+	return math.Max(0.0, 1.0 - tail(k - 1, 0, -1))
+}
+
+/*benjaminiHochberg compute the BH q-values of one test and sort the results by its p-value.
+The NaN p-values (untested sets) are excluded from the correction, have a NaN q-value and are sorted last */
+func benjaminiHochberg(results []setEnrichment, pvalue func(*setEnrichment) float64, setQvalue func(*setEnrichment, float64)) {
+	var pvalues []float64
+	var tested []int
+
+	for i := range results {
+		if math.IsNaN(pvalue(&results[i])) {
+			setQvalue(&results[i], math.NaN())
+			continue
+		}
+
+		pvalues = append(pvalues, pvalue(&results[i]))
+		tested = append(tested, i)
+	}
+
+	for pos, qvalue := range utils.BenjaminiHochberg(pvalues) {
+		setQvalue(&results[tested[pos]], qvalue)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		pi, pj := pvalue(&results[i]), pvalue(&results[j])
+
+		if math.IsNaN(pi) || math.IsNaN(pj) {
+			return !math.IsNaN(pi) && math.IsNaN(pj)
+		}
+
+		return pi < pj
+	})
+}
+
+/*formatNA format a value or NA if it is not defined (NaN) */
+func formatNA(format string, value float64) string {
+	if math.IsNaN(value) {
+		return "NA"
+	}
+
+	return fmt.Sprintf(format, value)
+}
+
+/*writeEnrichmentTable write the gene sets sorted by binomial p-value (significant if both q-values <= -alpha) and return the number of significant gene sets */
+func writeEnrichmentTable(fname string, results []setEnrichment, sets []geneSet) (nbSignificant int) {
+	var buffer bytes.Buffer
+
+	writer := utils.ReturnWriter(fname)
+	defer utils.CloseFile(writer)
+
+	buffer.WriteString("#name\tdescription\tnb_genes\tbinom_regions\tbinom_expected\tbinom_fold\tbinom_pvalue\tbinom_qvalue")
+	buffer.WriteString("\thyper_genes\thyper_set_genes\thyper_expected\thyper_fold\thyper_pvalue\thyper_qvalue\tsignificant\tgenes\n")
+
+	for _, result := range results {
+		isSignificant := result.binomQvalue <= ALPHA && result.hyperQvalue <= ALPHA
+
+		if isSignificant {
+			nbSignificant++
+		}
+
+		if !WRITEALL && !isSignificant {
+			continue
+		}
+
+		set := sets[result.set]
+
+		buffer.WriteString(fmt.Sprintf("%s\t%s\t%d\t%d\t%.3f\t%s\t%s\t%s\t%d\t%d\t%.3f\t%s\t%e\t%e\t%t\t%s\n",
+			set.name, set.description, len(set.genes),
+			result.binomRegions, result.binomExpected, formatNA("%.4f", result.binomFold),
+			formatNA("%e", result.binomPvalue), formatNA("%e", result.binomQvalue),
+			result.hyperGenes, result.hyperSetGenes, result.hyperExpected, formatNA("%.4f", result.hyperFold), result.hyperPvalue, result.hyperQvalue,
+			isSignificant, strings.Join(result.genes, ",")))
+	}
+
+	_, err := writer.Write(buffer.Bytes())
+	utils.Check(err)
+
+	return nbSignificant
+}
+
+/*writeRegionGenes write the genes associated with each region and their signed distance to the TSS: <chr><start><end><gene1 (+distance)>,... */
+func writeRegionGenes(fname string, regions []region, regionDomains [][]int, domains geneDomains) {
+	var buffer bytes.Buffer
+
+	writer := utils.ReturnWriter(fname)
+	defer utils.CloseFile(writer)
+
+	buffer.WriteString("#chr\tstart\tend\tgenes\n")
+
+	for i, r := range regions {
+		buffer.WriteString(fmt.Sprintf("%s\t%d\t%d\t", r.chr, r.start, r.end))
+
+		if len(regionDomains[i]) == 0 {
+			buffer.WriteString("NONE")
+		}
+
+		for pos, index := range regionDomains[i] {
+			if pos > 0 {
+				buffer.WriteRune(',')
+			}
+
+			domain := domains.domains[index]
+			buffer.WriteString(fmt.Sprintf("%s (%+d)", domains.names[domain.gene], domain.distance(r.center())))
+		}
+
+		buffer.WriteRune('\n')
+	}
+
+	_, err := writer.Write(buffer.Bytes())
+	utils.Check(err)
+}
@@ -0,0 +1,7 @@
+module github.com/opoirion/snATACUtils/ATACGREAT
+
+replace github.com/opoirion/snATACUtils/ATACdemultiplexUtils => ../ATACdemultiplexUtils
+
+go 1.15
+
+require github.com/opoirion/snATACUtils/ATACdemultiplexUtils v0.0.0-00010101000000-000000000000
@@ -0,0 +1,350 @@
+/* Latent semantic indexing (LSI) of a (cell x feature) snATAC-Seq sparse matrix */
+
+package main
+
+
+import(
+	"log"
+	"flag"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+	"fmt"
+	"bytes"
+	"strings"
+	"strconv"
+	"time"
+	"math"
+	"os"
+	"gonum.org/v1/gonum/mat"
+)
+
+
+/*MATRIXFILE input matrix file (COO, mtx or binary from ATACMatUtils) */
+var MATRIXFILE utils.Filename
+
+/*CELLSIDFNAME file name file with ordered cell IDs (one ID per line) */
+var CELLSIDFNAME utils.Filename
+
+/*PEAKFILE file with the ordered features (bed or one feature per line) */
+var PEAKFILE utils.Filename
+
+/*FILENAMEOUT  output file name prefix */
+var FILENAMEOUT string
+
+/*NBCOMPONENTS number of LSI components */
+var NBCOMPONENTS int
+
+/*OVERSAMPLING number of additional random vectors used by the randomized SVD */
+var OVERSAMPLING int
+
+/*POWERITER number of power iterations used by the randomized SVD */
+var POWERITER int
+
+/*TFIDF apply TF-IDF transformation before the SVD */
+var TFIDF bool
+
+/*SCALEFACTOR scale factor used for the TF-IDF transformation */
+var SCALEFACTOR float64
+
+/*DROPDEPTH drop the first component correlated with the sequencing depth */
+var DROPDEPTH bool
+
+/*DEPTHCOR minimum absolute correlation with the sequencing depth to drop a component */
+var DEPTHCOR float64
+
+/*SEED  Seed used for random processes*/
+var SEED int64
+
+/*THREADNB number of threads */
+var THREADNB int
+
+/*SEP separator for writing output */
+var SEP string
+
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `
+#################### MODULE TO COMPUTE THE LSI EMBEDDING OF A (cell x feature) MATRIX ########################
+The top-k components are computed using a randomized SVD on the sparse matrix created with ATACMatUtils (COO, mtx or binary format).
+The input matrix can be transformed using TF-IDF (log(1 + TF x IDF x scale factor)) before the SVD.
+
+USAGE: ATACLSI -in <matrix> -xgi <fname> (optional -ygi <bedFile> -k <int> -tfidf -drop_depth -out <string> -threads <int> -seed <int>)
+
+Output files:
+   <out>.cells.tsv: cell embeddings (U x S) ordered as in -xgi
+   <out>.features.tsv: feature loadings (V) ordered as in -ygi
+   <out>.components.tsv: singular values and correlation of each component with the sequencing depth (log total count per cell)
+
+With -drop_depth, the first component with an absolute correlation with the sequencing depth higher than -depth_cor is removed from the outputs.
+
+`)
+		 flag.PrintDefaults()
+	}
+
+	flag.Var(&MATRIXFILE, "in", "name of the input matrix file (COO, mtx or binary)")
+	flag.Var(&CELLSIDFNAME, "xgi", "name of the file containing the ordered list of cell IDs (one ID per line). Optional for binary matrices")
+	flag.Var(&PEAKFILE, "ygi", "name of the file containing the ordered list of features (bed file or one feature per line)")
+	flag.StringVar(&FILENAMEOUT, "out", "", "prefix of the output files (default: <in>.lsi)")
+	flag.IntVar(&NBCOMPONENTS, "k", 50, "number of LSI components")
+	flag.IntVar(&OVERSAMPLING, "oversampling", 10, "number of additional random vectors used by the randomized SVD")
+	flag.IntVar(&POWERITER, "power_iter", 2, "number of power iterations used by the randomized SVD")
+	flag.BoolVar(&TFIDF, "tfidf", false, "apply TF-IDF transformation to the input matrix before the SVD")
+	flag.Float64Var(&SCALEFACTOR, "scale_factor", 1e4, "scale factor used for the TF-IDF transformation")
+	flag.BoolVar(&DROPDEPTH, "drop_depth", false, "drop the first component correlated with the sequencing depth")
+	flag.Float64Var(&DEPTHCOR, "depth_cor", 0.75, "minimum absolute Pearson correlation with the sequencing depth to drop a component (with -drop_depth)")
+	flag.Int64Var(&SEED, "seed", 2020, "Seed used for random processes")
+	flag.IntVar(&THREADNB, "threads", 1, "threads concurrency")
+	flag.StringVar(&SEP, "delimiter", "\t", "delimiter used to write the output files")
+	flag.Parse()
+
+	switch {
+	case MATRIXFILE == "":
+		log.Fatal("Error input matrix (-in) must be provided!")
+	case THREADNB <= 0:
+		log.Fatal("Error -threads must be a positive number!")
+	case NBCOMPONENTS <= 0:
+		log.Fatal("Error -k must be a positive number of components!")
+	}
+
+	if FILENAMEOUT == "" {
+		FILENAMEOUT = fmt.Sprintf("%s.lsi", MATRIXFILE)
+	}
+
+	tStart := time.Now()
+
+	matrix := loadMatrix()
+	depth := computeLogDepth(&matrix)
+
+	if TFIDF {
+		fmt.Printf("TF-IDF transformation...\n")
+		tfidfTransform(&matrix)
+	}
+
+	fmt.Printf("randomized SVD of a %d x %d matrix with %d entries (k=%d)...\n",
+		matrix.NRows, matrix.NCols, matrix.NbEntries(), NBCOMPONENTS)
+
+	cellEmbeddings, loadings, singularValues := randomizedSVD(&matrix, NBCOMPONENTS, OVERSAMPLING, POWERITER, SEED)
+
+	correlations := make([]float64, len(singularValues))
+	dropped := -1
+
+	for comp := range singularValues {
+		correlations[comp] = pearsonCorrelation(mat.Col(nil, comp, cellEmbeddings), depth)
+		fmt.Printf("component %d: singular value: %f correlation with depth: %f\n",
+			comp + 1, singularValues[comp], correlations[comp])
+
+		if DROPDEPTH && dropped == -1 && math.Abs(correlations[comp]) >= DEPTHCOR {
+			dropped = comp
+		}
+	}
+
+	if DROPDEPTH {
+		if dropped == -1 {
+			fmt.Printf("No component with an absolute correlation with depth >= %f\n", DEPTHCOR)
+		} else {
+			fmt.Printf("component %d dropped (correlation with depth: %f)\n", dropped + 1, correlations[dropped])
+		}
+	}
+
+	writeEmbedding(fmt.Sprintf("%s.cells.tsv", FILENAMEOUT), "cellID", matrix.RowNames, cellEmbeddings, dropped)
+	writeEmbedding(fmt.Sprintf("%s.features.tsv", FILENAMEOUT), "feature", matrix.ColNames, loadings, dropped)
+	writeComponents(fmt.Sprintf("%s.components.tsv", FILENAMEOUT), singularValues, correlations, dropped)
+
+	tDiff := time.Since(tStart)
+	fmt.Printf("done in time: %f s \n", tDiff.Seconds())
+}
+
+/*loadMatrix load the input matrix and the cell / feature names */
+func loadMatrix() (matrix utils.SparseMatrix) {
+	var cellNames, featureNames []string
+
+	if CELLSIDFNAME != "" {
+		cellNames = loadIndexNames(CELLSIDFNAME, false)
+	}
+
+	if PEAKFILE != "" {
+		featureNames = loadIndexNames(PEAKFILE, true)
+	}
+
+	fmt.Printf("loading matrix: %s...\n", MATRIXFILE)
+	matrix = utils.LoadSparseMatrix(string(MATRIXFILE), len(cellNames), len(featureNames))
+
+	switch {
+	case len(cellNames) > 0:
+		if matrix.NRows > len(cellNames) {
+			log.Fatal(fmt.Sprintf("Error the matrix has more rows (%d) than cells in -xgi (%d)",
+				matrix.NRows, len(cellNames)))
+		}
+
+		matrix.RowNames = cellNames
+	case len(matrix.RowNames) == 0:
+		log.Fatal("Error -xgi file must be provided!")
+	}
+
+	switch {
+	case len(featureNames) > 0:
+		if matrix.NCols > len(featureNames) {
+			log.Fatal(fmt.Sprintf("Error the matrix has more columns (%d) than features in -ygi (%d)",
+				matrix.NCols, len(featureNames)))
+		}
+
+		matrix.ColNames = featureNames
+	case len(matrix.ColNames) == 0:
+		matrix.ColNames = make([]string, matrix.NCols)
+
+		for pos := range matrix.ColNames {
+			matrix.ColNames[pos] = strconv.Itoa(pos)
+		}
+	}
+
+	return matrix
+}
+
+/*loadIndexNames load the ordered names of a xgi (first column) or ygi (chr:start-end for bed files) index */
+func loadIndexNames(fname utils.Filename, isFeature bool) (names []string) {
+	scanner, file := fname.ReturnReader(0)
+	defer utils.CloseFile(file)
+
+	for scanner.Scan() {
+		split := strings.Split(scanner.Text(), "\t")
+
+		switch {
+		case isFeature && len(split) >= 3:
+			names = append(names, fmt.Sprintf("%s:%s-%s", split[0], split[1], split[2]))
+		default:
+			names = append(names, split[0])
+		}
+	}
+
+	return names
+}
+
+/*computeLogDepth return log(1 + total count) for each cell */
+func computeLogDepth(matrix *utils.SparseMatrix) (depth []float64) {
+	depth = make([]float64, matrix.NRows)
+
+	for i, row := range matrix.Rows {
+		for _, value := range row.Values {
+			depth[i] += value
+		}
+
+		depth[i] = math.Log1p(depth[i])
+	}
+
+	return depth
+}
+
+/*tfidfTransform log(1 + TF x IDF x SCALEFACTOR) with TF = count / cell total and IDF = nb cells / feature total */
+func tfidfTransform(matrix *utils.SparseMatrix) {
+	rowSums := make([]float64, matrix.NRows)
+	colSums := make([]float64, matrix.NCols)
+
+	for i, row := range matrix.Rows {
+		for k, j := range row.Index {
+			rowSums[i] += row.Values[k]
+			colSums[j] += row.Values[k]
+		}
+	}
+
+	nbCells := float64(matrix.NRows)
+
+	for i, row := range matrix.Rows {
+		for k, j := range row.Index {
+			row.Values[k] = math.Log1p(row.Values[k] / rowSums[i] * nbCells / colSums[j] * SCALEFACTOR)
+		}
+	}
+}
+
+/*pearsonCorrelation Pearson correlation between two vectors */
+func pearsonCorrelation(x, y []float64) float64 {
+	var meanX, meanY, cov, varX, varY float64
+
+	for i := range x {
+		meanX += x[i]
+		meanY += y[i]
+	}
+
+	meanX /= float64(len(x))
+	meanY /= float64(len(y))
+
+	for i := range x {
+		cov += (x[i] - meanX) * (y[i] - meanY)
+		varX += (x[i] - meanX) * (x[i] - meanX)
+		varY += (y[i] - meanY) * (y[i] - meanY)
+	}
+
+	if varX == 0 || varY == 0 {
+		return 0
+	}
+
+	return cov / math.Sqrt(varX * varY)
+}
+
+/*writeEmbedding write one row per name with the component values (the dropped component is skipped) */
+func writeEmbedding(fname, firstColumn string, names []string, embedding *mat.Dense, dropped int) {
+	var buffer bytes.Buffer
+	var err error
+
+	writer := utils.ReturnWriter(fname)
+	defer utils.CloseFile(writer)
+
+	nrows, ncols := embedding.Dims()
+
+	buffer.WriteString(fmt.Sprintf("#%s", firstColumn))
+
+	for comp := 0; comp < ncols; comp++ {
+		if comp == dropped {
+			continue
+		}
+
+		buffer.WriteString(fmt.Sprintf("%sLSI_%d", SEP, comp + 1))
+	}
+
+	buffer.WriteRune('\n')
+
+	for i := 0; i < nrows; i++ {
+		buffer.WriteString(names[i])
+
+		for comp, value := range embedding.RawRowView(i) {
+			if comp == dropped {
+				continue
+			}
+
+			buffer.WriteString(SEP)
+			buffer.WriteString(strconv.FormatFloat(value, 'g', 7, 64))
+		}
+
+		buffer.WriteRune('\n')
+
+		if buffer.Len() > 1000000 {
+			_, err = writer.Write(buffer.Bytes())
+			utils.Check(err)
+			buffer.Reset()
+		}
+	}
+
+	_, err = writer.Write(buffer.Bytes())
+	utils.Check(err)
+
+	fmt.Printf("file: %s written!\n", fname)
+}
+
+/*writeComponents write the singular values and the correlations with depth */
+func writeComponents(fname string, singularValues, correlations []float64, dropped int) {
+	var buffer bytes.Buffer
+
+	writer := utils.ReturnWriter(fname)
+	defer utils.CloseFile(writer)
+
+	buffer.WriteString(fmt.Sprintf("#component%ssingular value%sdepth correlation%sdropped\n", SEP, SEP, SEP))
+
+	for comp := range singularValues {
+		buffer.WriteString(fmt.Sprintf("LSI_%d%s%f%s%f%s%v\n", comp + 1,
+			SEP, singularValues[comp], SEP, correlations[comp], SEP, comp == dropped))
+	}
+
+	_, err := writer.Write(buffer.Bytes())
+	utils.Check(err)
+
+	fmt.Printf("file: %s written!\n", fname)
+}
@@ -0,0 +1,10 @@
+module github.com/opoirion/snATACUtils/ATACLSI
+
+replace github.com/opoirion/snATACUtils/ATACdemultiplexUtils => ../ATACdemultiplexUtils
+
+go 1.15
+
+require (
+	github.com/opoirion/snATACUtils/ATACdemultiplexUtils v0.0.0-00010101000000-000000000000
+	gonum.org/v1/gonum v0.9.3
+)
@@ -0,0 +1,210 @@
+/* Randomized truncated SVD of a sparse matrix (Halko, Martinsson and Tropp, 2011) */
+
+package main
+
+
+import(
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+	"gonum.org/v1/gonum/mat"
+)
+
+
+/*randomizedSVD compute the top k singular triplets of the sparse matrix A (n x m).
+Returns the row embeddings U x S (n x k), the column loadings V (m x k) and the singular values */
+func randomizedSVD(matrix *utils.SparseMatrix, k, oversampling, powerIter int, seed int64) (
+	embeddings, loadings *mat.Dense, singularValues []float64) {
+
+	n, m := matrix.NRows, matrix.NCols
+	l := k + oversampling
+
+	if l > n {
+		l = n
+	}
+
+	if l > m {
+		l = m
+	}
+
+	if k > l {
+		fmt.Printf("Warning: number of components reduced to the matrix rank bound: %d\n", l)
+		k = l
+	}
+
+	transposed := matrix.Transpose()
+	random := rand.New(rand.NewSource(seed))
+
+	omega := mat.NewDense(m, l, nil)
+
+	for i := 0; i < m; i++ {
+		for j := 0; j < l; j++ {
+			omega.Set(i, j, random.NormFloat64())
+		}
+	}
+
+	// range finder: Q = orth(A (A^T A)^q Omega)
+	y := mat.NewDense(n, l, nil)
+	z := mat.NewDense(m, l, nil)
+
+	sparseMulDense(matrix.Rows, omega, y)
+	orthonormalizeColumns(y)
+
+	for iter := 0; iter < powerIter; iter++ {
+		fmt.Printf("power iteration %d...\n", iter + 1)
+		sparseMulDense(transposed.Rows, y, z)
+		orthonormalizeColumns(z)
+		sparseMulDense(matrix.Rows, z, y)
+		orthonormalizeColumns(y)
+	}
+
+	// C = A^T Q = (Q^T A)^T is a small (m x l) matrix: C = Uc Sc Vc^T => A ~ (Q Vc) Sc Uc^T
+	sparseMulDense(transposed.Rows, y, z)
+
+	var svd mat.SVD
+
+	if ok := svd.Factorize(z, mat.SVDThin); !ok {
+		panic("SVD factorization failed")
+	}
+
+	var uc, vc, u mat.Dense
+
+	svd.UTo(&uc)
+	svd.VTo(&vc)
+	values := svd.Values(nil)
+
+	u.Mul(y, &vc)
+
+	embeddings = mat.NewDense(n, k, nil)
+	loadings = mat.NewDense(m, k, nil)
+	singularValues = values[:k]
+
+	for comp := 0; comp < k; comp++ {
+		sign := loadingSign(&uc, comp)
+
+		for i := 0; i < n; i++ {
+			embeddings.Set(i, comp, sign * u.At(i, comp) * values[comp])
+		}
+
+		for j := 0; j < m; j++ {
+			loadings.Set(j, comp, sign * uc.At(j, comp))
+		}
+	}
+
+	return embeddings, loadings, singularValues
+}
+
+/*loadingSign return the sign making the largest absolute loading of the component positive (deterministic output) */
+func loadingSign(loadings *mat.Dense, comp int) float64 {
+	var maxValue float64
+
+	nrows, _ := loadings.Dims()
+
+	for j := 0; j < nrows; j++ {
+		if value := loadings.At(j, comp); math.Abs(value) > math.Abs(maxValue) {
+			maxValue = value
+		}
+	}
+
+	if maxValue < 0 {
+		return -1
+	}
+
+	return 1
+}
+
+/*sparseMulDense out = A x (with A a list of sparse rows) using THREADNB threads */
+func sparseMulDense(rows []utils.SparseVector, x, out *mat.Dense) {
+	var waiting sync.WaitGroup
+
+	chunk := len(rows) / THREADNB + 1
+
+	for start := 0; start < len(rows); start += chunk {
+		end := start + chunk
+
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		waiting.Add(1)
+
+		go func(start, end int) {
+			defer waiting.Done()
+
+			for i := start; i < end; i++ {
+				outRow := out.RawRowView(i)
+
+				for c := range outRow {
+					outRow[c] = 0
+				}
+
+				for k, j := range rows[i].Index {
+					value := rows[i].Values[k]
+
+					for c, xValue := range x.RawRowView(int(j)) {
+						outRow[c] += value * xValue
+					}
+				}
+			}
+		}(start, end)
+	}
+
+	waiting.Wait()
+}
+
+/*orthonormalizeColumns orthonormalize in place the columns of a (tall) matrix using a modified Gram-Schmidt
+with re-orthogonalization. Columns linearly dependent of the previous ones are set to 0 */
+func orthonormalizeColumns(a *mat.Dense) {
+	nrows, ncols := a.Dims()
+	columns := make([][]float64, ncols)
+
+	for c := range columns {
+		columns[c] = mat.Col(nil, c, a)
+	}
+
+	for c := range columns {
+		initNorm := norm(columns[c])
+
+		for pass := 0; pass < 2; pass++ {
+			for p := 0; p < c; p++ {
+				dot := 0.0
+
+				for i, value := range columns[p] {
+					dot += value * columns[c][i]
+				}
+
+				for i, value := range columns[p] {
+					columns[c][i] -= dot * value
+				}
+			}
+		}
+
+		colNorm := norm(columns[c])
+
+		for i := range columns[c] {
+			if colNorm <= 1e-12 * initNorm || colNorm == 0 {
+				columns[c][i] = 0
+			} else {
+				columns[c][i] /= colNorm
+			}
+		}
+	}
+
+	for i := 0; i < nrows; i++ {
+		row := a.RawRowView(i)
+
+		for c := range columns {
+			row[c] = columns[c][i]
+		}
+	}
+}
+
+func norm(vector []float64) (value float64) {
+	for _, x := range vector {
+		value += x * x
+	}
+
+	return math.Sqrt(value)
+}
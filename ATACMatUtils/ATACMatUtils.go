@@ -146,6 +146,12 @@ var ALL bool
 /*TRIMPEAKSTR trim peak string */
 var TRIMPEAKSTR bool
 
+/*CUTSITES use the two Tn5 insertions of each fragment instead of the full fragment */
+var CUTSITES bool
+
+/*TN5SHIFT shift the fragment ends by +4/-5 before inferring the Tn5 insertions */
+var TN5SHIFT bool
+
 type normType string
 
 type matrixFormat string
@@ -168,6 +174,7 @@ const (
 	taiji matrixFormat = "taiji"
 	dense matrixFormat = "dense"
 	denseTranspose matrixFormat = "denseTranspose"
+	binaryMat matrixFormat = "binary"
 )
 
 func (t matrixFormat) isValid() matrixFormat {
@@ -188,7 +195,7 @@ func (t matrixFormat) isValid() matrixFormat {
 
 		if SPLIT > 0 {
 			panic(fmt.Sprintf(
-				"-format cellRanger cannot be used with -split option. Please use coo first then convert to mtx using ATACMatUtils -merge -in <coo file> -format cellRanger -out <matrix file>"))
+				"-format cellRanger cannot be used with -split option. Please use coo first then convert to mtx using ATACMatUtils -convert -in <coo file> -format cellRanger -ygi <bed file> -out <matrix file>"))
 		}
 
 		ext := path.Ext(FILENAMEOUT)
@@ -211,15 +218,19 @@ func (t matrixFormat) isValid() matrixFormat {
 	case mtx:
 		if SPLIT > 0 {
 			panic(fmt.Sprintf(
-				"-format mtx cannot be used with -split option. Please use coo first then convert to mtx using ATACMatUtils -merge -in <coo file> -format mtx -out <matrix file>"))
+				"-format mtx cannot be used with -split option. Please use coo first then convert to mtx using ATACMatUtils -convert -in <coo file> -format mtx -out <matrix file>"))
+		}
+	case binaryMat:
+		if SPLIT > 0 {
+			panic(fmt.Sprintf("-format binary cannot be used with -split option. Please use coo first then convert to binary using ATACMatUtils -merge -in <coo file> -format binary -out <matrix file>"))
 		}
 	case denseTranspose:
 		TRANSPOSE = true
 		if SPLIT > 0 {
-			panic(fmt.Sprintf("-format denseTranspose cannot be used with -split option"))
+			panic(fmt.Sprintf("-format denseTranspose cannot be used with -split option. Please use coo first then convert to a transposed matrix using ATACMatUtils -convert -in <coo file> -format mtxTranspose -out <matrix file>"))
 		}
 	default:
-		panic("Valid matrix format (-format) are taiji|coo|dense|denseTranspose|mtx|cooTranspose|mtxTranspose|cellRanger")
+		panic("Valid matrix format (-format) are taiji|coo|dense|denseTranspose|mtx|cooTranspose|mtxTranspose|cellRanger|binary")
 	}
 
 	return t
@@ -267,18 +278,29 @@ func main() {
 #################### MODULE TO CREATE (cell x genomic region) SPARSE MATRIX ########################
 """Boolean / interger Peak matrix """
 transform one (-bed) or multiple bed files into a sparse matrix
-USAGE: ATACMatUtils -bed  <bedFile> -ygi <bedFile> -xgi <file> (-threads <int> -out <fname> -use_count -taiji -bed <bedFile2> -use_symbol -format <string> -ygi_out <file>)
+USAGE: ATACMatUtils -bed  <bedFile> -ygi <bedFile> -xgi <file> (-threads <int> -out <fname> -use_count -taiji -bed <bedFile2> -use_symbol -format <string> -ygi_out <file> -cut_sites -tn5_shift)
 
 """Create a cell x bin matrix: -bin """
 transform one (-bed) or multiple (use multiple -bed options) bed file into a bin (using float) sparse matrix. If ygi provided, reads intersecting these bin are ignored
 
-USAGE: ATACMatUtils -bin -bed  <bedFile> (optional -ygi <bedFile> -xgi <fname> -bin_size <int> -ygi_out <string> -norm -taiji -format <string>)
+USAGE: ATACMatUtils -bin -bed  <bedFile> (optional -ygi <bedFile> -xgi <fname> -bin_size <int,int,...> -chr_sizes <file> -ygi_out <string> -norm -taiji -format <string> -cut_sites -tn5_shift)
+
+-bin_size can be a comma separated list of bin sizes (ex: 5000,50000,500000). In this case, all the matrices are created in one pass of the bed file and the bin size is added to the names of each output matrix and bin index (ex: <out>.bin5000.gz and <ygi_out>.bin5000.ygi).
+If -chr_sizes is provided, all the genome-wide bins are used as features (in the order of the chromosome size file) instead of only the bins observed in the bed file.
 
 """Count the number of reads in peaks for each cell: -count """
 USAGE: ATACMatUtils -count  -xgi <fname> -ygi <bedfile> -bed <bedFile> (optionnal: -out <fname> -norm -all)
 
+"""Convert large COO matrices with a bounded memory: -convert """
+The COO file(s) are sorted on disk (external sort) using chunks of at most -buffer_size entries. The output is sorted by row (coo|mtx) or by feature (cooTranspose|mtxTranspose|cellRanger). It can be used to convert the outputs of -split. Duplicated entries are summed with -use_count or -bin and set to 1 otherwise.
+USAGE: ATACMatUtils -convert -xgi <fname> -in <cooFile1> -in <cooFile2> ... -format <coo|cooTranspose|mtx|mtxTranspose|cellRanger> (optional -ygi <bedFile> -out <fname> -buffer_size <int> -tmp_dir <folder> -use_count -bin)
+
+"""Fetch cells and features from a binary matrix: -query """
+The output is a three columns table: cell ID, feature, value. Each -query_cells / -query_features can be a name, a comma separated list of names or a file with one name per line. Features can be peaks (chr:start-end), bins or symbols.
+USAGE: ATACMatUtils -query -in <binary matrix> -query_cells <cellIDs> -query_features <features> (optional -out <fname>)
+
 """Merge multiple matrices results into one output file: -merge """
-It can be used to convert taiji to coo or coo to taiji formats.
+It can be used to convert taiji to coo or coo to taiji formats. Input matrices can be coo, taiji or binary.
 USAGE: ATACMatUtils -merge -xgi <fname> -in <matrixFile1> -in <matrixFile2> ... (optional -bin -use_count -out <fname> -format <string>)
 
 USAGE for the -use_symbol option:
@@ -286,6 +308,9 @@ Optional use of the 4th column of -ygi as symbol.
 This option is usefull to reduce the signal of multiple loci (i.e. multiple vectors) corresponding to the same function into one single vector per distinct symbol.
 if used, the program will output the list of ordered symbol corresponding to the new ygi index.
 
+USAGE for the -cut_sites option:
+By default, a fragment is counted for each feature overlapping its full span. With -cut_sites, the two Tn5 insertions (i.e. the fragment ends) are used instead and each insertion is counted for the feature it falls into (ArchR/chromVAR convention). Use -tn5_shift to apply the +4/-5 Tn5 offsets when the bed file contains unshifted reads.
+
 USAGE for the -format option:
 Multiple output format can be used:
 
@@ -297,6 +322,7 @@ Multiple output format can be used:
 *  "dense": Dense format with first column barcode and first row genes
 *  "denseTranspose": Similar to dense but transposee
 *  "cellRanger": Similar to mtxTranspose. Additional formatted files for features.tsv and barcodes.tsv are created
+*  "binary": Compressed binary matrix stored both by cell (CSR) and by feature (CSC) with the embedded cell and feature names. Rows and columns can be fetched with -query without reading the full matrix
 
 `)
 		 flag.PrintDefaults()
@@ -304,7 +330,9 @@ Multiple output format can be used:
 
 
 	flag.IntVar(&SPLIT, "split", 0, "Split computation into n iterative chuncks (to reduce RAM usage for very large matrices)")
-	flag.IntVar(&BINSIZE, "bin_size", 5000, "Size of the bin for bin matrix")
+	flag.StringVar(&BINSIZESTR, "bin_size", "5000", `Size of the bin for bin matrix.
+    Multiple comma separated sizes (ex: 5000,50000,500000) create one matrix and one bin index per size in a single pass`)
+	flag.Var(&CHRSIZEFILE, "chr_sizes", `file with chromosome sizes (<chr><TAB><size>) used to create genome-wide fixed bins for the bin matrix instead of only the observed bins`)
 	flag.StringVar(&FILENAMEOUT, "out", "", "name of the output file")
 	flag.Var(&BEDFILENAME, "bed", "name of the bed file")
 	flag.Var(&INFILES, "in", "name of the input file(s)")
@@ -321,9 +349,13 @@ Multiple output format can be used:
 	flag.BoolVar(&COO, "coo", false,
 		`Use COO format as output (DEPRECIATED: use -format coo instead)`)
 	flag.StringVar(&MATRIXFORMATSTR, "format", "coo",
-		`Output matrix format (coo|taiji|dense|denseTransposee|mtx) `)
+		`Output matrix format (coo|taiji|dense|denseTranspose|mtx|cooTranspose|mtxTranspose|cellRanger|binary) `)
 	flag.BoolVar(&ALL, "all", false,
 		`Count the reads in peaks for the entire input bed file`)
+	flag.BoolVar(&CUTSITES, "cut_sites", false,
+		`Count the two Tn5 insertions (cut sites) of each fragment instead of the full fragment span`)
+	flag.BoolVar(&TN5SHIFT, "tn5_shift", false,
+		`Shift fragment ends by +4/-5 before inferring the Tn5 insertions (use with -cut_sites when the bed file is not already shifted)`)
 
 	flag.BoolVar(&NORM, "norm", false, "Normalize raw count by dividing using the total number of reads per cell (equivalent to -norm_type simple)")
 	flag.StringVar(&NORMTYPESTR, "norm_type", "", "Normalisation type to use: simple|rpm|logrpm|fpkm|logfpkm|count. \"Simple\" divides the feature values by the total number of read count per cell (equivalent to norm).\"count\" reports the number of reads")
@@ -332,11 +364,18 @@ Multiple output format can be used:
 		`transform one (-bed) or multiple (use multiple -beds option) into a bin (using float) sparse matrix in COO format.`)
 	flag.BoolVar(&MERGEOUTPUTS, "merge", false, `merge multiple matrices results into one output file`)
 	flag.BoolVar(&READINPEAK, "count", false, `Count the number of reads in peaks for each cell`)
+	flag.BoolVar(&CONVERTMATRIX, "convert", false, `convert COO matrix file(s) into a sorted coo|cooTranspose|mtx|mtxTranspose|cellRanger matrix using an external sort with bounded memory`)
+	flag.BoolVar(&QUERYMATRIX, "query", false, `fetch the rows of cells (-query_cells) and the columns of features (-query_features) from a binary matrix (-in)`)
+	flag.Var(&QUERYCELLS, "query_cells", "cell ID(s) to fetch with -query (name, comma separated list or file)")
+	flag.Var(&QUERYFEATURES, "query_features", "feature(s) (peak chr:start-end, bin or symbol) to fetch with -query (name, comma separated list or file)")
+	flag.IntVar(&SORTBUFFERSIZE, "buffer_size", 10000000, "maximum number of matrix entries kept in memory with -convert")
+	flag.StringVar(&TMPDIR, "tmp_dir", "", "folder used to write the temporary sorted chunks with -convert (default: system temporary folder)")
 	flag.IntVar(&THREADNB, "threads", 1, "threads concurrency")
 	flag.Parse()
 
 	var tag string
 
+	BINSIZE = loadBinSizes()[0]
 	NORMTYPE = normType(NORMTYPESTR)
 
 	if NORM && NORMTYPE == "" {
@@ -362,7 +401,13 @@ Multiple output format can be used:
 
 	MATRIXFORMAT = matrixFormat(MATRIXFORMATSTR).isValid()
 
+	if ISCELLRANGERFORMAT && CREATEBINMATRIX && strings.Contains(BINSIZESTR, ",") {
+		log.Fatal("Error -format cellRanger cannot be used with multiple -bin_size!")
+	}
+
 	switch {
+	case QUERYMATRIX:
+		// query results are written to stdout by default
 	case FILENAMEOUT == "" && len(INFILES) > 0:
 		FILENAMEOUT = fmt.Sprintf("%s.%s.gz", INFILES[0], tag)
 	case FILENAMEOUT == "" && BEDFILENAME != "":
@@ -374,8 +419,20 @@ Multiple output format can be used:
 	tStart := time.Now()
 
 	switch {
+	case QUERYMATRIX:
+		if len(INFILES) != 1 {
+			log.Fatal("Error one binary matrix (-in) must be provided!")
+		}
+
+		queryBinaryMatrix(INFILES[0])
 	case CELLSIDFNAME == "" && !READINPEAK:
 		log.Fatal("Error -xgi file must be provided!")
+	case CONVERTMATRIX:
+		if len(INFILES) == 0 {
+			log.Fatal("Error at least one input (-in) file must be provided!")
+		}
+
+		convertMatFilesOutOfCore(INFILES)
 	case MERGEOUTPUTS:
 		if len(INFILES) == 0 {
 			log.Fatal("Error at least one input (-in) file must be provided!")
@@ -400,7 +457,10 @@ Multiple output format can be used:
 	}
 
 	tDiff := time.Since(tStart)
-	fmt.Printf("done in time: %f s \n", tDiff.Seconds())
+
+	if !QUERYMATRIX {
+		fmt.Printf("done in time: %f s \n", tDiff.Seconds())
+	}
 
 	if ISCELLRANGERFORMAT {
 		formatXgiFileToCellRanger()
@@ -605,7 +665,7 @@ func getFeatureIndexToNameDict() (featureArray []string) {
 	var upos uint
 	var pos int
 	var bin binPos
-	var index int
+	var index, end int
 	var max uint
 
 	featureDict := make(map[uint]string)
@@ -624,9 +684,9 @@ func getFeatureIndexToNameDict() (featureArray []string) {
 				max = upos
 			}
 
-			index = int(bin.index) * BINSIZE
+			index, end = binCoordinates(bin, BINSIZE)
 			featureDict[upos] = fmt.Sprintf("%s:%d-%d",
-				bin.chr, index, index + BINSIZE)
+				bin.chr, index, end)
 		}
 
 	default:
@@ -740,6 +800,8 @@ func launchIntSparseMatrix(filenameout string, writeHeader bool) {
 		writeIntMatrixToDenseFile(filenameout, true)
 	case denseTranspose:
 		writeIntMatrixToDenseTransposeFile(filenameout)
+	case binaryMat:
+		writeIntMatrixToBinaryFile(filenameout)
 	}
 }
 
@@ -1338,6 +1400,12 @@ func mergeMatFiles(filenames []string) {
 		writeIntMatrixToDenseFile(FILENAMEOUT, true)
 	case denseTranspose:
 		writeIntMatrixToDenseTransposeFile(FILENAMEOUT)
+	case binaryMat:
+		if CREATEBINMATRIX {
+			writeFloatMatrixToBinaryFile(FILENAMEOUT)
+		} else {
+			writeIntMatrixToBinaryFile(FILENAMEOUT)
+		}
 	}
 }
 
@@ -1348,6 +1416,8 @@ func mergeIntMatFile(filename string, mtype mattype) {
 		mergeIntMatFileFromCOO(filename)
 	case "taiji":
 		mergeIntMatFileFromTaiji(filename)
+	case "binary":
+		mergeMatFileFromBinary(filename, false)
 	}
 }
 
@@ -1358,11 +1428,17 @@ func mergeFloatMatFile(filename string, mtype mattype) {
 		mergeFloatMatFileFromCOO(filename)
 	case "taiji":
 		mergeFloatMatFileFromTaiji(filename)
+	case "binary":
+		mergeMatFileFromBinary(filename, true)
 	}
 }
 
 /*findMatrixFormat find matrix format */
 func findMatrixFormat(filename string) mattype {
+	if utils.IsBinaryMatrix(filename) {
+		return mattype("binary")
+	}
+
 	scanner, f := utils.ReturnReader(filename, 0)
 
 	scanner.Scan()
@@ -1748,8 +1824,8 @@ func updateReadInPeakThread(bufferLine * [BUFFERSIZE]string, bufferStart ,buffer
 			continue
 		}
 
-		intervals = utils.CHRINTERVALDICTTHREAD[threadnb][split[0]].Get(
-			utils.IntInterval{Start: start, End: end})
+		intervals = getFragmentIntervals(
+			utils.CHRINTERVALDICTTHREAD[threadnb][split[0]], start, end)
 
 		MUTEX.Lock()
 
@@ -1827,8 +1903,8 @@ func updateIntSparseMatrixOneThread(
 			continue
 		}
 
-		intervals = utils.CHRINTERVALDICTTHREAD[threadnb][split[0]].Get(
-			utils.IntInterval{Start: start, End: end})
+		intervals = getFragmentIntervals(
+			utils.CHRINTERVALDICTTHREAD[threadnb][split[0]], start, end)
 
 		if len(intervals) == 0 {
 			continue
@@ -1875,6 +1951,20 @@ func updateIntSparseMatrixOneThread(
 	}
 }
 
+/*getFragmentIntervals return the features intersecting a fragment or, if CUTSITES is used, intersecting each of its two Tn5 insertions*/
+func getFragmentIntervals(intree *interval.IntTree, start, end int) (intervals []interval.IntInterface) {
+	if !CUTSITES {
+		return intree.Get(utils.IntInterval{Start: start, End: end})
+	}
+
+	cut1, cut2 := utils.FragmentToCutSites(start, end, TN5SHIFT)
+
+	intervals = intree.Get(utils.IntInterval{Start: cut1, End: cut1})
+	intervals = append(intervals, intree.Get(utils.IntInterval{Start: cut2, End: cut2})...)
+
+	return intervals
+}
+
 func createIntSparseMatrixOneFile(bedfilename utils.Filename) {
 	var line string
 	var split []string
@@ -1914,8 +2004,8 @@ func createIntSparseMatrixOneFile(bedfilename utils.Filename) {
 			continue
 		}
 
-		intervals = utils.CHRINTERVALDICT[split[0]].Get(
-			utils.IntInterval{Start: start, End: end})
+		intervals = getFragmentIntervals(
+			utils.CHRINTERVALDICT[split[0]], start, end)
 
 		for _, interval = range intervals {
 			featPos, isInside = utils.PEAKIDDICT[utils.INTERVALMAPPING[interval.ID()]]
@@ -0,0 +1,231 @@
+/* Binary sparse matrix (random-access CSR/CSC container) output, query and merge */
+
+package main
+
+
+import(
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+)
+
+
+/*QUERYMATRIX query rows or columns of a binary matrix */
+var QUERYMATRIX bool
+
+/*QUERYCELLS cell IDs to fetch from a binary matrix */
+var QUERYCELLS utils.ArrayFlags
+
+/*QUERYFEATURES features (peaks, bins or symbols) to fetch from a binary matrix */
+var QUERYFEATURES utils.ArrayFlags
+
+/*YGINAMES feature names embedded in a binary matrix used as input of -merge */
+var YGINAMES []string
+
+
+/*writeIntMatrixToBinaryFile write INTSPARSEMATRIX as a binary sparse matrix */
+func writeIntMatrixToBinaryFile(outfile string) {
+	fmt.Printf("writing to output file...\n")
+	loadYgiSize()
+
+	matrix := utils.SparseMatrix{Rows: make([]utils.SparseVector, len(INTSPARSEMATRIX))}
+
+	for cellPos := range INTSPARSEMATRIX {
+		row := &matrix.Rows[cellPos]
+		row.Index = make([]uint32, 0, len(INTSPARSEMATRIX[cellPos]))
+		row.Values = make([]float64, 0, len(INTSPARSEMATRIX[cellPos]))
+
+		for featPos, value := range INTSPARSEMATRIX[cellPos] {
+			row.Index = append(row.Index, uint32(featPos))
+
+			if NORM {
+				row.Values = append(row.Values, normValue(value, cellPos, int(featPos)))
+			} else {
+				row.Values = append(row.Values, float64(value))
+			}
+		}
+
+		row.SortIndex()
+	}
+
+	writeSparseMatrixToBinaryFile(outfile, &matrix)
+}
+
+/*writeFloatMatrixToBinaryFile write FLOATSPARSEMATRIX as a binary sparse matrix */
+func writeFloatMatrixToBinaryFile(outfile string) {
+	fmt.Printf("writing to output file...\n")
+
+	matrix := utils.SparseMatrix{Rows: make([]utils.SparseVector, len(FLOATSPARSEMATRIX))}
+
+	for cellPos := range FLOATSPARSEMATRIX {
+		row := &matrix.Rows[cellPos]
+
+		for featPos, value := range FLOATSPARSEMATRIX[cellPos] {
+			row.Index = append(row.Index, uint32(featPos))
+			row.Values = append(row.Values, value)
+		}
+
+		row.SortIndex()
+	}
+
+	writeSparseMatrixToBinaryFile(outfile, &matrix)
+}
+
+/*writeSparseMatrixToBinaryFile add the xgi / ygi names and dimensions and write the matrix */
+func writeSparseMatrixToBinaryFile(outfile string, matrix *utils.SparseMatrix) {
+	featureNames := YGINAMES
+
+	if len(featureNames) == 0 {
+		featureNames = getFeatureIndexToNameDict()
+	}
+
+	matrix.NRows = len(matrix.Rows)
+	matrix.NCols = YGIDIM
+
+	if len(featureNames) > matrix.NCols {
+		matrix.NCols = len(featureNames)
+	}
+
+	for _, row := range matrix.Rows {
+		if len(row.Index) > 0 && int(row.Index[len(row.Index) - 1]) >= matrix.NCols {
+			matrix.NCols = int(row.Index[len(row.Index) - 1]) + 1
+		}
+	}
+
+	matrix.RowNames = make([]string, matrix.NRows)
+	matrix.ColNames = make([]string, matrix.NCols)
+
+	for cellID, pos := range CELLIDDICT {
+		matrix.RowNames[pos] = cellID
+	}
+
+	copy(matrix.ColNames, featureNames)
+
+	utils.WriteBinaryMatrix(outfile, matrix)
+
+	fmt.Printf("binary matrix: %s (%d x %d, %d entries) created!\n",
+		outfile, matrix.NRows, matrix.NCols, matrix.NbEntries())
+}
+
+/*mergeMatFileFromBinary add one binary matrix to the matrix */
+func mergeMatFileFromBinary(filename string, isFloat bool) {
+	matrix := utils.OpenBinaryMatrix(filename)
+	defer matrix.Close()
+
+	if len(YGINAMES) == 0 {
+		YGINAMES = matrix.ColNames
+	}
+
+	if matrix.NCols > YGIDIM {
+		YGIDIM = matrix.NCols
+	}
+
+	for i := 0; i < matrix.NRows; i++ {
+		xgi, isInside := CELLIDDICT[matrix.RowNames[i]]
+
+		if !isInside {
+			panic(fmt.Sprintf("cell ID: %s from binary matrix %s is not present in the xgi file",
+				matrix.RowNames[i], filename))
+		}
+
+		row := matrix.Row(i)
+
+		for k, ygi := range row.Index {
+			switch {
+			case isFloat:
+				FLOATSPARSEMATRIX[xgi][uint(ygi)] += row.Values[k]
+			case USECOUNT:
+				INTSPARSEMATRIX[xgi][uint(ygi)] += int(row.Values[k])
+			default:
+				INTSPARSEMATRIX[xgi][uint(ygi)] = 1
+			}
+		}
+	}
+}
+
+/*queryBinaryMatrix write the rows of the -query_cells and the columns of the -query_features of a binary matrix
+as a three columns table (cell ID, feature, value) */
+func queryBinaryMatrix(filename string) {
+	var writer io.WriteCloser
+	var buffer bytes.Buffer
+
+	matrix := utils.OpenBinaryMatrix(filename)
+	defer matrix.Close()
+
+	if FILENAMEOUT != "" {
+		writer = utils.ReturnWriter(FILENAMEOUT)
+		defer utils.CloseFile(writer)
+	} else {
+		writer = os.Stdout
+	}
+
+	writeVector := func(vector utils.SparseVector, pos int, isRow bool) {
+		for k, index := range vector.Index {
+			if isRow {
+				buffer.WriteString(matrix.RowNames[pos])
+				buffer.WriteString(SEP)
+				buffer.WriteString(matrix.ColNames[index])
+			} else {
+				buffer.WriteString(matrix.RowNames[index])
+				buffer.WriteString(SEP)
+				buffer.WriteString(matrix.ColNames[pos])
+			}
+
+			buffer.WriteString(SEP)
+			buffer.WriteString(strconv.FormatFloat(vector.Values[k], 'f', -1, 64))
+			buffer.WriteRune('\n')
+		}
+
+		_, err := writer.Write(buffer.Bytes())
+		utils.Check(err)
+		buffer.Reset()
+	}
+
+	for _, cellID := range loadQueryList(QUERYCELLS) {
+		pos, isInside := matrix.RowIndex(cellID)
+
+		if !isInside {
+			fmt.Fprintf(os.Stderr, "cell ID: %s not found in %s\n", cellID, filename)
+			continue
+		}
+
+		writeVector(matrix.Row(pos), pos, true)
+	}
+
+	for _, feature := range loadQueryList(QUERYFEATURES) {
+		pos, isInside := matrix.ColIndex(feature)
+
+		if !isInside {
+			fmt.Fprintf(os.Stderr, "feature: %s not found in %s\n", feature, filename)
+			continue
+		}
+
+		writeVector(matrix.Col(pos), pos, false)
+	}
+}
+
+/*loadQueryList return the query names. Each query can be a name, a comma separated list of names or a file with one name per line */
+func loadQueryList(queries utils.ArrayFlags) (names []string) {
+	for _, query := range queries {
+		if _, err := os.Stat(query); err != nil {
+			names = append(names, strings.Split(query, ",")...)
+			continue
+		}
+
+		scanner, file := utils.ReturnReader(query, 0)
+
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				names = append(names, line)
+			}
+		}
+
+		utils.CloseFile(file)
+	}
+
+	return names
+}
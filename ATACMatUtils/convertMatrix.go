@@ -0,0 +1,355 @@
+/* Out-of-core conversion of COO matrices using an external sort */
+
+package main
+
+
+import(
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+)
+
+
+/*CONVERTMATRIX convert COO matrix file(s) into another format using an external sort */
+var CONVERTMATRIX bool
+
+/*SORTBUFFERSIZE maximum number of matrix entries kept in memory during the external sort */
+var SORTBUFFERSIZE int
+
+/*TMPDIR folder where the sorted temporary chunks are written */
+var TMPDIR string
+
+/*matEntryBytes size of one matrix entry in the binary chunk files */
+const matEntryBytes = 24
+
+/*matEntry one matrix entry. first is the sorting key (row or column if transposed) */
+type matEntry struct {
+	first, second uint64
+	value float64
+}
+
+/*matEntryList sortable list of matrix entries */
+type matEntryList []matEntry
+
+func (l matEntryList) Len() int {return len(l)}
+func (l matEntryList) Swap(i, j int) {l[i], l[j] = l[j], l[i]}
+func (l matEntryList) Less(i, j int) bool {
+	return l[i].first < l[j].first || (l[i].first == l[j].first && l[i].second < l[j].second)
+}
+
+/*chunkReader reader of one sorted chunk file */
+type chunkReader struct {
+	reader *bufio.Reader
+	file *os.File
+	current matEntry
+	buf [matEntryBytes]byte
+}
+
+/*next read the next entry of the chunk. Returns false when the chunk is exhausted */
+func (c *chunkReader) next() bool {
+	_, err := io.ReadFull(c.reader, c.buf[:])
+
+	if err == io.EOF {
+		return false
+	}
+
+	utils.Check(err)
+
+	c.current.first = binary.LittleEndian.Uint64(c.buf[0:8])
+	c.current.second = binary.LittleEndian.Uint64(c.buf[8:16])
+	c.current.value = math.Float64frombits(binary.LittleEndian.Uint64(c.buf[16:24]))
+
+	return true
+}
+
+/*chunkHeap min heap of chunk readers used for the k-way merge */
+type chunkHeap []*chunkReader
+
+func (h chunkHeap) Len() int {return len(h)}
+func (h chunkHeap) Swap(i, j int) {h[i], h[j] = h[j], h[i]}
+func (h chunkHeap) Less(i, j int) bool {
+	return h[i].current.first < h[j].current.first ||
+		(h[i].current.first == h[j].current.first && h[i].current.second < h[j].current.second)
+}
+func (h *chunkHeap) Push(x interface{}) {*h = append(*h, x.(*chunkReader))}
+func (h *chunkHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n - 1]
+	*h = old[:n - 1]
+	return x
+}
+
+/*convertMatFilesOutOfCore convert one or multiple COO files into a sorted coo|cooTranspose|mtx|mtxTranspose|cellRanger
+matrix while keeping at most SORTBUFFERSIZE entries in memory */
+func convertMatFilesOutOfCore(filenames []string) {
+	switch MATRIXFORMAT {
+	case coo, mtx:
+	default:
+		log.Fatal("Error -convert only supports the coo|cooTranspose|mtx|mtxTranspose|cellRanger output formats!")
+	}
+
+	if ISCELLRANGERFORMAT && PEAKFILE == "" {
+		log.Fatal("Error -format cellRanger with -convert requires the feature index (-ygi)!")
+	}
+
+	if SORTBUFFERSIZE <= 0 {
+		log.Fatal("Error -buffer_size must be a positive number of entries!")
+	}
+
+	tStart := time.Now()
+
+	fmt.Printf("creating xgi index..\n")
+	loadCellIDDict(CELLSIDFNAME)
+	XGIDIM = len(CELLIDDICT)
+
+	if PEAKFILE != "" {
+		YGIDIM = utils.LoadPeaks(PEAKFILE, TRIMPEAKSTR, true)
+	}
+
+	tmpFolder, err := ioutil.TempDir(TMPDIR, "ATACMatUtils_sort")
+	utils.Check(err)
+	defer os.RemoveAll(tmpFolder)
+
+	chunks := writeSortedChunks(filenames, tmpFolder)
+	fmt.Printf("%d sorted chunk(s) written in: %s\n", len(chunks), tmpFolder)
+
+	if MATRIXFORMAT != mtx {
+		writer := utils.ReturnWriter(FILENAMEOUT)
+		mergeSortedChunks(chunks, writer)
+		utils.CloseFile(writer)
+	} else {
+		// The number of entries is only known after the merge:
+		// the body is written first and the header is then prepended
+		bodyName := fmt.Sprintf("%s/matrix.body", tmpFolder)
+		body, err := os.Create(bodyName)
+		utils.Check(err)
+
+		NBENTRIES = mergeSortedChunks(chunks, body)
+		utils.CloseFile(body)
+
+		writeMtxHeaderAndBody(bodyName)
+	}
+
+	tDiff := time.Since(tStart)
+	fmt.Printf("file: %s created in %f s!\n", FILENAMEOUT, tDiff.Seconds())
+}
+
+/*writeSortedChunks read the COO files and write sorted binary chunks of at most SORTBUFFERSIZE entries */
+func writeSortedChunks(filenames []string, tmpFolder string) (chunks []string) {
+	var split []string
+	var xgi, ygi int
+	var value float64
+	var err error
+	var maxYgi int
+
+	buffer := make(matEntryList, 0, SORTBUFFERSIZE)
+	sumValues := USECOUNT || CREATEBINMATRIX
+
+	for _, filename := range filenames {
+		if mtype := findMatrixFormat(filename); mtype != "coo" {
+			log.Fatal(fmt.Sprintf("Error -convert only accepts COO input files: %s is %s", filename, mtype))
+		}
+
+		fmt.Printf("reading COO file: %s\n", filename)
+		scanner, f := utils.ReturnReader(filename, 0)
+
+		for scanner.Scan() {
+			split = strings.Split(scanner.Text(), SEP)
+			xgi, err = strconv.Atoi(split[0])
+			utils.Check(err)
+			ygi, err = strconv.Atoi(split[1])
+			utils.Check(err)
+
+			if sumValues {
+				value, err = strconv.ParseFloat(split[2], 64)
+				utils.Check(err)
+			} else {
+				value = 1
+			}
+
+			if xgi >= XGIDIM {
+				panic(fmt.Sprintf("Row index %d of %s is larger than the number of cells in -xgi (%d)",
+					xgi, filename, XGIDIM))
+			}
+
+			if ygi > maxYgi {
+				maxYgi = ygi
+			}
+
+			if TRANSPOSE {
+				xgi, ygi = ygi, xgi
+			}
+
+			buffer = append(buffer, matEntry{uint64(xgi), uint64(ygi), value})
+
+			if len(buffer) == SORTBUFFERSIZE {
+				chunks = append(chunks, writeOneSortedChunk(buffer, tmpFolder, len(chunks), sumValues))
+				buffer = buffer[:0]
+			}
+		}
+
+		utils.CloseFile(f)
+	}
+
+	if len(buffer) > 0 {
+		chunks = append(chunks, writeOneSortedChunk(buffer, tmpFolder, len(chunks), sumValues))
+	}
+
+	if PEAKFILE == "" {
+		YGIDIM = maxYgi + 1
+	} else if maxYgi >= YGIDIM {
+		panic(fmt.Sprintf("Column index %d is larger than the number of features in -ygi (%d)",
+			maxYgi, YGIDIM))
+	}
+
+	return chunks
+}
+
+/*writeOneSortedChunk sort the buffer, collapse the duplicated entries and write it to a binary chunk file */
+func writeOneSortedChunk(buffer matEntryList, tmpFolder string, chunkID int, sumValues bool) string {
+	var entryBuf [matEntryBytes]byte
+	var err error
+
+	sort.Sort(buffer)
+
+	fname := fmt.Sprintf("%s/chunk_%d.bin", tmpFolder, chunkID)
+	f, err := os.Create(fname)
+	utils.Check(err)
+	defer utils.CloseFile(f)
+
+	writer := bufio.NewWriter(f)
+
+	for i := 0; i < len(buffer); i++ {
+		entry := buffer[i]
+
+		for i + 1 < len(buffer) && buffer[i + 1].first == entry.first && buffer[i + 1].second == entry.second {
+			i++
+
+			if sumValues {
+				entry.value += buffer[i].value
+			}
+		}
+
+		binary.LittleEndian.PutUint64(entryBuf[0:8], entry.first)
+		binary.LittleEndian.PutUint64(entryBuf[8:16], entry.second)
+		binary.LittleEndian.PutUint64(entryBuf[16:24], math.Float64bits(entry.value))
+
+		_, err = writer.Write(entryBuf[:])
+		utils.Check(err)
+	}
+
+	utils.Check(writer.Flush())
+
+	return fname
+}
+
+/*mergeSortedChunks k-way merge of the sorted chunks written as text into writer. Returns the number of entries written */
+func mergeSortedChunks(chunks []string, writer io.Writer) (nbEntries int) {
+	var err error
+	var entry matEntry
+	var isSet bool
+
+	sumValues := USECOUNT || CREATEBINMATRIX
+	h := make(chunkHeap, 0, len(chunks))
+
+	for _, fname := range chunks {
+		f, err := os.Open(fname)
+		utils.Check(err)
+		defer utils.CloseFile(f)
+
+		chunk := &chunkReader{reader: bufio.NewReader(f), file: f}
+
+		if chunk.next() {
+			h = append(h, chunk)
+		}
+	}
+
+	heap.Init(&h)
+
+	bufWriter := bufio.NewWriter(writer)
+	offset := uint64(0)
+
+	if ISCELLRANGERFORMAT {
+		offset = 1
+	}
+
+	writeEntry := func() {
+		bufWriter.WriteString(strconv.FormatUint(entry.first + offset, 10))
+		bufWriter.WriteString(SEP)
+		bufWriter.WriteString(strconv.FormatUint(entry.second + offset, 10))
+		bufWriter.WriteString(SEP)
+		_, err = bufWriter.WriteString(strconv.FormatFloat(entry.value, 'f', -1, 64))
+		utils.Check(err)
+		bufWriter.WriteRune('\n')
+		nbEntries++
+	}
+
+	for h.Len() > 0 {
+		chunk := h[0]
+
+		switch {
+		case !isSet:
+			entry = chunk.current
+			isSet = true
+		case chunk.current.first == entry.first && chunk.current.second == entry.second:
+			// the same entry can be present in multiple chunks
+			if sumValues {
+				entry.value += chunk.current.value
+			}
+		default:
+			writeEntry()
+			entry = chunk.current
+		}
+
+		if chunk.next() {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+	}
+
+	if isSet {
+		writeEntry()
+	}
+
+	utils.Check(bufWriter.Flush())
+
+	return nbEntries
+}
+
+/*writeMtxHeaderAndBody write the mtx header followed by the merged entries into FILENAMEOUT */
+func writeMtxHeaderAndBody(bodyName string) {
+	writer := utils.ReturnWriter(FILENAMEOUT)
+	defer utils.CloseFile(writer)
+
+	first := XGIDIM
+	second := YGIDIM
+
+	if TRANSPOSE {
+		first, second = second, first
+	}
+
+	_, err := writer.Write([]byte(fmt.Sprintf(
+		"%%%%MatrixMarket matrix coordinate real general\n%%\n%d%s%d%s%d\n",
+		first, SEP, second, SEP, NBENTRIES)))
+	utils.Check(err)
+
+	body, err := os.Open(bodyName)
+	utils.Check(err)
+	defer utils.CloseFile(body)
+
+	_, err = io.Copy(writer, body)
+	utils.Check(err)
+}
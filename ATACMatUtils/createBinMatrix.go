@@ -10,7 +10,6 @@ import (
 	"path"
 	"sync"
 	"github.com/biogo/store/interval"
-	"sort"
 )
 
 type binPos struct {
@@ -18,14 +17,34 @@ type binPos struct {
 	index int
 }
 
+/*binResolution bin index and sparse matrix of one bin size */
+type binResolution struct {
+	binSize int
+	binIndex map[binPos]uint
+	binList []binPos
+	matrix []map[uint]int
+}
+
 /*BININDEX dict for bin index: map[bin]index */
 var BININDEX map[binPos]uint
 
 /*BINSIZE bin size for bin matrix */
 var BINSIZE int
 
-/*BININDEXCOUNT index used to create  */
-var BININDEXCOUNT uint
+/*BINSIZESTR list of bin sizes (comma separated) used to create the bin matrices */
+var BINSIZESTR string
+
+/*BINRESOLUTIONS bin index and matrix for each bin size */
+var BINRESOLUTIONS []*binResolution
+
+/*CHRSIZEFILE file with chromosome sizes used to create genome-wide fixed bins */
+var CHRSIZEFILE utils.Filename
+
+/*CHRSIZES chromosome <-> size */
+var CHRSIZES map[string]int
+
+/*CHRLIST ordered list of chromosomes from CHRSIZEFILE */
+var CHRLIST []string
 
 /*BININDEXMUTEX bin index mutex */
 var BININDEXMUTEX sync.Mutex
@@ -35,43 +54,181 @@ func createBinSparseMatrix() {
 	loadCellIDDict(CELLSIDFNAME)
 
 	XGIDIM = len(CELLIDDICT)
-	initIntSparseMatrix()
-	BININDEX = make(map[binPos]uint)
+
+	loadChrSizes()
+	initBinResolutions()
 
 	if PEAKFILE != "" {
 		YGIDIM = utils.LoadPeaks(PEAKFILE, TRIMPEAKSTR, false)
 		utils.CreatePeakIntervalTree()
 		utils.InitIntervalDictsThreading(THREADNB)
+	}
+
+	if PEAKFILE != "" || THREADNB > 1 {
 		createBinSparseMatrixOneFileThreading(BEDFILENAME)
 	} else {
 		scanBedFileForBinMat()
 	}
 
+	for _, res := range BINRESOLUTIONS {
+		INTSPARSEMATRIX = res.matrix
+		BININDEX = res.binIndex
+		BINSIZE = res.binSize
+		YGIDIM = len(res.binList)
+
+		filenameout := returnBinResolutionFilename(FILENAMEOUT, res.binSize)
+
+		writeBinList(res)
+
+		switch MATRIXFORMAT {
+		case mtx:
+			writeIntMatrixToCOOFile(filenameout, true)
+		case coo:
+			writeIntMatrixToCOOFile(filenameout, false)
+		case taiji:
+			writeIntMatrixToTaijiFile(filenameout, true)
+		case dense:
+			writeIntMatrixToDenseFile(filenameout, true)
+		case denseTranspose:
+			writeIntMatrixToDenseTransposeFile(filenameout)
+		case binaryMat:
+			writeIntMatrixToBinaryFile(filenameout)
+		}
+	}
+}
+
+/*loadBinSizes parse the -bin_size option (one or multiple comma separated bin sizes) */
+func loadBinSizes() (binSizes []int) {
+	for _, binSizeStr := range strings.Split(BINSIZESTR, ",") {
+		binSize, err := strconv.Atoi(strings.TrimSpace(binSizeStr))
+
+		if err != nil || binSize <= 0 {
+			panic(fmt.Sprintf("Error with -bin_size %s. Should be one or multiple positive int separated by comma (ex: 5000,50000,500000)",
+				BINSIZESTR))
+		}
 
-	switch MATRIXFORMAT {
-	case mtx:
-		writeIntMatrixToCOOFile(FILENAMEOUT, true)
-	case coo:
-		writeIntMatrixToCOOFile(FILENAMEOUT, false)
-	case taiji:
-		writeIntMatrixToTaijiFile(FILENAMEOUT, true)
-	case dense:
-		writeIntMatrixToDenseFile(FILENAMEOUT, true)
-	case denseTranspose:
-		writeIntMatrixToDenseTransposeFile(FILENAMEOUT)
+		binSizes = append(binSizes, binSize)
 	}
+
+	return binSizes
+}
+
+/*loadChrSizes load the chromosome size file (<chr><TAB><size>) used to create genome-wide fixed bins */
+func loadChrSizes() {
+	var split []string
+	var chrsize int
+	var err error
+
+	if CHRSIZEFILE == "" {
+		return
+	}
+
+	CHRSIZES = make(map[string]int)
+	CHRLIST = []string{}
+
+	scanner, file := CHRSIZEFILE.ReturnReader(0)
+	defer utils.CloseFile(file)
+
+	for scanner.Scan() {
+		split = strings.Split(strings.ReplaceAll(scanner.Text(), " ", "\t"), "\t")
+
+		if len(split) < 2 || split[0] == "" || split[0][0] == '#' {
+			continue
+		}
+
+		chrsize, err = strconv.Atoi(split[1])
+
+		if err != nil {
+			panic(fmt.Sprintf("Error with chromosome size file (%s) line: %s trying to convert %s to int",
+				CHRSIZEFILE, scanner.Text(), split[1]))
+		}
+
+		if _, isInside := CHRSIZES[split[0]];!isInside {
+			CHRLIST = append(CHRLIST, split[0])
+		}
+
+		CHRSIZES[split[0]] = chrsize
+	}
+}
+
+/*initBinResolutions create one sparse matrix and one bin index per bin size.
+If chromosome sizes are provided, all the genomic bins are indexed beforehand*/
+func initBinResolutions() {
+	BINRESOLUTIONS = []*binResolution{}
+
+	for _, binSize := range loadBinSizes() {
+		initIntSparseMatrix()
+
+		res := &binResolution{
+			binSize: binSize,
+			binIndex: make(map[binPos]uint),
+			matrix: INTSPARSEMATRIX,
+		}
+
+		for _, chr := range CHRLIST {
+			for index := 0; index * binSize < CHRSIZES[chr]; index++ {
+				res.binIndex[binPos{chr: chr, index: index}] = uint(len(res.binList))
+				res.binList = append(res.binList, binPos{chr: chr, index: index})
+			}
+		}
+
+		BINRESOLUTIONS = append(BINRESOLUTIONS, res)
+	}
+
+	BINSIZE = BINRESOLUTIONS[0].binSize
+}
+
+/*addCount add one count for the cell in the bin containing the genomic position.
+When fixed bins are used, positions outside the indexed bins are ignored */
+func (res *binResolution) addCount(cellID uint, chr string, pos int) {
+	bin := binPos{chr: chr, index: pos / res.binSize}
+	featureID, isInside := res.binIndex[bin]
+
+	if !isInside {
+		if CHRSIZEFILE != "" {
+			return
+		}
+
+		featureID = uint(len(res.binList))
+		res.binIndex[bin] = featureID
+		res.binList = append(res.binList, bin)
+	}
+
+	res.matrix[cellID][featureID]++
+}
+
+/*returnBinResolutionFilename add the bin size to the file name when multiple bin sizes are used */
+func returnBinResolutionFilename(filename string, binSize int) string {
+	if len(BINRESOLUTIONS) < 2 {
+		return filename
+	}
+
+	ext := path.Ext(filename)
+
+	return fmt.Sprintf("%s.bin%d%s", filename[:len(filename) - len(ext)], binSize, ext)
+}
+
+/*binCoordinates return the genomic start and end of a bin. The end is bounded by the chromosome size if known */
+func binCoordinates(bin binPos, binSize int) (start, end int) {
+	start = bin.index * binSize
+	end = start + binSize
+
+	if chrsize, isInside := CHRSIZES[bin.chr];isInside && end > chrsize {
+		end = chrsize
+	}
+
+	return start, end
 }
 
 func scanBedFileForBinMat() {
 	var line string
 	var split []string
 	var isInside bool
-	var cellID, featureID, count uint
-	var pos, index int
+	var cellID uint
+	var pos, start, end int
 	var err error
-	var bin binPos
+	var res *binResolution
 
-	binList := []binPos{}
 	tStart := time.Now()
 	fmt.Printf("Scanning bed file...\n")
 
@@ -86,40 +243,33 @@ func scanBedFileForBinMat() {
 			continue
 		}
 
-		pos, err = strconv.Atoi(split[1])
+		start, err = strconv.Atoi(split[1])
 		utils.Check(err)
 
-		index = (pos) / BINSIZE
-
-		bin.chr = split[0]
-		bin.index = index
-
-		if featureID, isInside = BININDEX[bin];!isInside {
-			featureID = count
-			BININDEX[bin] = count
-			binList = append(binList, bin)
-			count++
+		if CUTSITES {
+			end, err = strconv.Atoi(split[2])
+			utils.Check(err)
 		}
 
 		if NORM {
 			TOTALREADSCELL[cellID]++
 		}
 
-		INTSPARSEMATRIX[cellID][featureID]++
+		for _, pos = range getFragmentBinPositions(start, end) {
+			for _, res = range BINRESOLUTIONS {
+				res.addCount(cellID, split[0], pos)
+			}
+		}
 	}
 
-	YGIDIM = len(binList)
-
 	tDiff := time.Since(tStart)
 	fmt.Printf("Scanning done in time: %f s \n", tDiff.Seconds())
-
-	writeBinList(binList)
 }
 
 
-func writeBinList(binList []binPos) {
+func writeBinList(res *binResolution) {
 	var bin binPos
-	var index int
+	var start, end int
 	var outfname string
 
 	if YGIOUT != "" {
@@ -130,19 +280,21 @@ func writeBinList(binList []binPos) {
 		CELLSIDFNAME[:len(CELLSIDFNAME) - len(ext)])
 	}
 
+	outfname = returnBinResolutionFilename(outfname, res.binSize)
+
 	var buffer bytes.Buffer
 
 	writer := utils.ReturnWriter(outfname)
 	defer utils.CloseFile(writer)
 
-	for _, bin = range binList {
-		index = int(bin.index) * BINSIZE
+	for _, bin = range res.binList {
+		start, end = binCoordinates(bin, res.binSize)
 
 		buffer.WriteString(bin.chr)
 		buffer.WriteRune('\t')
-		buffer.WriteString(strconv.Itoa(index))
+		buffer.WriteString(strconv.Itoa(start))
 		buffer.WriteRune('\t')
-		buffer.WriteString(strconv.Itoa(index + BINSIZE))
+		buffer.WriteString(strconv.Itoa(end))
 		buffer.WriteRune('\n')
 	}
 
@@ -152,6 +304,7 @@ func writeBinList(binList []binPos) {
 	fmt.Printf("File %s written!\n", outfname)
 }
 
+/*createBinSparseMatrixOneFileThreading fill the matrices of all the bin sizes in one pass of the bed file */
 func createBinSparseMatrixOneFileThreading(bedfilename utils.Filename) {
 	var nbReads uint
 	var bufferLine1 [BUFFERSIZE]string
@@ -181,6 +334,7 @@ func createBinSparseMatrixOneFileThreading(bedfilename utils.Filename) {
 			bufferStop := chunk
 
 			for i := 0; i < THREADNB;i++{
+				waiting.Add(1)
 				go updateBinSparseMatrixOneThread(bufferPointer , bufferStart, bufferStop, i, &waiting)
 
 				bufferStart += chunk
@@ -211,35 +365,6 @@ func createBinSparseMatrixOneFileThreading(bedfilename utils.Filename) {
 		waiting.Add(1)
 		updateBinSparseMatrixOneThread(bufferPointer , 0, bufferIt, 0, &waiting)
 	}
-
-	sortBinIndexAndwrite()
-
-}
-
-func sortBinIndexAndwrite() {
-	type binSort struct {
-		bin binPos
-		indexMat uint
-	}
-
-	binList := []binSort{}
-
-	for bin, indexMat := range BININDEX {
-		binList = append(binList, binSort{bin:bin, indexMat:indexMat})
-	}
-
-	sort.Slice(binList, func(i, j int) bool {
-		return binList[i].indexMat < binList[j].indexMat
-	})
-
-	binListReady := make([]binPos, len(binList))
-
-	for i, binsort := range binList {
-		binListReady[i] = binsort.bin
-	}
-
-	writeBinList(binListReady)
-
 }
 
 func updateBinSparseMatrixOneThread(bufferLine * [BUFFERSIZE]string, bufferStart ,bufferStop, threadnb int,
@@ -249,20 +374,23 @@ func updateBinSparseMatrixOneThread(bufferLine * [BUFFERSIZE]string, bufferStart
 	var isInside bool
 	var start, end int
 	var err error
-	var bin binPos
-	var index int
-	var featureID, cellID uint
+	var pos int
+	var cellID uint
+	var res *binResolution
 
-	waiting.Add(1)
 	var intervals []interval.IntInterface
 
 	type tmpMatUnit struct {
-		bin binPos
+		chr string
+		pos int
 		cellID uint
 	}
 
 	var tmpResult []tmpMatUnit
 	var oneFeat tmpMatUnit
+	var fragmentCells []uint
+
+	usePeaks := PEAKFILE != ""
 
 	for i := bufferStart; i < bufferStop;i++ {
 
@@ -278,43 +406,54 @@ func updateBinSparseMatrixOneThread(bufferLine * [BUFFERSIZE]string, bufferStart
 		end, err = strconv.Atoi(split[2])
 		utils.Check(err)
 
-		if _, isInside = utils.CHRINTERVALDICT[split[0]];!isInside {
-			continue
-		}
+		if usePeaks {
+			if _, isInside = utils.CHRINTERVALDICT[split[0]];!isInside {
+				continue
+			}
 
-		intervals = utils.CHRINTERVALDICTTHREAD[threadnb][split[0]].Get(
-			utils.IntInterval{Start: start, End: end})
+			intervals = getFragmentIntervals(
+				utils.CHRINTERVALDICTTHREAD[threadnb][split[0]], start, end)
 
-		if len(intervals) == 0 {
-			continue
+			if len(intervals) == 0 {
+				continue
+			}
 		}
 
-		index = (start) / BINSIZE
-
-		bin.chr = split[0]
-		bin.index = index
+		if NORM {
+			fragmentCells = append(fragmentCells, cellID)
+		}
 
-		oneFeat.bin = bin
-		oneFeat.cellID = cellID
+		for _, pos = range getFragmentBinPositions(start, end) {
+			oneFeat.chr = split[0]
+			oneFeat.pos = pos
+			oneFeat.cellID = cellID
 
-		tmpResult = append(tmpResult, oneFeat)
+			tmpResult = append(tmpResult, oneFeat)
+		}
 	}
 
 	BININDEXMUTEX.Lock()
 
 	for _, oneFeat = range tmpResult {
-		if featureID, isInside = BININDEX[bin];!isInside {
-			featureID = BININDEXCOUNT
-			BININDEX[bin] = BININDEXCOUNT
-			BININDEXCOUNT++
-		}
-
-		if NORM {
-			TOTALREADSCELL[cellID]++
+		for _, res = range BINRESOLUTIONS {
+			res.addCount(oneFeat.cellID, oneFeat.chr, oneFeat.pos)
 		}
+	}
 
-		INTSPARSEMATRIX[cellID][featureID]++
+	for _, cellID = range fragmentCells {
+		TOTALREADSCELL[cellID]++
 	}
 
 	BININDEXMUTEX.Unlock()
 }
+
+/*getFragmentBinPositions return the genomic positions used to assign a fragment to bins: its start or, if CUTSITES is used, its two Tn5 insertions*/
+func getFragmentBinPositions(start, end int) []int {
+	if !CUTSITES {
+		return []int{start}
+	}
+
+	cut1, cut2 := utils.FragmentToCutSites(start, end, TN5SHIFT)
+
+	return []int{cut1, cut2}
+}
@@ -0,0 +1,227 @@
+/* Suite of functions dedicated to analyse TF motifs and sequence features of snATAC-Seq peaks */
+
+package main
+
+
+import(
+	"log"
+	"flag"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+	"fmt"
+	"time"
+	"os"
+)
+
+
+/*FASTAFILE indexed genome FASTA file */
+var FASTAFILE utils.Filename
+
+/*PEAKFILE file name file with ordered peaks (<chr><start><end>, one peak per line) */
+var PEAKFILE utils.Filename
+
+/*MOTIFFILES motif files (JASPAR, MEME or HOMER) */
+var MOTIFFILES utils.ArrayFlags
+
+/*MOTIFFORMAT format of the motif files (auto|jaspar|meme|homer) */
+var MOTIFFORMAT string
+
+/*FILENAMEOUT  output file name prefix */
+var FILENAMEOUT string
+
+/*PVALUE p-value threshold of the motif matches */
+var PVALUE float64
+
+/*GCBINS number of GC content bins used for the backgrounds */
+var GCBINS int
+
+/*MATRIXFILE input (cell x peak) matrix file (COO, mtx or binary from ATACMatUtils) */
+var MATRIXFILE utils.Filename
+
+/*CELLSIDFNAME file name file with ordered cell IDs (one ID per line) */
+var CELLSIDFNAME utils.Filename
+
+/*MATCHFILE sparse peak x motif match matrix (from -scan) */
+var MATCHFILE utils.Filename
+
+/*MOTIFNAMESFILE motif names of the match matrix (from -scan) */
+var MOTIFNAMESFILE utils.Filename
+
+/*ANNOTATIONBEDS bed files defining region sets (one set per file or per name in the 4th column) */
+var ANNOTATIONBEDS utils.ArrayFlags
+
+/*ITERATIONS number of background peak sets */
+var ITERATIONS int
+
+/*OUTPUTFORMAT format of the output matrices (coo|mtx|binary) */
+var OUTPUTFORMAT string
+
+/*NBBACKGROUND number of matched background peaks sampled per peak */
+var NBBACKGROUND int
+
+/*ACCESSIBILITYBINS number of accessibility bins used to define the GC x accessibility strata */
+var ACCESSIBILITYBINS int
+
+/*PVALUETABLE corrected p-value table of the significant peaks per cluster (ATACTopFeatures) */
+var PVALUETABLE utils.Filename
+
+/*PEAKGCFILE peak GC content and strata file (<out>.peaks_gc.bed from -gc) */
+var PEAKGCFILE utils.Filename
+
+/*BACKGROUNDFILE matched background peaks (<out>.background.bed from -gc) */
+var BACKGROUNDFILE utils.Filename
+
+/*BGRATIO number of background peaks sampled per foreground peak */
+var BGRATIO float64
+
+/*SEED  Seed used for random processes*/
+var SEED int64
+
+/*THREADNB number of threads */
+var THREADNB int
+
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `
+#################### SUITE OF FUNCTIONS TO ANALYSE TF MOTIFS AND SEQUENCE FEATURES OF PEAKS ########################
+
+"""Motif scanning: -scan """
+Scan the peaks of a ygi file with the log-odds PWMs of motif files (JASPAR, MEME or HOMER format, detected automatically).
+The peaks are split into -gc_bins GC content bins: the background of the log-odds scores and the score threshold corresponding
+to -pvalue (exact score distribution) are computed for each bin. The genome FASTA file is indexed (<fasta>.fai) if needed.
+
+USAGE: ATACMotifUtils -scan -fasta <genome.fa> -ygi <bedfile> -motifs <file> (optional -motifs <file2> ... -motif_format <auto|jaspar|meme|homer> -pvalue <float> -gc_bins <int> -out <string> -threads <int>)
+
+Output files:
+   <out>.motif_matches.coo: sparse peak x motif matrix: <peak index><TAB><motif index><TAB><number of matches> (peak indexes follow the ygi file)
+   <out>.motif_names.tsv: <motif ID><TAB><motif name><TAB><motif width> (one motif per line, motif index order)
+   <out>.motif_hits.bed: <chr><start><end><motif ID>_<motif name><score (bits)><strand>
+
+"""chromVAR-like deviations: -deviations """
+Compute for each cell and each annotation set (motif matches from -scan and/or region sets from bed files) the bias corrected deviation
+of the accessibility compared to the expected accessibility, and its z-score. -iterations background peak sets matched on GC content
+and mean accessibility are sampled to correct the deviations (deviation - mean background deviation) and to compute the z-scores.
+Alternatively, the background peaks sampled by -gc (same GC x accessibility stratum) can be used with -background instead of -fasta:
+the number of background peak sets is then the number of background peaks per peak of the file.
+
+USAGE: ATACMotifUtils -deviations -in <matrix> -xgi <fname> -ygi <bedfile> (-fasta <genome.fa> or -background <bed>) (-matches <coo> -motif_names <tsv> and/or -annotation_bed <bed>) (optional -iterations <int> -format <coo|mtx|binary> -seed <int> -out <string> -threads <int>)
+
+Output files:
+   <out>.deviations.<format>: cell x annotation bias corrected deviations
+   <out>.zscores.<format>: cell x annotation deviation z-scores
+   <out>.annotations.ygi: annotation names (column order)
+
+"""GC content and matched background peaks: -gc """
+Compute the GC fraction and the CpG density (CpG per bp) of each peak. The peaks are stratified into -gc_bins x -accessibility_bins
+quantile bins of GC content and mean accessibility (from the optional -in matrix) and -nb_background background peaks
+of the same stratum are sampled for each peak.
+
+USAGE: ATACMotifUtils -gc -fasta <genome.fa> -ygi <bedfile> (optional -in <matrix> -nb_background <int> -gc_bins <int> -accessibility_bins <int> -seed <int> -out <string>)
+
+Output files:
+   <out>.peaks_gc.bed: <chr><start><end><GC><CpG density><mean accessibility><stratum> (ygi order)
+   <out>.background.bed: <background chr><start><end><matched peak chr:start-end><sample>
+
+"""Motif enrichment of the significant peaks per cluster: -enrichment """
+Test the enrichment of the motifs (-matches and -motif_names from -scan) in the significant peaks with an odd ratio > 1 of each cluster
+(corrected p-value table or -da table from ATACTopFeatures, log2FC > 0) with a one-sided Fisher exact test (hypergeometric). The background is sampled from
+the other peaks of -ygi with the same strata distribution than the foreground: strata from -peaks_gc (output of -gc) or -gc_bins GC content bins
+computed with -fasta. -bg_ratio background peaks are sampled per foreground peak (less if a stratum has not enough peaks).
+The p-values are corrected per cluster with the Benjamini-Hochberg procedure.
+
+USAGE: ATACMotifUtils -enrichment -table <tsv> -ygi <bedfile> -matches <coo> -motif_names <tsv> (-peaks_gc <bed> or -fasta <genome.fa>) (optional -bg_ratio <float> -gc_bins <int> -seed <int> -out <string>)
+
+Output files:
+   <out>.<cluster>.motif_enrichment.tsv: <motif><nb foreground peaks><foreground fraction><nb background peaks><background fraction><fold><oddRatio><pvalue><qvalue> (sorted by p-value)
+
+`)
+		 flag.PrintDefaults()
+	}
+
+	var scan, deviations, gc, enrichment bool
+
+	flag.BoolVar(&scan, "scan", false, "scan the peaks with motif PWMs")
+	flag.BoolVar(&deviations, "deviations", false, "compute chromVAR-like deviations per cell and annotation set")
+	flag.BoolVar(&gc, "gc", false, "compute the GC content of the peaks and sample matched background peaks")
+	flag.BoolVar(&enrichment, "enrichment", false, "test the motif enrichment of the significant peaks of each cluster")
+	flag.Var(&FASTAFILE, "fasta", "indexed genome FASTA file (the .fai index is created if missing)")
+	flag.Var(&PEAKFILE, "ygi", "bed file with the ordered peaks")
+	flag.Var(&MOTIFFILES, "motifs", "motif file(s) (JASPAR, MEME or HOMER format)")
+	flag.StringVar(&MOTIFFORMAT, "motif_format", "auto", "format of the motif files: auto|jaspar|meme|homer")
+	flag.StringVar(&FILENAMEOUT, "out", "motifs", "prefix of the output files")
+	flag.Float64Var(&PVALUE, "pvalue", 5e-5, "p-value threshold of the motif matches")
+	flag.IntVar(&GCBINS, "gc_bins", 10, "number of GC content bins used for the backgrounds (-scan) or the strata (-gc)")
+	flag.Var(&MATRIXFILE, "in", "name of the input (cell x peak) matrix file (COO, mtx or binary)")
+	flag.Var(&CELLSIDFNAME, "xgi", "name of the file containing the ordered list of cell IDs (one ID per line). Optional for binary matrices")
+	flag.Var(&MATCHFILE, "matches", "sparse peak x motif match matrix (<out>.motif_matches.coo from -scan)")
+	flag.Var(&MOTIFNAMESFILE, "motif_names", "motif names of the match matrix (<out>.motif_names.tsv from -scan)")
+	flag.Var(&ANNOTATIONBEDS, "annotation_bed", "bed file(s) defining region sets (one set per file or per name in the 4th column)")
+	flag.IntVar(&ITERATIONS, "iterations", 50, "number of background peak sets")
+	flag.StringVar(&OUTPUTFORMAT, "format", "coo", "format of the output matrices: coo|mtx|binary")
+	flag.IntVar(&NBBACKGROUND, "nb_background", 50, "number of matched background peaks sampled per peak (-gc)")
+	flag.IntVar(&ACCESSIBILITYBINS, "accessibility_bins", 10, "number of accessibility bins used to define the strata (-gc)")
+	flag.Var(&PVALUETABLE, "table", "corrected p-value table of the significant peaks per cluster (ATACTopFeatures)")
+	flag.Var(&PEAKGCFILE, "peaks_gc", "peak GC content and strata file (<out>.peaks_gc.bed from -gc) used for the background (-enrichment)")
+	flag.Var(&BACKGROUNDFILE, "background", "matched background peaks (<out>.background.bed from -gc) used instead of -fasta (-deviations)")
+	flag.Float64Var(&BGRATIO, "bg_ratio", 5.0, "number of background peaks sampled per foreground peak (-enrichment)")
+	flag.Int64Var(&SEED, "seed", 2020, "Seed used for random processes")
+	flag.IntVar(&THREADNB, "threads", 1, "threads concurrency")
+	flag.Parse()
+
+	tStart := time.Now()
+
+	switch {
+	case scan:
+		switch {
+		case FASTAFILE == "" || PEAKFILE == "" || len(MOTIFFILES) == 0:
+			log.Fatal("Error -fasta, -ygi and -motifs must be provided!")
+		case PVALUE <= 0 || PVALUE >= 1:
+			log.Fatal("Error -pvalue must be in ]0, 1[!")
+		case GCBINS <= 0 || THREADNB <= 0:
+			log.Fatal("Error -gc_bins and -threads must be positive numbers!")
+		}
+
+		scanPeaks()
+	case deviations:
+		switch {
+		case MATRIXFILE == "" || PEAKFILE == "":
+			log.Fatal("Error -in and -ygi must be provided!")
+		case FASTAFILE == "" && BACKGROUNDFILE == "":
+			log.Fatal("Error -fasta or -background must be provided!")
+		case MATCHFILE == "" && len(ANNOTATIONBEDS) == 0:
+			log.Fatal("Error -matches or -annotation_bed must be provided!")
+		case ITERATIONS <= 1 || THREADNB <= 0:
+			log.Fatal("Error -iterations must be > 1 and -threads must be a positive number!")
+		case OUTPUTFORMAT != "coo" && OUTPUTFORMAT != "mtx" && OUTPUTFORMAT != "binary":
+			log.Fatal("Error -format must be coo, mtx or binary!")
+		}
+
+		computeDeviations()
+	case gc:
+		switch {
+		case FASTAFILE == "" || PEAKFILE == "":
+			log.Fatal("Error -fasta and -ygi must be provided!")
+		case GCBINS <= 0 || ACCESSIBILITYBINS <= 0 || NBBACKGROUND < 0:
+			log.Fatal("Error -gc_bins, -accessibility_bins and -nb_background must be positive numbers!")
+		}
+
+		computeGCAndBackground()
+	case enrichment:
+		switch {
+		case PVALUETABLE == "" || PEAKFILE == "" || MATCHFILE == "" || MOTIFNAMESFILE == "":
+			log.Fatal("Error -table, -ygi, -matches and -motif_names must be provided!")
+		case PEAKGCFILE == "" && FASTAFILE == "":
+			log.Fatal("Error -peaks_gc or -fasta must be provided!")
+		case BGRATIO <= 0 || GCBINS <= 0:
+			log.Fatal("Error -bg_ratio and -gc_bins must be positive numbers!")
+		}
+
+		computeMotifEnrichment()
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	tDiff := time.Since(tStart)
+	fmt.Printf("done in time: %f s \n", tDiff.Seconds())
+}
@@ -0,0 +1,231 @@
+/* Background peaks matched on GC content and accessibility (chromVAR procedure) */
+
+package main
+
+
+import(
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+)
+
+
+/*BACKGROUNDBINS number of bins per dimension of the GC x accessibility grid */
+const BACKGROUNDBINS = 50
+
+/*BACKGROUNDWIDTH standard deviation of the gaussian weights between the bins of the grid */
+const BACKGROUNDWIDTH = 0.1
+
+/*selectBackgroundPeaks sample nbBackgrounds background peaks for each peak.
+The (log accessibility, GC) values are decorrelated with the Cholesky decomposition of their covariance and binned in a grid.
+The bin of a background peak is sampled with a gaussian weight of its distance to the bin of the peak and the background peak is chosen uniformly in the bin */
+func selectBackgroundPeaks(gc, intensity []float64, nbBackgrounds int, random *rand.Rand) (backgrounds [][]int) {
+	n := len(gc)
+	coords := decorrelate(intensity, gc)
+
+	var mins, maxs [2]float64
+
+	for dim := range mins {
+		mins[dim], maxs[dim] = math.Inf(1), math.Inf(-1)
+
+		for _, coord := range coords {
+			mins[dim] = math.Min(mins[dim], coord[dim])
+			maxs[dim] = math.Max(maxs[dim], coord[dim])
+		}
+	}
+
+	binPeaks := make(map[int][]int)
+
+	for i, coord := range coords {
+		bin := 0
+
+		for dim := range coord {
+			pos := 0
+
+			if maxs[dim] > mins[dim] {
+				pos = int(math.Round((coord[dim] - mins[dim]) / (maxs[dim] - mins[dim]) * (BACKGROUNDBINS - 1)))
+			}
+
+			bin = bin * BACKGROUNDBINS + pos
+		}
+
+		binPeaks[bin] = append(binPeaks[bin], i)
+	}
+
+	bins := make([]int, 0, len(binPeaks))
+
+	for bin := range binPeaks {
+		bins = append(bins, bin)
+	}
+
+	sort.Ints(bins)
+
+	binCenter := func(bin int) (center [2]float64) {
+		positions := [2]int{bin / BACKGROUNDBINS, bin % BACKGROUNDBINS}
+
+		for dim := range center {
+			center[dim] = mins[dim] + float64(positions[dim]) * (maxs[dim] - mins[dim]) / (BACKGROUNDBINS - 1)
+		}
+
+		return center
+	}
+
+	backgrounds = make([][]int, n)
+
+	for _, bin := range bins {
+		center := binCenter(bin)
+		cumulWeights := make([]float64, len(bins))
+		cumul := 0.0
+
+		for pos, other := range bins {
+			otherCenter := binCenter(other)
+			dist2 := (center[0] - otherCenter[0]) * (center[0] - otherCenter[0]) +
+				(center[1] - otherCenter[1]) * (center[1] - otherCenter[1])
+			cumul += math.Exp(-dist2 / (2 * BACKGROUNDWIDTH * BACKGROUNDWIDTH))
+			cumulWeights[pos] = cumul
+		}
+
+		for _, peak := range binPeaks[bin] {
+			backgrounds[peak] = make([]int, nbBackgrounds)
+
+			for iter := range backgrounds[peak] {
+				pos := sort.SearchFloat64s(cumulWeights, random.Float64() * cumul)
+
+				if pos >= len(bins) {
+					pos = len(bins) - 1
+				}
+
+				candidates := binPeaks[bins[pos]]
+				backgrounds[peak][iter] = candidates[random.Intn(len(candidates))]
+			}
+		}
+	}
+
+	return backgrounds
+}
+
+/*decorrelate transform the (x, y) points with the inverse of the Cholesky factor of their covariance */
+func decorrelate(x, y []float64) (coords [][2]float64) {
+	var meanX, meanY, varX, varY, cov float64
+
+	n := float64(len(x))
+
+	for i := range x {
+		meanX += x[i] / n
+		meanY += y[i] / n
+	}
+
+	for i := range x {
+		varX += (x[i] - meanX) * (x[i] - meanX) / n
+		varY += (y[i] - meanY) * (y[i] - meanY) / n
+		cov += (x[i] - meanX) * (y[i] - meanY) / n
+	}
+
+	// covariance = R^T R with R = [[a, b], [0, c]]
+	a := math.Sqrt(varX)
+
+	if a == 0 {
+		a = 1
+	}
+
+	b := cov / a
+	c := math.Sqrt(varY - b * b)
+
+	if c == 0 || math.IsNaN(c) {
+		c = 1
+	}
+
+	coords = make([][2]float64, len(x))
+
+	for i := range x {
+		coords[i][0] = x[i] / a
+		coords[i][1] = (y[i] - x[i] * b / a) / c
+	}
+
+	return coords
+}
+
+/*loadBackgroundPeaks load the matched background peaks of -gc (<out>.background.bed) as peak indexes of -ygi.
+Return the backgrounds per peak and the number of background samples. The peaks without background (stratum with a single peak)
+are their own background */
+func loadBackgroundPeaks(fname utils.Filename, peaks []utils.Peak) (backgrounds [][]int, nbSamples int) {
+	peakIndex := make(map[string]int, len(peaks))
+
+	for i := range peaks {
+		peakIndex[fmt.Sprintf("%s:%d-%d", peaks[i].Chr(), peaks[i].Start, peaks[i].End)] = i
+	}
+
+	backgrounds = make([][]int, len(peaks))
+
+	scanner, file := fname.ReturnReader(0)
+	defer utils.CloseFile(file)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		split := strings.Split(line, "\t")
+
+		if len(split) < 5 {
+			log.Fatal(fmt.Sprintf("Error line: %s from %s must have 5 columns (output of -gc)", line, fname))
+		}
+
+		bg, isInside := peakIndex[fmt.Sprintf("%s:%s-%s", split[0], split[1], split[2])]
+		peak, isPeakInside := peakIndex[split[3]]
+
+		if !isInside || !isPeakInside {
+			log.Fatal(fmt.Sprintf("Error line: %s from %s has a peak not found in -ygi", line, fname))
+		}
+
+		sample, err := strconv.Atoi(split[4])
+		utils.Check(err)
+
+		if sample != len(backgrounds[peak]) {
+			log.Fatal(fmt.Sprintf("Error line: %s from %s: the background samples of a peak must be consecutive and start at 0", line, fname))
+		}
+
+		backgrounds[peak] = append(backgrounds[peak], bg)
+	}
+
+	for i := range backgrounds {
+		if len(backgrounds[i]) > nbSamples {
+			nbSamples = len(backgrounds[i])
+		}
+	}
+
+	nbUnmatched := 0
+
+	for i := range backgrounds {
+		switch len(backgrounds[i]) {
+		case nbSamples:
+		case 0:
+			nbUnmatched++
+			backgrounds[i] = make([]int, nbSamples)
+
+			for sample := range backgrounds[i] {
+				backgrounds[i][sample] = i
+			}
+		default:
+			log.Fatal(fmt.Sprintf("Error peak %s has %d background peaks in %s instead of %d",
+				peaks[i].PeakToString(), len(backgrounds[i]), fname, nbSamples))
+		}
+	}
+
+	if nbSamples < 2 {
+		log.Fatal(fmt.Sprintf("Error %s must have at least 2 background peaks per peak", fname))
+	}
+
+	if nbUnmatched > 0 {
+		fmt.Printf("%d peaks without background are used as their own background\n", nbUnmatched)
+	}
+
+	return backgrounds, nbSamples
+}
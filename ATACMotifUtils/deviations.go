@@ -0,0 +1,428 @@
+/* chromVAR-like bias corrected deviations of the accessibility of annotation sets (motifs or region sets) */
+
+package main
+
+
+import(
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"path"
+	"strconv"
+	"strings"
+	"github.com/biogo/store/interval"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+)
+
+
+/*computeDeviations compute the per-cell deviations and z-scores of each annotation set */
+func computeDeviations() {
+	random := rand.New(rand.NewSource(SEED))
+
+	peaks := loadPeakList(PEAKFILE)
+
+	var cells []string
+
+	if CELLSIDFNAME != "" {
+		cells = loadNames(CELLSIDFNAME)
+	}
+
+	fmt.Printf("loading matrix: %s...\n", MATRIXFILE)
+	matrix := utils.LoadSparseMatrix(string(MATRIXFILE), len(cells), len(peaks))
+
+	switch {
+	case matrix.NCols > len(peaks):
+		log.Fatal(fmt.Sprintf("Error the matrix has more columns (%d) than peaks in -ygi (%d)", matrix.NCols, len(peaks)))
+	case len(cells) == 0:
+		cells = matrix.RowNames
+	}
+
+	if len(cells) < len(matrix.Rows) {
+		log.Fatal("Error -xgi file must be provided!")
+	}
+
+	names, annotations := loadAnnotationSets(peaks)
+
+	peakCounts := make([]float64, len(peaks))
+	cellTotals := make([]float64, len(matrix.Rows))
+	total := 0.0
+
+	for i, row := range matrix.Rows {
+		for pos, peak := range row.Index {
+			peakCounts[peak] += row.Values[pos]
+			cellTotals[i] += row.Values[pos]
+			total += row.Values[pos]
+		}
+	}
+
+	if total == 0 {
+		log.Fatal("Error the matrix is empty!")
+	}
+
+	expected := make([]float64, len(peaks))
+	intensity := make([]float64, len(peaks))
+
+	for peak, count := range peakCounts {
+		expected[peak] = count / total
+		intensity[peak] = math.Log10(count + 1.0)
+	}
+
+	var backgrounds [][]int
+
+	if BACKGROUNDFILE != "" {
+		fmt.Printf("loading background peaks: %s...\n", BACKGROUNDFILE)
+		backgrounds, ITERATIONS = loadBackgroundPeaks(BACKGROUNDFILE, peaks)
+	} else {
+		gc := peakGCContent(peaks)
+
+		fmt.Printf("selecting %d background peaks per peak...\n", ITERATIONS)
+		backgrounds = selectBackgroundPeaks(gc, intensity, ITERATIONS, random)
+	}
+
+	nbCells, nbAnnotations := len(matrix.Rows), len(annotations)
+
+	observed := newDenseMatrix(nbCells, nbAnnotations)
+	bgSums := newDenseMatrix(nbCells, nbAnnotations)
+	bgSquares := newDenseMatrix(nbCells, nbAnnotations)
+
+	fmt.Printf("computing deviations for %d cells and %d annotations...\n", nbCells, nbAnnotations)
+
+	for iter := -1; iter < ITERATIONS; iter++ {
+		peakAnnotations := make([][]int, len(peaks))
+		annotExpected := make([]float64, nbAnnotations)
+
+		for annot, annotPeaks := range annotations {
+			for _, peak := range annotPeaks {
+				if iter >= 0 {
+					peak = backgrounds[peak][iter]
+				}
+
+				peakAnnotations[peak] = append(peakAnnotations[peak], annot)
+				annotExpected[annot] += expected[peak]
+			}
+		}
+
+		utils.ParallelFor(nbCells, THREADNB, func(cell int) {
+			if cellTotals[cell] == 0 {
+				return
+			}
+
+			counts := make([]float64, nbAnnotations)
+			row := matrix.Rows[cell]
+
+			for pos, peak := range row.Index {
+				for _, annot := range peakAnnotations[peak] {
+					counts[annot] += row.Values[pos]
+				}
+			}
+
+			for annot := range counts {
+				if annotExpected[annot] == 0 {
+					continue
+				}
+
+				deviation := counts[annot] / (cellTotals[cell] * annotExpected[annot]) - 1.0
+
+				if iter < 0 {
+					observed[cell][annot] = deviation
+				} else {
+					bgSums[cell][annot] += deviation
+					bgSquares[cell][annot] += deviation * deviation
+				}
+			}
+		})
+
+		if iter >= 0 {
+			fmt.Printf("\rbackground iteration: %d / %d", iter + 1, ITERATIONS)
+		}
+	}
+
+	fmt.Printf("\n")
+
+	zscores := newDenseMatrix(nbCells, nbAnnotations)
+
+	for cell := range observed {
+		for annot := range observed[cell] {
+			mean := bgSums[cell][annot] / float64(ITERATIONS)
+			variance := 0.0
+
+			if ITERATIONS > 1 {
+				variance = (bgSquares[cell][annot] - float64(ITERATIONS) * mean * mean) / float64(ITERATIONS - 1)
+			}
+
+			observed[cell][annot] -= mean
+
+			if variance > 0 {
+				zscores[cell][annot] = observed[cell][annot] / math.Sqrt(variance)
+			}
+		}
+	}
+
+	writeAnnotationNames(fmt.Sprintf("%s.annotations.ygi", FILENAMEOUT), names)
+	writeDenseMatrix(fmt.Sprintf("%s.deviations", FILENAMEOUT), observed, cells, names)
+	writeDenseMatrix(fmt.Sprintf("%s.zscores", FILENAMEOUT), zscores, cells, names)
+}
+
+func newDenseMatrix(nrows, ncols int) (matrix [][]float64) {
+	matrix = make([][]float64, nrows)
+
+	for i := range matrix {
+		matrix[i] = make([]float64, ncols)
+	}
+
+	return matrix
+}
+
+/*loadNames load the first tab-separated field of each line of an index file */
+func loadNames(fname utils.Filename) (names []string) {
+	scanner, file := fname.ReturnReader(0)
+	defer utils.CloseFile(file)
+
+	for scanner.Scan() {
+		names = append(names, strings.Split(scanner.Text(), "\t")[0])
+	}
+
+	return names
+}
+
+/*peakGCContent GC fraction of each peak */
+func peakGCContent(peaks []utils.Peak) (gc []float64) {
+	fasta := utils.OpenIndexedFasta(string(FASTAFILE))
+	defer fasta.Close()
+
+	gc = make([]float64, len(peaks))
+
+	for i := range peaks {
+		gc[i], _ = utils.GCContent(fasta.Fetch(peaks[i].Chr(), peaks[i].Start, peaks[i].End))
+	}
+
+	return gc
+}
+
+/*loadAnnotationSets load the peak indexes of each annotation from the motif matches (-matches) and the region sets (-annotation_bed) */
+func loadAnnotationSets(peaks []utils.Peak) (names []string, annotations [][]int) {
+	if MATCHFILE != "" {
+		names, annotations = loadMotifMatches(len(peaks))
+	}
+
+	if len(ANNOTATIONBEDS) > 0 {
+		bedNames, bedAnnotations := loadRegionSets(peaks)
+		names = append(names, bedNames...)
+		annotations = append(annotations, bedAnnotations...)
+	}
+
+	kept := 0
+
+	for i := range annotations {
+		if len(annotations[i]) > 0 {
+			names[kept], annotations[kept] = names[i], annotations[i]
+			kept++
+		}
+	}
+
+	if kept < len(annotations) {
+		fmt.Printf("%d annotations without peak removed\n", len(annotations) - kept)
+	}
+
+	if kept == 0 {
+		log.Fatal("Error no annotation with at least one peak!")
+	}
+
+	return names[:kept], annotations[:kept]
+}
+
+/*loadMotifMatches load the sparse peak x motif matrix (<peak index><motif index><value>) and the motif names */
+func loadMotifMatches(nbPeaks int) (names []string, annotations [][]int) {
+	if MOTIFNAMESFILE != "" {
+		scanner, file := MOTIFNAMESFILE.ReturnReader(0)
+
+		for scanner.Scan() {
+			split := strings.Split(scanner.Text(), "\t")
+			name := split[0]
+
+			if len(split) > 1 && split[1] != split[0] {
+				name = fmt.Sprintf("%s_%s", split[0], split[1])
+			}
+
+			names = append(names, name)
+		}
+
+		utils.CloseFile(file)
+	}
+
+	matches := utils.LoadSparseMatrix(string(MATCHFILE), nbPeaks, len(names))
+
+	for len(names) < matches.NCols {
+		names = append(names, fmt.Sprintf("annotation_%d", len(names)))
+	}
+
+	annotations = make([][]int, len(names))
+
+	for peak, row := range matches.Rows {
+		for pos, annot := range row.Index {
+			if row.Values[pos] > 0 {
+				annotations[annot] = append(annotations[annot], peak)
+			}
+		}
+	}
+
+	return names, annotations
+}
+
+/*loadRegionSets peaks overlapping the regions of each bed file (one set per file or per name if the bed file has a 4th column) */
+func loadRegionSets(peaks []utils.Peak) (names []string, annotations [][]int) {
+	trees := make(map[string]*interval.IntTree)
+
+	for i := range peaks {
+		if trees[peaks[i].Chr()] == nil {
+			trees[peaks[i].Chr()] = &interval.IntTree{}
+		}
+
+		inter := utils.IntInterval{Start: peaks[i].Start, End: peaks[i].End - 1}
+		inter.UID = uintptr(i)
+		utils.Check(trees[peaks[i].Chr()].Insert(inter, false))
+	}
+
+	for _, bedfile := range ANNOTATIONBEDS {
+		sets := make(map[string]map[int]bool)
+		var setNames []string
+		defaultName := strings.TrimSuffix(path.Base(bedfile), path.Ext(bedfile))
+
+		scanner, file := utils.ReturnReader(bedfile, 0)
+
+		for scanner.Scan() {
+			line := scanner.Text()
+
+			if len(line) == 0 || line[0] == '#' {
+				continue
+			}
+
+			split := strings.Split(line, "\t")
+
+			if len(split) < 3 {
+				log.Fatal(fmt.Sprintf("Error line: %s from %s is not a bed line", line, bedfile))
+			}
+
+			name := defaultName
+
+			if len(split) > 3 {
+				name = split[3]
+			}
+
+			if sets[name] == nil {
+				sets[name] = make(map[int]bool)
+				setNames = append(setNames, name)
+			}
+
+			start, err := strconv.Atoi(split[1])
+			utils.Check(err)
+			end, err := strconv.Atoi(split[2])
+			utils.Check(err)
+
+			if tree, isInside := trees[split[0]]; isInside {
+				for _, inter := range tree.Get(utils.IntInterval{Start: start, End: end - 1}) {
+					sets[name][int(inter.ID())] = true
+				}
+			}
+		}
+
+		utils.CloseFile(file)
+
+		for _, name := range setNames {
+			set := make([]int, 0, len(sets[name]))
+
+			for peak := range sets[name] {
+				set = append(set, peak)
+			}
+
+			names = append(names, name)
+			annotations = append(annotations, set)
+		}
+	}
+
+	return names, annotations
+}
+
+/*writeAnnotationNames write the annotation names (one per line, column order of the output matrices) */
+func writeAnnotationNames(fname string, names []string) {
+	writer := utils.ReturnWriter(fname)
+	defer utils.CloseFile(writer)
+
+	_, err := writer.Write([]byte(strings.Join(names, "\n") + "\n"))
+	utils.Check(err)
+}
+
+/*writeDenseMatrix write a cell x annotation matrix (non-zero values) in the OUTPUTFORMAT format (coo, mtx or binary) */
+func writeDenseMatrix(prefix string, matrix [][]float64, cells, names []string) {
+	var buffer bytes.Buffer
+	var err error
+	var nbEntries int
+
+	fname := fmt.Sprintf("%s.%s", prefix, OUTPUTFORMAT)
+
+	if OUTPUTFORMAT == "binary" {
+		sparse := utils.SparseMatrix{
+			NRows: len(matrix), NCols: len(names), RowNames: cells[:len(matrix)], ColNames: names,
+			Rows: make([]utils.SparseVector, len(matrix))}
+
+		for i := range matrix {
+			for j, value := range matrix[i] {
+				if value != 0 {
+					sparse.Rows[i].Index = append(sparse.Rows[i].Index, uint32(j))
+					sparse.Rows[i].Values = append(sparse.Rows[i].Values, value)
+				}
+			}
+		}
+
+		utils.WriteBinaryMatrix(fname, &sparse)
+		fmt.Printf("matrix written in: %s\n", fname)
+
+		return
+	}
+
+	if OUTPUTFORMAT == "mtx" {
+		for i := range matrix {
+			for _, value := range matrix[i] {
+				if value != 0 {
+					nbEntries++
+				}
+			}
+		}
+	}
+
+	writer := utils.ReturnWriter(fname)
+	defer utils.CloseFile(writer)
+
+	if OUTPUTFORMAT == "mtx" {
+		buffer.WriteString(fmt.Sprintf("%%%%MatrixMarket matrix coordinate real general\n%%\n%d\t%d\t%d\n",
+			len(matrix), len(names), nbEntries))
+	}
+
+	for i := range matrix {
+		for j, value := range matrix[i] {
+			if value == 0 {
+				continue
+			}
+
+			buffer.WriteString(strconv.Itoa(i))
+			buffer.WriteRune('\t')
+			buffer.WriteString(strconv.Itoa(j))
+			buffer.WriteRune('\t')
+			buffer.WriteString(strconv.FormatFloat(value, 'g', 7, 64))
+			buffer.WriteRune('\n')
+		}
+
+		if buffer.Len() > 1000000 {
+			_, err = writer.Write(buffer.Bytes())
+			utils.Check(err)
+			buffer.Reset()
+		}
+	}
+
+	_, err = writer.Write(buffer.Bytes())
+	utils.Check(err)
+
+	fmt.Printf("matrix written in: %s\n", fname)
+}
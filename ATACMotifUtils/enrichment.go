@@ -0,0 +1,261 @@
+/* Motif enrichment of the significant peaks of each cluster (ATACTopFeatures) against GC matched backgrounds */
+
+package main
+
+
+import(
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+)
+
+
+/*motifEnrichment result of the enrichment test of one motif for one cluster */
+type motifEnrichment struct {
+	motif int
+	nbForeground, nbBackground int
+	fgFraction, bgFraction float64
+	fold, oddRatio, pvalue, qvalue float64
+}
+
+/*computeMotifEnrichment test the enrichment of the motifs in the significant peaks of each cluster */
+func computeMotifEnrichment() {
+	random := rand.New(rand.NewSource(SEED))
+
+	peaks := loadPeakList(PEAKFILE)
+	names, motifPeaks := loadMotifMatches(len(peaks))
+	strata := loadPeakStrata(peaks)
+	clusterPeaks := loadSignificantPeaks()
+
+	clusters := make([]string, 0, len(clusterPeaks))
+
+	for cluster := range clusterPeaks {
+		clusters = append(clusters, cluster)
+	}
+
+	sort.Strings(clusters)
+
+	peakMotifs := make([][]int, len(peaks))
+
+	for motif, motifPeakList := range motifPeaks {
+		for _, peak := range motifPeakList {
+			peakMotifs[peak] = append(peakMotifs[peak], motif)
+		}
+	}
+
+	for _, cluster := range clusters {
+		foreground := clusterPeaks[cluster]
+		background := sampleMatchedBackground(foreground, strata, random)
+
+		if len(foreground) == 0 || len(background) == 0 {
+			fmt.Printf("cluster: %s skipped (%d foreground and %d background peaks)\n",
+				cluster, len(foreground), len(background))
+			continue
+		}
+
+		fgCounts := countMotifs(foreground, peakMotifs, len(names))
+		bgCounts := countMotifs(background, peakMotifs, len(names))
+
+		results := make([]motifEnrichment, len(names))
+
+		for motif := range names {
+			results[motif] = enrichmentTest(motif, fgCounts[motif], len(foreground), bgCounts[motif], len(background))
+		}
+
+		benjaminiHochberg(results)
+
+		fname := fmt.Sprintf("%s.%s.motif_enrichment.tsv", FILENAMEOUT, cluster)
+		writeEnrichmentTable(fname, results, names)
+
+		fmt.Printf("cluster: %s: %d foreground and %d background peaks, results written in: %s\n",
+			cluster, len(foreground), len(background), fname)
+	}
+}
+
+/*loadPeakStrata load the GC x accessibility strata (-peaks_gc from -gc) or compute GC content strata from the FASTA file */
+func loadPeakStrata(peaks []utils.Peak) (strata []int) {
+	strata = make([]int, len(peaks))
+
+	if PEAKGCFILE == "" {
+		gcs := peakGCContent(peaks)
+		return quantileBins(gcs, GCBINS)
+	}
+
+	found := 0
+	scanner, file := PEAKGCFILE.ReturnReader(0)
+	defer utils.CloseFile(file)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		split := strings.Split(line, "\t")
+
+		if len(split) < 7 {
+			log.Fatal(fmt.Sprintf("Error line: %s from %s must have 7 columns (output of -gc)", line, PEAKGCFILE))
+		}
+
+		if index, isInside := utils.PEAKIDDICT[strings.Join(split[:3], "\t")]; isInside {
+			stratum, err := strconv.Atoi(split[6])
+			utils.Check(err)
+			strata[index] = stratum
+			found++
+		}
+	}
+
+	if found < len(peaks) {
+		log.Fatal(fmt.Sprintf("Error only %d / %d peaks of -ygi found in %s", found, len(peaks), PEAKGCFILE))
+	}
+
+	return strata
+}
+
+/*loadSignificantPeaks load the significant peaks with an odd ratio > 1 (or a log2 fold change > 0) of each cluster
+from the ATACTopFeatures corrected p-value (or -da) table */
+func loadSignificantPeaks() (clusterPeaks map[string][]int) {
+	var nbUnknown int
+
+	clusterPeaks = make(map[string][]int)
+
+	for cluster, features := range utils.LoadSignificantFeatures(PVALUETABLE) {
+		clusterPeaks[cluster] = nil
+
+		for _, split := range features {
+			index, isInside := utils.PEAKIDDICT[strings.Join(split[:3], "\t")]
+
+			if !isInside {
+				nbUnknown++
+				continue
+			}
+
+			clusterPeaks[cluster] = append(clusterPeaks[cluster], int(index))
+		}
+	}
+
+	if nbUnknown > 0 {
+		fmt.Printf("%d significant peaks not found in -ygi ignored\n", nbUnknown)
+	}
+
+	return clusterPeaks
+}
+
+/*sampleMatchedBackground sample background peaks (not in the foreground) with the same strata distribution as the foreground.
+BGRATIO background peaks are sampled per foreground peak, or less if a stratum has not enough peaks (the same ratio is used for all the strata) */
+func sampleMatchedBackground(foreground []int, strata []int, random *rand.Rand) (background []int) {
+	isForeground := make(map[int]bool, len(foreground))
+	fgStrata := make(map[int]int)
+
+	for _, peak := range foreground {
+		isForeground[peak] = true
+		fgStrata[strata[peak]]++
+	}
+
+	candidates := make(map[int][]int)
+
+	for peak, stratum := range strata {
+		if !isForeground[peak] && fgStrata[stratum] > 0 {
+			candidates[stratum] = append(candidates[stratum], peak)
+		}
+	}
+
+	ratio := BGRATIO
+
+	for stratum, nb := range fgStrata {
+		if available := float64(len(candidates[stratum])) / float64(nb); available < ratio && available >= 1.0 {
+			ratio = available
+		}
+	}
+
+	stratumList := make([]int, 0, len(fgStrata))
+
+	for stratum := range fgStrata {
+		stratumList = append(stratumList, stratum)
+	}
+
+	sort.Ints(stratumList)
+
+	for _, stratum := range stratumList {
+		peaks := candidates[stratum]
+		nb := int(math.Round(ratio * float64(fgStrata[stratum])))
+
+		if nb > len(peaks) {
+			nb = len(peaks)
+		}
+
+		for _, pos := range random.Perm(len(peaks))[:nb] {
+			background = append(background, peaks[pos])
+		}
+	}
+
+	return background
+}
+
+/*countMotifs number of peaks with each motif */
+func countMotifs(peaks []int, peakMotifs [][]int, nbMotifs int) (counts []int) {
+	counts = make([]int, nbMotifs)
+
+	for _, peak := range peaks {
+		for _, motif := range peakMotifs[peak] {
+			counts[motif]++
+		}
+	}
+
+	return counts
+}
+
+/*enrichmentTest one-sided Fisher exact test (hypergeometric upper tail) of the motif frequency in the foreground vs the background */
+func enrichmentTest(motif, fgMotif, nbForeground, bgMotif, nbBackground int) (result motifEnrichment) {
+	result.motif = motif
+	result.nbForeground, result.nbBackground = fgMotif, bgMotif
+	result.fgFraction = float64(fgMotif) / float64(nbForeground)
+	result.bgFraction = float64(bgMotif) / float64(nbBackground)
+	result.fold = (float64(fgMotif) + 0.5) / float64(nbForeground) / ((float64(bgMotif) + 0.5) / float64(nbBackground))
+	result.oddRatio = (float64(fgMotif) + 0.5) * (float64(nbBackground - bgMotif) + 0.5) /
+		((float64(nbForeground - fgMotif) + 0.5) * (float64(bgMotif) + 0.5))
+	result.pvalue = utils.HypergeometricUpperTail(fgMotif, nbForeground + nbBackground, fgMotif + bgMotif, nbForeground)
+
+	return result
+}
+
+/*benjaminiHochberg compute the BH q-values and sort the results by p-value */
+func benjaminiHochberg(results []motifEnrichment) {
+	pvalues := make([]float64, len(results))
+
+	for i := range results {
+		pvalues[i] = results[i].pvalue
+	}
+
+	for i, qvalue := range utils.BenjaminiHochberg(pvalues) {
+		results[i].qvalue = qvalue
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {return results[i].pvalue < results[j].pvalue})
+}
+
+/*writeEnrichmentTable write the enrichment results of one cluster sorted by p-value */
+func writeEnrichmentTable(fname string, results []motifEnrichment, names []string) {
+	var buffer bytes.Buffer
+
+	writer := utils.ReturnWriter(fname)
+	defer utils.CloseFile(writer)
+
+	buffer.WriteString("#motif\tnb_foreground\tforeground_fraction\tnb_background\tbackground_fraction\tfold\toddRatio\tpvalue\tqvalue\n")
+
+	for _, result := range results {
+		buffer.WriteString(fmt.Sprintf("%s\t%d\t%.5f\t%d\t%.5f\t%.4f\t%e\t%e\t%e\n",
+			names[result.motif], result.nbForeground, result.fgFraction, result.nbBackground, result.bgFraction,
+			result.fold, result.oddRatio, result.pvalue, result.qvalue))
+	}
+
+	_, err := writer.Write(buffer.Bytes())
+	utils.Check(err)
+}
@@ -0,0 +1,204 @@
+/* GC content, CpG density and stratified background peaks */
+
+package main
+
+
+import(
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+)
+
+
+/*peakSequenceStats GC fraction, CpG density and mean accessibility of a peak with its GC x accessibility stratum */
+type peakSequenceStats struct {
+	gc, cpg, accessibility float64
+	stratum int
+}
+
+/*computeGCAndBackground compute the GC content of the peaks and sample matched background peaks */
+func computeGCAndBackground() {
+	random := rand.New(rand.NewSource(SEED))
+
+	peaks := loadPeakList(PEAKFILE)
+	stats := make([]peakSequenceStats, len(peaks))
+
+	fasta := utils.OpenIndexedFasta(string(FASTAFILE))
+
+	for i := range peaks {
+		stats[i].gc, stats[i].cpg = utils.GCContent(fasta.Fetch(peaks[i].Chr(), peaks[i].Start, peaks[i].End))
+	}
+
+	fasta.Close()
+
+	if MATRIXFILE != "" {
+		fmt.Printf("loading matrix: %s...\n", MATRIXFILE)
+		matrix := utils.LoadSparseMatrix(string(MATRIXFILE), 0, len(peaks))
+
+		if matrix.NCols > len(peaks) {
+			log.Fatal(fmt.Sprintf("Error the matrix has more columns (%d) than peaks in -ygi (%d)", matrix.NCols, len(peaks)))
+		}
+
+		for _, row := range matrix.Rows {
+			for pos, peak := range row.Index {
+				stats[peak].accessibility += row.Values[pos]
+			}
+		}
+
+		for i := range stats {
+			stats[i].accessibility /= float64(len(matrix.Rows))
+		}
+	}
+
+	gcs := make([]float64, len(stats))
+	accessibilities := make([]float64, len(stats))
+
+	for i := range stats {
+		gcs[i], accessibilities[i] = stats[i].gc, math.Log10(stats[i].accessibility + 1e-6)
+	}
+
+	gcBins := quantileBins(gcs, GCBINS)
+	accessibilityBins := quantileBins(accessibilities, ACCESSIBILITYBINS)
+
+	for i := range stats {
+		stats[i].stratum = gcBins[i] * ACCESSIBILITYBINS + accessibilityBins[i]
+	}
+
+	writePeakGC(fmt.Sprintf("%s.peaks_gc.bed", FILENAMEOUT), peaks, stats)
+
+	if NBBACKGROUND > 0 {
+		backgrounds := selectStratifiedBackgroundPeaks(stats, NBBACKGROUND, random)
+		writeBackgroundPeaks(fmt.Sprintf("%s.background.bed", FILENAMEOUT), peaks, backgrounds)
+	}
+}
+
+/*quantileBins assign each value to one of nbBins bins containing the same number of values (ties are kept in the same bin) */
+func quantileBins(values []float64, nbBins int) (bins []int) {
+	order := make([]int, len(values))
+
+	for i := range order {
+		order[i] = i
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {return values[order[i]] < values[order[j]]})
+
+	bins = make([]int, len(values))
+
+	for rank, i := range order {
+		bins[i] = rank * nbBins / len(values)
+
+		if rank > 0 && values[i] == values[order[rank - 1]] {
+			bins[i] = bins[order[rank - 1]]
+		}
+	}
+
+	return bins
+}
+
+/*selectStratifiedBackgroundPeaks sample nbBackgrounds peaks of the same GC x accessibility stratum (excluding the peak itself) for each peak */
+func selectStratifiedBackgroundPeaks(stats []peakSequenceStats, nbBackgrounds int, random *rand.Rand) (backgrounds [][]int) {
+	strata := make(map[int][]int)
+
+	for i := range stats {
+		strata[stats[i].stratum] = append(strata[stats[i].stratum], i)
+	}
+
+	backgrounds = make([][]int, len(stats))
+
+	for i := range stats {
+		candidates := strata[stats[i].stratum]
+
+		if len(candidates) < 2 {
+			continue
+		}
+
+		backgrounds[i] = make([]int, 0, nbBackgrounds)
+
+		// without replacement when the stratum is large enough
+		if len(candidates) - 1 >= nbBackgrounds {
+			used := map[int]bool{i: true}
+
+			for len(backgrounds[i]) < nbBackgrounds {
+				candidate := candidates[random.Intn(len(candidates))]
+
+				if !used[candidate] {
+					used[candidate] = true
+					backgrounds[i] = append(backgrounds[i], candidate)
+				}
+			}
+
+			continue
+		}
+
+		for len(backgrounds[i]) < nbBackgrounds {
+			if candidate := candidates[random.Intn(len(candidates))]; candidate != i {
+				backgrounds[i] = append(backgrounds[i], candidate)
+			}
+		}
+	}
+
+	return backgrounds
+}
+
+/*writePeakGC write the peaks with their GC content, CpG density, mean accessibility and stratum */
+func writePeakGC(fname string, peaks []utils.Peak, stats []peakSequenceStats) {
+	var buffer bytes.Buffer
+
+	writer := utils.ReturnWriter(fname)
+	defer utils.CloseFile(writer)
+
+	buffer.WriteString("#chr\tstart\tend\tGC\tCpG_density\tmean_accessibility\tstratum\n")
+
+	for i := range peaks {
+		buffer.WriteString(fmt.Sprintf("%s\t%d\t%d\t%.4f\t%.5f\t%s\t%d\n",
+			peaks[i].Chr(), peaks[i].Start, peaks[i].End, stats[i].gc, stats[i].cpg,
+			strconv.FormatFloat(stats[i].accessibility, 'g', 6, 64), stats[i].stratum))
+	}
+
+	_, err := writer.Write(buffer.Bytes())
+	utils.Check(err)
+
+	fmt.Printf("GC content of %d peaks written in: %s\n", len(peaks), fname)
+}
+
+/*writeBackgroundPeaks write the background peaks: <background chr><start><end><matched peak chr:start-end><sample> */
+func writeBackgroundPeaks(fname string, peaks []utils.Peak, backgrounds [][]int) {
+	var buffer bytes.Buffer
+	var err error
+	var nbUnmatched int
+
+	writer := utils.ReturnWriter(fname)
+	defer utils.CloseFile(writer)
+
+	for i := range peaks {
+		if len(backgrounds[i]) == 0 {
+			nbUnmatched++
+		}
+
+		for sample, bg := range backgrounds[i] {
+			buffer.WriteString(fmt.Sprintf("%s\t%d\t%d\t%s:%d-%d\t%d\n",
+				peaks[bg].Chr(), peaks[bg].Start, peaks[bg].End,
+				peaks[i].Chr(), peaks[i].Start, peaks[i].End, sample))
+		}
+
+		if buffer.Len() > 1000000 {
+			_, err = writer.Write(buffer.Bytes())
+			utils.Check(err)
+			buffer.Reset()
+		}
+	}
+
+	_, err = writer.Write(buffer.Bytes())
+	utils.Check(err)
+
+	if nbUnmatched > 0 {
+		fmt.Printf("%d peaks without background (stratum with a single peak)\n", nbUnmatched)
+	}
+
+	fmt.Printf("background peaks written in: %s\n", fname)
+}
@@ -0,0 +1,430 @@
+/* Motif files (JASPAR, MEME, HOMER) and log-odds position weight matrices */
+
+package main
+
+
+import(
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+)
+
+
+/*motif position frequency matrix (A, C, G, T) */
+type motif struct {
+	id, name string
+	freqs [][4]float64
+}
+
+/*pwm integer log-odds matrix (score resolution: 1 / PWMSCALE bits) with its score threshold */
+type pwm struct {
+	scores, reverse [][4]int
+	bestForward, bestReverse []int
+	threshold int
+}
+
+/*PWMSCALE number of integer units per bit of the log-odds scores */
+const PWMSCALE = 10.0
+
+/*MOTIFPSEUDOCOUNT pseudocount added to the motif counts (probability matrices are considered as MOTIFNBSITES sites) */
+const MOTIFPSEUDOCOUNT = 0.8
+
+/*MOTIFNBSITES number of sites used for the probability matrices (MEME and HOMER) */
+const MOTIFNBSITES = 100.0
+
+/*loadMotifs load all the motif files (format detected from the content if MOTIFFORMAT is auto) */
+func loadMotifs() (motifs []motif) {
+	for _, fname := range MOTIFFILES {
+		format := MOTIFFORMAT
+
+		if format == "auto" {
+			format = detectMotifFormat(fname)
+		}
+
+		var fileMotifs []motif
+
+		switch format {
+		case "jaspar":
+			fileMotifs = loadJasparMotifs(fname)
+		case "meme":
+			fileMotifs = loadMemeMotifs(fname)
+		case "homer":
+			fileMotifs = loadHomerMotifs(fname)
+		default:
+			log.Fatal(fmt.Sprintf("Error unknown motif format: %s (jaspar|meme|homer)", format))
+		}
+
+		fmt.Printf("%d motifs loaded from %s (%s format)\n", len(fileMotifs), fname, format)
+		motifs = append(motifs, fileMotifs...)
+	}
+
+	if len(motifs) == 0 {
+		log.Fatal("Error no motif loaded!")
+	}
+
+	return motifs
+}
+
+/*detectMotifFormat detect the format of a motif file: meme (MEME version header), homer (probabilities after the > header) or jaspar */
+func detectMotifFormat(fname string) string {
+	var lines []string
+
+	scanner, file := utils.ReturnReader(fname, 0)
+	defer utils.CloseFile(file)
+
+	for scanner.Scan() && len(lines) < 2 {
+		line := strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(line, "MEME version") {
+			return "meme"
+		}
+
+		if len(line) > 0 && (len(lines) > 0 || line[0] == '>') {
+			lines = append(lines, line)
+		}
+	}
+
+	if len(lines) == 2 && len(strings.Fields(lines[1])) == 4 {
+		if _, err := strconv.ParseFloat(strings.Fields(lines[1])[0], 64); err == nil {
+			return "homer"
+		}
+	}
+
+	return "jaspar"
+}
+
+/*loadJasparMotifs load a JASPAR file: >ID name header followed by 4 count lines (A, C, G, T, with or without letters and brackets) */
+func loadJasparMotifs(fname string) (motifs []motif) {
+	var rows [][]float64
+	var current motif
+
+	closeMotif := func() {
+		if current.id == "" {
+			return
+		}
+
+		if len(rows) != 4 {
+			log.Fatal(fmt.Sprintf("Error motif %s from %s must have 4 rows (A, C, G, T)", current.id, fname))
+		}
+
+		current.freqs = make([][4]float64, len(rows[0]))
+
+		for base := 0; base < 4; base++ {
+			if len(rows[base]) != len(rows[0]) {
+				log.Fatal(fmt.Sprintf("Error rows of motif %s from %s have different lengths", current.id, fname))
+			}
+
+			for pos, count := range rows[base] {
+				current.freqs[pos][base] = count
+			}
+		}
+
+		current.freqs = countsToFreqs(current.freqs)
+		motifs = append(motifs, current)
+		current, rows = motif{}, nil
+	}
+
+	scanner, file := utils.ReturnReader(fname, 0)
+	defer utils.CloseFile(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case len(line) == 0:
+			continue
+		case line[0] == '>':
+			closeMotif()
+			current = motifFromHeader(line[1:])
+		default:
+			line = strings.TrimLeft(line, "ACGT \t")
+			line = strings.NewReplacer("[", " ", "]", " ").Replace(line)
+			rows = append(rows, parseFloats(line, fname))
+		}
+	}
+
+	closeMotif()
+
+	return motifs
+}
+
+/*loadMemeMotifs load a MEME file: MOTIF ID name, then a letter-probability matrix */
+func loadMemeMotifs(fname string) (motifs []motif) {
+	var current motif
+	var width int
+	var inMatrix bool
+
+	scanner, file := utils.ReturnReader(fname, 0)
+	defer utils.CloseFile(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		fields := strings.Fields(line)
+
+		switch {
+		case strings.HasPrefix(line, "MOTIF"):
+			if len(fields) < 2 {
+				log.Fatal(fmt.Sprintf("Error line: %s from %s has no motif ID", line, fname))
+			}
+
+			current = motifFromHeader(strings.Join(fields[1:], "\t"))
+			inMatrix = false
+		case strings.HasPrefix(line, "letter-probability matrix"):
+			width = -1
+
+			for pos, field := range fields {
+				if field == "w=" && pos + 1 < len(fields) {
+					var err error
+					width, err = strconv.Atoi(fields[pos + 1])
+					utils.Check(err)
+				}
+			}
+
+			inMatrix = true
+		case inMatrix && len(fields) == 4:
+			row := parseFloats(line, fname)
+			current.freqs = append(current.freqs, [4]float64{row[0], row[1], row[2], row[3]})
+
+			if len(current.freqs) == width {
+				inMatrix = false
+			}
+		case inMatrix:
+			inMatrix = false
+		default:
+			continue
+		}
+
+		if !inMatrix && len(current.freqs) > 0 {
+			current.freqs = probsToFreqs(current.freqs)
+			motifs = append(motifs, current)
+			current = motif{}
+		}
+	}
+
+	if len(current.freqs) > 0 {
+		current.freqs = probsToFreqs(current.freqs)
+		motifs = append(motifs, current)
+	}
+
+	return motifs
+}
+
+/*loadHomerMotifs load a HOMER file: >consensus<TAB>name<TAB>... header followed by one probability line per position */
+func loadHomerMotifs(fname string) (motifs []motif) {
+	var current motif
+
+	closeMotif := func() {
+		if len(current.freqs) > 0 {
+			current.freqs = probsToFreqs(current.freqs)
+			motifs = append(motifs, current)
+		}
+
+		current = motif{}
+	}
+
+	scanner, file := utils.ReturnReader(fname, 0)
+	defer utils.CloseFile(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case len(line) == 0:
+			continue
+		case line[0] == '>':
+			closeMotif()
+			split := strings.Split(line[1:], "\t")
+
+			if len(split) > 1 {
+				current = motif{id: split[1], name: strings.Split(split[1], "/")[0]}
+			} else {
+				current = motif{id: split[0], name: split[0]}
+			}
+		default:
+			row := parseFloats(line, fname)
+
+			if len(row) != 4 {
+				log.Fatal(fmt.Sprintf("Error line: %s from %s must have 4 values", line, fname))
+			}
+
+			current.freqs = append(current.freqs, [4]float64{row[0], row[1], row[2], row[3]})
+		}
+	}
+
+	closeMotif()
+
+	return motifs
+}
+
+/*motifFromHeader ID and name from a header (<ID> <name>) */
+func motifFromHeader(header string) (m motif) {
+	fields := strings.Fields(header)
+
+	if len(fields) == 0 {
+		log.Fatal("Error empty motif header!")
+	}
+
+	m.id, m.name = fields[0], fields[0]
+
+	if len(fields) > 1 {
+		m.name = fields[1]
+	}
+
+	return m
+}
+
+func parseFloats(line, fname string) (values []float64) {
+	for _, field := range strings.Fields(line) {
+		value, err := strconv.ParseFloat(field, 64)
+
+		if err != nil {
+			log.Fatal(fmt.Sprintf("Error line: %s from %s cannot be converted to numbers", line, fname))
+		}
+
+		values = append(values, value)
+	}
+
+	return values
+}
+
+/*countsToFreqs convert the counts of each position to frequencies with a pseudocount */
+func countsToFreqs(counts [][4]float64) (freqs [][4]float64) {
+	freqs = make([][4]float64, len(counts))
+
+	for pos, row := range counts {
+		total := row[0] + row[1] + row[2] + row[3]
+
+		for base := range row {
+			freqs[pos][base] = (row[base] + MOTIFPSEUDOCOUNT / 4.0) / (total + MOTIFPSEUDOCOUNT)
+		}
+	}
+
+	return freqs
+}
+
+/*probsToFreqs convert probabilities to frequencies with a pseudocount (MOTIFNBSITES sites) */
+func probsToFreqs(probs [][4]float64) (freqs [][4]float64) {
+	counts := make([][4]float64, len(probs))
+
+	for pos, row := range probs {
+		total := row[0] + row[1] + row[2] + row[3]
+
+		for base := range row {
+			counts[pos][base] = MOTIFNBSITES * row[base] / total
+		}
+	}
+
+	return countsToFreqs(counts)
+}
+
+/*gcBackground background frequencies (A, C, G, T) for a GC fraction */
+func gcBackground(gc float64) [4]float64 {
+	return [4]float64{(1.0 - gc) / 2.0, gc / 2.0, gc / 2.0, (1.0 - gc) / 2.0}
+}
+
+/*createPWM create the integer log-odds matrix of a motif for a background and find the score threshold of the p-value */
+func (m *motif) createPWM(background [4]float64, pvalue float64) (p pwm) {
+	width := len(m.freqs)
+
+	p.scores = make([][4]int, width)
+	p.reverse = make([][4]int, width)
+
+	for pos, row := range m.freqs {
+		for base := range row {
+			p.scores[pos][base] = int(math.Round(PWMSCALE * math.Log2(row[base] / background[base])))
+		}
+	}
+
+	for pos := range p.scores {
+		for base := 0; base < 4; base++ {
+			p.reverse[pos][base] = p.scores[width - 1 - pos][3 - base]
+		}
+	}
+
+	p.bestForward = initBestRemaining(p.scores)
+	p.bestReverse = initBestRemaining(p.reverse)
+	p.threshold = scoreThreshold(p.scores, background, pvalue)
+
+	return p
+}
+
+/*initBestRemaining maximum score reachable from each position of a matrix (used to stop the scan early) */
+func initBestRemaining(scores [][4]int) (best []int) {
+	best = make([]int, len(scores) + 1)
+
+	for pos := len(scores) - 1; pos >= 0; pos-- {
+		best[pos] = best[pos + 1] + maxInt4(scores[pos])
+	}
+
+	return best
+}
+
+/*scoreThreshold lowest score with P(score >= threshold) <= pvalue under the background (exact distribution of the integer scores) */
+func scoreThreshold(scores [][4]int, background [4]float64, pvalue float64) int {
+	var minScore int
+
+	for _, row := range scores {
+		minScore += minInt4(row)
+	}
+
+	// distribution of the partial sums, shifted by the minimum partial sum
+	dist := []float64{1.0}
+	offset := 0
+
+	for _, row := range scores {
+		rowMin := minInt4(row)
+		newDist := make([]float64, len(dist) + maxInt4(row) - rowMin)
+
+		for value, prob := range dist {
+			if prob == 0 {
+				continue
+			}
+
+			for base := range row {
+				newDist[value + row[base] - rowMin] += prob * background[base]
+			}
+		}
+
+		dist = newDist
+		offset += rowMin
+	}
+
+	tail := 0.0
+
+	for value := len(dist) - 1; value >= 0; value-- {
+		if tail + dist[value] > pvalue {
+			return value + offset + 1
+		}
+
+		tail += dist[value]
+	}
+
+	return minScore
+}
+
+func minInt4(row [4]int) (value int) {
+	value = row[0]
+
+	for _, x := range row[1:] {
+		if x < value {
+			value = x
+		}
+	}
+
+	return value
+}
+
+func maxInt4(row [4]int) (value int) {
+	value = row[0]
+
+	for _, x := range row[1:] {
+		if x > value {
+			value = x
+		}
+	}
+
+	return value
+}
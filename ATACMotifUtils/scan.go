@@ -0,0 +1,240 @@
+/* Scan of the peak sequences with the motif PWMs */
+
+package main
+
+
+import(
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+)
+
+
+/*motifHit one motif match in a peak */
+type motifHit struct {
+	motif, start, score int
+	strand byte
+}
+
+/*SCANBATCHSIZE number of peaks scanned before writing the results */
+const SCANBATCHSIZE = 10000
+
+/*scanPeaks scan all the peaks of the ygi file and write the peak x motif matrix and the motif hits */
+func scanPeaks() {
+	var matchBuffer, hitBuffer bytes.Buffer
+	var nbHits, nbMatches int
+	var err error
+
+	peaks := loadPeakList(PEAKFILE)
+	motifs := loadMotifs()
+
+	fasta := utils.OpenIndexedFasta(string(FASTAFILE))
+	defer fasta.Close()
+
+	writeMotifNames(fmt.Sprintf("%s.motif_names.tsv", FILENAMEOUT), motifs)
+
+	matchWriter := utils.ReturnWriter(fmt.Sprintf("%s.motif_matches.coo", FILENAMEOUT))
+	defer utils.CloseFile(matchWriter)
+	hitWriter := utils.ReturnWriter(fmt.Sprintf("%s.motif_hits.bed", FILENAMEOUT))
+	defer utils.CloseFile(hitWriter)
+
+	pwms := make([][]pwm, GCBINS)
+
+	fmt.Printf("scanning %d peaks with %d motifs (p-value: %g)...\n", len(peaks), len(motifs), PVALUE)
+
+	for batchStart := 0; batchStart < len(peaks); batchStart += SCANBATCHSIZE {
+		batchEnd := batchStart + SCANBATCHSIZE
+
+		if batchEnd > len(peaks) {
+			batchEnd = len(peaks)
+		}
+
+		sequences := make([][]int8, batchEnd - batchStart)
+		gcBins := make([]int, len(sequences))
+
+		for i := range sequences {
+			seq := fasta.Fetch(peaks[batchStart + i].Chr(), peaks[batchStart + i].Start, peaks[batchStart + i].End)
+			gc, _ := utils.GCContent(seq)
+			gcBins[i] = gcBin(gc)
+			sequences[i] = encodeSequence(seq)
+
+			if pwms[gcBins[i]] == nil {
+				pwms[gcBins[i]] = createPWMs(motifs, gcBins[i])
+			}
+		}
+
+		hits := make([][]motifHit, len(sequences))
+
+		utils.ParallelFor(len(sequences), THREADNB, func(i int) {
+			hits[i] = scanSequence(sequences[i], pwms[gcBins[i]])
+		})
+
+		for i, peakHits := range hits {
+			peak := peaks[batchStart + i]
+			counts := make(map[int]int)
+
+			for _, hit := range peakHits {
+				counts[hit.motif]++
+
+				hitBuffer.WriteString(fmt.Sprintf("%s\t%d\t%d\t%s_%s\t%.2f\t%c\n",
+					peak.Chr(), peak.Start + hit.start, peak.Start + hit.start + len(motifs[hit.motif].freqs),
+					motifs[hit.motif].id, motifs[hit.motif].name, float64(hit.score) / PWMSCALE, hit.strand))
+			}
+
+			matched := make([]int, 0, len(counts))
+
+			for motif := range counts {
+				matched = append(matched, motif)
+			}
+
+			sort.Ints(matched)
+
+			for _, motif := range matched {
+				matchBuffer.WriteString(fmt.Sprintf("%d\t%d\t%d\n", batchStart + i, motif, counts[motif]))
+			}
+
+			nbHits += len(peakHits)
+			nbMatches += len(matched)
+		}
+
+		_, err = matchWriter.Write(matchBuffer.Bytes())
+		utils.Check(err)
+		_, err = hitWriter.Write(hitBuffer.Bytes())
+		utils.Check(err)
+
+		matchBuffer.Reset()
+		hitBuffer.Reset()
+
+		fmt.Printf("\r%d / %d peaks scanned", batchEnd, len(peaks))
+	}
+
+	fmt.Printf("\n%d motif hits and %d peak x motif matches written in %s.motif_hits.bed and %s.motif_matches.coo\n",
+		nbHits, nbMatches, FILENAMEOUT, FILENAMEOUT)
+}
+
+/*loadPeakList load the peaks of a ygi file in their index order */
+func loadPeakList(fname utils.Filename) (peaks []utils.Peak) {
+	nbPeaks := utils.LoadPeaks(fname, false, false)
+	peaks = make([]utils.Peak, nbPeaks)
+
+	for key, index := range utils.PEAKIDDICT {
+		peaks[index].StringToPeak(key)
+	}
+
+	return peaks
+}
+
+/*gcBin GC content bin of a GC fraction */
+func gcBin(gc float64) int {
+	bin := int(gc * float64(GCBINS))
+
+	if bin >= GCBINS {
+		bin = GCBINS - 1
+	}
+
+	return bin
+}
+
+/*createPWMs create the PWMs of all the motifs for the background of a GC content bin */
+func createPWMs(motifs []motif, bin int) (pwms []pwm) {
+	gc := (float64(bin) + 0.5) / float64(GCBINS)
+	background := gcBackground(gc)
+	pwms = make([]pwm, len(motifs))
+
+	utils.ParallelFor(len(motifs), THREADNB, func(i int) {
+		pwms[i] = motifs[i].createPWM(background, PVALUE)
+	})
+
+	return pwms
+}
+
+/*encodeSequence encode a sequence as A:0, C:1, G:2, T:3 and -1 for the other bases */
+func encodeSequence(seq []byte) (code []int8) {
+	code = make([]int8, len(seq))
+
+	for pos, char := range seq {
+		switch char {
+		case 'A':
+			code[pos] = 0
+		case 'C':
+			code[pos] = 1
+		case 'G':
+			code[pos] = 2
+		case 'T':
+			code[pos] = 3
+		default:
+			code[pos] = -1
+		}
+	}
+
+	return code
+}
+
+/*scanSequence return the hits of all the motifs on both strands of an encoded sequence */
+func scanSequence(code []int8, pwms []pwm) (hits []motifHit) {
+	for motif := range pwms {
+		p := &pwms[motif]
+		width := len(p.scores)
+
+		for start := 0; start + width <= len(code); start++ {
+			if score, isHit := windowScore(code, start, p.scores, p.bestForward, p.threshold); isHit {
+				hits = append(hits, motifHit{motif: motif, start: start, score: score, strand: '+'})
+			}
+
+			if score, isHit := windowScore(code, start, p.reverse, p.bestReverse, p.threshold); isHit {
+				hits = append(hits, motifHit{motif: motif, start: start, score: score, strand: '-'})
+			}
+		}
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].start != hits[j].start {
+			return hits[i].start < hits[j].start
+		}
+
+		return hits[i].motif < hits[j].motif
+	})
+
+	return hits
+}
+
+/*windowScore score of the window starting at start. The scan stops when the threshold cannot be reached */
+func windowScore(code []int8, start int, scores [][4]int, bestRemaining []int, threshold int) (score int, isHit bool) {
+	for pos := range scores {
+		base := code[start + pos]
+
+		if base < 0 {
+			return 0, false
+		}
+
+		score += scores[pos][base]
+
+		if score + bestRemaining[pos + 1] < threshold {
+			return 0, false
+		}
+	}
+
+	return score, true
+}
+
+/*writeMotifNames write the motif IDs and names in the motif index order */
+func writeMotifNames(fname string, motifs []motif) {
+	var buffer bytes.Buffer
+
+	writer := utils.ReturnWriter(fname)
+	defer utils.CloseFile(writer)
+
+	for _, m := range motifs {
+		buffer.WriteString(m.id)
+		buffer.WriteRune('\t')
+		buffer.WriteString(m.name)
+		buffer.WriteRune('\t')
+		buffer.WriteString(strconv.Itoa(len(m.freqs)))
+		buffer.WriteRune('\n')
+	}
+
+	_, err := writer.Write(buffer.Bytes())
+	utils.Check(err)
+}
@@ -0,0 +1,350 @@
+/* Peak calling from single-cell ATAC-Seq fragments (Tn5 insertions pileup with a MACS2-like local lambda) */
+
+package main
+
+
+import(
+	"log"
+	"flag"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+	"fmt"
+	"bytes"
+	"strings"
+	"strconv"
+	"time"
+	"os"
+	"sort"
+	"math/rand"
+)
+
+
+/*BEDFILENAMES fragment bed files (<chr><start><end><cell ID>) */
+var BEDFILENAMES utils.ArrayFlags
+
+/*CLUSTERFILE cell ID <-> cluster file used to call peaks per cluster */
+var CLUSTERFILE utils.Filename
+
+/*FILENAMEOUT  output file name prefix */
+var FILENAMEOUT string
+
+/*GENOMESIZE effective genome size */
+var GENOMESIZE float64
+
+/*PVALUE p-value threshold (used instead of the q-value if > 0) */
+var PVALUE float64
+
+/*QVALUE q-value threshold */
+var QVALUE float64
+
+/*SHIFT shift applied to the Tn5 insertions before the extension */
+var SHIFT int
+
+/*EXTSIZE size of the extension of the Tn5 insertions */
+var EXTSIZE int
+
+/*LLOCAL size of the window used to estimate the local lambda */
+var LLOCAL int
+
+/*MINLENGTH minimum peak length */
+var MINLENGTH int
+
+/*MAXGAP maximum gap between two significant regions to merge them */
+var MAXGAP int
+
+/*TN5SHIFT shift the fragment ends by +4/-5 before inferring the Tn5 insertions */
+var TN5SHIFT bool
+
+/*MINCELLS minimum number of cells per cluster to call peaks */
+var MINCELLS int
+
+/*THREADNB number of threads */
+var THREADNB int
+
+/*PSEUDOREP number of pseudo-replicates per group (cells randomly split) */
+var PSEUDOREP int
+
+/*SEED seed used to split the cells into pseudo-replicates */
+var SEED int64
+
+/*PEAKFILES narrowPeak files used to create the consensus peak set */
+var PEAKFILES utils.ArrayFlags
+
+/*PEAKWIDTH width of the consensus peaks centered on the summits */
+var PEAKWIDTH int
+
+/*REPRODUCIBILITY minimum number of pseudo-replicates supporting a peak */
+var REPRODUCIBILITY int
+
+/*CELLCLUSTER cell ID <-> cluster */
+var CELLCLUSTER map[string]string
+
+/*ALLCELLS name of the group when no cluster file is provided */
+const ALLCELLS = "all"
+
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `
+#################### MODULE TO CALL PEAKS FROM SINGLE-CELL ATAC-SEQ FRAGMENTS ########################
+"""Peak calling: -call """
+The Tn5 insertions (fragment ends) are shifted by -shift and extended by -ext_size (MACS2 --nomodel --shift -75 --extsize 150 by default) to create a pileup.
+The pileup is compared to a local lambda: max(genome background, insertions in a -llocal window) using a Poisson test.
+Regions above the p-value (-pvalue) or q-value (-qvalue) threshold are merged (-max_gap), filtered by length (-min_length) and written in narrowPeak format with their summit.
+If a cluster file is provided (<cell ID><TAB><cluster>), one narrowPeak file is created per cluster: <out>.<cluster>.narrowPeak.
+With -pseudo_rep <n>, the cells of each group are randomly split into n pseudo-replicates and peaks are also called for each of them: <out>.<cluster>.rep<i>.narrowPeak.
+
+USAGE: ATACPeakCalling -call -bed <fragment bed> (optional -bed <fragment bed 2> -cluster <file> -out <string> -gsize <float> -qvalue <float> -pvalue <float> -shift <int> -ext_size <int> -llocal <int> -tn5_shift -pseudo_rep <int> -seed <int> -threads <int>)
+
+"""Consensus peak set: -consensus """
+Iterative overlap procedure (ArchR): the summits of each narrowPeak file are resized to -width and ranked by score per million (-log10 p-value normalized by the sum of the file).
+Peaks overlapping a peak with a higher score are iteratively removed, first per group and then across groups.
+The pseudo-replicate files of a group (<prefix>.rep<i>.narrowPeak) are used to only keep the peaks supported by at least -reproducibility pseudo-replicates.
+The non-overlapping peaks are written in <out>.consensus.bed and can be used as -ygi file with ATACMatUtils.
+
+USAGE: ATACPeakCalling -consensus -peaks <narrowPeak> -peaks <narrowPeak 2> ... (optional -out <string> -width <int> -reproducibility <int>)
+
+`)
+		 flag.PrintDefaults()
+	}
+
+	var callPeaks, consensus bool
+
+	flag.BoolVar(&callPeaks, "call", false, "call peaks from fragment bed file(s)")
+	flag.BoolVar(&consensus, "consensus", false, "create a consensus peak set from narrowPeak files")
+	flag.Var(&BEDFILENAMES, "bed", "fragment bed file(s) (<chr><start><end><cell ID>)")
+	flag.Var(&CLUSTERFILE, "cluster", "cell ID <TAB> cluster file used to call peaks per cluster")
+	flag.StringVar(&FILENAMEOUT, "out", "peaks", "prefix of the output file(s)")
+	flag.Float64Var(&GENOMESIZE, "gsize", 2.7e9, "effective genome size (hs: 2.7e9, mm: 1.87e9)")
+	flag.Float64Var(&PVALUE, "pvalue", 0, "p-value threshold. If > 0, used instead of the q-value threshold")
+	flag.Float64Var(&QVALUE, "qvalue", 0.05, "q-value threshold")
+	flag.IntVar(&SHIFT, "shift", -75, "shift applied to the Tn5 insertions before the extension")
+	flag.IntVar(&EXTSIZE, "ext_size", 150, "size of the extension of the Tn5 insertions")
+	flag.IntVar(&LLOCAL, "llocal", 10000, "size of the window used to estimate the local lambda")
+	flag.IntVar(&MINLENGTH, "min_length", 150, "minimum peak length")
+	flag.IntVar(&MAXGAP, "max_gap", 30, "maximum gap between two significant regions to merge them into one peak")
+	flag.BoolVar(&TN5SHIFT, "tn5_shift", false, "shift the fragment ends by +4/-5 before inferring the Tn5 insertions")
+	flag.IntVar(&MINCELLS, "min_cells", 0, "minimum number of cells per cluster to call peaks")
+	flag.IntVar(&PSEUDOREP, "pseudo_rep", 0, "number of pseudo-replicates per group (cells randomly split)")
+	flag.Int64Var(&SEED, "seed", 2020, "seed used to create the pseudo-replicates")
+	flag.Var(&PEAKFILES, "peaks", "narrowPeak file(s) used to create the consensus peak set")
+	flag.IntVar(&PEAKWIDTH, "width", 501, "width of the consensus peaks centered on the summits")
+	flag.IntVar(&REPRODUCIBILITY, "reproducibility", 2, "minimum number of pseudo-replicates supporting a consensus peak")
+	flag.IntVar(&THREADNB, "threads", 1, "threads concurrency")
+	flag.Parse()
+
+	tStart := time.Now()
+
+	switch {
+	case callPeaks:
+		switch {
+		case len(BEDFILENAMES) == 0:
+			log.Fatal("Error at least one fragment bed file (-bed) must be provided!")
+		case PVALUE <= 0 && (QVALUE <= 0 || QVALUE >= 1):
+			log.Fatal("Error -qvalue must be in ]0, 1[ (or use -pvalue)!")
+		case EXTSIZE <= 0 || LLOCAL <= 0 || THREADNB <= 0:
+			log.Fatal("Error -ext_size, -llocal and -threads must be positive numbers!")
+		}
+
+		callPeaksForAllGroups()
+	case consensus:
+		switch {
+		case len(PEAKFILES) == 0:
+			log.Fatal("Error at least one narrowPeak file (-peaks) must be provided!")
+		case PEAKWIDTH <= 0:
+			log.Fatal("Error -width must be a positive number!")
+		}
+
+		createConsensusPeaks()
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	tDiff := time.Since(tStart)
+	fmt.Printf("done in time: %f s \n", tDiff.Seconds())
+}
+
+/*callPeaksForAllGroups load the insertions of each group (cluster) and call the peaks */
+func callPeaksForAllGroups() {
+	if CLUSTERFILE != "" {
+		loadClusterFile()
+	}
+
+	insertions, nbCells := loadInsertions()
+
+	groups := make([]string, 0, len(insertions))
+
+	for group := range insertions {
+		groups = append(groups, group)
+	}
+
+	sort.Strings(groups)
+
+	for _, group := range groups {
+		if nbCells[group] < MINCELLS {
+			fmt.Printf("group: %s skipped (%d cells)\n", group, nbCells[group])
+			continue
+		}
+
+		peaks := callPeaksForGroup(group, insertions[group])
+
+		writeNarrowPeak(groupFilename(group), peaks)
+	}
+}
+
+/*groupFilename return the narrowPeak file name of a group (or pseudo-replicate) */
+func groupFilename(group string) string {
+	switch {
+	case CLUSTERFILE != "":
+		return fmt.Sprintf("%s.%s.narrowPeak", FILENAMEOUT, group)
+	case group == ALLCELLS:
+		return fmt.Sprintf("%s.narrowPeak", FILENAMEOUT)
+	default:
+		return fmt.Sprintf("%s.%s.narrowPeak", FILENAMEOUT, strings.TrimPrefix(group, ALLCELLS + "."))
+	}
+}
+
+/*loadClusterFile load the <cell ID><TAB><cluster> file (lines starting with # are ignored) */
+func loadClusterFile() {
+	var split []string
+	var line string
+
+	CELLCLUSTER = make(map[string]string)
+
+	scanner, file := CLUSTERFILE.ReturnReader(0)
+	defer utils.CloseFile(file)
+
+	for scanner.Scan() {
+		line = scanner.Text()
+
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		split = strings.Split(line, "\t")
+
+		if len(split) < 2 {
+			log.Fatal(fmt.Sprintf("Error line: %s from %s cannot be splitted with <tab>", line, CLUSTERFILE))
+		}
+
+		CELLCLUSTER[strings.TrimSpace(split[0])] = strings.TrimSpace(split[1])
+	}
+}
+
+/*loadInsertions return the sorted Tn5 insertions per group (and pseudo-replicate: <group>.rep<i>) and per chromosome and the number of cells per group */
+func loadInsertions() (insertions map[string]map[string][]uint32, nbCells map[string]int) {
+	var split []string
+	var start, end, cut1, cut2 int
+	var err error
+	var group string
+	var groups []string
+	var isInside bool
+
+	insertions = make(map[string]map[string][]uint32)
+	nbCells = make(map[string]int)
+	cells := make(map[string]string)
+	random := rand.New(rand.NewSource(SEED))
+
+	for _, bedfile := range BEDFILENAMES {
+		fmt.Printf("loading fragments: %s...\n", bedfile)
+		scanner, file := utils.ReturnReader(bedfile, 0)
+
+		for scanner.Scan() {
+			split = strings.Split(scanner.Text(), "\t")
+
+			if len(split) < 3 {
+				continue
+			}
+
+			group = ALLCELLS
+
+			if CELLCLUSTER != nil {
+				if len(split) < 4 {
+					log.Fatal(fmt.Sprintf("Error no cell ID (4th column) in %s", bedfile))
+				}
+
+				if group, isInside = CELLCLUSTER[split[3]]; !isInside {
+					continue
+				}
+			}
+
+			groups = []string{group}
+
+			if len(split) > 3 {
+				if _, isInside = cells[split[3]];!isInside {
+					cells[split[3]] = ""
+					nbCells[group]++
+
+					if PSEUDOREP > 0 {
+						cells[split[3]] = fmt.Sprintf("%s.rep%d", group, random.Intn(PSEUDOREP) + 1)
+						nbCells[cells[split[3]]]++
+					}
+				}
+
+				if cells[split[3]] != "" {
+					groups = append(groups, cells[split[3]])
+				}
+			}
+
+			start, err = strconv.Atoi(split[1])
+			utils.Check(err)
+			end, err = strconv.Atoi(split[2])
+			utils.Check(err)
+
+			cut1, cut2 = utils.FragmentToCutSites(start, end, TN5SHIFT)
+
+			for _, group = range groups {
+				if insertions[group] == nil {
+					insertions[group] = make(map[string][]uint32)
+				}
+
+				if cut1 >= 0 {
+					insertions[group][split[0]] = append(insertions[group][split[0]], uint32(cut1))
+				}
+
+				if cut2 >= 0 {
+					insertions[group][split[0]] = append(insertions[group][split[0]], uint32(cut2))
+				}
+			}
+		}
+
+		utils.CloseFile(file)
+	}
+
+	for group := range insertions {
+		for chr := range insertions[group] {
+			positions := insertions[group][chr]
+			sort.Slice(positions, func(i, j int) bool {return positions[i] < positions[j]})
+		}
+	}
+
+	return insertions, nbCells
+}
+
+/*writeNarrowPeak write the peaks in narrowPeak format sorted by chromosome and position */
+func writeNarrowPeak(fname string, peaks []narrowPeak) {
+	var buffer bytes.Buffer
+
+	sort.Slice(peaks, func(i, j int) bool {
+		if peaks[i].chr != peaks[j].chr {
+			return peaks[i].chr < peaks[j].chr
+		}
+
+		return peaks[i].start < peaks[j].start
+	})
+
+	writer := utils.ReturnWriter(fname)
+	defer utils.CloseFile(writer)
+
+	for _, peak := range peaks {
+		buffer.WriteString(fmt.Sprintf("%s\t%d\t%d\t%s\t%d\t.\t%.5f\t%.5f\t%.5f\t%d\n",
+			peak.chr, peak.start, peak.end, peak.name,
+			int(10 * peak.qscore),
+			peak.fold, peak.pscore, peak.qscore, peak.summit - peak.start))
+	}
+
+	_, err := writer.Write(buffer.Bytes())
+	utils.Check(err)
+
+	fmt.Printf("%d peaks written in: %s\n", len(peaks), fname)
+}
@@ -0,0 +1,258 @@
+/* Consensus peak set using the iterative overlap procedure (ArchR) */
+
+package main
+
+
+import(
+	"bytes"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+)
+
+
+/*fixedPeak peak resized around its summit with its normalized score */
+type fixedPeak struct {
+	chr string
+	start, end int
+	score float64
+}
+
+/*peakGroup narrowPeak files of one group: the main peak file and its pseudo-replicates */
+type peakGroup struct {
+	main utils.Filename
+	replicates []utils.Filename
+}
+
+/*REPREGEXP pseudo-replicate suffix of a narrowPeak file */
+var REPREGEXP = regexp.MustCompile(`\.rep[0-9]+\.narrowPeak(\.gz)?$`)
+
+/*createConsensusPeaks create the consensus peak set from the narrowPeak files and write it as a bed file */
+func createConsensusPeaks() {
+	var allPeaks []fixedPeak
+
+	groups := groupPeakFiles()
+
+	names := make([]string, 0, len(groups))
+
+	for name := range groups {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		peaks := consensusForGroup(name, groups[name])
+		allPeaks = append(allPeaks, peaks...)
+	}
+
+	consensus := iterativeOverlap(allPeaks)
+
+	fmt.Printf("%d peaks kept after the iterative overlap across the %d groups\n", len(consensus), len(names))
+
+	writeConsensusBed(fmt.Sprintf("%s.consensus.bed", FILENAMEOUT), consensus)
+}
+
+/*groupPeakFiles group the narrowPeak files with their pseudo-replicates (<prefix>.rep<i>.narrowPeak) */
+func groupPeakFiles() (groups map[string]*peakGroup) {
+	groups = make(map[string]*peakGroup)
+
+	for _, fname := range PEAKFILES {
+		name := REPREGEXP.ReplaceAllString(fname, ".narrowPeak$1")
+		isReplicate := name != fname
+
+		if groups[name] == nil {
+			groups[name] = &peakGroup{}
+		}
+
+		if isReplicate {
+			groups[name].replicates = append(groups[name].replicates, utils.Filename(fname))
+		} else {
+			groups[name].main = utils.Filename(fname)
+		}
+	}
+
+	return groups
+}
+
+/*consensusForGroup iterative overlap of the peaks of one group filtered by their reproducibility across the pseudo-replicates */
+func consensusForGroup(name string, group *peakGroup) (peaks []fixedPeak) {
+	var repPeaks [][]fixedPeak
+
+	for _, fname := range group.replicates {
+		repPeaks = append(repPeaks, loadNarrowPeakAsFixed(fname))
+	}
+
+	if group.main != "" {
+		peaks = loadNarrowPeakAsFixed(group.main)
+	} else {
+		for _, rep := range repPeaks {
+			peaks = append(peaks, rep...)
+		}
+	}
+
+	peaks = iterativeOverlap(peaks)
+	nbPeaks := len(peaks)
+
+	minSupport := REPRODUCIBILITY
+
+	if minSupport > len(repPeaks) {
+		minSupport = len(repPeaks)
+	}
+
+	if minSupport > 0 {
+		trees := make([]utils.PeakIntervalTreeObject, len(repPeaks))
+
+		for i := range repPeaks {
+			trees[i] = createFixedPeakTree(repPeaks[i])
+		}
+
+		kept := peaks[:0]
+
+		for _, peak := range peaks {
+			support := 0
+
+			for i := range trees {
+				if len(trees[i].GetPeakIntervals(peak.toPeak(), true)) > 0 {
+					support++
+				}
+			}
+
+			if support >= minSupport {
+				kept = append(kept, peak)
+			}
+		}
+
+		peaks = kept
+	}
+
+	fmt.Printf("group: %s (%d pseudo-replicates): %d peaks after iterative overlap, %d reproducible peaks\n",
+		name, len(repPeaks), nbPeaks, len(peaks))
+
+	return peaks
+}
+
+/*loadNarrowPeakAsFixed load a narrowPeak file, resize the peaks to PEAKWIDTH around their summit and compute their score per million */
+func loadNarrowPeakAsFixed(fname utils.Filename) (peaks []fixedPeak) {
+	var split []string
+	var line string
+	var start, end, summit int
+	var score, total float64
+	var err error
+
+	scanner, file := fname.ReturnReader(0)
+	defer utils.CloseFile(file)
+
+	for scanner.Scan() {
+		line = scanner.Text()
+
+		if len(line) == 0 || line[0] == '#' || strings.HasPrefix(line, "track") {
+			continue
+		}
+
+		split = strings.Split(line, "\t")
+
+		if len(split) < 10 {
+			log.Fatal(fmt.Sprintf("Error line: %s from %s is not in narrowPeak format", line, fname))
+		}
+
+		start, err = strconv.Atoi(split[1])
+		utils.Check(err)
+		end, err = strconv.Atoi(split[2])
+		utils.Check(err)
+		score, err = strconv.ParseFloat(split[7], 64)
+		utils.Check(err)
+		summit, err = strconv.Atoi(split[9])
+		utils.Check(err)
+
+		if summit < 0 {
+			summit = (end - start) / 2
+		}
+
+		start = start + summit - PEAKWIDTH / 2
+
+		if start < 0 {
+			start = 0
+		}
+
+		peaks = append(peaks, fixedPeak{chr: split[0], start: start, end: start + PEAKWIDTH, score: score})
+		total += score
+	}
+
+	if total > 0 {
+		for i := range peaks {
+			peaks[i].score = 1e6 * peaks[i].score / total
+		}
+	}
+
+	return peaks
+}
+
+/*iterativeOverlap keep the peaks by decreasing score while removing the peaks overlapping an already kept peak */
+func iterativeOverlap(peaks []fixedPeak) (kept []fixedPeak) {
+	sorted := append([]fixedPeak{}, peaks...)
+
+	sort.SliceStable(sorted, func(i, j int) bool {return sorted[i].score > sorted[j].score})
+
+	tree := utils.NewPeakIntervalTreeObject()
+
+	for _, peak := range sorted {
+		if len(tree.GetPeakIntervals(peak.toPeak(), true)) > 0 {
+			continue
+		}
+
+		tree.InsertPeak(peak.toPeak(), uintptr(len(kept)), true)
+		kept = append(kept, peak)
+	}
+
+	return kept
+}
+
+/*createFixedPeakTree create the interval trees of the peaks */
+func createFixedPeakTree(peaks []fixedPeak) (tree utils.PeakIntervalTreeObject) {
+	tree = utils.NewPeakIntervalTreeObject()
+
+	for i, peak := range peaks {
+		tree.InsertPeak(peak.toPeak(), uintptr(i), true)
+	}
+
+	return tree
+}
+
+/*toPeak convert a fixed peak into a bed peak */
+func (peak fixedPeak) toPeak() utils.Peak {
+	return utils.Peak{
+		Slice: [3]string{peak.chr, strconv.Itoa(peak.start), strconv.Itoa(peak.end)},
+		Start: peak.start,
+		End: peak.end,
+	}
+}
+
+/*writeConsensusBed write the consensus peaks sorted by position (<chr><start><end>) */
+func writeConsensusBed(fname string, peaks []fixedPeak) {
+	var buffer bytes.Buffer
+
+	sort.Slice(peaks, func(i, j int) bool {
+		if peaks[i].chr != peaks[j].chr {
+			return peaks[i].chr < peaks[j].chr
+		}
+
+		return peaks[i].start < peaks[j].start
+	})
+
+	writer := utils.ReturnWriter(fname)
+	defer utils.CloseFile(writer)
+
+	for _, peak := range peaks {
+		buffer.WriteString(fmt.Sprintf("%s\t%d\t%d\n", peak.chr, peak.start, peak.end))
+	}
+
+	_, err := writer.Write(buffer.Bytes())
+	utils.Check(err)
+
+	fmt.Printf("%d consensus peaks written in: %s\n", len(peaks), fname)
+}
@@ -0,0 +1,314 @@
+/* Pileup of the Tn5 insertions, Poisson scores and peak detection */
+
+package main
+
+
+import(
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+
+/*POISSONMAXTERMS maximum number of terms of the Poisson upper tail sum */
+const POISSONMAXTERMS = 1000000
+
+
+/*narrowPeak one peak with its summit */
+type narrowPeak struct {
+	chr, name string
+	start, end, summit int
+	pileup int
+	pscore, qscore, fold float64
+}
+
+/*scoreKey pileup and number of insertions in the local lambda window of a segment */
+type scoreKey struct {
+	pileup, lambdaCount int
+}
+
+/*segment region [start, end) with a constant pileup and local lambda */
+type segment struct {
+	start, end int
+	key scoreKey
+}
+
+/*groupScorer compute and cache the -log10 p-values and q-values of a group */
+type groupScorer struct {
+	lambdaBG float64
+	pscores map[scoreKey]float64
+	qscores map[scoreKey]float64
+	lengths map[scoreKey]int
+	mutex sync.Mutex
+}
+
+/*callPeaksForGroup call the peaks of one group from its sorted insertions per chromosome */
+func callPeaksForGroup(group string, insertions map[string][]uint32) (peaks []narrowPeak) {
+	var nbInsertions int
+	var mutex sync.Mutex
+
+	chrs := make([]string, 0, len(insertions))
+
+	for chr, positions := range insertions {
+		chrs = append(chrs, chr)
+		nbInsertions += len(positions)
+	}
+
+	sort.Strings(chrs)
+
+	scorer := &groupScorer{
+		lambdaBG: float64(nbInsertions) * float64(EXTSIZE) / GENOMESIZE,
+		pscores: make(map[scoreKey]float64),
+		lengths: make(map[scoreKey]int),
+	}
+
+	fmt.Printf("group: %s: %d insertions, background lambda: %f\n", group, nbInsertions, scorer.lambdaBG)
+
+	// first pass: genome-wide distribution of the scores used for the q-values
+	parallelForChr(chrs, func(chr string) {
+		lengths := make(map[scoreKey]int)
+
+		sweepSegments(insertions[chr], func(seg segment) {
+			lengths[seg.key] += seg.end - seg.start
+		})
+
+		scorer.mutex.Lock()
+
+		for key, length := range lengths {
+			scorer.lengths[key] += length
+		}
+
+		scorer.mutex.Unlock()
+	})
+
+	scorer.computeScores()
+
+	// second pass: peak calling
+	parallelForChr(chrs, func(chr string) {
+		chrPeaks := callPeaksForChr(chr, insertions[chr], scorer)
+
+		mutex.Lock()
+		peaks = append(peaks, chrPeaks...)
+		mutex.Unlock()
+	})
+
+	sort.Slice(peaks, func(i, j int) bool {
+		if peaks[i].chr != peaks[j].chr {
+			return peaks[i].chr < peaks[j].chr
+		}
+
+		return peaks[i].start < peaks[j].start
+	})
+
+	for i := range peaks {
+		peaks[i].name = fmt.Sprintf("%s_peak_%d", group, i + 1)
+	}
+
+	return peaks
+}
+
+/*parallelForChr process the chromosomes using THREADNB threads */
+func parallelForChr(chrs []string, function func(chr string)) {
+	var waiting sync.WaitGroup
+
+	guard := make(chan bool, THREADNB)
+
+	for _, chr := range chrs {
+		waiting.Add(1)
+		guard <- true
+
+		go func(chr string) {
+			defer waiting.Done()
+			function(chr)
+			<-guard
+		}(chr)
+	}
+
+	waiting.Wait()
+}
+
+/*sweepSegments sweep the sorted insertions of one chromosome and call function for each segment with a non-zero pileup.
+Each insertion x covers [x + SHIFT, x + SHIFT + EXTSIZE) for the pileup and [x - LLOCAL / 2, x + LLOCAL / 2) for the local lambda */
+func sweepSegments(positions []uint32, function func(seg segment)) {
+	var pileup, lambdaCount int
+	var pos, next int
+	var ptrs [4]int
+
+	n := len(positions)
+	offsets := [4]int{SHIFT, SHIFT + EXTSIZE, -LLOCAL / 2, LLOCAL - LLOCAL / 2}
+	deltas := [4]int{1, -1, 1, -1}
+
+	eventPos := func(event, ptr int) int {
+		value := int(positions[ptr]) + offsets[event]
+
+		if value < 0 {
+			return 0
+		}
+
+		return value
+	}
+
+	nextEvent := func() (next int) {
+		next = math.MaxInt64
+
+		for event := range ptrs {
+			if ptrs[event] < n {
+				if value := eventPos(event, ptrs[event]); value < next {
+					next = value
+				}
+			}
+		}
+
+		return next
+	}
+
+	pos = nextEvent()
+
+	for pos != math.MaxInt64 {
+		for event := range ptrs {
+			for ptrs[event] < n && eventPos(event, ptrs[event]) == pos {
+				if event < 2 {
+					pileup += deltas[event]
+				} else {
+					lambdaCount += deltas[event]
+				}
+
+				ptrs[event]++
+			}
+		}
+
+		next = nextEvent()
+
+		if pileup > 0 && next != math.MaxInt64 && next > pos {
+			function(segment{start: pos, end: next, key: scoreKey{pileup, lambdaCount}})
+		}
+
+		pos = next
+	}
+}
+
+/*lambda local lambda: max(background lambda, lambda of the -llocal window) */
+func (s *groupScorer) lambda(key scoreKey) float64 {
+	return math.Max(s.lambdaBG, float64(key.lambdaCount) * float64(EXTSIZE) / float64(LLOCAL))
+}
+
+/*computeScores compute the -log10 p-values and the Benjamini-Hochberg -log10 q-values (using the effective genome size as number of tests) */
+func (s *groupScorer) computeScores() {
+	keys := make([]scoreKey, 0, len(s.lengths))
+
+	for key := range s.lengths {
+		s.pscores[key] = poissonUpperLog10Pvalue(key.pileup, s.lambda(key))
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {return s.pscores[keys[i]] > s.pscores[keys[j]]})
+
+	s.qscores = make(map[scoreKey]float64, len(keys))
+	qscores := make([]float64, len(keys))
+	cumulLength := 0
+
+	for i, key := range keys {
+		cumulLength += s.lengths[key]
+		qscores[i] = s.pscores[key] - math.Log10(GENOMESIZE) + math.Log10(float64(cumulLength))
+	}
+
+	// q-values are monotone: q_i = min(q_j) for j >= i (in -log10: max)
+	for i := len(keys) - 1; i >= 0; i-- {
+		if i < len(keys) - 1 && qscores[i + 1] > qscores[i] {
+			qscores[i] = qscores[i + 1]
+		}
+
+		if qscores[i] < 0 {
+			qscores[i] = 0
+		}
+	}
+
+	for i, key := range keys {
+		s.qscores[key] = qscores[i]
+	}
+}
+
+/*isSignificant check if a segment passes the p-value or q-value threshold */
+func (s *groupScorer) isSignificant(key scoreKey) bool {
+	if PVALUE > 0 {
+		return s.pscores[key] >= -math.Log10(PVALUE)
+	}
+
+	return s.qscores[key] >= -math.Log10(QVALUE)
+}
+
+/*callPeaksForChr merge the significant segments of one chromosome into peaks */
+func callPeaksForChr(chr string, positions []uint32, scorer *groupScorer) (peaks []narrowPeak) {
+	var current narrowPeak
+	var isOpen bool
+
+	closePeak := func() {
+		if isOpen && current.end - current.start >= MINLENGTH {
+			peaks = append(peaks, current)
+		}
+
+		isOpen = false
+	}
+
+	sweepSegments(positions, func(seg segment) {
+		if !scorer.isSignificant(seg.key) {
+			return
+		}
+
+		if isOpen && seg.start - current.end > MAXGAP {
+			closePeak()
+		}
+
+		if !isOpen {
+			current = narrowPeak{chr: chr, start: seg.start}
+			isOpen = true
+		}
+
+		current.end = seg.end
+
+		if seg.key.pileup > current.pileup {
+			lambda := scorer.lambda(seg.key)
+			current.pileup = seg.key.pileup
+			current.summit = (seg.start + seg.end) / 2
+			current.pscore = scorer.pscores[seg.key]
+			current.qscore = scorer.qscores[seg.key]
+			current.fold = (float64(seg.key.pileup) + 1.0) / (lambda + 1.0)
+		}
+	})
+
+	closePeak()
+
+	return peaks
+}
+
+/*poissonUpperLog10Pvalue -log10 P(X >= k) with X ~ Poisson(lambda) (0 if k <= lambda) */
+func poissonUpperLog10Pvalue(k int, lambda float64) float64 {
+	if k <= 0 || float64(k) <= lambda {
+		return 0
+	}
+
+	// log P(X = k) + log(sum_{i >= k} P(X = i) / P(X = k)), the terms decrease since i > lambda
+	lgammaK, _ := math.Lgamma(float64(k + 1))
+	logTerm := float64(k) * math.Log(lambda) - lambda - lgammaK
+
+	sum, logRatio := 1.0, 0.0
+
+	for i := k + 1; i <= k + POISSONMAXTERMS; i++ {
+		logRatio += math.Log(lambda / float64(i))
+		term := math.Exp(logRatio)
+		sum += term
+
+		if term < 1e-15 * sum {
+			break
+		}
+	}
+
+	log10Pvalue := (logTerm + math.Log(sum)) / math.Ln10
+
+	if log10Pvalue > 0 {
+		return 0
+	}
+
+	return -log10Pvalue
+}
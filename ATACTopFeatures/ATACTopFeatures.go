@@ -10,14 +10,13 @@ import (
 	"strconv"
 	"github.com/biogo/store/interval"
 	"sync"
+	"sync/atomic"
 	"time"
 	stats "github.com/glycerine/golang-fisher-exact"
 	"sort"
 	"bytes"
 	"path"
 	"os"
-	"path/filepath"
-	"runtime"
 )
 
 type peakFeature struct {
@@ -27,20 +26,11 @@ type peakFeature struct {
 	pvalue float64
 	qvalue float64
 	n11, n21 int
+	reads int64
 }
 
-type chi2feature struct {
-	id uintptr
-	clusterID, cellID int
-}
-
-type cellpeak struct {
-	cellID int
-	peakID uintptr
-}
-
-/*CELLPEAKMAPPING map[(cell, peak)] is used */
-var CELLPEAKMAPPING map[cellpeak]bool
+/*PEAKCELLSHARDS map[thread][peak ID] cells with the peak found by the thread*/
+var PEAKCELLSHARDS [][]*cellBitmap
 
 /*BEDFILENAME bed file name (input) */
 var BEDFILENAME utils.Filename
@@ -102,6 +92,12 @@ var CLUSTERSUM []int
 /*TOTALNBCELLS  total nb of cells*/
 var TOTALNBCELLS int
 
+/*CLUSTERDEPTH  nb of reads of the cells of each cluster*/
+var CLUSTERDEPTH []int64
+
+/*CELLDEPTH  cell ID <int> -> nb of reads*/
+var CELLDEPTH []int64
+
 /*BUFFERSIZE buffer size for multithreading */
 const BUFFERSIZE = 50000
 
@@ -111,8 +107,6 @@ const SMALLBUFFERSIZE = 50000
 /*BUFFERARRAY map slice: [THREAD][BUFFERSIZE]line*/
 var BUFFERARRAY [][BUFFERSIZE]string
 
-/*BUFFERRESARRAY map slice: [THREAD][BUFFERSIZE]line*/
-var BUFFERRESARRAY [][BUFFERSIZE]chi2feature
 
 /*CHI2SCORE map[cluster ID][peak ID]count*/
 var CHI2SCORE [][]peakFeature
@@ -129,22 +123,81 @@ var MUTEX sync.Mutex
 /*WRITEALL Write all features even the not significant one*/
 var WRITEALL bool
 
+/*TESTTYPE statistical test of the contingency tables (fisher|chi2)*/
+var TESTTYPE string
+
+/*ALTERNATIVE alternative hypothesis of the contingency table tests (greater|two-sided)*/
+var ALTERNATIVE string
+
+/*CONTINGENCYTEST compute the pvalues of a contingency table file*/
+var CONTINGENCYTEST bool
+
+/*CONTINGENCYFILE contingency table file (input of CONTINGENCYTEST)*/
+var CONTINGENCYFILE utils.Filename
+
+/*DIFFANALYSIS depth-aware differential accessibility analysis from a (cell x peak) matrix*/
+var DIFFANALYSIS bool
+
+/*MATRIXFILE (cell x peak) matrix file (COO, mtx or binary from ATACMatUtils)*/
+var MATRIXFILE utils.Filename
+
+/*CELLSIDFNAME file with the ordered cell IDs of the matrix rows*/
+var CELLSIDFNAME utils.Filename
+
+/*DEPTHFILE cell depth file (<cell ID><nb of fragments>)*/
+var DEPTHFILE utils.Filename
+
+/*IDENT1 foreground cluster of the differential analysis*/
+var IDENT1 string
+
+/*IDENT2 background cluster of the differential analysis (all the other cells if empty)*/
+var IDENT2 string
+
+/*MINPCT minimum fraction of cells with the peak in one of the groups to test a peak*/
+var MINPCT float64
+
+/*PSEUDOBULK pseudobulk negative binomial differential accessibility analysis*/
+var PSEUDOBULK bool
+
+/*SAMPLEFILE cell ID -> sample file (<cell ID><sample>)*/
+var SAMPLEFILE utils.Filename
+
+/*MINCELLS minimum number of cells of a pseudobulk library*/
+var MINCELLS int
+
+/*ENTROPYANALYSIS entropy-based feature selection*/
+var ENTROPYANALYSIS bool
+
 
 func main() {
+	var correction string
+
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, `
 #################### MODULE TO INFER SIGNIFICANT CLUSTER PEAKS ########################
 """Full annotation workflow. The input files are: A) single-cell bed file, B) peak regions in bed format, C) two-columns barcode/clusterID file in tsv format, and optionally D) a reference 4-columns bed file (<chr><start><end><annotation>) to annotate the peaks
-USAGE: ATACTopFeatures -workflow -bed <fname> -peak <fname> -cluster <fname> -out <folder> (optional -threads <int> -ref <file> -split <int> -alpha <float> -write_all -symbol <file>)_
+USAGE: ATACTopFeatures -workflow (-bed <fname> OR -matrix <fname> -xgi <fname>) -peak <fname> -cluster <fname> -out <folder> (optional -test <fisher|chi2> -alternative <greater|two-sided> -correction <bh,by,bonferroni,holm,storey> -threads <int> -ref <file> -split <int> -alpha <float> -write_all -contrasts <fname> -symbol <file>)_
+
+"""full individual test computation (chi2 by default or fisher exact test with -test fisher, one-sided alternative greater by default, see -alternative) for each peak with FDR correction (Benjamini-Hochberg by default, see -correction)"""
+USAGE: ATACTopFeatures -chi2 (-bed <fname> OR -matrix <fname> -xgi <fname>) -peak <fname> -cluster <fname> (optional -test <fisher|chi2> -alternative <greater|two-sided> -correction <bh,by,bonferroni,holm,storey> -out <string> -threads <int> -alpha <float> -write_all -split <int> -contrasts <fname>)
 
-"""full individual chi2 computation for each peak with FDR correction using Benjamini-Hochberg correction. Not recommended because using golang suboptimal chi2 implementation"""
-USAGE: ATACTopFeatures -chi2 -bed <fname> -peak <fname> -cluster <fname> (optional -out <string> -threads <int> -alpha <float> -write_all -split <int>)
+"""compute the odd ratio and the pvalue (one-sided fisher exact test by default) of each line of a contingency table file (from -create_contingency)"""
+USAGE: ATACTopFeatures -test_contingency -contingency_table <fname> (optional -test <fisher|chi2> -alternative <greater|two-sided> -out <string> -threads <int>)
 
 """Create contingency table for each feature and each cluster"""
-USAGE: ATACTopFeatures -create_contingency -bed <fname> -peak <fname> -cluster <fname> (optional -out <string> -threads <int> -symbol <file>)
+USAGE: ATACTopFeatures -create_contingency (-bed <fname> OR -matrix <fname> -xgi <fname>) -peak <fname> -cluster <fname> (optional -out <string> -threads <int> -symbol <file> -contrasts <fname>)
+
+"""depth-aware differential accessibility from a (cell x peak) matrix: logistic regression with the log depth as covariate (-test lr, default) or wilcoxon rank-sum test (-test wilcox) on the normalized accessibility log1p(count / depth * 10000), for each cluster vs the other cells or for -ident1 vs -ident2"""
+USAGE: ATACTopFeatures -da -matrix <fname> -peak <fname> -cluster <fname> (optional -xgi <fname> -test <lr|wilcox> -ident1 <cluster> -ident2 <cluster> -contrasts <fname> -depth <fname> -min_pct <float> -correction <bh,by,bonferroni,holm,storey> -out <string> -threads <int> -alpha <float> -write_all -symbol <file>)
+
+"""pseudobulk differential accessibility: the counts are summed per cluster x sample (from a (cell x peak) matrix or the reads in the peak from a bed file), normalized with TMM and tested with a negative binomial GLM with empirical Bayes dispersions (likelihood ratio test, or wald test with -test wald), for each cluster vs the other clusters or for -ident1 vs -ident2"""
+USAGE: ATACTopFeatures -pseudobulk -sample <fname> -peak <fname> -cluster <fname> (-matrix <fname> (optional -xgi <fname>) OR -bed <fname>) (optional -test <lrt|wald> -ident1 <cluster> -ident2 <cluster> -contrasts <fname> -min_cells <int> -correction <bh,by,bonferroni,holm,storey> -out <string> -threads <int> -alpha <float> -write_all -symbol <file>)
+
+"""entropy-based feature selection (port of scripts/snATAC_entropy_feature): Shannon entropy of the cluster-level relative accessibility of each peak and entropy score Q = entropy - log(p cluster) of each (cluster, peak). The significant low Q scores are obtained with a Gaussian mixture fitted on the log Q scores, excluding the -perc_significant lowest scores of each cluster"""
+USAGE: ATACTopFeatures -entropy -peak <fname> -cluster <fname> (-matrix <fname> (optional -xgi <fname>) OR -bed <fname>) (optional -depth <fname> -perc_significant <float> -top_k <int> -alpha <float> -write_all -out <string> -threads <int> -symbol <file>)
 
 """correct feature pvalue for multiple tests performed or each cluster"""
-USAGE: ATACTopFeatures -pvalue_correction -ptable <fname> (optional -out <string> -threads <int> -alpha <float> -write_all)
+USAGE: ATACTopFeatures -pvalue_correction -ptable <fname> (optional -correction <bh,by,bonferroni,holm,storey> -storey_lambda <float> -out <string> -threads <int> -alpha <float> -write_all)
 
 
 `)
@@ -156,23 +209,135 @@ USAGE: ATACTopFeatures -pvalue_correction -ptable <fname> (optional -out <string
 	flag.Var(&REFFILE, "ref", "name of the reference bed file containing genome annotation (four-columns)")
 	flag.BoolVar(&WORKFLOW, "workflow", false, "Execute full top feature workflow")
 	flag.Var(&PEAKFILE, "peak", "File containing peaks")
+	flag.Var(&PEAKFILE, "ygi", "File containing peaks (alias of -peak, for the columns of -matrix)")
 	flag.Var(&PEAKSYMBOLFILE, "symbol", `File containing symbols (such as gene name) for peak file.
      Each row should either contain one symbol per line and matches the peaks from -peak OR option2:<symbol>\t<chromosome>\t<start>\t<stop>\n`)
 	flag.Var(&CLUSTERFILE, "cluster", "File containing cluster")
-	flag.Var(&FEATUREPVALUEFILE, "ptable", `File containing pvalue for each interval feature
-                row scheme: <chromosome>\t<start>\t<stop>\t<cluster ID>\t<pvalue>\n`)
+	flag.Var(&FEATUREPVALUEFILE, "ptable", fmt.Sprintf(`File containing pvalue for each interval feature (from -test_contingency)
+                row scheme: <chromosome>\t<start>\t<stop>\t<cluster ID>(\t<symbol>)(\t<%s>)\t<OR>\t<pvalue>\n
+                the optional symbol and effect columns are defined by the header line (#chr\tstart\tstop\tcluster(\tsymbol)\t%s\tOR\tpvalue)`,
+		strings.Join(EFFECTCOLUMNS, `>\t<`), strings.Join(EFFECTCOLUMNS, `\t`)))
 	flag.StringVar(&FILENAMEOUT, "out", "", "name the output file(s)")
 	flag.IntVar(&THREADNB, "threads", 1, "threads concurrency")
 	flag.IntVar(&SPLIT, "split", 0, "Split the input set of peaks into multiple subsets (The number is defined by the -split option) processed one by one for memory efficiency.")
-	flag.Float64Var(&ALPHA, "alpha", 0.05, "Decision threshold")
+	flag.Float64Var(&ALPHA, "alpha", 0.05, "Decision threshold (on the adjusted pvalues)")
+	flag.StringVar(&correction, "correction", "bh", `multiple test correction method(s) (comma-separated) among: bh (Benjamini-Hochberg), by (Benjamini-Yekutieli), bonferroni, holm, storey (q-values).
+     The first method defines the qvalue column and the significant features, the other ones are written as additional qvalue_<method> columns`)
+	flag.Float64Var(&STOREYLAMBDA, "storey_lambda", 0.5, "lambda used to estimate the proportion of null features for the storey correction")
 	flag.BoolVar(&WRITEALL, "write_all", false, "Write all features including the not significant ones")
 	flag.BoolVar(&CHI2ANALYSIS, "chi2", false, `perform chi2 analysis with multiple test correction`)
 	flag.BoolVar(&CREATECONTINGENCY, "create_contingency", false, `Create contingency table for each feature and each cluster`)
 	flag.BoolVar(&MULTIPLETESTS, "pvalue_correction", false, `correct feature pvalue for multiple tests performed or each cluster`)
+	flag.BoolVar(&CONTINGENCYTEST, "test_contingency", false, `compute the pvalue of each line of a contingency table file`)
+	flag.Var(&CONTINGENCYFILE, "contingency_table", fmt.Sprintf(`Contingency table file (from -create_contingency)
+                row scheme: <chromosome>\t<start>\t<stop>\t<cluster ID>(\t<symbol>)\t<%s>\t<n11>\t<n12>\t<n21>\t<n22>\n
+                the columns before the last four ones are copied in the output of -test_contingency`,
+		strings.Join(EFFECTCOLUMNS, `>\t<`)))
+	flag.StringVar(&TESTTYPE, "test", "", `statistical test: fisher (exact test) or chi2 for the contingency tables and lr (logistic regression) or wilcox (wilcoxon rank-sum) with -da and lrt (likelihood ratio test) or wald with -pseudobulk.
+     Default: chi2 with -chi2, lr with -da, lrt with -pseudobulk and fisher otherwise`)
+	flag.StringVar(&ALTERNATIVE, "alternative", "greater", `alternative hypothesis of the fisher and chi2 tests: greater (enrichment of the peak in the cluster, as scripts/snATAC_feature_selection) or two-sided.
+     With two-sided, the depleted peaks (odd ratio < 1) can be significant`)
+	flag.BoolVar(&DIFFANALYSIS, "da", false, `depth-aware differential accessibility analysis from a (cell x peak) matrix`)
+	flag.Var(&MATRIXFILE, "matrix", "(cell x peak) matrix file (COO, mtx or binary from ATACMatUtils). The columns follow -peak")
+	flag.Var(&CELLSIDFNAME, "xgi", "file with the ordered cell IDs of the matrix rows (optional for binary matrices)")
+	flag.Var(&DEPTHFILE, "depth", "cell depth file (<cell ID><TAB><nb of fragments>). Default: number of reads in peaks of each cell")
+	flag.StringVar(&IDENT1, "ident1", "", "foreground cluster of the differential analysis (default: each cluster)")
+	flag.StringVar(&IDENT2, "ident2", "", "background cluster of the differential analysis (default: all the other cells)")
+	flag.Float64Var(&MINPCT, "min_pct", 0.05, "minimum fraction of cells with the peak in one of the groups to test a peak (-da)")
+	flag.BoolVar(&PSEUDOBULK, "pseudobulk", false, `pseudobulk negative binomial differential accessibility analysis (edgeR / DESeq2 like) using the samples of the cells`)
+	flag.Var(&SAMPLEFILE, "sample", "two-columns cell ID / sample file in tsv format (-pseudobulk)")
+	flag.IntVar(&MINCELLS, "min_cells", 2, "minimum number of cells of a pseudobulk library (-pseudobulk)")
+	flag.BoolVar(&ENTROPYANALYSIS, "entropy", false, `entropy-based feature selection with a Gaussian mixture threshold on the entropy scores`)
+	flag.Float64Var(&PERCSIGNIFICANT, "perc_significant", 0.10, "expected fraction of significant features per cluster, excluded from the null fit (-entropy)")
+	flag.IntVar(&TOPK, "top_k", 20, "number of top features per cluster always written (-entropy)")
+	flag.Var(&CONTRASTFILE, "contrasts", `contrast specification file (instead of each cluster vs all the other cells)
+                row scheme: <name>\t<foreground clusters>\t<background clusters>\n (comma-separated clusters, '*' background: all the other cells, '*' foreground: each cluster of the background vs the other ones)`)
 
 	flag.Parse()
 
+	parseCorrections(correction)
+
+	if STOREYLAMBDA <= 0 || STOREYLAMBDA >= 1 {
+		log.Fatal("-storey_lambda must be in ]0, 1[!\n")
+	}
+
+	if TESTTYPE == "" {
+		switch {
+		case CHI2ANALYSIS:
+			TESTTYPE = "chi2"
+		case DIFFANALYSIS:
+			TESTTYPE = "lr"
+		case PSEUDOBULK:
+			TESTTYPE = "lrt"
+		default:
+			TESTTYPE = "fisher"
+		}
+	}
+
+	switch {
+	case DIFFANALYSIS && TESTTYPE != "lr" && TESTTYPE != "wilcox":
+		log.Fatal("-test must be lr or wilcox with -da!\n")
+	case PSEUDOBULK && TESTTYPE != "lrt" && TESTTYPE != "wald":
+		log.Fatal("-test must be lrt or wald with -pseudobulk!\n")
+	case !DIFFANALYSIS && !PSEUDOBULK && TESTTYPE != "fisher" && TESTTYPE != "chi2":
+		log.Fatal("-test must be fisher or chi2!\n")
+	case ALTERNATIVE != "greater" && ALTERNATIVE != "two-sided":
+		log.Fatal("-alternative must be greater or two-sided!\n")
+	}
+
 	switch {
+	case CONTRASTFILE != "" && IDENT1 != "":
+		log.Fatal("-contrasts cannot be used with -ident1!\n")
+	case CONTRASTFILE != "" && ENTROPYANALYSIS:
+		log.Fatal("-contrasts cannot be used with -entropy (the entropy is computed across all the clusters)!\n")
+	}
+
+	switch {
+	case DIFFANALYSIS:
+		switch {
+		case MATRIXFILE == "" || PEAKFILE == "" || CLUSTERFILE == "":
+			log.Fatal("-matrix, -peak and -cluster must be provided!\n")
+		case IDENT2 != "" && IDENT1 == "":
+			log.Fatal("-ident1 must be provided with -ident2!\n")
+		}
+
+		launchDifferentialAnalysis()
+		return
+	case PSEUDOBULK:
+		switch {
+		case (MATRIXFILE == "" && BEDFILENAME == "") || PEAKFILE == "" || CLUSTERFILE == "" || SAMPLEFILE == "":
+			log.Fatal("-matrix (or -bed), -peak, -cluster and -sample must be provided!\n")
+		case IDENT2 != "" && IDENT1 == "":
+			log.Fatal("-ident1 must be provided with -ident2!\n")
+		case MINCELLS < 1:
+			log.Fatal("-min_cells must be >= 1!\n")
+		}
+
+		launchPseudobulkAnalysis()
+		return
+	case ENTROPYANALYSIS:
+		switch {
+		case (MATRIXFILE == "" && BEDFILENAME == "") || PEAKFILE == "" || CLUSTERFILE == "":
+			log.Fatal("-matrix (or -bed), -peak and -cluster must be provided!\n")
+		case PERCSIGNIFICANT < 0 || PERCSIGNIFICANT >= 1:
+			log.Fatal("-perc_significant must be in [0, 1[!\n")
+		}
+
+		launchEntropyFeatureSelection()
+		return
+	case CONTINGENCYTEST:
+		if CONTINGENCYFILE == "" {
+			log.Fatal("-contingency_table must be provided!\n")
+		}
+
+		if FILENAMEOUT == "" {
+			ext := path.Ext(CONTINGENCYFILE.String())
+			FILENAMEOUT = fmt.Sprintf("%s.%s%s",
+				CONTINGENCYFILE[:len(CONTINGENCYFILE)-len(ext)], TESTTYPE, ext)
+		}
+
+		testContingencyTable(CONTINGENCYFILE, FILENAMEOUT)
+		return
 	case MULTIPLETESTS:
 		if FEATUREPVALUEFILE == "" {
 			log.Fatal("-ptable must be provided!\n")
@@ -183,8 +348,8 @@ USAGE: ATACTopFeatures -pvalue_correction -ptable <fname> (optional -out <string
 	}
 
 	switch {
-	case BEDFILENAME == "":
-		log.Fatal("-bed must be provided!\n")
+	case BEDFILENAME == "" && MATRIXFILE == "":
+		log.Fatal("-bed or -matrix must be provided!\n")
 
 	case PEAKFILE == "":
 		log.Fatal("-peak must be provided!\n")
@@ -210,23 +375,6 @@ USAGE: ATACTopFeatures -pvalue_correction -ptable <fname> (optional -out <string
 
 
 func launchTopFeaturesWorkflow() {
-	_, filename, _, _ := runtime.Caller(1)
-
-	currentDir, err := filepath.Abs(filename)
-	currentDir = filepath.Dir(currentDir)
-	utils.Check(err)
-
-	pythonFeaturesScript := fmt.Sprintf("%s/../scripts/snATAC_feature_selection", currentDir)
-	utils.AssertIfFileExists(pythonFeaturesScript)
-
-	cmd := fmt.Sprintf("%s -h", pythonFeaturesScript)
-	err = utils.TryExceCmd(cmd)
-
-	if err != nil {
-		panic(fmt.Sprintf("#### Error when trying to launch %s. Maybe try to install scipy dependency (pip install scipy)?",
-			pythonFeaturesScript))
-	}
-
 	folderName := FILENAMEOUT
 
 	if !utils.CheckIfFolderExists(folderName) {
@@ -236,26 +384,38 @@ func launchTopFeaturesWorkflow() {
 
 	FILENAMEOUT = fmt.Sprintf("%s/table.contingency", folderName)
 
+	var contrastNames []string
+
 	if SPLIT > 1 {
-			createContingencyTableUsingSubsets()
+			contrastNames = createContingencyTableUsingSubsets()
 		} else {
-			createContingencyTable()
+			contrastNames = createContingencyTable()
 		}
 
-	cmd = fmt.Sprintf(
-		"%s -contingency_table %s -threads %d -verbose 0 -test fisher -out %s/table.fisher",
-		pythonFeaturesScript, FILENAMEOUT, THREADNB, folderName)
-	fmt.Printf("%s\n", utils.ExceCmdReturnOutput(cmd))
+	// one table prefix per contrast: <folder>/table.<contrast>
+	prefixes := []string{fmt.Sprintf("%s/table", folderName)}
+
+	if contrastNames != nil {
+		prefixes = nil
 
-	FEATUREPVALUEFILE = utils.Filename(fmt.Sprintf("%s/table.fisher", folderName))
-	FILENAMEOUT = fmt.Sprintf("%s/table.fisher.corrected", folderName)
+		for _, name := range contrastNames {
+			prefixes = append(prefixes, fmt.Sprintf("%s/table.%s", folderName, name))
+		}
+	}
 
-	launchMultipleTestAnalysis()
+	for _, prefix := range prefixes {
+		testContingencyTable(utils.Filename(fmt.Sprintf("%s.contingency", prefix)), fmt.Sprintf("%s.%s", prefix, TESTTYPE))
 
-	if REFFILE != "" {
-		fmt.Printf("#### ANNOTATING specific features with ref bed file...\n")
-		cmd = fmt.Sprintf("ATACAnnotateRegions -bed %s/table.fisher.corrected -ref %s -bed_pos 0,1,2 -annotate_line -ignore -unique -out %s/table.fisher.corrected.annotated", folderName, REFFILE, folderName)
-		fmt.Printf("%s\n", utils.ExceCmdReturnOutput(cmd))
+		FEATUREPVALUEFILE = utils.Filename(fmt.Sprintf("%s.%s", prefix, TESTTYPE))
+		FILENAMEOUT = fmt.Sprintf("%s.%s.corrected", prefix, TESTTYPE)
+
+		launchMultipleTestAnalysis()
+
+		if REFFILE != "" {
+			fmt.Printf("#### ANNOTATING specific features with ref bed file...\n")
+			cmd := fmt.Sprintf("ATACAnnotateRegions -bed %s.%s.corrected -ref %s -bed_pos 0,1,2 -annotate_line -ignore -unique -out %s.%s.corrected.annotated", prefix, TESTTYPE, REFFILE, prefix, TESTTYPE)
+			fmt.Printf("%s\n", utils.ExceCmdReturnOutput(cmd))
+		}
 	}
 }
 
@@ -275,14 +435,15 @@ func launchMultipleTestAnalysis() {
 }
 
 
-func createContingencyTable() {
+/*createContingencyTable create the contingency table (one table per contrast with -contrasts, returning the contrast names)*/
+func createContingencyTable() (contrastNames []string) {
 	BUFFERARRAY = make([][BUFFERSIZE]string, THREADNB)
-	BUFFERRESARRAY = make([][BUFFERSIZE]chi2feature, THREADNB)
 
 	if FILENAMEOUT == "" {
-		ext := path.Ext(BEDFILENAME.String())
+		input := inputFilename()
+		ext := path.Ext(input.String())
 		FILENAMEOUT = fmt.Sprintf("%s.contingency_table.tsv",
-			BEDFILENAME[:len(BEDFILENAME)-len(ext)])
+			input[:len(input)-len(ext)])
 	}
 
 	tStart := time.Now()
@@ -290,69 +451,115 @@ func createContingencyTable() {
 	utils.LoadSymbolFile(PEAKSYMBOLFILE, PEAKFILE)
 	utils.LoadPeaks(PEAKFILE, false, true)
 	loadCellClusterIDAndInitMaps()
-	utils.CreatePeakIntervalTree()
-	utils.InitIntervalDictsThreading(THREADNB)
 	createPeakMappingDict()
-	scanBedFile()
-	writeContingencyTable(FILENAMEOUT, true)
+	loadCellPeakCounts(0)
+	contrastNames = writeContingencyTables(FILENAMEOUT, "", true)
 
 	tDiff := time.Since(tStart)
 	fmt.Printf("Create contingency table done in time: %f s \n", tDiff.Seconds())
 
+	return contrastNames
 }
 
-func createContingencyTableUsingSubsets() {
+func createContingencyTableUsingSubsets() (contrastNames []string) {
 	var chunk, firstPeak, lastPeak int
-	var filenameout string
-	var filenames []string
+	var suffix string
+
+	filenames := make(map[string][]string)
 
 	BUFFERARRAY = make([][BUFFERSIZE]string, THREADNB)
-	BUFFERRESARRAY = make([][BUFFERSIZE]chi2feature, THREADNB)
 
 	if FILENAMEOUT == "" {
-		ext := path.Ext(BEDFILENAME.String())
+		input := inputFilename()
+		ext := path.Ext(input.String())
 		FILENAMEOUT = fmt.Sprintf("%s.contingency_table.tsv",
-			BEDFILENAME[:len(BEDFILENAME)-len(ext)])
+			input[:len(input)-len(ext)])
 	}
 
 	utils.LoadSymbolFile(PEAKSYMBOLFILE, PEAKFILE)
 	utils.LoadPeaks(PEAKFILE, false, true)
 
+	// the matrix is loaded once with all the peaks
+	if MATRIXFILE != "" {
+		createPeakMappingDict()
+		loadContingencyMatrix()
+	}
+
 	chunk = (len(utils.PEAKIDDICT) + SPLIT) / SPLIT
 	lastPeak = chunk
 
 	tStart := time.Now()
 
 	for i := 0; i < SPLIT; i ++ {
-		filenameout = fmt.Sprintf("%s.%d", FILENAMEOUT, i)
+		suffix = fmt.Sprintf(".%d", i)
 
 		fmt.Printf("Processing set of peaks: (start: %d  end:%d)\n", firstPeak, lastPeak)
 		utils.LoadPeaksSubset(PEAKFILE, firstPeak, lastPeak)
 		utils.LoadSymbolFile(PEAKSYMBOLFILE, PEAKFILE)
 		loadCellClusterIDAndInitMaps()
-
-		utils.CreatePeakIntervalTree()
-		utils.InitIntervalDictsThreading(THREADNB)
-
 		createPeakMappingDict()
-		scanBedFile()
-		writeContingencyTable(filenameout, i == 0)
+		loadCellPeakCounts(firstPeak)
+		contrastNames = writeContingencyTables(FILENAMEOUT, suffix, i == 0)
 
 		lastPeak += chunk
 		firstPeak += chunk
 
-		filenames = append(filenames, filenameout)
+		for _, filenameout := range contrastFilenames(FILENAMEOUT, contrastNames) {
+			filenames[filenameout] = append(filenames[filenameout], filenameout + suffix)
+		}
 	}
 
 	fmt.Printf("Combining contingency table and cleaning...\n")
-	mergeAndCleanTmpContingencyTables(filenames)
+
+	for _, filenameout := range contrastFilenames(FILENAMEOUT, contrastNames) {
+		mergeAndCleanTmpContingencyTables(filenames[filenameout], filenameout)
+	}
 
 	tDiff := time.Since(tStart)
 	fmt.Printf("Create contingency table done in time: %f s \n", tDiff.Seconds())
+
+	return contrastNames
 }
 
+/*writeContingencyTables write the contingency table of the clusters in filenameout + suffix or,
+with -contrasts, the table of each contrast in the contrast output file + suffix (returning the contrast names)*/
+func writeContingencyTables(filenameout, suffix string, header bool) (contrastNames []string) {
+	if CONTRASTFILE == "" {
+		computePeakSpecificity()
+		writeContingencyTable(filenameout + suffix, header)
+		return nil
+	}
+
+	counts := saveClusterCounts()
+	defer counts.restore()
+
+	// specificity across the original clusters
+	computePeakSpecificity()
+
+	for _, contrast := range loadContrastFile(counts.names) {
+		counts.applyContrast(contrast)
+		computePeakTotals()
+		writeContingencyTable(contrastFilename(filenameout, contrast.name) + suffix, header)
+		contrastNames = append(contrastNames, contrast.name)
+	}
+
+	return contrastNames
+}
 
-func mergeAndCleanTmpContingencyTables(filenames []string) {
+/*contrastFilenames output file of each contrast (or filenameout without contrast)*/
+func contrastFilenames(filenameout string, contrastNames []string) (filenames []string) {
+	if contrastNames == nil {
+		return []string{filenameout}
+	}
+
+	for _, name := range contrastNames {
+		filenames = append(filenames, contrastFilename(filenameout, name))
+	}
+
+	return filenames
+}
+
+func mergeAndCleanTmpContingencyTables(filenames []string, filenameout string) {
 	var cmd, cmdRm bytes.Buffer
 
 	cmd.WriteString("cat ")
@@ -367,7 +574,7 @@ func mergeAndCleanTmpContingencyTables(filenames []string) {
 	}
 
 	cmd.WriteString(" > ")
-	cmd.WriteString(FILENAMEOUT)
+	cmd.WriteString(filenameout)
 
 	utils.ExceCmd(cmd.String())
 	utils.ExceCmd(cmdRm.String())
@@ -375,25 +582,44 @@ func mergeAndCleanTmpContingencyTables(filenames []string) {
 
 func launchChi2Analysis() {
 	BUFFERARRAY = make([][BUFFERSIZE]string, THREADNB)
-	BUFFERRESARRAY = make([][BUFFERSIZE]chi2feature, THREADNB)
 
 	if FILENAMEOUT == "" {
-		ext := path.Ext(BEDFILENAME.String())
+		input := inputFilename()
+		ext := path.Ext(input.String())
 		FILENAMEOUT = fmt.Sprintf("%s.chi2.tsv",
-			BEDFILENAME[:len(BEDFILENAME)-len(ext)])
+			input[:len(input)-len(ext)])
 	}
 
 	utils.LoadSymbolFile(PEAKSYMBOLFILE, PEAKFILE)
 	utils.LoadPeaks(PEAKFILE, false, true)
 	loadCellClusterIDAndInitMaps()
-	utils.CreatePeakIntervalTree()
-	utils.InitIntervalDictsThreading(THREADNB)
 	createPeakMappingDict()
-	scanBedFile()
-	computeChi2Score()
-	performMultipleTestCorrection()
-	writePvalueCorrectedTable()
+	loadCellPeakCounts(0)
 
+	if CONTRASTFILE == "" {
+		computeChi2Score()
+		computePeakSpecificity()
+		performMultipleTestCorrection()
+		writePvalueCorrectedTable()
+		return
+	}
+
+	filenameout := FILENAMEOUT
+	counts := saveClusterCounts()
+	defer counts.restore()
+
+	// specificity across the original clusters
+	computePeakSpecificity()
+
+	for _, contrast := range loadContrastFile(counts.names) {
+		fmt.Printf("#### Contrast: %s\n", contrast.name)
+		counts.applyContrast(contrast)
+		FILENAMEOUT = contrastFilename(filenameout, contrast.name)
+		computeChi2Score()
+		computePeakTotals()
+		performMultipleTestCorrection()
+		writePvalueCorrectedTable()
+	}
 }
 
 
@@ -412,6 +638,11 @@ func loadPvalueTable() {
 
 	CHI2SCORE = make([][]peakFeature, 0)
 	CLUSTERNAMEMAPPING = make(map[string]int)
+	PTABLEEFFECTS = make([]map[uintptr]string, 0)
+	EFFECTHEADER = ""
+
+	// without header, the symbol is the 5th column of the 7 columns lines
+	symbolPos, effectStart := -1, -1
 
 	peakset := make(map[utils.Peak]uintptr)
 
@@ -423,6 +654,19 @@ func loadPvalueTable() {
 	for scanner.Scan() {
 		line = scanner.Text()
 		if line[0] == '#' {
+			header := strings.Split(line[1:], "\t")
+
+			// the columns between the cluster (or symbol) and the last two columns (odd ratio, pvalue) are effect columns
+			if len(header) > 6 {
+				effectStart = 4
+
+				if header[4] == "symbol" {
+					symbolPos, effectStart = 4, 5
+				}
+
+				EFFECTHEADER = strings.Join(header[effectStart:len(header) - 2], "\t")
+			}
+
 			continue
 		}
 
@@ -435,6 +679,7 @@ func loadPvalueTable() {
 		if clusterID, isInside = CLUSTERNAMEMAPPING[cluster];!isInside {
 
 			CHI2SCORE = append(CHI2SCORE, make([]peakFeature, 0))
+			PTABLEEFFECTS = append(PTABLEEFFECTS, make(map[uintptr]string))
 			CLUSTERNAMEMAPPING[cluster] = clusterIndex
 			clusterID = clusterIndex
 			clusterIndex++
@@ -462,7 +707,11 @@ func loadPvalueTable() {
 
 		CHI2SCORE[peaki.cluster] = append(CHI2SCORE[peaki.cluster], peaki)
 
-		if !isSymbolFile && len(split) == 7 {
+		if effectStart != -1 && len(split) > effectStart + 2 {
+			PTABLEEFFECTS[peaki.cluster][peaki.id] = strings.Join(split[effectStart:len(split) - 2], "\t")
+		}
+
+		if !isSymbolFile && len(utils.PEAKSYMBOLDICT[peakl]) == 0 && (symbolPos != -1 || (effectStart == -1 && len(split) == 7)) {
 			symbol = split[4]
 			utils.PEAKSYMBOLDICT[peakl] = append(
 				utils.PEAKSYMBOLDICT[peakl], symbol)
@@ -495,24 +744,12 @@ func createPeakMappingDict() {
 
 func loadCellClusterIDAndInitMaps() {
 	var line, cellName, cluster string
-	var clusterID, cellID int
-	var isInside bool
 	var split []string
+	var cellNames, clusters []string
 
 	scanner, file := CLUSTERFILE.ReturnReader(0)
 	defer utils.CloseFile(file)
 
-	CELLMAPPING = make(map[string]int)
-	CLUSTERNAMEMAPPING = make(map[string]int)
-	clustersum := make(map[int]int)
-	CELLPEAKMAPPING = make(map[cellpeak]bool)
-	CELLCLUSTERID = make([]int, 0)
-	CHI2SCORE = make([][]peakFeature, 0)
-
-	if len(utils.PEAKIDDICT) == 0 {
-		panic("Error PEAKIDDICT empty!")
-	}
-
 	for scanner.Scan() {
 		line = scanner.Text()
 
@@ -521,13 +758,42 @@ func loadCellClusterIDAndInitMaps() {
 		}
 
 		split = strings.Split(line, "\t")
-		cellName = strings.Trim(split[0], " \t\n")
-		cluster = strings.Trim(split[1], " \t\n")
 
 		if len(split) < 2 {
 			panic(fmt.Sprintf("line: %s cannot be splitted with <tab>\n", line))
 		}
 
+		cellName = strings.Trim(split[0], " \t\n")
+		cluster = strings.Trim(split[1], " \t\n")
+
+		cellNames = append(cellNames, cellName)
+		clusters = append(clusters, cluster)
+	}
+
+	initCellClusterMaps(cellNames, clusters)
+}
+
+/*initCellClusterMaps init the cell and cluster maps and the (cluster x peak) features from the cluster of each cell*/
+func initCellClusterMaps(cellNames, clusters []string) {
+	var clusterID, cellID int
+	var isInside bool
+	var cluster string
+
+	CELLMAPPING = make(map[string]int)
+	CLUSTERNAMEMAPPING = make(map[string]int)
+	clustersum := make(map[int]int)
+	CELLCLUSTERID = make([]int, 0)
+	CHI2SCORE = make([][]peakFeature, 0)
+	TOTALNBCELLS = 0
+	CELLDEPTH = make([]int64, len(cellNames))
+
+	if len(utils.PEAKIDDICT) == 0 {
+		panic("Error PEAKIDDICT empty!")
+	}
+
+	for pos, cellName := range cellNames {
+		cluster = clusters[pos]
+
 		if _, isInside = CLUSTERNAMEMAPPING[cluster];!isInside {
 			CLUSTERNAMEMAPPING[cluster] = clusterID
 			CHI2SCORE = append(CHI2SCORE, make([]peakFeature, 0))
@@ -544,6 +810,7 @@ func loadCellClusterIDAndInitMaps() {
 
 	NAMECLUSTERMAPPING = make([]string, len(CLUSTERNAMEMAPPING))
 	CLUSTERSUM = make([]int, len(clustersum))
+	CLUSTERDEPTH = make([]int64, len(clustersum))
 
 	for cluster, clusterID = range CLUSTERNAMEMAPPING {
 		CLUSTERSUM[clusterID] = clustersum[clusterID]
@@ -562,8 +829,11 @@ func scanBedFile() {
 
 	count := 0
 
+	PEAKCELLSHARDS = make([][]*cellBitmap, THREADNB)
+
 	for i:=0;i<THREADNB;i++ {
 		THREADSCHANNEL <- i
+		PEAKCELLSHARDS[i] = make([]*cellBitmap, len(PEAKMAPPING))
 	}
 
 	threadnb := <- THREADSCHANNEL
@@ -585,22 +855,26 @@ func scanBedFile() {
 	go processBufferArray(&BUFFERARRAY[threadnb], count, threadnb, waiting)
 	waiting.Wait()
 
+	mergePeakCellShards()
+
 	tDiff := time.Since(tStart)
 	fmt.Printf("Scanning bed file done in time: %f s \n", tDiff.Seconds())
 }
 
+/*processBufferArray add the cells of the reads overlapping each peak into the shard of the thread (PEAKCELLSHARDS[threadnb]).
+The shard is only used by one goroutine at a time and the read counts are incremented atomically*/
 func processBufferArray(lineArray * [BUFFERSIZE]string, nbLines, threadnb int, waiting * sync.WaitGroup) {
-	var intervals []interval.IntInterface
 	var inter interval.IntInterface
-	var start, end, count, clusterID, cellID int
+	var start, end, clusterID, cellID int
 	var split []string
 	var err error
 	var isInside bool
 	var intree *interval.IntTree
-	var mapping cellpeak
 
 	defer waiting.Done()
 
+	shard := PEAKCELLSHARDS[threadnb]
+
 	for i := 0; i < nbLines; i++ {
 		split = strings.Split(lineArray[i], "\t")
 
@@ -608,6 +882,8 @@ func processBufferArray(lineArray * [BUFFERSIZE]string, nbLines, threadnb int, w
 			continue
 		}
 
+		atomic.AddInt64(&CELLDEPTH[cellID], 1)
+
 		if intree, isInside = utils.CHRINTERVALDICT[split[0]];!isInside {
 			continue
 		}
@@ -620,72 +896,75 @@ func processBufferArray(lineArray * [BUFFERSIZE]string, nbLines, threadnb int, w
 		end, err = strconv.Atoi(split[2])
 		utils.Check(err)
 
-		intervals = intree.Get(
-			utils.IntInterval{Start: start, End: end})
+		for _, inter = range intree.Get(utils.IntInterval{Start: start, End: end}) {
+			peakID := inter.ID()
+			atomic.AddInt64(&CHI2SCORE[clusterID][peakID].reads, 1)
 
-		for _, inter = range intervals {
-			BUFFERRESARRAY[threadnb][count].clusterID = clusterID
-			BUFFERRESARRAY[threadnb][count].cellID = cellID
-			BUFFERRESARRAY[threadnb][count].id = inter.ID()
+			if shard[peakID] == nil {
+				shard[peakID] = &cellBitmap{}
+			}
 
-			count++
+			shard[peakID].Add(uint32(cellID))
+		}
+	}
 
-			if count >= BUFFERSIZE {
-				MUTEX.Lock()
-				for i :=0; i<count;i++ {
-					clusterID = BUFFERRESARRAY[threadnb][i].clusterID
+	THREADSCHANNEL <- threadnb
+}
 
-					mapping.cellID = BUFFERRESARRAY[threadnb][i].cellID
-					mapping.peakID = BUFFERRESARRAY[threadnb][i].id
+/*mergePeakCellShards merge the cells of each peak from the thread shards (in parallel over the peaks)
+and count the cells with the peak in each cluster (n11) and in total (n21)*/
+func mergePeakCellShards() {
+	var waiting sync.WaitGroup
 
-					if CELLPEAKMAPPING[mapping] {
-						continue
-					}
+	for thread := 0; thread < THREADNB; thread++ {
+		waiting.Add(1)
 
-					CELLPEAKMAPPING[mapping] = true
+		go func(thread int) {
+			defer waiting.Done()
 
-					CHI2SCORE[clusterID][mapping.peakID].n11++
+			for peakID := thread; peakID < len(PEAKMAPPING); peakID += THREADNB {
+				var cells *cellBitmap
 
-					for clusterID = range CLUSTERSUM {
-						CHI2SCORE[clusterID][mapping.peakID].n21++
+				for _, shard := range PEAKCELLSHARDS {
+					switch {
+					case shard[peakID] == nil:
+					case cells == nil:
+						cells = shard[peakID]
+					default:
+						cells.Or(shard[peakID])
 					}
 
+					shard[peakID] = nil
 				}
-				count = 0
 
-				MUTEX.Unlock()
-			}
-		}
-	}
+				if cells == nil {
+					continue
+				}
 
-	MUTEX.Lock()
+				cells.ForEach(func(cellID uint32) {
+					CHI2SCORE[CELLCLUSTERID[cellID]][peakID].n11++
+				})
 
-	for i :=0; i<count;i++ {
-		clusterID = BUFFERRESARRAY[threadnb][i].clusterID
+				total := cells.Cardinality()
 
-		mapping.cellID = BUFFERRESARRAY[threadnb][i].cellID
-		mapping.peakID = BUFFERRESARRAY[threadnb][i].id
+				for clusterID := range CHI2SCORE {
+					CHI2SCORE[clusterID][peakID].n21 = total
+				}
+			}
+		}(thread)
+	}
 
-		if CELLPEAKMAPPING[mapping] {
-			continue
-		}
+	waiting.Wait()
 
-		CELLPEAKMAPPING[mapping] = true
-		CHI2SCORE[clusterID][mapping.peakID].n11++
+	PEAKCELLSHARDS = nil
 
-		for clusterID = range CLUSTERSUM {
-			CHI2SCORE[clusterID][mapping.peakID].n21++
-		}
+	for cellID, depth := range CELLDEPTH {
+		CLUSTERDEPTH[CELLCLUSTERID[cellID]] += depth
 	}
-
-	MUTEX.Unlock()
-
-	THREADSCHANNEL <- threadnb
 }
 
-
 func computeChi2Score() {
-	fmt.Printf("Computing chi2 exact test...\n")
+	fmt.Printf("Computing %s test...\n", TESTTYPE)
 	THREADSCHANNEL = make(chan int, THREADNB)
 	var peakID int
 
@@ -723,14 +1002,14 @@ func computeChi2Score() {
 	waiting.Wait()
 
 	tDiff := time.Since(tStart)
-	fmt.Printf("Computing chi2 score done in time: %f s \n", tDiff.Seconds())
+	fmt.Printf("Computing %s score done in time: %f s \n", TESTTYPE, tDiff.Seconds())
 
 }
 
 
 func chi2ScoreOneThread(chi2Array * []int, waiting * sync.WaitGroup, max, threadnb int) {
 	var peakID int
-	var pvalue float64
+	var pvalue, oddRatio float64
 	var clusterID, clusterSum, peakTotal, value int
 
 	var results [SMALLBUFFERSIZE]peakFeature
@@ -742,44 +1021,53 @@ func chi2ScoreOneThread(chi2Array * []int, waiting * sync.WaitGroup, max, thread
 	for _, peakID = range (*chi2Array)[:max] {
 
 		for clusterID, clusterSum = range CLUSTERSUM {
+			if clusterID == CONTRASTBACKGROUND {
+				continue
+			}
+
 			results[count].id = uintptr(peakID)
 			results[count].cluster = clusterID
 
 			value = CHI2SCORE[clusterID][peakID].n11
 			peakTotal = CHI2SCORE[clusterID][peakID].n21
 
-			_, pvalue = chiSquareTest(
+			oddRatio, pvalue = contingencyTest(
 				value, clusterSum,
-				peakTotal - value, TOTALNBCELLS - clusterSum, true)
+				peakTotal - value, TOTALNBCELLS - clusterSum)
 
 			results[count].pvalue = pvalue
+			results[count].oddRatio = oddRatio
 
 			count++
 
 			if count >= SMALLBUFFERSIZE {
-				MUTEX.Lock()
-				for i := 0; i < count;i++ {
-					CHI2SCORE[results[i].cluster][results[i].id].pvalue = results[i].pvalue
-				}
-
-				MUTEX.Unlock()
+				storeTestResults(results[:count])
 				count = 0
 			}
 		}
 	}
 
 
-	MUTEX.Lock()
-	for i := 0; i < count;i++ {
-		CHI2SCORE[results[i].cluster] = append(CHI2SCORE[results[i].cluster], results[i])
-	}
-
-	MUTEX.Unlock()
+	storeTestResults(results[:count])
 
 	THREADSCHANNEL <- threadnb
 
 }
 
+/*storeTestResults store the test results in the (cluster, peak) features holding the counts */
+func storeTestResults(results []peakFeature) {
+	MUTEX.Lock()
+	defer MUTEX.Unlock()
+
+	for _, result := range results {
+		feature := &CHI2SCORE[result.cluster][result.id]
+		feature.id = result.id
+		feature.cluster = result.cluster
+		feature.pvalue = result.pvalue
+		feature.oddRatio = result.oddRatio
+	}
+}
+
 func chiSquareTest(n11, n12, n21, n22 int, correction bool) (score, pvalue float64) {
 	defer recoverChiScore(n11, n12, n21, n22)
 
@@ -807,6 +1095,10 @@ func sortPvalueScore() {
 
 	for clusterID = range CHI2SCORE {
 		func(clusterID int) {
+			for i := range CHI2SCORE[clusterID] {
+				CHI2SCORE[clusterID][i].pvalue = nanToOne(CHI2SCORE[clusterID][i].pvalue)
+			}
+
 			sort.Slice(CHI2SCORE[clusterID], func(i int, j int) bool {
 				return CHI2SCORE[clusterID][i].pvalue < CHI2SCORE[clusterID][j].pvalue})
 		}(clusterID)
@@ -816,39 +1108,6 @@ func sortPvalueScore() {
 	fmt.Printf("Sorting pvalue done in time: %f s \n", tDiff.Seconds())
 }
 
-func performCorrectionAfterSorting() {
-
-	var clusterID int
-	tStart := time.Now()
-	THREADSCHANNEL = make(chan int, THREADNB)
-
-	for i:=0;i<THREADNB;i++ {
-		THREADSCHANNEL <- i
-	}
-
-	threadnb := <- THREADSCHANNEL
-
-	for clusterID = range CHI2SCORE {
-		go func(threadnb int, clusterID int) {
-			var rank int
-
-			cllength := float64(len(CHI2SCORE[clusterID]))
-
-			for rank = range CHI2SCORE[clusterID] {
-				CHI2SCORE[clusterID][rank].qvalue = float64(rank + 1) * ALPHA / cllength
-			}
-
-			THREADSCHANNEL <- threadnb
-
-		}(threadnb, clusterID)
-
-		threadnb = <- THREADSCHANNEL
-	}
-
-	tDiff := time.Since(tStart)
-	fmt.Printf("Correction done in time: %f s \n", tDiff.Seconds())
-}
-
 func writePvalueCorrectedTable() {
 	var buffer bytes.Buffer
 	var peakl utils.Peak
@@ -863,20 +1122,36 @@ func writePvalueCorrectedTable() {
 	defer utils.CloseFile(writer)
 	tStart := time.Now()
 
-	buffer.WriteString("#chr\tstart\tstop\tcluster\toddRatio\tpvalue\tqvalue\tsignificant")
+	buffer.WriteString("#chr\tstart\tstop\tcluster")
 
 	if writeSymbol {
 		buffer.WriteString("\tsymbol")
 	}
 
-	buffer.WriteRune('\n')
+	if EFFECTHEADER != "" {
+		buffer.WriteRune('\t')
+		buffer.WriteString(EFFECTHEADER)
+	}
+
+	buffer.WriteString("\toddRatio\tpvalue\tqvalue")
+
+	for _, method := range CORRECTIONS[1:] {
+		buffer.WriteString("\tqvalue_")
+		buffer.WriteString(method)
+	}
+
+	buffer.WriteString("\tsignificant\n")
 
 	for clusterID = range CHI2SCORE {
+		if clusterID == CONTRASTBACKGROUND {
+			continue
+		}
+
 		cluster = NAMECLUSTERMAPPING[clusterID]
 
 		featureLoop:
-		for _, peaki := range CHI2SCORE[clusterID] {
-			isSignificant = peaki.pvalue < peaki.qvalue
+		for rank, peaki := range CHI2SCORE[clusterID] {
+			isSignificant = peaki.qvalue <= ALPHA
 
 			if !WRITEALL && !isSignificant {
 				continue featureLoop
@@ -897,12 +1172,20 @@ func writePvalueCorrectedTable() {
 					strings.Join(utils.PEAKSYMBOLDICT[peakl], "-"))
 			}
 
+			writeEffectColumns(&buffer, clusterID, peaki.id, peaki)
+
 			buffer.WriteRune('\t')
 			buffer.WriteString(fmt.Sprintf("%e", peaki.oddRatio))
 			buffer.WriteRune('\t')
 			buffer.WriteString(fmt.Sprintf("%e", peaki.pvalue))
 			buffer.WriteRune('\t')
 			buffer.WriteString(fmt.Sprintf("%e", peaki.qvalue))
+
+			for _, adjusted := range ADJUSTEDPVALUES[clusterID] {
+				buffer.WriteRune('\t')
+				buffer.WriteString(fmt.Sprintf("%e", adjusted[rank]))
+			}
+
 			buffer.WriteRune('\t')
 			buffer.WriteString(strconv.FormatBool(isSignificant))
 
@@ -940,10 +1223,16 @@ func writeContingencyTable(filenameout string, header bool) {
 			buffer.WriteString("\tsymbol")
 		}
 
+		buffer.WriteRune('\t')
+		buffer.WriteString(EFFECTHEADER)
 		buffer.WriteString("\tn11\tn12\tn21\tn22\n")
 	}
 
 	for clusterID = range CHI2SCORE {
+		if clusterID == CONTRASTBACKGROUND {
+			continue
+		}
+
 		cluster = NAMECLUSTERMAPPING[clusterID]
 		clusterSum = CLUSTERSUM[clusterID]
 		n22 = strconv.Itoa(TOTALNBCELLS - clusterSum)
@@ -969,6 +1258,8 @@ func writeContingencyTable(filenameout string, header bool) {
 					strings.Join(utils.PEAKSYMBOLDICT[peakl], "-"))
 			}
 
+			writeEffectColumns(&buffer, clusterID, uintptr(peakIndex), peaki)
+
 			buffer.WriteRune('\t')
 			buffer.WriteString(strconv.Itoa(peaki.n11))
 			buffer.WriteRune('\t')
@@ -986,5 +1277,5 @@ func writeContingencyTable(filenameout string, header bool) {
 	}
 
 	tDiff := time.Since(tStart)
-	fmt.Printf("File: %s written in: %f s \n", FILENAMEOUT, tDiff.Seconds())
+	fmt.Printf("File: %s written in: %f s \n", filenameout, tDiff.Seconds())
 }
@@ -0,0 +1,194 @@
+package main
+
+
+import (
+	"math/bits"
+	"sort"
+)
+
+
+/*ARRAYCONTAINERMAX maximum cardinality of a sorted array container before its conversion into a bitset container*/
+const ARRAYCONTAINERMAX = 4096
+
+/*BITSETWORDS number of 64 bits words of a bitset container (2^16 bits)*/
+const BITSETWORDS = 1024
+
+/*cellBitmap compressed set of cell IDs (roaring-like): the IDs are split by their 16 high bits into containers
+storing the 16 low bits either as a sorted array (sparse) or as a bitset (dense)*/
+type cellBitmap struct {
+	keys []uint16
+	containers []*bitmapContainer
+}
+
+/*bitmapContainer 16 low bits of the IDs sharing the same 16 high bits*/
+type bitmapContainer struct {
+	array []uint16
+	bitset []uint64
+	cardinality int
+}
+
+/*Add add the ID and return true if it was not already in the bitmap*/
+func (bitmap *cellBitmap) Add(id uint32) bool {
+	key := uint16(id >> 16)
+	pos := sort.Search(len(bitmap.keys), func(i int) bool {return bitmap.keys[i] >= key})
+
+	if pos == len(bitmap.keys) || bitmap.keys[pos] != key {
+		bitmap.keys = append(bitmap.keys, 0)
+		copy(bitmap.keys[pos + 1:], bitmap.keys[pos:])
+		bitmap.keys[pos] = key
+
+		bitmap.containers = append(bitmap.containers, nil)
+		copy(bitmap.containers[pos + 1:], bitmap.containers[pos:])
+		bitmap.containers[pos] = &bitmapContainer{}
+	}
+
+	return bitmap.containers[pos].add(uint16(id))
+}
+
+/*Cardinality number of IDs in the bitmap*/
+func (bitmap *cellBitmap) Cardinality() (cardinality int) {
+	for _, container := range bitmap.containers {
+		cardinality += container.cardinality
+	}
+
+	return cardinality
+}
+
+/*Or add all the IDs of other into the bitmap*/
+func (bitmap *cellBitmap) Or(other *cellBitmap) {
+	for i, key := range other.keys {
+		pos := sort.Search(len(bitmap.keys), func(j int) bool {return bitmap.keys[j] >= key})
+
+		if pos == len(bitmap.keys) || bitmap.keys[pos] != key {
+			bitmap.keys = append(bitmap.keys, 0)
+			copy(bitmap.keys[pos + 1:], bitmap.keys[pos:])
+			bitmap.keys[pos] = key
+
+			bitmap.containers = append(bitmap.containers, nil)
+			copy(bitmap.containers[pos + 1:], bitmap.containers[pos:])
+			bitmap.containers[pos] = other.containers[i].clone()
+			continue
+		}
+
+		bitmap.containers[pos].or(other.containers[i])
+	}
+}
+
+/*ForEach call f for each ID of the bitmap in increasing order*/
+func (bitmap *cellBitmap) ForEach(f func(id uint32)) {
+	for i, container := range bitmap.containers {
+		high := uint32(bitmap.keys[i]) << 16
+
+		if container.bitset == nil {
+			for _, low := range container.array {
+				f(high | uint32(low))
+			}
+
+			continue
+		}
+
+		for word, value := range container.bitset {
+			for value != 0 {
+				bit := bits.TrailingZeros64(value)
+				f(high | uint32(word * 64 + bit))
+				value &= value - 1
+			}
+		}
+	}
+}
+
+func (container *bitmapContainer) add(low uint16) bool {
+	if container.bitset != nil {
+		word, mask := low / 64, uint64(1) << (low % 64)
+
+		if container.bitset[word] & mask != 0 {
+			return false
+		}
+
+		container.bitset[word] |= mask
+		container.cardinality++
+
+		return true
+	}
+
+	pos := sort.Search(len(container.array), func(i int) bool {return container.array[i] >= low})
+
+	if pos < len(container.array) && container.array[pos] == low {
+		return false
+	}
+
+	container.array = append(container.array, 0)
+	copy(container.array[pos + 1:], container.array[pos:])
+	container.array[pos] = low
+	container.cardinality++
+
+	if container.cardinality > ARRAYCONTAINERMAX {
+		container.toBitset()
+	}
+
+	return true
+}
+
+func (container *bitmapContainer) or(other *bitmapContainer) {
+	switch {
+	case container.bitset == nil && other.bitset == nil:
+		// merge of the two sorted arrays
+		merged := make([]uint16, 0, len(container.array) + len(other.array))
+		i, j := 0, 0
+
+		for i < len(container.array) || j < len(other.array) {
+			switch {
+			case j == len(other.array) || (i < len(container.array) && container.array[i] < other.array[j]):
+				merged = append(merged, container.array[i])
+				i++
+			case i == len(container.array) || other.array[j] < container.array[i]:
+				merged = append(merged, other.array[j])
+				j++
+			default:
+				merged = append(merged, container.array[i])
+				i++
+				j++
+			}
+		}
+
+		container.array = merged
+		container.cardinality = len(merged)
+
+		if container.cardinality > ARRAYCONTAINERMAX {
+			container.toBitset()
+		}
+	case other.bitset == nil:
+		for _, low := range other.array {
+			container.add(low)
+		}
+	default:
+		if container.bitset == nil {
+			container.toBitset()
+		}
+
+		container.cardinality = 0
+
+		for word := range container.bitset {
+			container.bitset[word] |= other.bitset[word]
+			container.cardinality += bits.OnesCount64(container.bitset[word])
+		}
+	}
+}
+
+func (container *bitmapContainer) toBitset() {
+	container.bitset = make([]uint64, BITSETWORDS)
+
+	for _, low := range container.array {
+		container.bitset[low / 64] |= uint64(1) << (low % 64)
+	}
+
+	container.array = nil
+}
+
+func (container *bitmapContainer) clone() *bitmapContainer {
+	return &bitmapContainer{
+		array: append([]uint16(nil), container.array...),
+		bitset: append([]uint64(nil), container.bitset...),
+		cardinality: container.cardinality,
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+)
+
+
+/*CONTRASTFILE contrast specification file: <name>\t<foreground clusters>\t<background clusters>\n (comma-separated clusters)*/
+var CONTRASTFILE utils.Filename
+
+/*CONTRASTBACKGROUND cluster ID of the background group of the current contrast (-1 without contrast). The background group is neither tested nor written*/
+var CONTRASTBACKGROUND = -1
+
+/*clusterContrast foreground vs background set of clusters. A nil background is all the other cells*/
+type clusterContrast struct {
+	name string
+	foreground, background map[string]bool
+}
+
+/*clusterCounts contingency counts of the clusters (before merging the clusters of a contrast)*/
+type clusterCounts struct {
+	score [][]peakFeature
+	clusterSum []int
+	clusterDepth []int64
+	names []string
+}
+
+func (contrast clusterContrast) isForeground(cluster string) bool {
+	return contrast.foreground[cluster]
+}
+
+func (contrast clusterContrast) isBackground(cluster string) bool {
+	if contrast.background == nil {
+		return !contrast.foreground[cluster]
+	}
+
+	return contrast.background[cluster]
+}
+
+/*loadContrastFile load the contrasts of CONTRASTFILE for the given clusters.
+A foreground '*' defines one contrast <name>.<cluster> for each cluster of the background set vs the other clusters of the set
+(siblings of a lineage) and a background '*' (or no background column) is all the other cells*/
+func loadContrastFile(clusters []string) (contrasts []clusterContrast) {
+	clusterSet := make(map[string]bool)
+	nameSet := make(map[string]bool)
+
+	for _, cluster := range clusters {
+		clusterSet[cluster] = true
+	}
+
+	sorted := append([]string(nil), clusters...)
+	sort.Strings(sorted)
+
+	parseClusters := func(field string) (set map[string]bool) {
+		if field == "*" {
+			return nil
+		}
+
+		set = make(map[string]bool)
+
+		for _, cluster := range strings.Split(field, ",") {
+			cluster = strings.TrimSpace(cluster)
+
+			if !clusterSet[cluster] {
+				log.Fatal(fmt.Sprintf("Error cluster %s of the contrast file %s not found in the clusters of the cells!", cluster, CONTRASTFILE))
+			}
+
+			set[cluster] = true
+		}
+
+		return set
+	}
+
+	addContrast := func(contrast clusterContrast) {
+		switch {
+		case contrast.name == "" || strings.ContainsAny(contrast.name, "/ \t"):
+			log.Fatal(fmt.Sprintf("Error invalid contrast name: '%s' (no space or '/' allowed)!", contrast.name))
+		case nameSet[contrast.name]:
+			log.Fatal(fmt.Sprintf("Error contrast %s defined several times!", contrast.name))
+		}
+
+		empty := true
+
+		for _, cluster := range clusters {
+			if contrast.isForeground(cluster) && contrast.background != nil && contrast.background[cluster] {
+				log.Fatal(fmt.Sprintf("Error cluster %s is both in the foreground and the background of the contrast %s!", cluster, contrast.name))
+			}
+
+			if !contrast.isForeground(cluster) && contrast.isBackground(cluster) {
+				empty = false
+			}
+		}
+
+		if empty {
+			log.Fatal(fmt.Sprintf("Error the background of the contrast %s is empty!", contrast.name))
+		}
+
+		nameSet[contrast.name] = true
+		contrasts = append(contrasts, contrast)
+	}
+
+	scanner, file := CONTRASTFILE.ReturnReader(0)
+	defer utils.CloseFile(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		split := strings.Split(line, "\t")
+
+		if len(split) < 2 {
+			log.Fatal(fmt.Sprintf("Error line: %s of the contrast file must be <name>\\t<foreground>\\t<background>", line))
+		}
+
+		name := strings.TrimSpace(split[0])
+		background := "*"
+
+		if len(split) > 2 && strings.TrimSpace(split[2]) != "" {
+			background = strings.TrimSpace(split[2])
+		}
+
+		foreground := parseClusters(strings.TrimSpace(split[1]))
+		backgroundSet := parseClusters(background)
+
+		if foreground != nil {
+			addContrast(clusterContrast{name: name, foreground: foreground, background: backgroundSet})
+			continue
+		}
+
+		// each cluster of the set vs its siblings
+		for _, cluster := range sorted {
+			if backgroundSet != nil && !backgroundSet[cluster] {
+				continue
+			}
+
+			var siblings map[string]bool
+
+			if backgroundSet != nil {
+				siblings = make(map[string]bool)
+
+				for sibling := range backgroundSet {
+					if sibling != cluster {
+						siblings[sibling] = true
+					}
+				}
+			}
+
+			addContrast(clusterContrast{
+				name: fmt.Sprintf("%s.%s", name, cluster),
+				foreground: map[string]bool{cluster: true},
+				background: siblings})
+		}
+	}
+
+	if len(contrasts) == 0 {
+		log.Fatal(fmt.Sprintf("Error no contrast found in %s!", CONTRASTFILE))
+	}
+
+	return contrasts
+}
+
+/*contrastFilename insert the contrast name before the extension of the output file*/
+func contrastFilename(filename, name string) string {
+	ext := path.Ext(filename)
+
+	return fmt.Sprintf("%s.%s%s", filename[:len(filename) - len(ext)], name, ext)
+}
+
+/*saveClusterCounts keep the contingency counts of the clusters of the cells*/
+func saveClusterCounts() clusterCounts {
+	return clusterCounts{
+		score: CHI2SCORE,
+		clusterSum: CLUSTERSUM,
+		clusterDepth: CLUSTERDEPTH,
+		names: NAMECLUSTERMAPPING,
+	}
+}
+
+/*applyContrast replace the clusters by the foreground (cluster ID 0) and background (cluster ID 1) groups of the contrast
+by summing the counts of their clusters*/
+func (counts clusterCounts) applyContrast(contrast clusterContrast) {
+	nbPeaks := len(PEAKMAPPING)
+	peakTotals := make([]int, nbPeaks)
+
+	CHI2SCORE = [][]peakFeature{make([]peakFeature, nbPeaks), make([]peakFeature, nbPeaks)}
+	CLUSTERSUM = make([]int, 2)
+	CLUSTERDEPTH = make([]int64, 2)
+	NAMECLUSTERMAPPING = []string{contrast.name, fmt.Sprintf("%s_background", contrast.name)}
+	CONTRASTBACKGROUND = 1
+	TOTALNBCELLS = 0
+
+	for clusterID, cluster := range counts.names {
+		var group int
+
+		switch {
+		case contrast.isForeground(cluster):
+			group = 0
+		case contrast.isBackground(cluster):
+			group = 1
+		default:
+			continue
+		}
+
+		CLUSTERSUM[group] += counts.clusterSum[clusterID]
+		CLUSTERDEPTH[group] += counts.clusterDepth[clusterID]
+		TOTALNBCELLS += counts.clusterSum[clusterID]
+
+		for peakID, peaki := range counts.score[clusterID] {
+			CHI2SCORE[group][peakID].n11 += peaki.n11
+			CHI2SCORE[group][peakID].reads += peaki.reads
+			peakTotals[peakID] += peaki.n11
+		}
+	}
+
+	for group := range CHI2SCORE {
+		for peakID, total := range peakTotals {
+			CHI2SCORE[group][peakID].n21 = total
+		}
+	}
+}
+
+/*restore set back the clusters of the cells*/
+func (counts clusterCounts) restore() {
+	CHI2SCORE = counts.score
+	CLUSTERSUM = counts.clusterSum
+	CLUSTERDEPTH = counts.clusterDepth
+	NAMECLUSTERMAPPING = counts.names
+	CONTRASTBACKGROUND = -1
+	TOTALNBCELLS = 0
+
+	for _, sum := range CLUSTERSUM {
+		TOTALNBCELLS += sum
+	}
+}
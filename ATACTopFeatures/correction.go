@@ -0,0 +1,169 @@
+package main
+
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+
+/*CORRECTIONMETHODS available multiple test correction methods*/
+var CORRECTIONMETHODS = []string{"bh", "by", "bonferroni", "holm", "storey"}
+
+/*CORRECTIONS multiple test correction methods used (the first one defines the significant features)*/
+var CORRECTIONS []string
+
+/*STOREYLAMBDA lambda used to estimate the proportion of null features (storey correction)*/
+var STOREYLAMBDA float64
+
+/*ADJUSTEDPVALUES map[cluster ID][additional correction method][rank]adjusted pvalue*/
+var ADJUSTEDPVALUES [][][]float64
+
+/*parseCorrections parse and check the comma-separated list of correction methods*/
+func parseCorrections(corrections string) {
+	CORRECTIONS = nil
+
+	methodLoop:
+	for _, method := range strings.Split(corrections, ",") {
+		method = strings.ToLower(strings.TrimSpace(method))
+
+		for _, available := range CORRECTIONMETHODS {
+			if method == available {
+				CORRECTIONS = append(CORRECTIONS, method)
+				continue methodLoop
+			}
+		}
+
+		log.Fatal(fmt.Sprintf("Error -correction method %s not in: %s", method, strings.Join(CORRECTIONMETHODS, ",")))
+	}
+}
+
+/*nanToOne return 1 for a NaN pvalue (untestable feature) so the pvalues can be sorted before the correction*/
+func nanToOne(pvalue float64) float64 {
+	if math.IsNaN(pvalue) {
+		return 1.0
+	}
+
+	return pvalue
+}
+
+/*adjustPvalues return the adjusted pvalues of pvalues sorted in increasing order (without NaN, see nanToOne)*/
+func adjustPvalues(pvalues []float64, method string) (adjusted []float64) {
+	m := float64(len(pvalues))
+	adjusted = make([]float64, len(pvalues))
+
+	pvalue := func(rank int) float64 {
+		return pvalues[rank]
+	}
+
+	// step-up procedures: adjusted_i = min_{j >= i} factor * m * p_j / j
+	stepUp := func(factor float64) {
+		minQ := 1.0
+
+		for rank := len(pvalues) - 1; rank >= 0; rank-- {
+			minQ = math.Min(minQ, factor * m * pvalue(rank) / float64(rank + 1))
+			adjusted[rank] = minQ
+		}
+	}
+
+	switch method {
+	case "bh":
+		stepUp(1.0)
+	case "by":
+		harmonic := 0.0
+
+		for i := 1; i <= len(pvalues); i++ {
+			harmonic += 1.0 / float64(i)
+		}
+
+		stepUp(harmonic)
+	case "storey":
+		stepUp(storeyPi0(pvalues))
+	case "bonferroni":
+		for rank := range pvalues {
+			adjusted[rank] = math.Min(1.0, m * pvalue(rank))
+		}
+	case "holm":
+		// step-down: adjusted_i = max_{j <= i} (m - j + 1) * p_j
+		maxQ := 0.0
+
+		for rank := range pvalues {
+			maxQ = math.Max(maxQ, math.Min(1.0, (m - float64(rank)) * pvalue(rank)))
+			adjusted[rank] = maxQ
+		}
+	}
+
+	return adjusted
+}
+
+/*storeyPi0 estimate of the proportion of null features: #{p > lambda} / (m * (1 - lambda)) (at most 1)*/
+func storeyPi0(pvalues []float64) float64 {
+	nbNull := 0
+
+	for _, pvalue := range pvalues {
+		if pvalue > STOREYLAMBDA {
+			nbNull++
+		}
+	}
+
+	pi0 := float64(nbNull) / (float64(len(pvalues)) * (1.0 - STOREYLAMBDA))
+
+	if pi0 <= 0 {
+		pi0 = 1.0 / float64(len(pvalues))
+	}
+
+	return math.Min(1.0, pi0)
+}
+
+func performCorrectionAfterSorting() {
+	var waiting sync.WaitGroup
+
+	tStart := time.Now()
+	THREADSCHANNEL = make(chan int, THREADNB)
+
+	for i:=0;i<THREADNB;i++ {
+		THREADSCHANNEL <- i
+	}
+
+	ADJUSTEDPVALUES = make([][][]float64, len(CHI2SCORE))
+
+	for clusterID := range CHI2SCORE {
+		threadnb := <- THREADSCHANNEL
+		waiting.Add(1)
+
+		go func(threadnb int, clusterID int) {
+			defer waiting.Done()
+
+			pvalues := make([]float64, len(CHI2SCORE[clusterID]))
+
+			for rank := range CHI2SCORE[clusterID] {
+				pvalues[rank] = CHI2SCORE[clusterID][rank].pvalue
+			}
+
+			for pos, method := range CORRECTIONS {
+				adjusted := adjustPvalues(pvalues, method)
+
+				if pos == 0 {
+					for rank := range CHI2SCORE[clusterID] {
+						CHI2SCORE[clusterID][rank].qvalue = adjusted[rank]
+					}
+
+					continue
+				}
+
+				ADJUSTEDPVALUES[clusterID] = append(ADJUSTEDPVALUES[clusterID], adjusted)
+			}
+
+			THREADSCHANNEL <- threadnb
+		}(threadnb, clusterID)
+	}
+
+	waiting.Wait()
+
+	tDiff := time.Since(tStart)
+	fmt.Printf("Correction (%s) done in time: %f s \n", strings.Join(CORRECTIONS, ","), tDiff.Seconds())
+}
@@ -0,0 +1,743 @@
+package main
+
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+)
+
+
+/*NORMALIZATIONSCALE scale factor of the normalized accessibility: log1p(count / depth * NORMALIZATIONSCALE)*/
+const NORMALIZATIONSCALE = 10000.0
+
+/*daFeature differential accessibility result of one peak for one contrast*/
+type daFeature struct {
+	peak int
+	log2FC, pctIn, pctOut float64
+	pvalue float64
+	qvalues []float64
+}
+
+/*daContrast foreground cells vs background cells (group: 1 foreground, 0 background, -1 not used)*/
+type daContrast struct {
+	name string
+	group []int
+}
+
+/*daModel cells of a contrast with their response (1: foreground) and log depth, and the null logistic regression model*/
+type daModel struct {
+	cells []int
+	response, logDepth []float64
+	nullBeta []float64
+	nullLogLik float64
+	nbForeground, nbBackground int
+}
+
+/*daData per-peak accessibility of the cells with a cluster*/
+type daData struct {
+	peaks []utils.SparseVector
+	depth []float64
+	logDepth []float64
+	cluster []string
+}
+
+/*launchDifferentialAnalysis depth-aware differential accessibility (logistic regression or wilcoxon) from a (cell x peak) matrix*/
+func launchDifferentialAnalysis() {
+	var buffer bytes.Buffer
+	var err error
+
+	tStart := time.Now()
+
+	if FILENAMEOUT == "" {
+		ext := path.Ext(MATRIXFILE.String())
+		FILENAMEOUT = fmt.Sprintf("%s.da_%s.tsv",
+			MATRIXFILE[:len(MATRIXFILE)-len(ext)], TESTTYPE)
+	}
+
+	utils.LoadSymbolFile(PEAKSYMBOLFILE, PEAKFILE)
+	utils.LoadPeaks(PEAKFILE, false, true)
+	createPeakMappingDict()
+
+	data := loadDifferentialData()
+	contrasts := createDifferentialContrasts(data)
+
+	writer := utils.ReturnWriter(FILENAMEOUT)
+	defer utils.CloseFile(writer)
+
+	writeSymbol := len(utils.PEAKSYMBOLDICT) != 0
+
+	buffer.WriteString("#chr\tstart\tstop\tcluster")
+
+	if writeSymbol {
+		buffer.WriteString("\tsymbol")
+	}
+
+	buffer.WriteString("\tlog2FC\tpct.in\tpct.out\tpvalue\tqvalue")
+
+	for _, method := range CORRECTIONS[1:] {
+		buffer.WriteString("\tqvalue_")
+		buffer.WriteString(method)
+	}
+
+	buffer.WriteString("\tsignificant\n")
+
+	for _, contrast := range contrasts {
+		features := testContrast(data, contrast)
+		nbSignificant := 0
+
+		for _, feature := range features {
+			isSignificant := feature.qvalues[0] <= ALPHA
+
+			if isSignificant {
+				nbSignificant++
+			}
+
+			if !WRITEALL && !isSignificant {
+				continue
+			}
+
+			peakl := PEAKMAPPING[feature.peak]
+			buffer.WriteString(fmt.Sprintf("%s\t%s\t%s\t%s", peakl.Slice[0], peakl.Slice[1], peakl.Slice[2], contrast.name))
+
+			if writeSymbol {
+				buffer.WriteRune('\t')
+				buffer.WriteString(strings.Join(utils.PEAKSYMBOLDICT[peakl], "-"))
+			}
+
+			buffer.WriteString(fmt.Sprintf("\t%e\t%.4f\t%.4f\t%e", feature.log2FC, feature.pctIn, feature.pctOut, feature.pvalue))
+
+			for _, qvalue := range feature.qvalues {
+				buffer.WriteString(fmt.Sprintf("\t%e", qvalue))
+			}
+
+			buffer.WriteRune('\t')
+			buffer.WriteString(strconv.FormatBool(isSignificant))
+			buffer.WriteRune('\n')
+		}
+
+		_, err = writer.Write(buffer.Bytes())
+		utils.Check(err)
+		buffer.Reset()
+
+		fmt.Printf("contrast: %s: %d peaks tested, %d significant\n", contrast.name, len(features), nbSignificant)
+	}
+
+	tDiff := time.Since(tStart)
+	fmt.Printf("File: %s written in: %f s \n", FILENAMEOUT, tDiff.Seconds())
+}
+
+/*loadDifferentialData load the matrix, the cell clusters and the cell depths (-depth or number of reads in peaks)*/
+func loadDifferentialData() (data daData) {
+	matrix, cellNames := loadMatrixAndCellNames()
+
+	cellClusters := loadCellClusters()
+	cellDepths := loadCellDepths()
+
+	// rows of the matrix kept (cells with a cluster and a positive depth)
+	kept := make([]int, matrix.NRows)
+
+	for i, row := range matrix.Rows {
+		kept[i] = -1
+		cluster, isInside := cellClusters[cellNames[i]]
+
+		if !isInside {
+			continue
+		}
+
+		depth := 0.0
+
+		if DEPTHFILE != "" {
+			depth = cellDepths[cellNames[i]]
+		} else {
+			for _, value := range row.Values {
+				depth += value
+			}
+		}
+
+		if depth <= 0 {
+			continue
+		}
+
+		kept[i] = len(data.cluster)
+		data.cluster = append(data.cluster, cluster)
+		data.depth = append(data.depth, depth)
+	}
+
+	if len(data.cluster) == 0 {
+		log.Fatal("Error no cell of the matrix found in the -cluster file!")
+	}
+
+	// centered log depth used as covariate of the logistic regression
+	meanLogDepth := 0.0
+	data.logDepth = make([]float64, len(data.depth))
+
+	for i, depth := range data.depth {
+		data.logDepth[i] = math.Log(depth)
+		meanLogDepth += data.logDepth[i] / float64(len(data.depth))
+	}
+
+	for i := range data.logDepth {
+		data.logDepth[i] -= meanLogDepth
+	}
+
+	data.peaks = make([]utils.SparseVector, len(PEAKMAPPING))
+
+	for i, row := range matrix.Rows {
+		if kept[i] == -1 {
+			continue
+		}
+
+		for pos, peak := range row.Index {
+			if row.Values[pos] > 0 {
+				data.peaks[peak].Index = append(data.peaks[peak].Index, uint32(kept[i]))
+				data.peaks[peak].Values = append(data.peaks[peak].Values, row.Values[pos])
+			}
+		}
+	}
+
+	fmt.Printf("%d cells with a cluster and %d peaks loaded\n", len(data.cluster), len(data.peaks))
+
+	return data
+}
+
+/*loadCellDepths cell ID -> depth from the depth file (empty if -depth is not provided)*/
+func loadCellDepths() (cellDepths map[string]float64) {
+	cellDepths = make(map[string]float64)
+
+	if DEPTHFILE == "" {
+		return cellDepths
+	}
+
+	scanner, file := DEPTHFILE.ReturnReader(0)
+	defer utils.CloseFile(file)
+
+	for scanner.Scan() {
+		split := strings.Fields(scanner.Text())
+
+		if len(split) < 2 || split[0][0] == '#' {
+			continue
+		}
+
+		depth, err := strconv.ParseFloat(split[1], 64)
+		utils.Check(err)
+		cellDepths[split[0]] = depth
+	}
+
+	return cellDepths
+}
+
+/*loadMatrixAndCellNames load the (cell x peak) matrix and the cell IDs of its rows (-xgi or names of the binary matrix)*/
+func loadMatrixAndCellNames() (matrix utils.SparseMatrix, cellNames []string) {
+	if CELLSIDFNAME != "" {
+		scanner, file := CELLSIDFNAME.ReturnReader(0)
+
+		for scanner.Scan() {
+			cellNames = append(cellNames, strings.Split(scanner.Text(), "\t")[0])
+		}
+
+		utils.CloseFile(file)
+	}
+
+	fmt.Printf("loading matrix: %s...\n", MATRIXFILE)
+	matrix = utils.LoadSparseMatrix(string(MATRIXFILE), len(cellNames), len(PEAKMAPPING))
+
+	if len(cellNames) == 0 {
+		cellNames = matrix.RowNames
+	}
+
+	switch {
+	case len(cellNames) < matrix.NRows:
+		log.Fatal(fmt.Sprintf("Error the matrix has more rows (%d) than cell IDs (%d): -xgi must be provided!", matrix.NRows, len(cellNames)))
+	case matrix.NCols > len(PEAKMAPPING):
+		log.Fatal(fmt.Sprintf("Error the matrix has more columns (%d) than peaks in -peak (%d)", matrix.NCols, len(PEAKMAPPING)))
+	}
+
+	return matrix, cellNames
+}
+
+/*loadCellClusters cell ID -> cluster from the cluster file*/
+func loadCellClusters() (cellClusters map[string]string) {
+	cellClusters = make(map[string]string)
+
+	scanner, file := CLUSTERFILE.ReturnReader(0)
+	defer utils.CloseFile(file)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		split := strings.Split(line, "\t")
+
+		if len(split) < 2 {
+			panic(fmt.Sprintf("line: %s cannot be splitted with <tab>\n", line))
+		}
+
+		cellClusters[strings.Trim(split[0], " \t\n")] = strings.Trim(split[1], " \t\n")
+	}
+
+	return cellClusters
+}
+
+/*createDifferentialContrasts IDENT1 vs IDENT2 (or vs all the other cells) or each cluster vs all the other cells*/
+func createDifferentialContrasts(data daData) (contrasts []daContrast) {
+	clusterSet := make(map[string]bool)
+
+	for _, cluster := range data.cluster {
+		clusterSet[cluster] = true
+	}
+
+	newContrast := func(name string, isForeground, isBackground func(string) bool) daContrast {
+		contrast := daContrast{name: name, group: make([]int, len(data.cluster))}
+
+		for cell, cluster := range data.cluster {
+			switch {
+			case isForeground(cluster):
+				contrast.group[cell] = 1
+			case isBackground(cluster):
+				contrast.group[cell] = 0
+			default:
+				contrast.group[cell] = -1
+			}
+		}
+
+		return contrast
+	}
+
+	if CONTRASTFILE != "" {
+		clusters := make([]string, 0, len(clusterSet))
+
+		for cluster := range clusterSet {
+			clusters = append(clusters, cluster)
+		}
+
+		for _, contrast := range loadContrastFile(clusters) {
+			contrasts = append(contrasts, newContrast(contrast.name, contrast.isForeground, contrast.isBackground))
+		}
+
+		return contrasts
+	}
+
+	if IDENT1 != "" {
+		for _, ident := range []string{IDENT1, IDENT2} {
+			if ident != "" && !clusterSet[ident] {
+				log.Fatal(fmt.Sprintf("Error cluster %s not found in the cells of the matrix!", ident))
+			}
+		}
+
+		if IDENT2 == "" {
+			return []daContrast{newContrast(IDENT1,
+				func(cluster string) bool {return cluster == IDENT1},
+				func(cluster string) bool {return true})}
+		}
+
+		return []daContrast{newContrast(fmt.Sprintf("%s_vs_%s", IDENT1, IDENT2),
+			func(cluster string) bool {return cluster == IDENT1},
+			func(cluster string) bool {return cluster == IDENT2})}
+	}
+
+	clusters := make([]string, 0, len(clusterSet))
+
+	for cluster := range clusterSet {
+		clusters = append(clusters, cluster)
+	}
+
+	sort.Strings(clusters)
+
+	for _, cluster := range clusters {
+		ident := cluster
+		contrasts = append(contrasts, newContrast(ident,
+			func(cluster string) bool {return cluster == ident},
+			func(cluster string) bool {return true}))
+	}
+
+	return contrasts
+}
+
+/*testContrast test all the peaks (expressed in at least MINPCT of one of the groups) in parallel and correct the pvalues*/
+func testContrast(data daData, contrast daContrast) (features []daFeature) {
+	var waiting sync.WaitGroup
+
+	model := createContrastModel(data, contrast)
+
+	if model.nbForeground == 0 || model.nbBackground == 0 {
+		fmt.Printf("contrast: %s skipped (%d foreground and %d background cells)\n",
+			contrast.name, model.nbForeground, model.nbBackground)
+		return features
+	}
+
+	threadFeatures := make([][]daFeature, THREADNB)
+
+	for thread := 0; thread < THREADNB; thread++ {
+		waiting.Add(1)
+
+		go func(thread int) {
+			defer waiting.Done()
+
+			// position of each cell of the matrix in the contrast cells
+			cellPos := make([]int, len(contrast.group))
+			values := make([]float64, len(model.cells))
+
+			for i := range cellPos {
+				cellPos[i] = -1
+			}
+
+			for pos, cell := range model.cells {
+				cellPos[cell] = pos
+			}
+
+			for peak := thread; peak < len(data.peaks); peak += THREADNB {
+				feature, isTested := testPeak(data, contrast, &model, peak, cellPos, values)
+
+				if isTested {
+					threadFeatures[thread] = append(threadFeatures[thread], feature)
+				}
+			}
+		}(thread)
+	}
+
+	waiting.Wait()
+
+	for thread := range threadFeatures {
+		features = append(features, threadFeatures[thread]...)
+	}
+
+	for i := range features {
+		features[i].pvalue = nanToOne(features[i].pvalue)
+	}
+
+	sort.Slice(features, func(i, j int) bool {
+		if features[i].pvalue == features[j].pvalue {
+			return features[i].peak < features[j].peak
+		}
+
+		return features[i].pvalue < features[j].pvalue
+	})
+
+	pvalues := make([]float64, len(features))
+
+	for rank := range features {
+		pvalues[rank] = features[rank].pvalue
+		features[rank].qvalues = make([]float64, len(CORRECTIONS))
+	}
+
+	for pos, method := range CORRECTIONS {
+		for rank, adjusted := range adjustPvalues(pvalues, method) {
+			features[rank].qvalues[pos] = adjusted
+		}
+	}
+
+	return features
+}
+
+/*createContrastModel cells used in the contrast and null model (intercept + log depth, independent of the peak) of the logistic regression*/
+func createContrastModel(data daData, contrast daContrast) (model daModel) {
+	for cell, group := range contrast.group {
+		switch group {
+		case 1:
+			model.nbForeground++
+		case 0:
+			model.nbBackground++
+		default:
+			continue
+		}
+
+		model.cells = append(model.cells, cell)
+		model.response = append(model.response, float64(group))
+		model.logDepth = append(model.logDepth, data.logDepth[cell])
+	}
+
+	if TESTTYPE == "lr" && model.nbForeground > 0 && model.nbBackground > 0 {
+		model.nullBeta, model.nullLogLik, _ = fitLogistic(model.response, [][]float64{model.logDepth}, []float64{0, 0})
+	}
+
+	return model
+}
+
+/*testPeak compute the log2 fold change, the fractions of cells with the peak and the pvalue of one peak*/
+func testPeak(data daData, contrast daContrast, model *daModel, peak int, cellPos []int, values []float64) (feature daFeature, isTested bool) {
+	var sumIn, sumOut float64
+	var nbIn, nbOut int
+
+	column := data.peaks[peak]
+	feature.peak = peak
+
+	for pos, cell := range column.Index {
+		if cellPos[cell] == -1 {
+			continue
+		}
+
+		normalized := column.Values[pos] / data.depth[cell] * NORMALIZATIONSCALE
+
+		if contrast.group[cell] == 1 {
+			sumIn += normalized
+			nbIn++
+		} else {
+			sumOut += normalized
+			nbOut++
+		}
+	}
+
+	feature.pctIn = float64(nbIn) / float64(model.nbForeground)
+	feature.pctOut = float64(nbOut) / float64(model.nbBackground)
+
+	if nbIn + nbOut == 0 || math.Max(feature.pctIn, feature.pctOut) < MINPCT {
+		return feature, false
+	}
+
+	feature.log2FC = math.Log2((sumIn / float64(model.nbForeground) + 1.0) / (sumOut / float64(model.nbBackground) + 1.0))
+
+	// normalized accessibility: log1p(count / depth * NORMALIZATIONSCALE)
+	for pos, cell := range column.Index {
+		if cellPos[cell] != -1 {
+			values[cellPos[cell]] = math.Log1p(column.Values[pos] / data.depth[cell] * NORMALIZATIONSCALE)
+		}
+	}
+
+	switch TESTTYPE {
+	case "lr":
+		feature.pvalue = logisticRegressionTest(model, values)
+	default:
+		feature.pvalue = wilcoxonTest(values, model.response)
+	}
+
+	for _, cell := range column.Index {
+		if cellPos[cell] != -1 {
+			values[cellPos[cell]] = 0
+		}
+	}
+
+	return feature, true
+}
+
+/*logisticRegressionTest likelihood ratio test of the logistic regression group ~ log depth + accessibility vs group ~ log depth*/
+func logisticRegressionTest(model *daModel, values []float64) float64 {
+	beta0 := append(append([]float64{}, model.nullBeta...), 0)
+	_, logLik, isFitted := fitLogistic(model.response, [][]float64{model.logDepth, values}, beta0)
+
+	if !isFitted {
+		return 1.0
+	}
+
+	statistic := 2.0 * (logLik - model.nullLogLik)
+
+	if statistic <= 0 {
+		return 1.0
+	}
+
+	// chi2 survival function with one degree of freedom
+	return math.Erfc(math.Sqrt(statistic / 2.0))
+}
+
+/*fitLogistic fit the logistic regression response ~ intercept + covariates with iteratively reweighted least squares.
+Return the coefficients, the log likelihood and false if the information matrix is singular*/
+func fitLogistic(response []float64, covariates [][]float64, beta0 []float64) (beta []float64, logLik float64, isFitted bool) {
+	nbParams := len(covariates) + 1
+	beta = append([]float64{}, beta0...)
+	hessian := make([][]float64, nbParams)
+	gradient := make([]float64, nbParams)
+	x := make([]float64, nbParams)
+
+	for i := range hessian {
+		hessian[i] = make([]float64, nbParams)
+	}
+
+	logLik = math.Inf(-1)
+
+	for iter := 0; iter < 50; iter++ {
+		newLogLik := 0.0
+
+		for i := range hessian {
+			gradient[i] = 0
+
+			for j := range hessian[i] {
+				hessian[i][j] = 0
+			}
+		}
+
+		for cell := range response {
+			x[0] = 1.0
+			eta := beta[0]
+
+			for k, covariate := range covariates {
+				x[k + 1] = covariate[cell]
+				eta += beta[k + 1] * covariate[cell]
+			}
+
+			mu := 1.0 / (1.0 + math.Exp(-eta))
+			mu = math.Min(math.Max(mu, 1e-12), 1.0 - 1e-12)
+			weight := mu * (1.0 - mu)
+
+			if response[cell] == 1 {
+				newLogLik += math.Log(mu)
+			} else {
+				newLogLik += math.Log(1.0 - mu)
+			}
+
+			for i := range x {
+				gradient[i] += (response[cell] - mu) * x[i]
+
+				for j := i; j < nbParams; j++ {
+					hessian[i][j] += weight * x[i] * x[j]
+				}
+			}
+		}
+
+		for i := range hessian {
+			for j := 0; j < i; j++ {
+				hessian[i][j] = hessian[j][i]
+			}
+		}
+
+		if math.Abs(newLogLik - logLik) < 1e-8 * (math.Abs(newLogLik) + 1e-8) {
+			return beta, newLogLik, true
+		}
+
+		logLik = newLogLik
+		step, isSolved := solveLinearSystem(hessian, gradient)
+
+		if !isSolved {
+			return beta, logLik, false
+		}
+
+		for i := range beta {
+			beta[i] += step[i]
+		}
+	}
+
+	return beta, logLik, true
+}
+
+/*solveLinearSystem solve a x = b with a small dense matrix (gaussian elimination with partial pivoting)*/
+func solveLinearSystem(a [][]float64, b []float64) (x []float64, isSolved bool) {
+	n := len(b)
+	m := make([][]float64, n)
+
+	for i := range m {
+		m[i] = append(append(make([]float64, 0, n + 1), a[i]...), b[i])
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+
+		for row := col + 1; row < n; row++ {
+			if math.Abs(m[row][col]) > math.Abs(m[pivot][col]) {
+				pivot = row
+			}
+		}
+
+		if math.Abs(m[pivot][col]) < 1e-12 {
+			return nil, false
+		}
+
+		m[col], m[pivot] = m[pivot], m[col]
+
+		for row := col + 1; row < n; row++ {
+			factor := m[row][col] / m[col][col]
+
+			for k := col; k <= n; k++ {
+				m[row][k] -= factor * m[col][k]
+			}
+		}
+	}
+
+	x = make([]float64, n)
+
+	for row := n - 1; row >= 0; row-- {
+		x[row] = m[row][n]
+
+		for k := row + 1; k < n; k++ {
+			x[row] -= m[row][k] * x[k]
+		}
+
+		x[row] /= m[row][row]
+	}
+
+	return x, true
+}
+
+/*wilcoxonTest two-sided wilcoxon rank-sum test (normal approximation with tie and continuity corrections) of the foreground vs background values*/
+func wilcoxonTest(values, response []float64) float64 {
+	var nbForeground, nbBackground, nbZeros, nbZerosForeground int
+	var nonZeros []int
+
+	for cell, value := range values {
+		if response[cell] == 1 {
+			nbForeground++
+		} else {
+			nbBackground++
+		}
+
+		if value == 0 {
+			nbZeros++
+
+			if response[cell] == 1 {
+				nbZerosForeground++
+			}
+
+			continue
+		}
+
+		nonZeros = append(nonZeros, cell)
+	}
+
+	sort.Slice(nonZeros, func(i, j int) bool {return values[nonZeros[i]] < values[nonZeros[j]]})
+
+	n1, n2 := float64(nbForeground), float64(nbBackground)
+	n := n1 + n2
+
+	// the zeros are tied and share the average rank (nbZeros + 1) / 2
+	rankSum := float64(nbZerosForeground) * float64(nbZeros + 1) / 2.0
+	tieSum := math.Pow(float64(nbZeros), 3) - float64(nbZeros)
+
+	for start := 0; start < len(nonZeros); {
+		end := start + 1
+
+		for end < len(nonZeros) && values[nonZeros[end]] == values[nonZeros[start]] {
+			end++
+		}
+
+		rank := float64(nbZeros) + float64(start + end + 1) / 2.0
+
+		for _, cell := range nonZeros[start:end] {
+			if response[cell] == 1 {
+				rankSum += rank
+			}
+		}
+
+		tieSum += math.Pow(float64(end - start), 3) - float64(end - start)
+		start = end
+	}
+
+	u := rankSum - n1 * (n1 + 1.0) / 2.0
+	mean := n1 * n2 / 2.0
+	variance := n1 * n2 / 12.0 * ((n + 1.0) - tieSum / (n * (n - 1.0)))
+
+	if variance <= 0 {
+		return 1.0
+	}
+
+	diff := u - mean
+	correction := 0.5
+
+	if diff < 0 {
+		correction = -0.5
+	} else if diff == 0 {
+		correction = 0
+	}
+
+	z := (diff - correction) / math.Sqrt(variance)
+
+	return math.Min(1.0, math.Erfc(math.Abs(z) / math.Sqrt2))
+}
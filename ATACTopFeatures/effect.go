@@ -0,0 +1,153 @@
+package main
+
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+)
+
+
+/*ORCIZ normal quantile of the 95% confidence interval of the log odd ratio*/
+const ORCIZ = 1.959963984540054
+
+/*EFFECTCOLUMNS effect size and specificity columns written after the cluster (and symbol) columns*/
+var EFFECTCOLUMNS = []string{"frac.in", "frac.out", "log2OR", "log2OR.low", "log2OR.high", "log2FC", "tau", "entropy", "specificity"}
+
+/*EFFECTHEADER header of the effect columns of the output tables (from the p-value table with -pvalue_correction)*/
+var EFFECTHEADER = strings.Join(EFFECTCOLUMNS, "\t")
+
+/*PTABLEEFFECTS map[cluster ID][peak ID] effect columns loaded from the p-value table (-pvalue_correction)*/
+var PTABLEEFFECTS []map[uintptr]string
+
+/*peakSpecificity specificity of the accessibility of a peak across the clusters*/
+type peakSpecificity struct {
+	tau, entropy float64
+	fracSum float64
+	reads int64
+	cells int
+}
+
+/*PEAKSPECIFICITY map[peak ID]specificity across the clusters*/
+var PEAKSPECIFICITY []peakSpecificity
+
+/*computePeakSpecificity compute the tau index and the Shannon entropy of the fractions of cells with each peak across the clusters.
+CHI2SCORE must be indexed by peak (before sorting the p-values). With -contrasts, it is called with the original clusters
+(before applyContrast) and computePeakTotals is called for each contrast*/
+func computePeakSpecificity() {
+	nbClusters := len(CHI2SCORE)
+
+	if nbClusters == 0 {
+		return
+	}
+
+	PEAKSPECIFICITY = make([]peakSpecificity, len(CHI2SCORE[0]))
+
+	for peakID := range PEAKSPECIFICITY {
+		spec := &PEAKSPECIFICITY[peakID]
+		maxFrac := 0.0
+
+		for clusterID := range CHI2SCORE {
+			frac := float64(CHI2SCORE[clusterID][peakID].n11) / float64(CLUSTERSUM[clusterID])
+			spec.fracSum += frac
+			maxFrac = math.Max(maxFrac, frac)
+		}
+
+		if spec.fracSum == 0 {
+			spec.entropy = math.Log(float64(nbClusters))
+			continue
+		}
+
+		for clusterID := range CHI2SCORE {
+			frac := float64(CHI2SCORE[clusterID][peakID].n11) / float64(CLUSTERSUM[clusterID])
+
+			if nbClusters > 1 {
+				spec.tau += (1.0 - frac / maxFrac) / float64(nbClusters - 1)
+			}
+
+			if frac > 0 {
+				spec.entropy -= frac / spec.fracSum * math.Log(frac / spec.fracSum)
+			}
+		}
+	}
+
+	computePeakTotals()
+}
+
+/*computePeakTotals number of reads and of cells with each peak in the current clusters (or contrast groups)*/
+func computePeakTotals() {
+	for peakID := range PEAKSPECIFICITY {
+		spec := &PEAKSPECIFICITY[peakID]
+		spec.reads, spec.cells = 0, 0
+
+		for clusterID := range CHI2SCORE {
+			spec.reads += CHI2SCORE[clusterID][peakID].reads
+			spec.cells += CHI2SCORE[clusterID][peakID].n11
+		}
+	}
+}
+
+/*writeEffectColumns write the effect size and specificity columns of a (cluster, peak) feature:
+fractions of cells with the peak in / out of the cluster, log2 odd ratio with its 95% CI (Haldane correction),
+log2 fold change of the normalized accessibility (reads / depth * NORMALIZATIONSCALE), and the tau index, the Shannon entropy
+across the clusters and the cluster specificity Q = entropy - log(p cluster), as scripts/snATAC_entropy_feature.
+With -contrasts, tau and entropy are computed over the original clusters and p is the fraction of the foreground group*/
+func writeEffectColumns(buffer *bytes.Buffer, clusterID int, peakID uintptr, peaki peakFeature) {
+	if PTABLEEFFECTS != nil {
+		if EFFECTHEADER != "" {
+			buffer.WriteRune('\t')
+			buffer.WriteString(PTABLEEFFECTS[clusterID][peakID])
+		}
+
+		return
+	}
+
+	spec := PEAKSPECIFICITY[peakID]
+	clusterSum := CLUSTERSUM[clusterID]
+	totalDepth := int64(0)
+
+	for _, depth := range CLUSTERDEPTH {
+		totalDepth += depth
+	}
+
+	// [[a, b], [c, d]]: cells with / without the peak in / out of the cluster
+	a := float64(peaki.n11) + 0.5
+	b := float64(clusterSum - peaki.n11) + 0.5
+	c := float64(spec.cells - peaki.n11) + 0.5
+	d := float64(TOTALNBCELLS - clusterSum - spec.cells + peaki.n11) + 0.5
+
+	logOR := math.Log(a * d / (b * c))
+	logORse := math.Sqrt(1.0 / a + 1.0 / b + 1.0 / c + 1.0 / d)
+
+	normIn := normalizedAccessibility(peaki.reads, CLUSTERDEPTH[clusterID])
+	normOut := normalizedAccessibility(spec.reads - peaki.reads, totalDepth - CLUSTERDEPTH[clusterID])
+
+	fracIn := float64(peaki.n11) / float64(clusterSum)
+	fracOut := 0.0
+
+	if TOTALNBCELLS > clusterSum {
+		fracOut = float64(spec.cells - peaki.n11) / float64(TOTALNBCELLS - clusterSum)
+	}
+
+	specificity := math.Inf(1)
+
+	if fracIn > 0 {
+		specificity = spec.entropy - math.Log(fracIn / spec.fracSum)
+	}
+
+	buffer.WriteString(fmt.Sprintf("\t%.5f\t%.5f\t%.4f\t%.4f\t%.4f\t%.4f\t%.4f\t%.4f\t%.4f",
+		fracIn, fracOut,
+		logOR / math.Ln2, (logOR - ORCIZ * logORse) / math.Ln2, (logOR + ORCIZ * logORse) / math.Ln2,
+		math.Log2((normIn + 1.0) / (normOut + 1.0)),
+		spec.tau, spec.entropy, specificity))
+}
+
+/*normalizedAccessibility mean number of reads in the peak per NORMALIZATIONSCALE reads of the cells*/
+func normalizedAccessibility(reads, depth int64) float64 {
+	if depth == 0 {
+		return 0
+	}
+
+	return float64(reads) / float64(depth) * NORMALIZATIONSCALE
+}
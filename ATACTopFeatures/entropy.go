@@ -0,0 +1,567 @@
+package main
+
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+)
+
+
+/*PERCSIGNIFICANT expected fraction of significant features, excluded from the fit of the null entropy score distribution*/
+var PERCSIGNIFICANT float64
+
+/*TOPK number of top features of each cluster written even if not significant*/
+var TOPK int
+
+/*PSCORESCALE scaling constant of the normalized cluster accessibility (P score)*/
+const PSCORESCALE = 1e6
+
+/*GMMVARIANCEFLOOR minimum variance of the Gaussian mixture components (as sklearn reg_covar)*/
+const GMMVARIANCEFLOOR = 1e-6
+
+/*entropyData cluster-level accessibility used to compute the entropy scores*/
+type entropyData struct {
+	clusters []string
+	nbCells []int
+	medianDepth []float64
+	// map[cluster][peak] nb of cells with the peak
+	counts [][]float64
+}
+
+/*entropyFeature entropy score of a (cluster, peak) feature*/
+type entropyFeature struct {
+	peak int
+	pscore float64
+	qscore float64
+	pvalue, individualPvalue float64
+}
+
+/*gaussian mean and standard deviation of a normal distribution*/
+type gaussian struct {
+	mean, std float64
+}
+
+/*withVarianceFloor gaussian with a variance of at least GMMVARIANCEFLOOR (the densities are not defined for a null std)*/
+func (distribution gaussian) withVarianceFloor() gaussian {
+	distribution.std = math.Sqrt(math.Max(distribution.std * distribution.std, GMMVARIANCEFLOOR))
+
+	return distribution
+}
+
+/*launchEntropyFeatureSelection rank the features of each cluster using the Shannon entropy of the cluster-level accessibility
+(Python scripts/snATAC_entropy_feature). The low entropy score threshold is obtained with a Gaussian mixture on the log scores*/
+func launchEntropyFeatureSelection() {
+	tStart := time.Now()
+
+	if FILENAMEOUT == "" {
+		input := inputFilename()
+		ext := path.Ext(input.String())
+		FILENAMEOUT = fmt.Sprintf("%s.entropy", input[:len(input)-len(ext)])
+	}
+
+	if folderName := path.Dir(FILENAMEOUT); !utils.CheckIfFolderExists(folderName) {
+		err := os.MkdirAll(folderName, 0755)
+		utils.Check(err)
+	}
+
+	utils.LoadSymbolFile(PEAKSYMBOLFILE, PEAKFILE)
+	utils.LoadPeaks(PEAKFILE, false, true)
+	createPeakMappingDict()
+
+	var data entropyData
+
+	if MATRIXFILE != "" {
+		data = loadEntropyDataFromMatrix()
+	} else {
+		data = loadEntropyDataFromBed()
+	}
+
+	if len(data.clusters) < 2 {
+		log.Fatal("Error at least two clusters are needed to compute the entropy scores!")
+	}
+
+	pscores := computeRelativeAccessibility(data)
+	qscores, entropies := computeEntropyScores(pscores)
+
+	features := make([][]entropyFeature, len(data.clusters))
+	var pooled []float64
+	nulls := make([]gaussian, len(data.clusters))
+
+	for clusterID := range data.clusters {
+		features[clusterID] = make([]entropyFeature, len(PEAKMAPPING))
+
+		for peak := range PEAKMAPPING {
+			features[clusterID][peak] = entropyFeature{
+				peak: peak,
+				pscore: pscores[clusterID][peak] * PSCORESCALE,
+				qscore: qscores[clusterID][peak],
+			}
+		}
+
+		// decreasing Q scores: the features with the lowest scores (the PERCSIGNIFICANT fraction) are excluded from the null fit
+		sort.Slice(features[clusterID], func(i, j int) bool {
+			return features[clusterID][i].qscore > features[clusterID][j].qscore})
+
+		cutoff := int(float64(len(PEAKMAPPING)) * (1.0 - PERCSIGNIFICANT))
+		bottom := make([]float64, cutoff)
+
+		for i := range bottom {
+			bottom[i] = math.Log(features[clusterID][i].qscore)
+		}
+
+		nulls[clusterID] = fitNullGaussianMixture(bottom)
+		pooled = append(pooled, bottom...)
+	}
+
+	null := fitNullGaussianMixture(pooled)
+
+	fmt.Printf("global null log(Q) distribution: N(%f, %f)\n", null.mean, null.std)
+
+	for clusterID := range data.clusters {
+		for i := range features[clusterID] {
+			logQ := math.Log(features[clusterID][i].qscore)
+			features[clusterID][i].pvalue = normalCDF(logQ, null)
+			features[clusterID][i].individualPvalue = normalCDF(logQ, nulls[clusterID])
+		}
+
+		// increasing Q scores: the most cluster specific features first
+		sort.SliceStable(features[clusterID], func(i, j int) bool {
+			return features[clusterID][i].qscore < features[clusterID][j].qscore})
+	}
+
+	writeEntropyFeatures(fmt.Sprintf("%s.cluster_features.tsv", FILENAMEOUT), data, features, entropies)
+	writeSelectedEntropyFeatures(fmt.Sprintf("%s.selected_features.tsv", FILENAMEOUT), data, features, entropies)
+
+	tDiff := time.Since(tStart)
+	fmt.Printf("Entropy feature selection done in: %f s \n", tDiff.Seconds())
+}
+
+/*loadEntropyDataFromMatrix nb of cells with each peak per cluster and median depth of the cells of each cluster from the (cell x peak) matrix.
+The depth is read from -depth or is the sum of the row*/
+func loadEntropyDataFromMatrix() (data entropyData) {
+	matrix, cellNames := loadMatrixAndCellNames()
+	cellClusters := loadCellClusters()
+	cellDepths := loadCellDepths()
+
+	clusterIndex := make(map[string]int)
+	var depths [][]float64
+
+	for i, row := range matrix.Rows {
+		cluster, isInside := cellClusters[cellNames[i]]
+
+		if !isInside {
+			continue
+		}
+
+		if _, isInside = clusterIndex[cluster]; !isInside {
+			clusterIndex[cluster] = len(data.clusters)
+			data.clusters = append(data.clusters, cluster)
+			data.nbCells = append(data.nbCells, 0)
+			data.counts = append(data.counts, make([]float64, len(PEAKMAPPING)))
+			depths = append(depths, nil)
+		}
+
+		clusterID := clusterIndex[cluster]
+		depth := 0.0
+
+		if DEPTHFILE != "" {
+			depth = cellDepths[cellNames[i]]
+		}
+
+		for pos, peak := range row.Index {
+			if row.Values[pos] > 0 {
+				data.counts[clusterID][peak]++
+			}
+
+			if DEPTHFILE == "" {
+				depth += row.Values[pos]
+			}
+		}
+
+		data.nbCells[clusterID]++
+		depths[clusterID] = append(depths[clusterID], depth)
+	}
+
+	if len(data.clusters) == 0 {
+		log.Fatal("Error no cell of the matrix found in the -cluster file!")
+	}
+
+	for _, clusterDepths := range depths {
+		data.medianDepth = append(data.medianDepth, median(clusterDepths))
+	}
+
+	return sortEntropyData(data)
+}
+
+/*loadEntropyDataFromBed nb of cells with each peak per cluster and median depth of the cells of each cluster from the bed file.
+The depth is read from -depth or is the number of reads of the cell*/
+func loadEntropyDataFromBed() (data entropyData) {
+	BUFFERARRAY = make([][BUFFERSIZE]string, THREADNB)
+
+	loadCellClusterIDAndInitMaps()
+	loadCellPeakCounts(0)
+
+	cellDepths := loadCellDepths()
+	depths := make([][]float64, len(CLUSTERSUM))
+
+	for cellName, cellID := range CELLMAPPING {
+		depth := float64(CELLDEPTH[cellID])
+
+		if DEPTHFILE != "" {
+			depth = cellDepths[cellName]
+		}
+
+		depths[CELLCLUSTERID[cellID]] = append(depths[CELLCLUSTERID[cellID]], depth)
+	}
+
+	for clusterID, cluster := range NAMECLUSTERMAPPING {
+		data.clusters = append(data.clusters, cluster)
+		data.nbCells = append(data.nbCells, CLUSTERSUM[clusterID])
+		data.medianDepth = append(data.medianDepth, median(depths[clusterID]))
+		data.counts = append(data.counts, make([]float64, len(PEAKMAPPING)))
+
+		for peak := range CHI2SCORE[clusterID] {
+			data.counts[clusterID][peak] = float64(CHI2SCORE[clusterID][peak].n11)
+		}
+	}
+
+	CHI2SCORE = nil
+
+	return sortEntropyData(data)
+}
+
+/*sortEntropyData sort the clusters by name*/
+func sortEntropyData(data entropyData) (sorted entropyData) {
+	order := make([]int, len(data.clusters))
+
+	for i := range order {
+		order[i] = i
+	}
+
+	sort.Slice(order, func(i, j int) bool {return data.clusters[order[i]] < data.clusters[order[j]]})
+
+	for _, i := range order {
+		sorted.clusters = append(sorted.clusters, data.clusters[i])
+		sorted.nbCells = append(sorted.nbCells, data.nbCells[i])
+		sorted.medianDepth = append(sorted.medianDepth, data.medianDepth[i])
+		sorted.counts = append(sorted.counts, data.counts[i])
+	}
+
+	fmt.Printf("%d clusters loaded\n", len(sorted.clusters))
+
+	return sorted
+}
+
+/*computeRelativeAccessibility normalized accessibility of each peak per cluster: the fraction of cells with the peak (plus 1 / nb of cells)
+is transformed into a relative accessibility score 1 - (1 - fraction)^(1 / median depth) and normalized to sum to 1 over the peaks of the cluster*/
+func computeRelativeAccessibility(data entropyData) (pscores [][]float64) {
+	totalCells := 0
+
+	for _, nbCells := range data.nbCells {
+		totalCells += nbCells
+	}
+
+	pscores = make([][]float64, len(data.clusters))
+
+	for clusterID := range data.clusters {
+		pscores[clusterID] = make([]float64, len(PEAKMAPPING))
+		sum := 0.0
+		exponent := 1.0
+
+		if data.medianDepth[clusterID] > 0 {
+			exponent = 1.0 / data.medianDepth[clusterID]
+		}
+
+		for peak := range PEAKMAPPING {
+			fraction := data.counts[clusterID][peak] / float64(data.nbCells[clusterID]) + 1.0 / float64(totalCells)
+			pscores[clusterID][peak] = 1.0 - math.Pow(math.Max(1.0 - fraction, 0), exponent)
+			sum += pscores[clusterID][peak]
+		}
+
+		for peak := range PEAKMAPPING {
+			pscores[clusterID][peak] /= sum
+		}
+	}
+
+	return pscores
+}
+
+/*computeEntropyScores Shannon entropy H of each peak across the clusters and entropy score Q = H - log(p cluster) of each (cluster, peak)*/
+func computeEntropyScores(pscores [][]float64) (qscores [][]float64, entropies []float64) {
+	qscores = make([][]float64, len(pscores))
+	entropies = make([]float64, len(PEAKMAPPING))
+
+	for clusterID := range pscores {
+		qscores[clusterID] = make([]float64, len(PEAKMAPPING))
+	}
+
+	for peak := range PEAKMAPPING {
+		sum := 0.0
+
+		for clusterID := range pscores {
+			sum += pscores[clusterID][peak]
+		}
+
+		for clusterID := range pscores {
+			proba := pscores[clusterID][peak] / sum
+			entropies[peak] -= proba * math.Log(proba)
+		}
+
+		for clusterID := range pscores {
+			qscores[clusterID][peak] = entropies[peak] - math.Log(pscores[clusterID][peak] / sum)
+		}
+	}
+
+	return qscores, entropies
+}
+
+/*fitNullGaussianMixture fit a two-component Gaussian mixture (EM) on the values and return the component with the lowest mean.
+As the Python script, the mean and std are computed from the values assigned to each component*/
+func fitNullGaussianMixture(values []float64) (null gaussian) {
+	if len(values) < 2 {
+		log.Fatal("Error not enough features to fit the null entropy score distribution!")
+	}
+
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+
+	// initialization with the lower and upper halves of the values
+	components := [2]gaussian{
+		meanStd(sorted[:len(sorted) / 2]).withVarianceFloor(),
+		meanStd(sorted[len(sorted) / 2:]).withVarianceFloor(),
+	}
+	weights := [2]float64{0.5, 0.5}
+	responsibilities := make([]float64, len(values))
+	previousLogLik := math.Inf(-1)
+
+	for iter := 0; iter < 200; iter++ {
+		logLik := 0.0
+
+		// E step: responsibility of the first component
+		for i, value := range values {
+			d0 := weights[0] * normalPDF(value, components[0])
+			d1 := weights[1] * normalPDF(value, components[1])
+
+			if d0 + d1 == 0 {
+				responsibilities[i] = 0.5
+				continue
+			}
+
+			responsibilities[i] = d0 / (d0 + d1)
+			logLik += math.Log(d0 + d1)
+		}
+
+		// M step
+		for k := range components {
+			sumWeights, sumValues, sumSquares := 0.0, 0.0, 0.0
+
+			for i, value := range values {
+				weight := responsibilities[i]
+
+				if k == 1 {
+					weight = 1.0 - weight
+				}
+
+				sumWeights += weight
+				sumValues += weight * value
+			}
+
+			if sumWeights == 0 {
+				continue
+			}
+
+			mean := sumValues / sumWeights
+
+			for i, value := range values {
+				weight := responsibilities[i]
+
+				if k == 1 {
+					weight = 1.0 - weight
+				}
+
+				sumSquares += weight * (value - mean) * (value - mean)
+			}
+
+			components[k] = gaussian{mean, math.Sqrt(sumSquares / sumWeights)}.withVarianceFloor()
+			weights[k] = sumWeights / float64(len(values))
+		}
+
+		// convergence of the mean log likelihood (as sklearn tol)
+		if math.Abs(logLik - previousLogLik) < 1e-3 * float64(len(values)) {
+			break
+		}
+
+		previousLogLik = logLik
+	}
+
+	var assigned [2][]float64
+
+	for i, value := range values {
+		if responsibilities[i] >= 0.5 {
+			assigned[0] = append(assigned[0], value)
+		} else {
+			assigned[1] = append(assigned[1], value)
+		}
+	}
+
+	null = meanStd(values)
+	isFound := false
+
+	for k := range assigned {
+		if len(assigned[k]) < 2 {
+			continue
+		}
+
+		component := meanStd(assigned[k])
+
+		if !isFound || component.mean < null.mean {
+			null, isFound = component, true
+		}
+	}
+
+	return null.withVarianceFloor()
+}
+
+/*meanStd mean and (population) standard deviation of the values*/
+func meanStd(values []float64) (distribution gaussian) {
+	for _, value := range values {
+		distribution.mean += value / float64(len(values))
+	}
+
+	for _, value := range values {
+		distribution.std += (value - distribution.mean) * (value - distribution.mean) / float64(len(values))
+	}
+
+	distribution.std = math.Sqrt(distribution.std)
+
+	return distribution
+}
+
+func normalPDF(x float64, distribution gaussian) float64 {
+	z := (x - distribution.mean) / distribution.std
+
+	return math.Exp(-0.5 * z * z) / (distribution.std * math.Sqrt(2.0 * math.Pi))
+}
+
+func normalCDF(x float64, distribution gaussian) float64 {
+	return 0.5 * math.Erfc(-(x - distribution.mean) / (distribution.std * math.Sqrt2))
+}
+
+/*median median of the values (0 if empty)*/
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+
+	if len(sorted) % 2 == 1 {
+		return sorted[len(sorted) / 2]
+	}
+
+	return (sorted[len(sorted) / 2 - 1] + sorted[len(sorted) / 2]) / 2.0
+}
+
+/*writeEntropyFeatures write the (cluster, peak) features sorted by entropy score for each cluster: the significant features
+(global null distribution) and the TOPK first features of each cluster, or all the features with -write_all*/
+func writeEntropyFeatures(fname string, data entropyData, features [][]entropyFeature, entropies []float64) {
+	var buffer bytes.Buffer
+
+	writer := utils.ReturnWriter(fname)
+	defer utils.CloseFile(writer)
+
+	writeSymbol := len(utils.PEAKSYMBOLDICT) != 0
+
+	buffer.WriteString("#chr\tstart\tstop\tcluster")
+
+	if writeSymbol {
+		buffer.WriteString("\tsymbol")
+	}
+
+	buffer.WriteString("\trank\tP_score\tentropy\tQ_score\tpvalue\tpvalue_individual\tsignificant\tsignificant_individual\n")
+
+	for clusterID, cluster := range data.clusters {
+		nbSignificant := 0
+
+		for rank, feature := range features[clusterID] {
+			isSignificant := feature.pvalue < ALPHA
+
+			if isSignificant {
+				nbSignificant++
+			}
+
+			if !WRITEALL && !isSignificant && rank >= TOPK {
+				continue
+			}
+
+			peakl := PEAKMAPPING[feature.peak]
+			buffer.WriteString(fmt.Sprintf("%s\t%s\t%s\t%s", peakl.Slice[0], peakl.Slice[1], peakl.Slice[2], cluster))
+
+			if writeSymbol {
+				buffer.WriteRune('\t')
+				buffer.WriteString(strings.Join(utils.PEAKSYMBOLDICT[peakl], "-"))
+			}
+
+			buffer.WriteString(fmt.Sprintf("\t%d\t%e\t%.6f\t%.6f\t%e\t%e\t%s\t%s\n",
+				rank + 1, feature.pscore, entropies[feature.peak], feature.qscore, feature.pvalue, feature.individualPvalue,
+				strconv.FormatBool(isSignificant), strconv.FormatBool(feature.individualPvalue < ALPHA)))
+		}
+
+		_, err := writer.Write(buffer.Bytes())
+		utils.Check(err)
+		buffer.Reset()
+
+		fmt.Printf("cluster: %s: %d significant features\n", cluster, nbSignificant)
+	}
+
+	fmt.Printf("File: %s written\n", fname)
+}
+
+/*writeSelectedEntropyFeatures write the features significant for at least one cluster with their clusters (global null distribution)*/
+func writeSelectedEntropyFeatures(fname string, data entropyData, features [][]entropyFeature, entropies []float64) {
+	var buffer bytes.Buffer
+
+	peakClusters := make([][]string, len(PEAKMAPPING))
+
+	for clusterID, cluster := range data.clusters {
+		for _, feature := range features[clusterID] {
+			if feature.pvalue >= ALPHA {
+				break
+			}
+
+			peakClusters[feature.peak] = append(peakClusters[feature.peak], cluster)
+		}
+	}
+
+	writer := utils.ReturnWriter(fname)
+	defer utils.CloseFile(writer)
+
+	buffer.WriteString("#chr\tstart\tstop\tentropy\tclusters\n")
+	nbSelected := 0
+
+	for peak, clusters := range peakClusters {
+		if len(clusters) == 0 {
+			continue
+		}
+
+		peakl := PEAKMAPPING[peak]
+		buffer.WriteString(fmt.Sprintf("%s\t%s\t%s\t%.6f\t%s\n",
+			peakl.Slice[0], peakl.Slice[1], peakl.Slice[2], entropies[peak], strings.Join(clusters, ",")))
+		nbSelected++
+	}
+
+	_, err := writer.Write(buffer.Bytes())
+	utils.Check(err)
+
+	fmt.Printf("%d features selected. File: %s written\n", nbSelected, fname)
+}
@@ -0,0 +1,273 @@
+package main
+
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+)
+
+
+/*FISHERRELATIVEERROR relative tolerance used to include the tables as extreme as the observed one (same as scipy) */
+const FISHERRELATIVEERROR = 1e-7
+
+/*contingencyTest compute the odd ratio and the p-value (TESTTYPE: fisher or chi2) of the contingency table [[n11, n12], [n21, n22]] */
+func contingencyTest(n11, n12, n21, n22 int) (oddRatio, pvalue float64) {
+	oddRatio = (float64(n11) / float64(n12)) / (float64(n21 + 1) / float64(n22 + 1))
+
+	switch TESTTYPE {
+	case "fisher":
+		if ALTERNATIVE == "greater" {
+			pvalue = fisherGreaterTest(n11, n12, n21, n22)
+		} else {
+			pvalue = fisherExactTest(n11, n12, n21, n22)
+		}
+	default:
+		_, pvalue = chiSquareTest(n11, n12, n21, n22, true)
+
+		// alternative greater: depleted tables get 1 - pvalue (as scripts/snATAC_feature_selection)
+		if ALTERNATIVE == "greater" && float64(n11) * float64(n22) < float64(n21) * float64(n12) {
+			pvalue = 1.0 - pvalue
+		}
+	}
+
+	return oddRatio, pvalue
+}
+
+/*hypergeometricTable support [low, high], mode and log probability function of the hypergeometric distribution of n11
+for the margins of the contingency table [[n11, n12], [n21, n22]] */
+type hypergeometricTable struct {
+	row, col, total int
+	low, high, mode int
+}
+
+func newHypergeometricTable(n11, n12, n21, n22 int) (table hypergeometricTable) {
+	table.total = n11 + n12 + n21 + n22
+	table.row = n11 + n12
+	table.col = n11 + n21
+
+	if table.row + table.col - table.total > table.low {
+		table.low = table.row + table.col - table.total
+	}
+
+	table.high = table.row
+
+	if table.col < table.high {
+		table.high = table.col
+	}
+
+	table.mode = int(float64(table.row + 1) * float64(table.col + 1) / float64(table.total + 2))
+
+	if table.mode < table.low {
+		table.mode = table.low
+	}
+
+	if table.mode > table.high {
+		table.mode = table.high
+	}
+
+	return table
+}
+
+func (table hypergeometricTable) logPmf(x int) float64 {
+	return utils.LogChoose(table.col, x) + utils.LogChoose(table.total - table.col, table.row - x) - utils.LogChoose(table.total, table.row)
+}
+
+/*tail sum of the hypergeometric probabilities from start to end (decreasing terms) */
+func (table hypergeometricTable) tail(start, end, step int) float64 {
+	return hypergeometricTail(start, end, step, table.row, table.col, table.total, table.logPmf(start))
+}
+
+/*fisherGreaterTest one-sided (alternative greater) Fisher exact test of the contingency table [[n11, n12], [n21, n22]]:
+P(X >= n11), summed over the decreasing side of the distribution */
+func fisherGreaterTest(n11, n12, n21, n22 int) float64 {
+	table := newHypergeometricTable(n11, n12, n21, n22)
+
+	switch {
+	case n11 <= table.low:
+		return 1.0
+	case n11 > table.mode:
+		return math.Min(table.tail(n11, table.high, 1), 1.0)
+	default:
+		return math.Max(1.0 - table.tail(n11 - 1, table.low, -1), 0.0)
+	}
+}
+
+/*fisherExactTest two-sided Fisher exact test of the contingency table [[n11, n12], [n21, n22]].
+The p-value is the sum of the hypergeometric probabilities of the tables not more likely than the observed one.
+The probabilities are computed in log space and summed from the observed table toward the tails, which is stable for large counts */
+func fisherExactTest(n11, n12, n21, n22 int) float64 {
+	table := newHypergeometricTable(n11, n12, n21, n22)
+	low, high, mode := table.low, table.high, table.mode
+	row, col, total := table.row, table.col, table.total
+	logPmf := table.logPmf
+
+	if low == high {
+		return 1.0
+	}
+
+	logObserved := logPmf(n11)
+	threshold := logObserved + math.Log1p(FISHERRELATIVEERROR)
+
+	if logPmf(mode) <= threshold {
+		return 1.0
+	}
+
+	var pvalue float64
+
+	if n11 < mode {
+		pvalue = hypergeometricTail(n11, low, -1, row, col, total, logObserved)
+		// first table after the mode not more likely than the observed one
+		first := mode + sort.Search(high - mode, func(i int) bool {return logPmf(mode + i + 1) <= threshold}) + 1
+
+		if first <= high {
+			pvalue += hypergeometricTail(first, high, 1, row, col, total, logPmf(first))
+		}
+	} else {
+		pvalue = hypergeometricTail(n11, high, 1, row, col, total, logObserved)
+		// last table before the mode not more likely than the observed one
+		last := mode - sort.Search(mode - low, func(i int) bool {return logPmf(mode - i - 1) <= threshold}) - 1
+
+		if last >= low {
+			pvalue += hypergeometricTail(last, low, -1, row, col, total, logPmf(last))
+		}
+	}
+
+	return math.Min(pvalue, 1.0)
+}
+
+/*hypergeometricTail sum of the (decreasing) hypergeometric probabilities from start to end using the ratio between consecutive terms */
+func hypergeometricTail(start, end, step, row, col, total int, logStart float64) float64 {
+	sum := 1.0
+	term := 1.0
+
+	for x := start; x != end; x += step {
+		if step > 0 {
+			term *= float64((col - x) * (row - x)) / float64((x + 1) * (total - col - row + x + 1))
+		} else {
+			term *= float64(x * (total - col - row + x)) / float64((col - x + 1) * (row - x + 1))
+		}
+
+		sum += term
+
+		if term < sum * 1e-17 {
+			break
+		}
+	}
+
+	return math.Exp(logStart + math.Log(sum))
+}
+
+/*testContingencyTable compute the odd ratio and the p-value of each line of a contingency table file (<features>...<n11><n12><n21><n22>)
+and write <features>...<OR><pvalue> lines, as scripts/snATAC_feature_selection */
+func testContingencyTable(filenamein utils.Filename, filenameout string) {
+	var buffer bytes.Buffer
+	var err error
+	var lines []string
+
+	tStart := time.Now()
+	nbTables := 0
+
+	scanner, file := filenamein.ReturnReader(0)
+	defer utils.CloseFile(file)
+
+	writer := utils.ReturnWriter(filenameout)
+	defer utils.CloseFile(writer)
+
+	results := make([]string, BUFFERSIZE)
+
+	processLines := func() {
+		var waiting sync.WaitGroup
+
+		chunk := len(lines) / THREADNB + 1
+
+		for start := 0; start < len(lines); start += chunk {
+			end := start + chunk
+
+			if end > len(lines) {
+				end = len(lines)
+			}
+
+			waiting.Add(1)
+
+			go func(start, end int) {
+				defer waiting.Done()
+
+				for i := start; i < end; i++ {
+					results[i] = testContingencyLine(lines[i])
+				}
+			}(start, end)
+		}
+
+		waiting.Wait()
+
+		for i := range lines {
+			buffer.WriteString(results[i])
+		}
+
+		_, err = writer.Write(buffer.Bytes())
+		utils.Check(err)
+		buffer.Reset()
+
+		nbTables += len(lines)
+		lines = lines[:0]
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if len(line) == 0 {
+			continue
+		}
+
+		if line[0] == '#' {
+			split := strings.Split(line, "\t")
+
+			if len(split) > 4 {
+				buffer.WriteString(strings.Join(split[:len(split) - 4], "\t"))
+				buffer.WriteString("\tOR\tpvalue\n")
+			}
+
+			continue
+		}
+
+		lines = append(lines, line)
+
+		if len(lines) >= BUFFERSIZE {
+			processLines()
+		}
+	}
+
+	processLines()
+
+	tDiff := time.Since(tStart)
+	fmt.Printf("%s test of %d contingency tables done. File: %s written in: %f s \n",
+		TESTTYPE, nbTables, filenameout, tDiff.Seconds())
+}
+
+/*testContingencyLine test the contingency table of one line: <features>...<n11><n12><n21><n22> */
+func testContingencyLine(line string) string {
+	var counts [4]int
+	var err error
+
+	split := strings.Split(line, "\t")
+
+	if len(split) < 5 {
+		panic(fmt.Sprintf("Error line: %s is not a contingency table line (<features>...<n11><n12><n21><n22>)", line))
+	}
+
+	for i := range counts {
+		counts[i], err = strconv.Atoi(split[len(split) - 4 + i])
+		utils.Check(err)
+	}
+
+	oddRatio, pvalue := contingencyTest(counts[0], counts[1], counts[2], counts[3])
+
+	return fmt.Sprintf("%s\t%e\t%e\n", strings.Join(split[:len(split) - 4], "\t"), oddRatio, pvalue)
+}
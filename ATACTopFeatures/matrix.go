@@ -0,0 +1,101 @@
+package main
+
+
+import (
+	"fmt"
+	"math"
+	"time"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+)
+
+
+/*CELLPEAKMATRIX (cell x peak) matrix used instead of the bed file to create the contingency tables*/
+var CELLPEAKMATRIX utils.SparseMatrix
+
+/*MATRIXCELLNAMES cell IDs of the rows of CELLPEAKMATRIX*/
+var MATRIXCELLNAMES []string
+
+/*inputFilename name of the input used to define the default output names (-matrix or -bed)*/
+func inputFilename() utils.Filename {
+	if MATRIXFILE != "" {
+		return MATRIXFILE
+	}
+
+	return BEDFILENAME
+}
+
+/*loadCellPeakCounts count the cells with each peak per cluster from the matrix (-matrix) or from the bed file.
+firstPeak is the index of the first peak of the current subset of peaks (-split)*/
+func loadCellPeakCounts(firstPeak int) {
+	if MATRIXFILE != "" {
+		scanMatrixFile(firstPeak)
+		return
+	}
+
+	utils.CreatePeakIntervalTree()
+	utils.InitIntervalDictsThreading(THREADNB)
+	scanBedFile()
+}
+
+/*loadContingencyMatrix load the (cell x peak) matrix once (all the peaks of -peak must be loaded)*/
+func loadContingencyMatrix() {
+	if CELLPEAKMATRIX.NRows != 0 {
+		return
+	}
+
+	CELLPEAKMATRIX, MATRIXCELLNAMES = loadMatrixAndCellNames()
+}
+
+/*scanMatrixFile fill the contingency tables from the nonzero entries of the matrix (same counts as scanBedFile:
+cells with the peak per cluster and nb of reads). The depth of a cell is read from -depth or is the sum of its row*/
+func scanMatrixFile(firstPeak int) {
+	fmt.Printf("Scanning matrix file: %s\n", MATRIXFILE)
+	tStart := time.Now()
+
+	loadContingencyMatrix()
+
+	cellDepths := loadCellDepths()
+	peakTotals := make([]int, len(PEAKMAPPING))
+	nbCells := 0
+
+	for i, row := range CELLPEAKMATRIX.Rows {
+		cellID, isInside := CELLMAPPING[MATRIXCELLNAMES[i]]
+
+		if !isInside {
+			continue
+		}
+
+		nbCells++
+		clusterID := CELLCLUSTERID[cellID]
+		depth := 0.0
+
+		for pos, column := range row.Index {
+			depth += row.Values[pos]
+			peakID := int(column) - firstPeak
+
+			if peakID < 0 || peakID >= len(PEAKMAPPING) || row.Values[pos] <= 0 {
+				continue
+			}
+
+			CHI2SCORE[clusterID][peakID].n11++
+			CHI2SCORE[clusterID][peakID].reads += int64(math.Round(row.Values[pos]))
+			peakTotals[peakID]++
+		}
+
+		if DEPTHFILE != "" {
+			depth = cellDepths[MATRIXCELLNAMES[i]]
+		}
+
+		CELLDEPTH[cellID] = int64(math.Round(depth))
+		CLUSTERDEPTH[clusterID] += CELLDEPTH[cellID]
+	}
+
+	for clusterID := range CHI2SCORE {
+		for peakID, total := range peakTotals {
+			CHI2SCORE[clusterID][peakID].n21 = total
+		}
+	}
+
+	tDiff := time.Since(tStart)
+	fmt.Printf("Scanning matrix file done (%d cells of -cluster found) in time: %f s \n", nbCells, tDiff.Seconds())
+}
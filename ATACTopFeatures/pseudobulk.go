@@ -0,0 +1,928 @@
+package main
+
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	utils "github.com/opoirion/snATACUtils/ATACdemultiplexUtils"
+)
+
+
+/*MINDISPERSION lower bound of the negative binomial dispersions*/
+const MINDISPERSION = 1e-8
+
+/*MAXDISPERSION upper bound of the negative binomial dispersions*/
+const MAXDISPERSION = 10.0
+
+/*PRIORCOUNT prior count (scaled by the library sizes) used to compute the log fold changes, as edgeR*/
+const PRIORCOUNT = 0.125
+
+/*pbLibrary pseudobulk library: sum of the counts of the cells of one cluster (or of the other clusters) in one sample*/
+type pbLibrary struct {
+	name string
+	group int
+	nbCells int
+	counts []float64
+	offset float64
+}
+
+/*pbFeature pseudobulk differential accessibility result of one peak*/
+type pbFeature struct {
+	peak int
+	logFC, logCPM float64
+	dispersion float64
+	pvalue float64
+	qvalues []float64
+}
+
+/*pbColumn counts of the cells of one cluster in one sample*/
+type pbColumn struct {
+	cluster, sample string
+	nbCells int
+	counts []float64
+}
+
+/*launchPseudobulkAnalysis pseudobulk negative binomial differential accessibility (edgeR / DESeq2 like)*/
+func launchPseudobulkAnalysis() {
+	var buffer bytes.Buffer
+	var err error
+
+	tStart := time.Now()
+
+	if FILENAMEOUT == "" {
+		input := inputFilename()
+		ext := path.Ext(input.String())
+		FILENAMEOUT = fmt.Sprintf("%s.pseudobulk_%s.tsv",
+			input[:len(input)-len(ext)], TESTTYPE)
+	}
+
+	utils.LoadSymbolFile(PEAKSYMBOLFILE, PEAKFILE)
+	utils.LoadPeaks(PEAKFILE, false, true)
+	createPeakMappingDict()
+
+	columns := loadPseudobulkColumns()
+
+	writer := utils.ReturnWriter(FILENAMEOUT)
+	defer utils.CloseFile(writer)
+
+	writeSymbol := len(utils.PEAKSYMBOLDICT) != 0
+
+	buffer.WriteString("#chr\tstart\tstop\tcluster")
+
+	if writeSymbol {
+		buffer.WriteString("\tsymbol")
+	}
+
+	buffer.WriteString("\tlogFC\tlogCPM\tdispersion\tpvalue\tqvalue")
+
+	for _, method := range CORRECTIONS[1:] {
+		buffer.WriteString("\tqvalue_")
+		buffer.WriteString(method)
+	}
+
+	buffer.WriteString("\tsignificant\n")
+
+	for _, contrast := range createPseudobulkContrasts(columns) {
+		features := testPseudobulkContrast(contrast.name, contrast.libraries)
+		nbSignificant := 0
+
+		for _, feature := range features {
+			isSignificant := feature.qvalues[0] <= ALPHA
+
+			if isSignificant {
+				nbSignificant++
+			}
+
+			if !WRITEALL && !isSignificant {
+				continue
+			}
+
+			peakl := PEAKMAPPING[feature.peak]
+			buffer.WriteString(fmt.Sprintf("%s\t%s\t%s\t%s", peakl.Slice[0], peakl.Slice[1], peakl.Slice[2], contrast.name))
+
+			if writeSymbol {
+				buffer.WriteRune('\t')
+				buffer.WriteString(strings.Join(utils.PEAKSYMBOLDICT[peakl], "-"))
+			}
+
+			buffer.WriteString(fmt.Sprintf("\t%e\t%.4f\t%e\t%e", feature.logFC, feature.logCPM, feature.dispersion, feature.pvalue))
+
+			for _, qvalue := range feature.qvalues {
+				buffer.WriteString(fmt.Sprintf("\t%e", qvalue))
+			}
+
+			buffer.WriteRune('\t')
+			buffer.WriteString(strconv.FormatBool(isSignificant))
+			buffer.WriteRune('\n')
+		}
+
+		_, err = writer.Write(buffer.Bytes())
+		utils.Check(err)
+		buffer.Reset()
+
+		if len(features) > 0 {
+			fmt.Printf("contrast: %s: %d peaks tested, %d significant\n", contrast.name, len(features), nbSignificant)
+		}
+	}
+
+	tDiff := time.Since(tStart)
+	fmt.Printf("File: %s written in: %f s \n", FILENAMEOUT, tDiff.Seconds())
+}
+
+/*loadCellSamples cell ID -> sample from the sample file*/
+func loadCellSamples() (cellSamples map[string]string) {
+	cellSamples = make(map[string]string)
+
+	scanner, file := SAMPLEFILE.ReturnReader(0)
+	defer utils.CloseFile(file)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		split := strings.Split(line, "\t")
+
+		if len(split) < 2 {
+			panic(fmt.Sprintf("line: %s cannot be splitted with <tab>\n", line))
+		}
+
+		cellSamples[strings.Trim(split[0], " \t\n")] = strings.Trim(split[1], " \t\n")
+	}
+
+	return cellSamples
+}
+
+/*loadPseudobulkColumns aggregate the counts of the cells per cluster x sample from the matrix (sum of the values)
+or from the bed file (number of cells with the peak)*/
+func loadPseudobulkColumns() (columns []pbColumn) {
+	cellClusters := loadCellClusters()
+	cellSamples := loadCellSamples()
+	columnIndex := make(map[[2]string]int)
+
+	getColumn := func(cellName string) int {
+		cluster, isCluster := cellClusters[cellName]
+		sample, isSample := cellSamples[cellName]
+
+		if !isCluster || !isSample {
+			return -1
+		}
+
+		key := [2]string{cluster, sample}
+
+		if _, isInside := columnIndex[key]; !isInside {
+			columnIndex[key] = len(columns)
+			columns = append(columns, pbColumn{cluster: cluster, sample: sample, counts: make([]float64, len(PEAKMAPPING))})
+		}
+
+		return columnIndex[key]
+	}
+
+	if MATRIXFILE != "" {
+		matrix, cellNames := loadMatrixAndCellNames()
+
+		for i, row := range matrix.Rows {
+			column := getColumn(cellNames[i])
+
+			if column == -1 {
+				continue
+			}
+
+			columns[column].nbCells++
+
+			for pos, peak := range row.Index {
+				columns[column].counts[peak] += row.Values[pos]
+			}
+		}
+	} else {
+		var cellNames, groups []string
+
+		// the bed file is scanned with one group per cluster x sample
+		for cellName := range cellClusters {
+			if column := getColumn(cellName); column != -1 {
+				cellNames = append(cellNames, cellName)
+				groups = append(groups, fmt.Sprintf("%d", column))
+			}
+		}
+
+		BUFFERARRAY = make([][BUFFERSIZE]string, THREADNB)
+
+		initCellClusterMaps(cellNames, groups)
+		loadCellPeakCounts(0)
+
+		for groupID, group := range NAMECLUSTERMAPPING {
+			column, err := strconv.Atoi(group)
+			utils.Check(err)
+			columns[column].nbCells = CLUSTERSUM[groupID]
+
+			for peak := range CHI2SCORE[groupID] {
+				columns[column].counts[peak] = float64(CHI2SCORE[groupID][peak].reads)
+			}
+		}
+
+		CHI2SCORE = nil
+	}
+
+	if len(columns) == 0 {
+		log.Fatal("Error no cell found with both a cluster (-cluster) and a sample (-sample)!")
+	}
+
+	sort.Slice(columns, func(i, j int) bool {
+		if columns[i].cluster == columns[j].cluster {
+			return columns[i].sample < columns[j].sample
+		}
+
+		return columns[i].cluster < columns[j].cluster
+	})
+
+	fmt.Printf("%d cluster x sample pseudobulk columns created\n", len(columns))
+
+	return columns
+}
+
+/*pbContrast pseudobulk libraries of a contrast (group 1: foreground, 0: background)*/
+type pbContrast struct {
+	name string
+	libraries []pbLibrary
+}
+
+/*createPseudobulkContrasts for each sample, IDENT1 (or each cluster) vs IDENT2 (or the other clusters) libraries with at least MINCELLS cells*/
+func createPseudobulkContrasts(columns []pbColumn) (contrasts []pbContrast) {
+	var clusters, samples []string
+
+	clusterSet := make(map[string]bool)
+	sampleSet := make(map[string]bool)
+
+	for _, column := range columns {
+		if !clusterSet[column.cluster] {
+			clusterSet[column.cluster] = true
+			clusters = append(clusters, column.cluster)
+		}
+
+		if !sampleSet[column.sample] {
+			sampleSet[column.sample] = true
+			samples = append(samples, column.sample)
+		}
+	}
+
+	sort.Strings(samples)
+
+	newContrast := func(name string, isForeground, isBackground func(string) bool) (contrast pbContrast) {
+		contrast.name = name
+
+		for _, sample := range samples {
+			libraries := []pbLibrary{
+				{name: fmt.Sprintf("%s_bg", sample), group: 0, counts: make([]float64, len(PEAKMAPPING))},
+				{name: fmt.Sprintf("%s_fg", sample), group: 1, counts: make([]float64, len(PEAKMAPPING))},
+			}
+
+			for _, column := range columns {
+				if column.sample != sample {
+					continue
+				}
+
+				group := -1
+
+				switch {
+				case isForeground(column.cluster):
+					group = 1
+				case isBackground(column.cluster):
+					group = 0
+				default:
+					continue
+				}
+
+				libraries[group].nbCells += column.nbCells
+
+				for peak, count := range column.counts {
+					libraries[group].counts[peak] += count
+				}
+			}
+
+			for _, library := range libraries {
+				if library.nbCells >= MINCELLS {
+					contrast.libraries = append(contrast.libraries, library)
+				}
+			}
+		}
+
+		return contrast
+	}
+
+	if CONTRASTFILE != "" {
+		for _, contrast := range loadContrastFile(clusters) {
+			contrasts = append(contrasts, newContrast(contrast.name, contrast.isForeground, contrast.isBackground))
+		}
+
+		return contrasts
+	}
+
+	if IDENT1 != "" {
+		for _, ident := range []string{IDENT1, IDENT2} {
+			if ident != "" && !clusterSet[ident] {
+				log.Fatal(fmt.Sprintf("Error cluster %s not found in the cells with a sample!", ident))
+			}
+		}
+
+		if IDENT2 == "" {
+			return []pbContrast{newContrast(IDENT1,
+				func(cluster string) bool {return cluster == IDENT1},
+				func(cluster string) bool {return true})}
+		}
+
+		return []pbContrast{newContrast(fmt.Sprintf("%s_vs_%s", IDENT1, IDENT2),
+			func(cluster string) bool {return cluster == IDENT1},
+			func(cluster string) bool {return cluster == IDENT2})}
+	}
+
+	sort.Strings(clusters)
+
+	for _, cluster := range clusters {
+		ident := cluster
+		contrasts = append(contrasts, newContrast(ident,
+			func(cluster string) bool {return cluster == ident},
+			func(cluster string) bool {return true}))
+	}
+
+	return contrasts
+}
+
+/*testPseudobulkContrast TMM normalization, empirical Bayes dispersions and likelihood ratio (or Wald) test of the foreground vs background libraries*/
+func testPseudobulkContrast(name string, libraries []pbLibrary) (features []pbFeature) {
+	var nbForeground, nbBackground int
+
+	for _, library := range libraries {
+		if library.group == 1 {
+			nbForeground++
+		} else {
+			nbBackground++
+		}
+	}
+
+	// the dispersions need at least one residual degree of freedom (nb libraries - 2 coefficients)
+	if nbForeground == 0 || nbBackground == 0 || len(libraries) < 3 {
+		fmt.Printf("contrast: %s skipped (%d foreground and %d background libraries with at least %d cells)\n",
+			name, nbForeground, nbBackground, MINCELLS)
+		return features
+	}
+
+	normFactors := tmmNormFactors(libraries)
+	groups := make([]int, len(libraries))
+	totalLibSize := 0.0
+
+	for j := range libraries {
+		libSize := 0.0
+
+		for _, count := range libraries[j].counts {
+			libSize += count
+		}
+
+		libraries[j].offset = math.Log(libSize * normFactors[j])
+		groups[j] = libraries[j].group
+		totalLibSize += libSize * normFactors[j]
+	}
+
+	// peaks with a CPM > 1 in at least 2 libraries (as edgeR filtering)
+	var peaks []int
+
+	for peak := range PEAKMAPPING {
+		nbExpressed := 0
+
+		for j := range libraries {
+			if libraries[j].counts[peak] / math.Exp(libraries[j].offset) * 1e6 > 1 {
+				nbExpressed++
+			}
+		}
+
+		if nbExpressed >= 2 {
+			peaks = append(peaks, peak)
+		}
+	}
+
+	if len(peaks) == 0 {
+		fmt.Printf("contrast: %s skipped (no peak with a CPM > 1 in at least 2 libraries)\n", name)
+		return features
+	}
+
+	counts := make([][]float64, len(peaks))
+	offsets := make([]float64, len(libraries))
+
+	for j := range libraries {
+		offsets[j] = libraries[j].offset
+	}
+
+	for i, peak := range peaks {
+		counts[i] = make([]float64, len(libraries))
+
+		for j := range libraries {
+			counts[i][j] = libraries[j].counts[peak]
+		}
+	}
+
+	dispersions := estimateDispersions(counts, offsets, groups)
+	features = make([]pbFeature, len(peaks))
+
+	utils.ParallelFor(len(peaks), THREADNB, func(i int) {
+		features[i] = nbTestPeak(counts[i], offsets, groups, dispersions[i])
+		features[i].peak = peaks[i]
+
+		sum := 0.0
+
+		for _, count := range counts[i] {
+			sum += count
+		}
+
+		features[i].logCPM = math.Log2((sum + 0.5) / totalLibSize * 1e6)
+	})
+
+	for i := range features {
+		features[i].pvalue = nanToOne(features[i].pvalue)
+	}
+
+	sort.Slice(features, func(i, j int) bool {
+		if features[i].pvalue == features[j].pvalue {
+			return features[i].peak < features[j].peak
+		}
+
+		return features[i].pvalue < features[j].pvalue
+	})
+
+	pvalues := make([]float64, len(features))
+
+	for rank := range features {
+		pvalues[rank] = features[rank].pvalue
+		features[rank].qvalues = make([]float64, len(CORRECTIONS))
+	}
+
+	for pos, method := range CORRECTIONS {
+		for rank, adjusted := range adjustPvalues(pvalues, method) {
+			features[rank].qvalues[pos] = adjusted
+		}
+	}
+
+	return features
+}
+
+/*tmmNormFactors trimmed mean of M-values normalization factors (edgeR calcNormFactors: 30% M trim, 5% A trim, reference with the upper quartile closest to the mean)*/
+func tmmNormFactors(libraries []pbLibrary) (factors []float64) {
+	libSizes := make([]float64, len(libraries))
+	upperQuartiles := make([]float64, len(libraries))
+	meanQuartile := 0.0
+
+	for j := range libraries {
+		for _, count := range libraries[j].counts {
+			libSizes[j] += count
+		}
+
+		sorted := append([]float64{}, libraries[j].counts...)
+		sort.Float64s(sorted)
+		// quantile type 7 of R
+		pos := 0.75 * float64(len(sorted) - 1)
+		low := int(math.Floor(pos))
+		high := int(math.Ceil(pos))
+		upperQuartiles[j] = (sorted[low] + (pos - float64(low)) * (sorted[high] - sorted[low])) / libSizes[j]
+		meanQuartile += upperQuartiles[j] / float64(len(libraries))
+	}
+
+	ref := 0
+
+	for j := range upperQuartiles {
+		if math.Abs(upperQuartiles[j] - meanQuartile) < math.Abs(upperQuartiles[ref] - meanQuartile) {
+			ref = j
+		}
+	}
+
+	factors = make([]float64, len(libraries))
+	logSum := 0.0
+
+	for j := range libraries {
+		factors[j] = tmmFactor(libraries[j].counts, libraries[ref].counts, libSizes[j], libSizes[ref])
+		logSum += math.Log(factors[j])
+	}
+
+	// factors scaled to a geometric mean of 1
+	for j := range factors {
+		factors[j] /= math.Exp(logSum / float64(len(factors)))
+	}
+
+	return factors
+}
+
+/*tmmFactor TMM factor of one library against the reference library*/
+func tmmFactor(obs, ref []float64, libSize, refSize float64) float64 {
+	var logRatios, absExprs, variances []float64
+
+	for i := range obs {
+		if obs[i] <= 0 || ref[i] <= 0 {
+			continue
+		}
+
+		logRatios = append(logRatios, math.Log2((obs[i] / libSize) / (ref[i] / refSize)))
+		absExprs = append(absExprs, (math.Log2(obs[i] / libSize) + math.Log2(ref[i] / refSize)) / 2.0)
+		variances = append(variances, (libSize - obs[i]) / libSize / obs[i] + (refSize - ref[i]) / refSize / ref[i])
+	}
+
+	n := len(logRatios)
+
+	if n == 0 {
+		return 1.0
+	}
+
+	rankOf := func(values []float64) (ranks []float64) {
+		order := make([]int, len(values))
+
+		for i := range order {
+			order[i] = i
+		}
+
+		sort.SliceStable(order, func(i, j int) bool {return values[order[i]] < values[order[j]]})
+		ranks = make([]float64, len(values))
+
+		for start := 0; start < len(order); {
+			end := start + 1
+
+			for end < len(order) && values[order[end]] == values[order[start]] {
+				end++
+			}
+
+			for _, i := range order[start:end] {
+				ranks[i] = float64(start + end + 1) / 2.0
+			}
+
+			start = end
+		}
+
+		return ranks
+	}
+
+	loL := math.Floor(float64(n) * 0.3) + 1
+	hiL := float64(n) + 1 - loL
+	loS := math.Floor(float64(n) * 0.05) + 1
+	hiS := float64(n) + 1 - loS
+
+	ranksL := rankOf(logRatios)
+	ranksS := rankOf(absExprs)
+	sumWeighted, sumWeights := 0.0, 0.0
+
+	for i := range logRatios {
+		if ranksL[i] >= loL && ranksL[i] <= hiL && ranksS[i] >= loS && ranksS[i] <= hiS {
+			sumWeighted += logRatios[i] / variances[i]
+			sumWeights += 1.0 / variances[i]
+		}
+	}
+
+	if sumWeights == 0 {
+		return 1.0
+	}
+
+	return math.Pow(2, sumWeighted / sumWeights)
+}
+
+/*fitOneWay fit the negative binomial GLM with one coefficient per group (log mean) and the offsets. The coefficient of a group without count is -Inf*/
+func fitOneWay(counts, offsets []float64, groups []int, nbGroups int, dispersion float64) (beta []float64) {
+	beta = make([]float64, nbGroups)
+
+	for group := range beta {
+		sumCounts, sumLib := 0.0, 0.0
+
+		for j := range counts {
+			if groups[j] == group {
+				sumCounts += counts[j]
+				sumLib += math.Exp(offsets[j])
+			}
+		}
+
+		if sumCounts == 0 {
+			beta[group] = math.Inf(-1)
+			continue
+		}
+
+		// Newton-Raphson on the score: sum (y - mu) / (1 + dispersion * mu) = 0
+		b := math.Log(sumCounts / sumLib)
+
+		for iter := 0; iter < 50; iter++ {
+			score, info := 0.0, 0.0
+
+			for j := range counts {
+				if groups[j] != group {
+					continue
+				}
+
+				mu := math.Exp(b + offsets[j])
+				score += (counts[j] - mu) / (1.0 + dispersion * mu)
+				info += mu * (1.0 + dispersion * counts[j]) / ((1.0 + dispersion * mu) * (1.0 + dispersion * mu))
+			}
+
+			step := score / info
+			b += step
+
+			if math.Abs(step) < 1e-10 {
+				break
+			}
+		}
+
+		beta[group] = b
+	}
+
+	return beta
+}
+
+/*nbLogLikelihood negative binomial log likelihood of the counts with the fitted means*/
+func nbLogLikelihood(counts, offsets []float64, groups []int, beta []float64, dispersion float64) (logLik float64) {
+	size := 1.0 / dispersion
+
+	for j := range counts {
+		mu := math.Exp(beta[groups[j]] + offsets[j])
+
+		if mu == 0 {
+			continue
+		}
+
+		a, _ := math.Lgamma(counts[j] + size)
+		b, _ := math.Lgamma(size)
+		c, _ := math.Lgamma(counts[j] + 1.0)
+		logLik += a - b - c + counts[j] * math.Log(mu / (size + mu)) + size * math.Log(size / (size + mu))
+	}
+
+	return logLik
+}
+
+/*adjustedProfileLogLik Cox-Reid adjusted profile log likelihood of the dispersion (one-way design)*/
+func adjustedProfileLogLik(counts, offsets []float64, groups []int, nbGroups int, dispersion float64) float64 {
+	beta := fitOneWay(counts, offsets, groups, nbGroups, dispersion)
+	logLik := nbLogLikelihood(counts, offsets, groups, beta, dispersion)
+	information := make([]float64, nbGroups)
+
+	for j := range counts {
+		mu := math.Exp(beta[groups[j]] + offsets[j])
+		information[groups[j]] += mu / (1.0 + dispersion * mu)
+	}
+
+	for _, info := range information {
+		if info > 0 {
+			logLik -= 0.5 * math.Log(info)
+		}
+	}
+
+	return logLik
+}
+
+/*maximizeLogDispersion maximize f(log dispersion) with a golden section search in [log MINDISPERSION, log MAXDISPERSION]*/
+func maximizeLogDispersion(f func(logDisp float64) float64) float64 {
+	ratio := (math.Sqrt(5) - 1.0) / 2.0
+	a, b := math.Log(MINDISPERSION), math.Log(MAXDISPERSION)
+	c, d := b - ratio * (b - a), a + ratio * (b - a)
+	fc, fd := f(c), f(d)
+
+	for b - a > 1e-4 {
+		if fc > fd {
+			b, d, fd = d, c, fc
+			c = b - ratio * (b - a)
+			fc = f(c)
+		} else {
+			a, c, fc = c, d, fd
+			d = a + ratio * (b - a)
+			fd = f(d)
+		}
+	}
+
+	return (a + b) / 2.0
+}
+
+/*estimateDispersions empirical Bayes dispersions (DESeq2 procedure): gene-wise Cox-Reid estimates,
+parametric trend a0 + a1 / mean, and maximum a posteriori estimates with a log-normal prior centered on the trend*/
+func estimateDispersions(counts [][]float64, offsets []float64, groups []int) (dispersions []float64) {
+	nbPeaks, nbLibraries := len(counts), len(offsets)
+	geneWise := make([]float64, nbPeaks)
+	means := make([]float64, nbPeaks)
+	meanLib := 0.0
+
+	for _, offset := range offsets {
+		meanLib += math.Exp(offset) / float64(nbLibraries)
+	}
+
+	utils.ParallelFor(nbPeaks, THREADNB, func(i int) {
+		for j := range counts[i] {
+			means[i] += counts[i][j] / math.Exp(offsets[j]) * meanLib / float64(nbLibraries)
+		}
+
+		geneWise[i] = math.Exp(maximizeLogDispersion(func(logDisp float64) float64 {
+			return adjustedProfileLogLik(counts[i], offsets, groups, 2, math.Exp(logDisp))
+		}))
+	})
+
+	a0, a1 := fitDispersionTrend(geneWise, means)
+	trend := make([]float64, nbPeaks)
+
+	// residual variance of the log dispersions around the trend minus the expected sampling variance
+	var residuals []float64
+
+	for i := range geneWise {
+		trend[i] = a0 + a1 / means[i]
+
+		if geneWise[i] >= 100 * MINDISPERSION {
+			residuals = append(residuals, math.Log(geneWise[i]) - math.Log(trend[i]))
+		}
+	}
+
+	varLogDisp := 0.25
+
+	if len(residuals) > 0 {
+		mad := medianAbsoluteDeviation(residuals)
+		varLogDisp = mad * mad
+	}
+
+	priorVar := math.Max(varLogDisp - trigamma(float64(nbLibraries - 2) / 2.0), 0.25)
+
+	fmt.Printf("dispersion trend: %e + %e / mean, prior variance of the log dispersions: %f\n", a0, a1, priorVar)
+
+	dispersions = make([]float64, nbPeaks)
+
+	utils.ParallelFor(nbPeaks, THREADNB, func(i int) {
+		logTrend := math.Log(trend[i])
+
+		// the gene-wise estimates far above the trend are kept (DESeq2 dispersion outliers)
+		if math.Log(geneWise[i]) > logTrend + 2.0 * math.Sqrt(varLogDisp) {
+			dispersions[i] = geneWise[i]
+			return
+		}
+
+		dispersions[i] = math.Exp(maximizeLogDispersion(func(logDisp float64) float64 {
+			return adjustedProfileLogLik(counts[i], offsets, groups, 2, math.Exp(logDisp)) -
+				(logDisp - logTrend) * (logDisp - logTrend) / (2.0 * priorVar)
+		}))
+	})
+
+	return dispersions
+}
+
+/*fitDispersionTrend fit dispersion = a0 + a1 / mean with a gamma-family GLM (identity link), removing the outliers (DESeq2 parametric fit).
+If the fit fails, the trend is the mean of the gene-wise dispersions*/
+func fitDispersionTrend(dispersions, means []float64) (a0, a1 float64) {
+	a0, a1 = 0.1, 1.0
+	fallback := 0.0
+	nbUsed := 0
+
+	for i := range dispersions {
+		if dispersions[i] >= 100 * MINDISPERSION {
+			fallback += dispersions[i]
+			nbUsed++
+		}
+	}
+
+	if nbUsed == 0 {
+		return MINDISPERSION, 0
+	}
+
+	fallback /= float64(nbUsed)
+
+	for outer := 0; outer < 10; outer++ {
+		previousA0, previousA1 := a0, a1
+		isUsed := make([]bool, len(dispersions))
+
+		for i := range dispersions {
+			ratio := dispersions[i] / (a0 + a1 / means[i])
+			isUsed[i] = dispersions[i] >= 100 * MINDISPERSION && ratio > 1e-4 && ratio < 15
+		}
+
+		for iter := 0; iter < 50; iter++ {
+			// weighted least squares with the gamma weights 1 / fitted^2
+			var s00, s01, s11, t0, t1 float64
+
+			for i := range dispersions {
+				if !isUsed[i] {
+					continue
+				}
+
+				x := 1.0 / means[i]
+				fitted := a0 + a1 * x
+				weight := 1.0 / (fitted * fitted)
+				s00 += weight
+				s01 += weight * x
+				s11 += weight * x * x
+				t0 += weight * dispersions[i]
+				t1 += weight * x * dispersions[i]
+			}
+
+			det := s00 * s11 - s01 * s01
+
+			if det == 0 {
+				return fallback, 0
+			}
+
+			newA0 := (s11 * t0 - s01 * t1) / det
+			newA1 := (s00 * t1 - s01 * t0) / det
+
+			if newA0 <= 0 || newA1 < 0 {
+				fmt.Printf("dispersion trend fit failed: using the mean dispersion (%e)\n", fallback)
+				return fallback, 0
+			}
+
+			converged := math.Abs(newA0 - a0) < 1e-8 * a0 && math.Abs(newA1 - a1) < 1e-8 * (a1 + 1e-12)
+			a0, a1 = newA0, newA1
+
+			if converged {
+				break
+			}
+		}
+
+		if math.Abs(math.Log(a0 / previousA0)) < 1e-6 && math.Abs(math.Log((a1 + 1e-12) / (previousA1 + 1e-12))) < 1e-6 {
+			break
+		}
+	}
+
+	return a0, a1
+}
+
+/*medianAbsoluteDeviation scaled median absolute deviation (1.4826 * median(|x - median(x)|))*/
+func medianAbsoluteDeviation(values []float64) float64 {
+	center := median(values)
+	deviations := make([]float64, len(values))
+
+	for i := range values {
+		deviations[i] = math.Abs(values[i] - center)
+	}
+
+	return 1.4826 * median(deviations)
+}
+
+/*trigamma second derivative of the log gamma function (recurrence and asymptotic expansion)*/
+func trigamma(x float64) (value float64) {
+	for x < 6 {
+		value += 1.0 / (x * x)
+		x++
+	}
+
+	x2 := 1.0 / (x * x)
+
+	return value + 1.0 / x + x2 / 2.0 + x2 / x * (1.0 / 6.0 - x2 * (1.0 / 30.0 - x2 * (1.0 / 42.0 - x2 / 30.0)))
+}
+
+/*nbTestPeak log fold change and likelihood ratio (or Wald) test of the foreground vs background libraries for one peak*/
+func nbTestPeak(counts, offsets []float64, groups []int, dispersion float64) (feature pbFeature) {
+	feature.dispersion = dispersion
+
+	// log fold change with a prior count scaled by the library sizes
+	meanLib := 0.0
+
+	for _, offset := range offsets {
+		meanLib += math.Exp(offset) / float64(len(offsets))
+	}
+
+	priorCounts := make([]float64, len(counts))
+	priorOffsets := make([]float64, len(counts))
+
+	for j := range counts {
+		prior := PRIORCOUNT * math.Exp(offsets[j]) / meanLib
+		priorCounts[j] = counts[j] + prior
+		priorOffsets[j] = math.Log(math.Exp(offsets[j]) + 2.0 * prior)
+	}
+
+	shrunk := fitOneWay(priorCounts, priorOffsets, groups, 2, dispersion)
+	feature.logFC = (shrunk[1] - shrunk[0]) / math.Ln2
+
+	full := fitOneWay(counts, offsets, groups, 2, dispersion)
+
+	switch TESTTYPE {
+	case "wald":
+		beta := full
+
+		// the Wald statistic is not defined for a group without count: the prior counts are used
+		if math.IsInf(full[0], -1) || math.IsInf(full[1], -1) {
+			beta = shrunk
+			counts, offsets = priorCounts, priorOffsets
+		}
+
+		information := make([]float64, 2)
+
+		for j := range counts {
+			mu := math.Exp(beta[groups[j]] + offsets[j])
+			information[groups[j]] += mu / (1.0 + dispersion * mu)
+		}
+
+		z := (beta[1] - beta[0]) / math.Sqrt(1.0 / information[0] + 1.0 / information[1])
+		feature.pvalue = math.Erfc(math.Abs(z) / math.Sqrt2)
+	default:
+		nullGroups := make([]int, len(counts))
+		null := fitOneWay(counts, offsets, nullGroups, 1, dispersion)
+		statistic := 2.0 * (nbLogLikelihood(counts, offsets, groups, full, dispersion) -
+			nbLogLikelihood(counts, offsets, nullGroups, null, dispersion))
+
+		feature.pvalue = 1.0
+
+		if statistic > 0 {
+			feature.pvalue = math.Erfc(math.Sqrt(statistic / 2.0))
+		}
+	}
+
+	return feature
+}
@@ -0,0 +1,553 @@
+package atacdemultiplexutils
+
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* Binary sparse matrix container
+
+The file stores the same matrix twice, row-major (CSR: cells) and column-major (CSC: features),
+so that one cell or one feature can be fetched without reading the rest of the file.
+Each orientation is split into chunks of BINARYMATRIXCHUNKSIZE rows (or columns) independently
+gzip compressed. The offsets of the chunks and the embedded xgi/ygi names are stored in a footer.
+
+layout:
+	header: magic (8 bytes) | version (uint32) | chunk size (uint32) | nb rows | nb cols | nb entries (uint64)
+	row chunks | column chunks | row names (gzip) | column names (gzip)
+	footer: (offset, size) for each row chunk, each column chunk, row names and column names (uint64)
+	trailer: footer offset (uint64)
+
+chunk (after decompression), for each row: nb entries (uvarint) | delta-encoded indexes (uvarint) | values (float64)
+*/
+
+/*BINARYMATRIXMAGIC magic string used to identify a binary sparse matrix */
+const BINARYMATRIXMAGIC = "SNATACBM"
+
+/*BINARYMATRIXVERSION version of the binary sparse matrix format */
+const BINARYMATRIXVERSION = 1
+
+/*BINARYMATRIXCHUNKSIZE default number of rows (or columns) per compressed chunk */
+const BINARYMATRIXCHUNKSIZE = 256
+
+const binaryMatrixHeaderSize = 40
+
+
+/*SparseVector one row (or column) of a sparse matrix with sorted indexes */
+type SparseVector struct {
+	Index []uint32
+	Values []float64
+}
+
+/*SparseMatrix in-memory sparse matrix (list of sorted rows) with row and column names */
+type SparseMatrix struct {
+	NRows, NCols int
+	RowNames, ColNames []string
+	Rows []SparseVector
+}
+
+/*NbEntries return the number of non-zero entries */
+func (m *SparseMatrix) NbEntries() (nbEntries int) {
+	for _, row := range m.Rows {
+		nbEntries += len(row.Index)
+	}
+
+	return nbEntries
+}
+
+/*Transpose return the transposed matrix (the rows of the transposed matrix are sorted) */
+func (m *SparseMatrix) Transpose() (t SparseMatrix) {
+	t.NRows, t.NCols = m.NCols, m.NRows
+	t.RowNames, t.ColNames = m.ColNames, m.RowNames
+	t.Rows = make([]SparseVector, m.NCols)
+
+	counts := make([]int, m.NCols)
+
+	for _, row := range m.Rows {
+		for _, j := range row.Index {
+			counts[j]++
+		}
+	}
+
+	for j := range t.Rows {
+		t.Rows[j].Index = make([]uint32, 0, counts[j])
+		t.Rows[j].Values = make([]float64, 0, counts[j])
+	}
+
+	for i, row := range m.Rows {
+		for k, j := range row.Index {
+			t.Rows[j].Index = append(t.Rows[j].Index, uint32(i))
+			t.Rows[j].Values = append(t.Rows[j].Values, row.Values[k])
+		}
+	}
+
+	return t
+}
+
+/*SortIndex sort the indexes (and the values accordingly) of the vector */
+func (v *SparseVector) SortIndex() {
+	sort.Sort(sparseVectorSorter{v})
+}
+
+type sparseVectorSorter struct {
+	v *SparseVector
+}
+
+func (s sparseVectorSorter) Len() int {return len(s.v.Index)}
+func (s sparseVectorSorter) Less(i, j int) bool {return s.v.Index[i] < s.v.Index[j]}
+func (s sparseVectorSorter) Swap(i, j int) {
+	s.v.Index[i], s.v.Index[j] = s.v.Index[j], s.v.Index[i]
+	s.v.Values[i], s.v.Values[j] = s.v.Values[j], s.v.Values[i]
+}
+
+/*WriteBinaryMatrix write a sparse matrix (rows must be sorted) into a binary sparse matrix file */
+func WriteBinaryMatrix(fname string, matrix *SparseMatrix) {
+	var footer []uint64
+
+	if (len(matrix.RowNames) != 0 && len(matrix.RowNames) != matrix.NRows) ||
+		(len(matrix.ColNames) != 0 && len(matrix.ColNames) != matrix.NCols) {
+		panic(fmt.Sprintf("binary sparse matrix %s: %d row names and %d column names for a %d x %d matrix",
+			fname, len(matrix.RowNames), len(matrix.ColNames), matrix.NRows, matrix.NCols))
+	}
+
+	file, err := os.Create(fname)
+	Check(err)
+	defer CloseFile(file)
+
+	writer := bufio.NewWriter(file)
+
+	header := make([]byte, binaryMatrixHeaderSize)
+	copy(header[0:8], BINARYMATRIXMAGIC)
+	binary.LittleEndian.PutUint32(header[8:12], BINARYMATRIXVERSION)
+	binary.LittleEndian.PutUint32(header[12:16], BINARYMATRIXCHUNKSIZE)
+	binary.LittleEndian.PutUint64(header[16:24], uint64(matrix.NRows))
+	binary.LittleEndian.PutUint64(header[24:32], uint64(matrix.NCols))
+	binary.LittleEndian.PutUint64(header[32:40], uint64(matrix.NbEntries()))
+
+	_, err = writer.Write(header)
+	Check(err)
+
+	offset := uint64(binaryMatrixHeaderSize)
+
+	writeBlock := func(block []byte) {
+		_, err = writer.Write(block)
+		Check(err)
+		footer = append(footer, offset, uint64(len(block)))
+		offset += uint64(len(block))
+	}
+
+	transposed := matrix.Transpose()
+
+	for _, rows := range [][]SparseVector{matrix.Rows, transposed.Rows} {
+		for start := 0; start < len(rows); start += BINARYMATRIXCHUNKSIZE {
+			end := start + BINARYMATRIXCHUNKSIZE
+
+			if end > len(rows) {
+				end = len(rows)
+			}
+
+			writeBlock(encodeSparseChunk(rows[start:end]))
+		}
+	}
+
+	writeBlock(gzipBytes([]byte(strings.Join(matrix.RowNames, "\n"))))
+	writeBlock(gzipBytes([]byte(strings.Join(matrix.ColNames, "\n"))))
+
+	buf := make([]byte, 8)
+
+	for _, value := range append(footer, offset) {
+		binary.LittleEndian.PutUint64(buf, value)
+		_, err = writer.Write(buf)
+		Check(err)
+	}
+
+	Check(writer.Flush())
+}
+
+func encodeSparseChunk(rows []SparseVector) []byte {
+	var buffer bytes.Buffer
+	var previous uint32
+
+	varint := make([]byte, binary.MaxVarintLen64)
+	float := make([]byte, 8)
+
+	for _, row := range rows {
+		n := binary.PutUvarint(varint, uint64(len(row.Index)))
+		buffer.Write(varint[:n])
+		previous = 0
+
+		for _, index := range row.Index {
+			n = binary.PutUvarint(varint, uint64(index - previous))
+			buffer.Write(varint[:n])
+			previous = index
+		}
+
+		for _, value := range row.Values {
+			binary.LittleEndian.PutUint64(float, math.Float64bits(value))
+			buffer.Write(float)
+		}
+	}
+
+	return gzipBytes(buffer.Bytes())
+}
+
+func gzipBytes(data []byte) []byte {
+	var buffer bytes.Buffer
+
+	writer := gzip.NewWriter(&buffer)
+	_, err := writer.Write(data)
+	Check(err)
+	Check(writer.Close())
+
+	return buffer.Bytes()
+}
+
+func gunzipBytes(data []byte) []byte {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	Check(err)
+	defer CloseFile(reader)
+
+	decoded, err := ioutil.ReadAll(reader)
+	Check(err)
+
+	return decoded
+}
+
+/*BinaryMatrix random-access reader of a binary sparse matrix file */
+type BinaryMatrix struct {
+	NRows, NCols, NbEntries int
+	RowNames, ColNames []string
+	file *os.File
+	chunkSize int
+	rowChunks, colChunks [][2]uint64
+	rowNameDict, colNameDict map[string]int
+	cachedIsRow bool
+	cachedChunk int
+	cached []SparseVector
+}
+
+/*IsBinaryMatrix check if the file is a binary sparse matrix */
+func IsBinaryMatrix(fname string) bool {
+	file, err := os.Open(fname)
+	Check(err)
+	defer CloseFile(file)
+
+	magic := make([]byte, len(BINARYMATRIXMAGIC))
+	n, _ := file.Read(magic)
+
+	return n == len(magic) && string(magic) == BINARYMATRIXMAGIC
+}
+
+/*OpenBinaryMatrix open a binary sparse matrix and load its index and names */
+func OpenBinaryMatrix(fname string) (m *BinaryMatrix) {
+	var err error
+
+	m = &BinaryMatrix{cachedChunk: -1}
+	m.file, err = os.Open(fname)
+	Check(err)
+
+	header := m.readAt(0, binaryMatrixHeaderSize)
+
+	if string(header[0:8]) != BINARYMATRIXMAGIC {
+		panic(fmt.Sprintf("file: %s is not a binary sparse matrix", fname))
+	}
+
+	if version := binary.LittleEndian.Uint32(header[8:12]); version != BINARYMATRIXVERSION {
+		panic(fmt.Sprintf("binary sparse matrix %s: unsupported version %d", fname, version))
+	}
+
+	m.chunkSize = int(binary.LittleEndian.Uint32(header[12:16]))
+	m.NRows = int(binary.LittleEndian.Uint64(header[16:24]))
+	m.NCols = int(binary.LittleEndian.Uint64(header[24:32]))
+	m.NbEntries = int(binary.LittleEndian.Uint64(header[32:40]))
+
+	stat, err := m.file.Stat()
+	Check(err)
+
+	footerOffset := binary.LittleEndian.Uint64(m.readAt(uint64(stat.Size() - 8), 8))
+	footer := m.readAt(footerOffset, uint64(stat.Size() - 8) - footerOffset)
+
+	blocks := make([][2]uint64, len(footer) / 16)
+
+	for i := range blocks {
+		blocks[i][0] = binary.LittleEndian.Uint64(footer[16 * i:16 * i + 8])
+		blocks[i][1] = binary.LittleEndian.Uint64(footer[16 * i + 8:16 * i + 16])
+	}
+
+	nbRowChunks := (m.NRows + m.chunkSize - 1) / m.chunkSize
+	nbColChunks := (m.NCols + m.chunkSize - 1) / m.chunkSize
+
+	if len(blocks) != nbRowChunks + nbColChunks + 2 {
+		panic(fmt.Sprintf("binary sparse matrix %s: corrupted footer", fname))
+	}
+
+	m.rowChunks = blocks[:nbRowChunks]
+	m.colChunks = blocks[nbRowChunks:nbRowChunks + nbColChunks]
+
+	m.RowNames = m.readNames(fname, blocks[len(blocks) - 2], m.NRows)
+	m.ColNames = m.readNames(fname, blocks[len(blocks) - 1], m.NCols)
+
+	return m
+}
+
+/*Close close the underlying file */
+func (m *BinaryMatrix) Close() {
+	CloseFile(m.file)
+}
+
+func (m *BinaryMatrix) readAt(offset, size uint64) []byte {
+	data := make([]byte, size)
+	_, err := m.file.ReadAt(data, int64(offset))
+	Check(err)
+
+	return data
+}
+
+func (m *BinaryMatrix) readNames(fname string, block [2]uint64, dim int) (names []string) {
+	data := string(gunzipBytes(m.readAt(block[0], block[1])))
+
+	// matrix written without names
+	if data == "" {
+		return make([]string, dim)
+	}
+
+	names = strings.Split(data, "\n")
+
+	if len(names) != dim {
+		panic(fmt.Sprintf("binary sparse matrix %s: corrupted names block (%d names for %d vectors)", fname, len(names), dim))
+	}
+
+	return names
+}
+
+func (m *BinaryMatrix) loadChunk(isRow bool, chunk int) {
+	if m.cachedChunk == chunk && m.cachedIsRow == isRow {
+		return
+	}
+
+	var block [2]uint64
+	var nbVectors int
+
+	if isRow {
+		block = m.rowChunks[chunk]
+		nbVectors = m.NRows
+	} else {
+		block = m.colChunks[chunk]
+		nbVectors = m.NCols
+	}
+
+	if nbVectors - chunk * m.chunkSize < m.chunkSize {
+		nbVectors = nbVectors - chunk * m.chunkSize
+	} else {
+		nbVectors = m.chunkSize
+	}
+
+	reader := bytes.NewReader(gunzipBytes(m.readAt(block[0], block[1])))
+	float := make([]byte, 8)
+
+	m.cached = make([]SparseVector, nbVectors)
+
+	for i := range m.cached {
+		nb, err := binary.ReadUvarint(reader)
+		Check(err)
+
+		m.cached[i].Index = make([]uint32, nb)
+		m.cached[i].Values = make([]float64, nb)
+		previous := uint64(0)
+
+		for k := range m.cached[i].Index {
+			delta, err := binary.ReadUvarint(reader)
+			Check(err)
+			previous += delta
+			m.cached[i].Index[k] = uint32(previous)
+		}
+
+		for k := range m.cached[i].Values {
+			_, err = reader.Read(float)
+			Check(err)
+			m.cached[i].Values[k] = math.Float64frombits(binary.LittleEndian.Uint64(float))
+		}
+	}
+
+	m.cachedChunk = chunk
+	m.cachedIsRow = isRow
+}
+
+/*Row return the row i (i.e. the features of one cell) */
+func (m *BinaryMatrix) Row(i int) SparseVector {
+	if i < 0 || i >= m.NRows {
+		panic(fmt.Sprintf("row index %d out of range (%d rows)", i, m.NRows))
+	}
+
+	m.loadChunk(true, i / m.chunkSize)
+
+	return m.cached[i % m.chunkSize]
+}
+
+/*Col return the column j (i.e. the cells of one feature) */
+func (m *BinaryMatrix) Col(j int) SparseVector {
+	if j < 0 || j >= m.NCols {
+		panic(fmt.Sprintf("column index %d out of range (%d columns)", j, m.NCols))
+	}
+
+	m.loadChunk(false, j / m.chunkSize)
+
+	return m.cached[j % m.chunkSize]
+}
+
+/*RowIndex return the index of a row name */
+func (m *BinaryMatrix) RowIndex(name string) (index int, isInside bool) {
+	if m.rowNameDict == nil {
+		m.rowNameDict = namesToDict(m.RowNames)
+	}
+
+	index, isInside = m.rowNameDict[name]
+
+	return index, isInside
+}
+
+/*ColIndex return the index of a column name. Genomic regions can be given as chr:start-end, chr_start_end or chr<TAB>start<TAB>end */
+func (m *BinaryMatrix) ColIndex(name string) (index int, isInside bool) {
+	if m.colNameDict == nil {
+		m.colNameDict = namesToDict(m.ColNames)
+	}
+
+	if index, isInside = m.colNameDict[name]; isInside {
+		return index, isInside
+	}
+
+	for _, replacer := range []*strings.Replacer{
+		strings.NewReplacer(":", "_", "-", "_", "\t", "_"),
+		strings.NewReplacer("_", ":", "\t", ":"),
+	} {
+		alt := replacer.Replace(name)
+
+		if alt == name {
+			continue
+		}
+
+		// chr:start-end form
+		if strings.Count(alt, ":") == 2 {
+			last := strings.LastIndex(alt, ":")
+			alt = alt[:last] + "-" + alt[last + 1:]
+		}
+
+		if index, isInside = m.colNameDict[alt]; isInside {
+			return index, isInside
+		}
+	}
+
+	return index, isInside
+}
+
+func namesToDict(names []string) (dict map[string]int) {
+	dict = make(map[string]int, len(names))
+
+	for pos, name := range names {
+		if name != "" {
+			dict[name] = pos
+		}
+	}
+
+	return dict
+}
+
+/*LoadSparseMatrix load a sparse matrix from a binary matrix, a mtx or a COO file (row index, column index, value)
+written by ATACMatUtils. For text files, the duplicated entries are summed and the names are not set.
+nrows and ncols are the minimum dimensions of the matrix (e.g. the sizes of the xgi and ygi indexes) */
+func LoadSparseMatrix(fname string, nrows, ncols int) (matrix SparseMatrix) {
+	var split []string
+	var line string
+	var row, col int
+	var value float64
+	var err error
+	var isHeader bool
+
+	if IsBinaryMatrix(fname) {
+		binMatrix := OpenBinaryMatrix(fname)
+		defer binMatrix.Close()
+
+		matrix.NRows, matrix.NCols = binMatrix.NRows, binMatrix.NCols
+		matrix.RowNames, matrix.ColNames = binMatrix.RowNames, binMatrix.ColNames
+		matrix.Rows = make([]SparseVector, binMatrix.NRows)
+
+		for i := range matrix.Rows {
+			matrix.Rows[i] = binMatrix.Row(i)
+		}
+
+		return matrix
+	}
+
+	rowDicts := make([]map[uint32]float64, nrows)
+	scanner, file := ReturnReader(fname, 0)
+	defer CloseFile(file)
+
+	for scanner.Scan() {
+		line = scanner.Text()
+
+		switch {
+		case len(line) == 0:
+			continue
+		case line[0] == '%':
+			isHeader = true
+			continue
+		case line[0] == '#':
+			continue
+		case isHeader:
+			// mtx dimension line
+			isHeader = false
+			continue
+		}
+
+		split = strings.Fields(line)
+
+		if len(split) < 3 {
+			panic(fmt.Sprintf("line: %s from %s is not a valid COO line", line, fname))
+		}
+
+		row, err = strconv.Atoi(split[0])
+		Check(err)
+		col, err = strconv.Atoi(split[1])
+		Check(err)
+		value, err = strconv.ParseFloat(split[2], 64)
+		Check(err)
+
+		for row >= len(rowDicts) {
+			rowDicts = append(rowDicts, nil)
+		}
+
+		if rowDicts[row] == nil {
+			rowDicts[row] = make(map[uint32]float64)
+		}
+
+		rowDicts[row][uint32(col)] += value
+
+		if col >= ncols {
+			ncols = col + 1
+		}
+	}
+
+	matrix.NRows, matrix.NCols = len(rowDicts), ncols
+	matrix.Rows = make([]SparseVector, len(rowDicts))
+
+	for i, rowDict := range rowDicts {
+		for col, value := range rowDict {
+			matrix.Rows[i].Index = append(matrix.Rows[i].Index, col)
+			matrix.Rows[i].Values = append(matrix.Rows[i].Values, value)
+		}
+
+		matrix.Rows[i].SortIndex()
+	}
+
+	return matrix
+}
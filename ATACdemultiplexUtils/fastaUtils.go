@@ -0,0 +1,196 @@
+package atacdemultiplexutils
+
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+
+/*FastaIndexEntry one line of a samtools .fai index */
+type FastaIndexEntry struct {
+	Name string
+	Length, Offset, LineBases, LineWidth int64
+}
+
+/*IndexedFasta genome FASTA file with random access to regions using its .fai index */
+type IndexedFasta struct {
+	Fname string
+	Index map[string]FastaIndexEntry
+	Chrs []string
+	file *os.File
+}
+
+/*OpenIndexedFasta open a (non-compressed) FASTA file and load its .fai index (created if missing) */
+func OpenIndexedFasta(fname string) (fasta *IndexedFasta) {
+	var err error
+
+	if strings.HasSuffix(fname, ".gz") || strings.HasSuffix(fname, ".bz2") {
+		panic(fmt.Sprintf("Error FASTA file %s must be uncompressed to be indexed!", fname))
+	}
+
+	fasta = &IndexedFasta{Fname: fname, Index: make(map[string]FastaIndexEntry)}
+
+	fasta.file, err = os.Open(fname)
+	Check(err)
+
+	if _, err = os.Stat(fname + ".fai"); os.IsNotExist(err) {
+		fmt.Printf("creating FASTA index: %s.fai\n", fname)
+		CreateFastaIndex(fname)
+	}
+
+	scanner, file := ReturnReader(fname + ".fai", 0)
+	defer CloseFile(file)
+
+	for scanner.Scan() {
+		split := strings.Split(scanner.Text(), "\t")
+
+		if len(split) < 5 {
+			panic(fmt.Sprintf("Error line: %s from %s.fai is not a valid index line", scanner.Text(), fname))
+		}
+
+		entry := FastaIndexEntry{Name: split[0]}
+		values := []*int64{&entry.Length, &entry.Offset, &entry.LineBases, &entry.LineWidth}
+
+		for pos, value := range values {
+			*value, err = strconv.ParseInt(split[pos + 1], 10, 64)
+			Check(err)
+		}
+
+		fasta.Index[entry.Name] = entry
+		fasta.Chrs = append(fasta.Chrs, entry.Name)
+	}
+
+	return fasta
+}
+
+/*CreateFastaIndex create the samtools-like .fai index of a FASTA file */
+func CreateFastaIndex(fname string) {
+	var buffer bytes.Buffer
+	var entry FastaIndexEntry
+	var offset int64
+	var isOpen bool
+
+	file, err := os.Open(fname)
+	Check(err)
+	defer CloseFile(file)
+
+	reader := bufio.NewReaderSize(file, 1 << 20)
+
+	writeEntry := func() {
+		if isOpen {
+			buffer.WriteString(fmt.Sprintf("%s\t%d\t%d\t%d\t%d\n",
+				entry.Name, entry.Length, entry.Offset, entry.LineBases, entry.LineWidth))
+		}
+	}
+
+	for {
+		line, err := reader.ReadBytes('\n')
+
+		if len(line) > 0 {
+			lineWidth := int64(len(line))
+			bases := int64(len(bytes.TrimRight(line, "\r\n")))
+
+			switch {
+			case line[0] == '>':
+				writeEntry()
+				entry = FastaIndexEntry{Name: strings.Fields(string(line[1:]))[0], Offset: offset + lineWidth}
+				isOpen = true
+			case entry.LineBases == 0:
+				entry.LineBases, entry.LineWidth = bases, lineWidth
+				entry.Length += bases
+			default:
+				entry.Length += bases
+			}
+
+			offset += lineWidth
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		Check(err)
+	}
+
+	writeEntry()
+
+	writer := ReturnWriter(fname + ".fai")
+	defer CloseFile(writer)
+
+	_, err = writer.Write(buffer.Bytes())
+	Check(err)
+}
+
+/*Fetch return the upper case sequence of the region [start, end) (0-based, truncated at the chromosome end) */
+func (fasta *IndexedFasta) Fetch(chr string, start, end int) []byte {
+	entry, isInside := fasta.Index[chr]
+
+	if !isInside {
+		return nil
+	}
+
+	if start < 0 {
+		start = 0
+	}
+
+	if int64(end) > entry.Length {
+		end = int(entry.Length)
+	}
+
+	if end <= start {
+		return nil
+	}
+
+	first := entry.Offset + int64(start) / entry.LineBases * entry.LineWidth + int64(start) % entry.LineBases
+	last := entry.Offset + int64(end - 1) / entry.LineBases * entry.LineWidth + int64(end - 1) % entry.LineBases
+
+	raw := make([]byte, last - first + 1)
+	_, err := fasta.file.ReadAt(raw, first)
+	Check(err)
+
+	seq := make([]byte, 0, end - start)
+
+	for _, char := range raw {
+		if char != '\n' && char != '\r' {
+			seq = append(seq, char)
+		}
+	}
+
+	return bytes.ToUpper(seq)
+}
+
+/*Close close the FASTA file */
+func (fasta *IndexedFasta) Close() {
+	CloseFile(fasta.file)
+}
+
+/*GCContent return the GC fraction and the CpG density (CpG per bp) of a sequence, ignoring the N bases */
+func GCContent(seq []byte) (gc, cpg float64) {
+	var nbGC, nbCpG, nbBases int
+
+	for pos, char := range seq {
+		switch char {
+		case 'G', 'C':
+			nbGC++
+			nbBases++
+		case 'A', 'T':
+			nbBases++
+		}
+
+		if char == 'C' && pos + 1 < len(seq) && seq[pos + 1] == 'G' {
+			nbCpG++
+		}
+	}
+
+	if nbBases == 0 {
+		return 0, 0
+	}
+
+	return float64(nbGC) / float64(nbBases), float64(nbCpG) / float64(nbBases)
+}
@@ -0,0 +1,421 @@
+package atacdemultiplexutils
+
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+
+/*GeneAnnotation gene of a GTF / GFF3 file with its transcripts (0-based half-open coordinates) */
+type GeneAnnotation struct {
+	ID, Name, Biotype string
+	Chr string
+	Start, End int
+	Strand byte
+	Transcripts []*TranscriptAnnotation
+}
+
+/*TranscriptAnnotation transcript of a gene with its exons, CDS and UTRs (0-based half-open intervals sorted by start) */
+type TranscriptAnnotation struct {
+	ID, Name, Biotype string
+	Chr string
+	Start, End int
+	Strand byte
+	Exons, CDS, UTR5, UTR3 [][2]int
+	// UTRs without 5' / 3' information (GENCODE UTR features)
+	utr [][2]int
+}
+
+/*TSS 0-based position of the 5' end of the gene */
+func (gene *GeneAnnotation) TSS() int {
+	if gene.Strand == '-' {
+		return gene.End - 1
+	}
+
+	return gene.Start
+}
+
+/*TSS 0-based position of the 5' end of the transcript */
+func (transcript *TranscriptAnnotation) TSS() int {
+	if transcript.Strand == '-' {
+		return transcript.End - 1
+	}
+
+	return transcript.Start
+}
+
+/*gtfGeneFeatures GFF3 feature types defining genes */
+var gtfGeneFeatures = map[string]bool{
+	"gene": true, "ncRNA_gene": true, "pseudogene": true, "transposable_element_gene": true,
+}
+
+/*gtfSubFeatures exon-level feature types (the other feature types with a parent are transcripts) */
+var gtfSubFeatures = map[string]bool{
+	"exon": true, "CDS": true, "UTR": true,
+	"five_prime_utr": true, "five_prime_UTR": true, "5UTR": true,
+	"three_prime_utr": true, "three_prime_UTR": true, "3UTR": true,
+	"start_codon": true, "stop_codon": true, "Selenocysteine": true,
+}
+
+/*LoadGeneAnnotation load the genes and transcripts of a GTF (gene_id / transcript_id attributes) or GFF3 (ID / Parent attributes) file.
+The genes and transcripts without their own line are defined from their exons. The UTRs are derived from the exons and the CDS
+when they are not annotated. The genes are sorted by chromosome and start */
+func LoadGeneAnnotation(fname Filename) (genes []*GeneAnnotation) {
+	var isGFF3, isFormatKnown bool
+
+	geneDict := make(map[string]*GeneAnnotation)
+	transcriptDict := make(map[string]*TranscriptAnnotation)
+	transcriptGene := make(map[string]string)
+	var transcriptOrder []string
+
+	getGene := func(id string) *GeneAnnotation {
+		gene, isInside := geneDict[id]
+
+		if !isInside {
+			gene = &GeneAnnotation{ID: id, End: -1}
+			geneDict[id] = gene
+		}
+
+		return gene
+	}
+
+	getTranscript := func(id string) *TranscriptAnnotation {
+		transcript, isInside := transcriptDict[id]
+
+		if !isInside {
+			transcript = &TranscriptAnnotation{ID: id, End: -1}
+			transcriptDict[id] = transcript
+			transcriptOrder = append(transcriptOrder, id)
+		}
+
+		return transcript
+	}
+
+	scanner, file := fname.ReturnReader(0)
+	defer CloseFile(file)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		split := strings.Split(line, "\t")
+
+		if len(split) < 9 {
+			panic(fmt.Sprintf("Error line: %s from %s is not a GTF / GFF3 line (9 columns)", line, fname))
+		}
+
+		if !isFormatKnown {
+			isGFF3 = strings.Contains(split[8], "=") && !strings.Contains(split[8], "\"")
+			isFormatKnown = true
+		}
+
+		chr, feature := split[0], split[2]
+		start, err := strconv.Atoi(split[3])
+		Check(err)
+		end, err := strconv.Atoi(split[4])
+		Check(err)
+		// 1-based inclusive to 0-based half-open
+		start--
+
+		strand := byte('+')
+
+		if split[6] == "-" {
+			strand = '-'
+		}
+
+		attributes := parseGTFAttributes(split[8], isGFF3)
+
+		setGene := func(gene *GeneAnnotation, isGeneLine bool) {
+			if gene.Chr == "" {
+				gene.Chr, gene.Strand = chr, strand
+			}
+
+			if gene.Name == "" {
+				gene.Name = firstAttribute(attributes, "gene_name", "Name", "gene")
+			}
+
+			if gene.Biotype == "" {
+				gene.Biotype = firstAttribute(attributes, "gene_type", "gene_biotype", "biotype")
+			}
+
+			if isGeneLine {
+				gene.Start, gene.End = start, end
+			}
+		}
+
+		var transcriptIDs []string
+		var geneID string
+
+		switch {
+		case !isGFF3:
+			geneID = attributes["gene_id"]
+
+			if geneID == "" {
+				continue
+			}
+
+			if feature == "gene" {
+				setGene(getGene(geneID), true)
+				continue
+			}
+
+			setGene(getGene(geneID), false)
+
+			if attributes["transcript_id"] == "" {
+				continue
+			}
+
+			transcriptIDs = []string{attributes["transcript_id"]}
+		case gtfGeneFeatures[feature]:
+			setGene(getGene(attributes["ID"]), true)
+			continue
+		case gtfSubFeatures[feature]:
+			if attributes["Parent"] == "" {
+				continue
+			}
+
+			transcriptIDs = strings.Split(attributes["Parent"], ",")
+		default:
+			// transcript (the features without parent such as chromosome or region are ignored)
+			if attributes["ID"] == "" || attributes["Parent"] == "" {
+				continue
+			}
+
+			transcriptIDs = []string{attributes["ID"]}
+			geneID = strings.Split(attributes["Parent"], ",")[0]
+			feature = "transcript"
+		}
+
+		for _, transcriptID := range transcriptIDs {
+			transcript := getTranscript(transcriptID)
+
+			if transcript.Chr == "" {
+				transcript.Chr, transcript.Strand = chr, strand
+			}
+
+			if geneID != "" {
+				transcriptGene[transcriptID] = geneID
+			}
+
+			if transcript.Name == "" {
+				transcript.Name = firstAttribute(attributes, "transcript_name")
+			}
+
+			if transcript.Biotype == "" {
+				transcript.Biotype = firstAttribute(attributes, "transcript_type", "transcript_biotype")
+			}
+
+			interval := [2]int{start, end}
+
+			switch feature {
+			case "transcript", "mRNA":
+				transcript.Start, transcript.End = start, end
+
+				if isGFF3 {
+					transcript.Name = firstAttribute(attributes, "transcript_name", "Name")
+					transcript.Biotype = firstAttribute(attributes, "transcript_type", "transcript_biotype", "biotype")
+				}
+			case "exon":
+				transcript.Exons = append(transcript.Exons, interval)
+			case "CDS", "start_codon", "stop_codon":
+				transcript.CDS = append(transcript.CDS, interval)
+			case "five_prime_utr", "five_prime_UTR", "5UTR":
+				transcript.UTR5 = append(transcript.UTR5, interval)
+			case "three_prime_utr", "three_prime_UTR", "3UTR":
+				transcript.UTR3 = append(transcript.UTR3, interval)
+			case "UTR":
+				transcript.utr = append(transcript.utr, interval)
+			}
+		}
+	}
+
+	for _, transcriptID := range transcriptOrder {
+		transcript := transcriptDict[transcriptID]
+		transcript.finalize()
+
+		geneID, isInside := transcriptGene[transcriptID]
+
+		if !isInside {
+			geneID = transcriptID
+		}
+
+		gene := getGene(geneID)
+
+		if gene.Chr == "" {
+			gene.Chr, gene.Strand = transcript.Chr, transcript.Strand
+		}
+
+		gene.Transcripts = append(gene.Transcripts, transcript)
+	}
+
+	for id, gene := range geneDict {
+		for _, transcript := range gene.Transcripts {
+			if gene.End == -1 || transcript.Start < gene.Start {
+				gene.Start = transcript.Start
+			}
+
+			if transcript.End > gene.End {
+				gene.End = transcript.End
+			}
+		}
+
+		if gene.End == -1 {
+			continue
+		}
+
+		if gene.Name == "" {
+			gene.Name = strings.TrimPrefix(id, "gene:")
+		}
+
+		genes = append(genes, gene)
+	}
+
+	sort.Slice(genes, func(i, j int) bool {
+		if genes[i].Chr != genes[j].Chr {
+			return genes[i].Chr < genes[j].Chr
+		}
+
+		if genes[i].Start != genes[j].Start {
+			return genes[i].Start < genes[j].Start
+		}
+
+		return genes[i].ID < genes[j].ID
+	})
+
+	return genes
+}
+
+/*finalize sort the intervals, define the transcript bounds from the exons if needed and the 5' / 3' UTRs */
+func (transcript *TranscriptAnnotation) finalize() {
+	for _, intervals := range [][][2]int{transcript.Exons, transcript.CDS, transcript.UTR5, transcript.UTR3, transcript.utr} {
+		sort.Slice(intervals, func(i, j int) bool {return intervals[i][0] < intervals[j][0]})
+	}
+
+	if transcript.End == -1 {
+		for _, intervals := range [][][2]int{transcript.Exons, transcript.CDS, transcript.UTR5, transcript.UTR3, transcript.utr} {
+			for _, interval := range intervals {
+				if transcript.End == -1 || interval[0] < transcript.Start {
+					transcript.Start = interval[0]
+				}
+
+				if interval[1] > transcript.End {
+					transcript.End = interval[1]
+				}
+			}
+		}
+	}
+
+	if len(transcript.CDS) == 0 || len(transcript.UTR5) != 0 || len(transcript.UTR3) != 0 {
+		transcript.utr = nil
+		return
+	}
+
+	cdsStart, cdsEnd := transcript.CDS[0][0], transcript.CDS[0][1]
+
+	for _, cds := range transcript.CDS {
+		if cds[1] > cdsEnd {
+			cdsEnd = cds[1]
+		}
+	}
+
+	utrs := transcript.utr
+
+	// UTRs from the exons outside of the CDS
+	if len(utrs) == 0 {
+		for _, exon := range transcript.Exons {
+			if exon[0] < cdsStart {
+				utrs = append(utrs, [2]int{exon[0], MinInt(exon[1], cdsStart)})
+			}
+
+			if exon[1] > cdsEnd {
+				utrs = append(utrs, [2]int{MaxInt(exon[0], cdsEnd), exon[1]})
+			}
+		}
+	}
+
+	for _, utr := range utrs {
+		isUpstream := utr[0] < cdsStart
+
+		if isUpstream == (transcript.Strand == '+') {
+			transcript.UTR5 = append(transcript.UTR5, utr)
+		} else {
+			transcript.UTR3 = append(transcript.UTR3, utr)
+		}
+	}
+
+	transcript.utr = nil
+}
+
+/*parseGTFAttributes parse the 9th column of a GTF (key "value";) or GFF3 (key=value;) line. The first value of a key is kept */
+func parseGTFAttributes(field string, isGFF3 bool) (attributes map[string]string) {
+	attributes = make(map[string]string)
+
+	for _, attribute := range strings.Split(field, ";") {
+		attribute = strings.TrimSpace(attribute)
+
+		if attribute == "" {
+			continue
+		}
+
+		var key, value string
+
+		if isGFF3 {
+			pos := strings.IndexByte(attribute, '=')
+
+			if pos == -1 {
+				continue
+			}
+
+			key, value = attribute[:pos], attribute[pos + 1:]
+		} else {
+			pos := strings.IndexAny(attribute, " \t")
+
+			if pos == -1 {
+				continue
+			}
+
+			key, value = attribute[:pos], strings.Trim(strings.TrimSpace(attribute[pos + 1:]), "\"")
+		}
+
+		if _, isInside := attributes[key]; !isInside {
+			attributes[key] = value
+		}
+	}
+
+	return attributes
+}
+
+/*firstAttribute value of the first key found in the attributes */
+func firstAttribute(attributes map[string]string, keys ...string) string {
+	for _, key := range keys {
+		if value := attributes[key]; value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
+
+/*MinInt minimum of two integers */
+func MinInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+/*MaxInt maximum of two integers */
+func MaxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
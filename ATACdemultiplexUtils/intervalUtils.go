@@ -440,9 +440,6 @@ func createPeakIntervalTree(peakPos []int, sep string, verbose bool) {
 func createPeakIntervalTreeObject(peakiddict map[string]uint, peakPos []int, verbose bool) (
 	intervalObject PeakIntervalTreeObject) {
 
-	var chroStr string
-	var err error
-	var isInside bool
 	var peak Peak
 	var peakPosTriplet [3]int
 
@@ -461,20 +458,7 @@ func createPeakIntervalTreeObject(peakiddict map[string]uint, peakPos []int, ver
 			peakPosTriplet[2] = peakPos[2 + 3 * peakNb]
 
 			peak.StringToPeakWithPos(key, peakPosTriplet)
-			chroStr = peak.Chr()
-
-			int := IntInterval{
-				Start: peak.Start, End: peak.End}
-			int.UID = uintptr(uintptr(pos))
-
-			if _, isInside = intervalObject.Chrintervaldict[chroStr];!isInside {
-				intervalObject.Chrintervaldict[chroStr] = &interval.IntTree{}
-			}
-
-			err = intervalObject.Chrintervaldict[chroStr].Insert(int, false)
-			Check(err)
-
-			intervalObject.Intervalmapping[int.ID()] = peak.PeakToString()
+			intervalObject.InsertPeak(peak, uintptr(pos), false)
 		}
 	}
 
@@ -488,6 +472,59 @@ func createPeakIntervalTreeObject(peakiddict map[string]uint, peakPos []int, ver
 }
 
 
+/*NewPeakIntervalTreeObject create an empty peak intervall dict object filled with InsertPeak*/
+func NewPeakIntervalTreeObject() (intervalObject PeakIntervalTreeObject) {
+	peakiddict := make(map[string]uint)
+
+	intervalObject.Chrintervaldict = make(map[string]*interval.IntTree)
+	intervalObject.Intervalmapping = make(map[uintptr]string)
+	intervalObject.Peakiddict = &peakiddict
+
+	return intervalObject
+}
+
+
+/*peakToInterval interval of a peak. If isBed, the end is excluded (bed coordinates: adjacent peaks do not overlap)*/
+func peakToInterval(peak Peak, isBed bool) (inter IntInterval) {
+	inter = IntInterval{Start: peak.Start, End: peak.End}
+
+	if isBed {
+		inter.End--
+	}
+
+	return inter
+}
+
+
+/*InsertPeak insert a peak with its ID in the interval tree of its chromosome. If isBed, the end is excluded (bed coordinates)*/
+func (intervalObject *PeakIntervalTreeObject) InsertPeak(peak Peak, uid uintptr, isBed bool) {
+	chroStr := peak.Chr()
+
+	inter := peakToInterval(peak, isBed)
+	inter.UID = uid
+
+	if _, isInside := intervalObject.Chrintervaldict[chroStr];!isInside {
+		intervalObject.Chrintervaldict[chroStr] = &interval.IntTree{}
+	}
+
+	Check(intervalObject.Chrintervaldict[chroStr].Insert(inter, false))
+
+	intervalObject.Intervalmapping[inter.ID()] = peak.PeakToString()
+}
+
+
+/*GetPeakIntervals return the intervals overlapping a peak. If isBed, the end is excluded (bed coordinates)*/
+func (intervalObject *PeakIntervalTreeObject) GetPeakIntervals(peak Peak, isBed bool) []interval.IntInterface {
+	tree, isInside := intervalObject.Chrintervaldict[peak.Chr()]
+
+	if !isInside {
+		return nil
+	}
+
+	return tree.Get(peakToInterval(peak, isBed))
+}
+
+
 /*CreatePeakIntervalTreeObjectFromFile create a peak intervall dict object*/
 func CreatePeakIntervalTreeObjectFromFile(bedfile Filename, sep string, peakPos []int) (
 	intervalObject PeakIntervalTreeObject) {
@@ -699,6 +736,18 @@ func InitIntervalDictsThreading(threadnb int) {
 }
 
 
+/*FragmentToCutSites return the two Tn5 insertion positions (0-based) of a fragment.
+If shift is true, the fragment ends are first corrected using the +4/-5 Tn5 offsets (as in ArchR/chromVAR)*/
+func FragmentToCutSites(start, end int, shift bool) (cut1, cut2 int) {
+	if shift {
+		start += 4
+		end -= 5
+	}
+
+	return start, end - 1
+}
+
+
 /*MaxIntList int give the max of list */
 func MaxIntList(intlist []int) (max int) {
 
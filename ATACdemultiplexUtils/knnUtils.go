@@ -0,0 +1,126 @@
+package atacdemultiplexutils
+
+import (
+	"math"
+	"sync"
+)
+
+
+/*MetricSpace points (dense embedding or sparse matrix rows) with the distance used for the nearest neighbor searches.
+The sparse points always use the cosine distance */
+type MetricSpace struct {
+	Dense [][]float64
+	Sparse []SparseVector
+	Cosine bool
+}
+
+/*NbPoints number of points of the space */
+func (s *MetricSpace) NbPoints() int {
+	if s.Sparse != nil {
+		return len(s.Sparse)
+	}
+
+	return len(s.Dense)
+}
+
+/*Normalize L2 normalize (in place) the points when the cosine distance is used */
+func (s *MetricSpace) Normalize() {
+	if !s.Cosine && s.Sparse == nil {
+		return
+	}
+
+	for _, point := range s.Dense {
+		if pointNorm := VectorNorm(point); pointNorm > 0 {
+			for i := range point {
+				point[i] /= pointNorm
+			}
+		}
+	}
+
+	for _, point := range s.Sparse {
+		if pointNorm := VectorNorm(point.Values); pointNorm > 0 {
+			for i := range point.Values {
+				point.Values[i] /= pointNorm
+			}
+		}
+	}
+}
+
+/*Distance euclidean or cosine (1 - cosine similarity of the normalized points) distance between two points */
+func (s *MetricSpace) Distance(i, j int) (dist float64) {
+	if s.Sparse != nil {
+		return 1.0 - SparseDot(s.Sparse[i], s.Sparse[j])
+	}
+
+	a, b := s.Dense[i], s.Dense[j]
+
+	if s.Cosine {
+		for pos := range a {
+			dist += a[pos] * b[pos]
+		}
+
+		return 1.0 - dist
+	}
+
+	for pos := range a {
+		dist += (a[pos] - b[pos]) * (a[pos] - b[pos])
+	}
+
+	return math.Sqrt(dist)
+}
+
+/*SparseDot dot product of two sparse vectors (sorted indexes) */
+func SparseDot(a, b SparseVector) (dot float64) {
+	var i, j int
+
+	for i < len(a.Index) && j < len(b.Index) {
+		switch {
+		case a.Index[i] == b.Index[j]:
+			dot += a.Values[i] * b.Values[j]
+			i++
+			j++
+		case a.Index[i] < b.Index[j]:
+			i++
+		default:
+			j++
+		}
+	}
+
+	return dot
+}
+
+/*VectorNorm L2 norm of a vector */
+func VectorNorm(vector []float64) (value float64) {
+	for _, x := range vector {
+		value += x * x
+	}
+
+	return math.Sqrt(value)
+}
+
+/*ParallelFor call function(i) for i in [0, n) using threadnb threads */
+func ParallelFor(n, threadnb int, function func(i int)) {
+	var waiting sync.WaitGroup
+
+	chunk := n / threadnb + 1
+
+	for start := 0; start < n; start += chunk {
+		end := start + chunk
+
+		if end > n {
+			end = n
+		}
+
+		waiting.Add(1)
+
+		go func(start, end int) {
+			defer waiting.Done()
+
+			for i := start; i < end; i++ {
+				function(i)
+			}
+		}(start, end)
+	}
+
+	waiting.Wait()
+}
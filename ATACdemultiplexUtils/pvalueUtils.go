@@ -0,0 +1,170 @@
+package atacdemultiplexutils
+
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+
+/*pvalueTableColumns positions of the columns of an ATACTopFeatures p-value table used to select the significant features */
+type pvalueTableColumns struct {
+	cluster, effect, significant int
+	// the features are enriched in the cluster if effect > minEffect (odd ratio > 1 or log2 fold change > 0)
+	minEffect float64
+	hasOddRatio bool
+}
+
+/*newPvalueTableColumns column positions (from the end of the line if negative) used if the table has no header:
+#chr start stop cluster ... oddRatio pvalue qvalue significant */
+func newPvalueTableColumns() pvalueTableColumns {
+	return pvalueTableColumns{cluster: 3, effect: -4, significant: -1, minEffect: 1.0}
+}
+
+/*parseHeader read the column positions from the header line (the odd ratio is used if the table has both an odd ratio and a fold change) */
+func (columns *pvalueTableColumns) parseHeader(line string) {
+	for pos, column := range strings.Split(strings.TrimPrefix(line, "#"), "\t") {
+		switch column {
+		case "cluster":
+			columns.cluster = pos
+		case "oddRatio":
+			columns.effect, columns.minEffect, columns.hasOddRatio = pos, 1.0, true
+		case "log2FC", "logFC":
+			if !columns.hasOddRatio {
+				columns.effect, columns.minEffect = pos, 0.0
+			}
+		case "significant":
+			columns.significant = pos
+		}
+	}
+}
+
+func (columns *pvalueTableColumns) column(split []string, pos int) string {
+	if pos < 0 {
+		return split[len(split) + pos]
+	}
+
+	return split[pos]
+}
+
+/*LoadSignificantFeatures load the significant features enriched in each cluster (odd ratio > 1 or log2 fold change > 0)
+of an ATACTopFeatures corrected p-value (or -da / -pseudobulk) table. Return the split lines of each cluster (the clusters
+without significant feature are included) without duplicated <chr><start><end> */
+func LoadSignificantFeatures(fname Filename) (clusterFeatures map[string][][]string) {
+	clusterFeatures = make(map[string][][]string)
+	used := make(map[string]map[string]bool)
+	columns := newPvalueTableColumns()
+
+	scanner, file := fname.ReturnReader(0)
+	defer CloseFile(file)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if len(line) == 0 {
+			continue
+		}
+
+		if line[0] == '#' {
+			columns.parseHeader(line)
+			continue
+		}
+
+		split := strings.Split(line, "\t")
+
+		if len(split) < 8 {
+			panic(fmt.Sprintf("Error line: %s from %s is not an ATACTopFeatures p-value table line", line, fname))
+		}
+
+		effect, err := strconv.ParseFloat(columns.column(split, columns.effect), 64)
+		Check(err)
+
+		cluster := columns.column(split, columns.cluster)
+
+		if used[cluster] == nil {
+			used[cluster] = make(map[string]bool)
+			clusterFeatures[cluster] = nil
+		}
+
+		if columns.column(split, columns.significant) != "true" || effect <= columns.minEffect {
+			continue
+		}
+
+		key := strings.Join(split[:3], "\t")
+
+		if !used[cluster][key] {
+			used[cluster][key] = true
+			clusterFeatures[cluster] = append(clusterFeatures[cluster], split)
+		}
+	}
+
+	return clusterFeatures
+}
+
+/*LogChoose log of the binomial coefficient (n k) (-Inf if k is not in [0, n]) */
+func LogChoose(n, k int) float64 {
+	if k < 0 || k > n {
+		return math.Inf(-1)
+	}
+
+	a, _ := math.Lgamma(float64(n + 1))
+	b, _ := math.Lgamma(float64(k + 1))
+	c, _ := math.Lgamma(float64(n - k + 1))
+
+	return a - b - c
+}
+
+/*HypergeometricUpperTail P(X >= k) with X the number of successes in n draws from a population of size N with K successes */
+func HypergeometricUpperTail(k, N, K, n int) float64 {
+	maxK := MinInt(n, K)
+
+	if k <= 0 {
+		return 1.0
+	}
+
+	if k > maxK {
+		return 0.0
+	}
+
+	logTerms := make([]float64, 0, maxK - k + 1)
+	maxLog := math.Inf(-1)
+
+	for i := k; i <= maxK; i++ {
+		logTerm := LogChoose(K, i) + LogChoose(N - K, n - i) - LogChoose(N, n)
+		logTerms = append(logTerms, logTerm)
+		maxLog = math.Max(maxLog, logTerm)
+	}
+
+	sum := 0.0
+
+	for _, logTerm := range logTerms {
+		sum += math.Exp(logTerm - maxLog)
+	}
+
+	return math.Min(1.0, math.Exp(maxLog + math.Log(sum)))
+}
+
+/*BenjaminiHochberg Benjamini-Hochberg q-values of the pvalues (same order as the pvalues) */
+func BenjaminiHochberg(pvalues []float64) (qvalues []float64) {
+	order := make([]int, len(pvalues))
+
+	for i := range order {
+		order[i] = i
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {return pvalues[order[i]] < pvalues[order[j]]})
+
+	qvalues = make([]float64, len(pvalues))
+	n := float64(len(pvalues))
+	minQ := 1.0
+
+	for rank := len(order) - 1; rank >= 0; rank-- {
+		minQ = math.Min(minQ, pvalues[order[rank]] * n / float64(rank + 1))
+		qvalues[order[rank]] = minQ
+	}
+
+	return qvalues
+}
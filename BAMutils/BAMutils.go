@@ -137,6 +137,12 @@ var BAMTAG string
 /*USEBAMNAME array of int representing position of field in the BAM file*/
 var USEBAMNAME utils.ArrayFlags
 
+/*CUTSITES use the two Tn5 insertions of each fragment for the bedgraph instead of the full fragment */
+var CUTSITES bool
+
+/*TN5SHIFT shift the fragment ends by +4/-5 before inferring the Tn5 insertions */
+var TN5SHIFT bool
+
 func main() {
 
 	flag.Usage = func() {
@@ -144,7 +150,7 @@ func main() {
 #################### Suite of functions dedicated to process BAM or BED files ########################
 
 -bed_to_bedgraph: Transform one (-bed) or multiple (use multiple -beds option) into bedgraph
-USAGE: BAMutils -bed_to_bedgraph -bed <fname> (-out <fname> -threads <int> -cellsID <fname> -split -binsize <int> -refchr <filename>)
+USAGE: BAMutils -bed_to_bedgraph -bed <fname> (-out <fname> -threads <int> -cellsID <fname> -split -binsize <int> -refchr <filename> -cut_sites -tn5_shift)
 
 -create_cell_index: Create cell index (cell -> read Counts) for a bam or bed file
 USAGE: BAMutils -create_cell_index -bed/bam <name> -out <output name> (-sort)
@@ -200,6 +206,10 @@ USAGE: BAMutils -bamtobed -bam <filename> -out <bedfile> (-optionnal -cellsID <f
 	flag.Float64Var(&DOWNSAMPLE, "downsample", 1.0, `Downsample the number of reads from a a bed file (downsample = 1.0 is 100% and downsample = 0.0 is 0% of the reads)`)
 	flag.IntVar(&THREADNB, "threads", 1, "threads concurrency for reading bam file")
 	flag.IntVar(&BINSIZE, "binsize", 50, "bin size for bedgraph creation")
+	flag.BoolVar(&CUTSITES, "cut_sites", false,
+		`bedgraph: count the two Tn5 insertions (cut sites) of each fragment instead of the full fragment span`)
+	flag.BoolVar(&TN5SHIFT, "tn5_shift", false,
+		`bedgraph: shift fragment ends by +4/-5 before inferring the Tn5 insertions (use with -cut_sites)`)
 	flag.StringVar(&DELIMITER, "delimiter", "\t", "delimiter used")
 	flag.StringVar(&TAG, "tag", "", "Used to tag output barcode")
 	flag.Parse()
@@ -1609,6 +1619,13 @@ func bedToBedGraphDictOneThread(bed string, waiting *sync.WaitGroup, checkCellIn
 				line, nbReads))
 		}
 
+		if CUTSITES {
+			pos, pos2 = utils.FragmentToCutSites(pos, pos2, TN5SHIFT)
+			bedtobedgraphdict[chroIndex][pos / BINSIZE]++
+			bedtobedgraphdict[chroIndex][pos2 / BINSIZE]++
+			continue
+		}
+
 		nbit = (pos2-pos) / BINSIZE
 
 		for it =0 ; it <= nbit ; it++  {